@@ -1,7 +1,42 @@
 import { connect } from 'cloudflare:sockets';
 const TOKEN = 'xxx';
+// 令牌轮换期间同时接受的其他令牌，轮换完成后移除旧令牌
+const EXTRA_TOKENS = [];
+// 设置后改用 TOTP 一次性令牌认证（客户端 -totp），此时忽略 TOKEN
+const TOTP_SECRET = '';
+const TOTP_STEP = 30, TOTP_SKEW = 1;
+
+const isValidToken = async (t) => {
+    if (TOTP_SECRET) return verifyTOTP(t);
+    return !TOKEN || t === TOKEN || EXTRA_TOKENS.includes(t);
+};
+
+// 令牌格式 totp.<时间步>.<HMAC-SHA256(密钥, "ech-workers totp <时间步>") 前 16 字节十六进制>
+async function verifyTOTP(token) {
+    const m = /^totp\.(\d+)\.([0-9a-f]{32})$/.exec(token);
+    if (!m) return false;
+    const step = parseInt(m[1], 10);
+    const current = Math.floor(Date.now() / 1000 / TOTP_STEP);
+    if (Math.abs(step - current) > TOTP_SKEW) return false;
+    const key = await crypto.subtle.importKey('raw', encoder.encode(TOTP_SECRET), { name: 'HMAC', hash: 'SHA-256' }, false, ['sign']);
+    const mac = new Uint8Array(await crypto.subtle.sign('HMAC', key, encoder.encode('ech-workers totp ' + step)));
+    const expected = [...mac.subarray(0, 16)].map(b => b.toString(16).padStart(2, '0')).join('');
+    let diff = 0;
+    for (let i = 0; i < expected.length; i++) diff |= expected.charCodeAt(i) ^ m[2].charCodeAt(i);
+    return diff === 0;
+}
 const encoder = new TextEncoder();
 
+// 隧道协议版本范围与本 Worker 支持的功能
+const PROTOCOL_MIN_VERSION = 1;
+const PROTOCOL_MAX_VERSION = 1;
+const SUPPORTED_FEATURES = ['addrframe', 'aead', 'halfclose', 'heartbeat', 'closecode', 'reauth'];
+// 支持的压缩算法（CompressionStream 不支持 zstd，也不支持指定级别）
+const SUPPORTED_COMPRESSION = ['deflate'];
+const MAX_MESSAGE_SIZE = 1024 * 1024;
+// 关闭原因码（与客户端 protocol.CloseCode 一致），会话关闭帧状态码为 4000 + 原因码
+const CLOSE_NORMAL = 0, CLOSE_RESET = 3, CLOSE_INTERNAL_ERROR = 6, CLOSE_AUTH_FAILED = 7;
+
 export default {
     async fetch(request) {
         try {
@@ -11,18 +46,19 @@ export default {
                     ? new Response('WebSocket Proxy Server', { status: 200 })
                     : new Response('Expected WebSocket', { status: 426 });
             }
-            if (TOKEN && request.headers.get('Sec-WebSocket-Protocol') !== TOKEN) {
+            const token = request.headers.get('Sec-WebSocket-Protocol') || '';
+            if (!(await isValidToken(token))) {
                 return new Response('Unauthorized', { status: 401 });
             }
             const [client, server] = Object.values(new WebSocketPair());
             server.accept();
-            handleSession(server).catch(() => safeCloseWebSocket(server));
+            handleSession(server, token).catch(() => safeCloseWebSocket(server));
             const responseInit = {
                 status: 101,
                 webSocket: client
             };
-            if (TOKEN) {
-                responseInit.headers = { 'Sec-WebSocket-Protocol': TOKEN };
+            if (token) {
+                responseInit.headers = { 'Sec-WebSocket-Protocol': token };
             }
             return new Response(null, responseInit);
         } catch (err) {
@@ -31,13 +67,19 @@ export default {
     },
 };
 
-async function handleSession(webSocket) {
+async function handleSession(webSocket, token) {
     let remoteSocket, remoteWriter, remoteReader;
     let isClosed = false;
     let isConnecting = false;
     let connectionAttempts = 0;
+    // 半关闭状态：两个方向都收到 FIN 后才清理
+    let localFin = false, remoteFin = false;
+    // token 为建立会话时使用的令牌，内层加密密钥由它派生（TOTP 模式下由共享密钥派生）
+    const session = { version: 0, features: new Set(), aead: null, compression: 'none', token: TOTP_SECRET || token };
+    // 消息处理涉及异步解压，串行执行以保证写入远端的顺序
+    let inbound = Promise.resolve();
 
-    const cleanup = () => {
+    const cleanup = (code = CLOSE_NORMAL) => {
         if (isClosed) return;
         isClosed = true;
         isConnecting = false;
@@ -45,19 +87,38 @@ async function handleSession(webSocket) {
         try { remoteReader?.releaseLock(); } catch { }
         try { remoteSocket?.close(); } catch { }
         remoteWriter = remoteReader = remoteSocket = null;
-        safeCloseWebSocket(webSocket);
+        if (session.features.has('closecode') && code !== CLOSE_NORMAL) {
+            try { webSocket.close(4000 + code, ''); } catch { }
+        } else {
+            safeCloseWebSocket(webSocket);
+        }
+    };
+
+    // 发送流关闭消息，协商了 closecode 时附带原因码
+    const sendClose = (code, reason = '') => {
+        let msg = 'CLOSE';
+        if (session.features.has('closecode')) {
+            msg += ':' + code + (reason ? ':' + reason : '');
+        }
+        try { webSocket.send(msg); } catch { }
     };
 
     const pumpRemoteToWebSocket = async () => {
+        let pumpError = null;
         try {
             while (!isClosed && remoteReader) {
                 const { done, value } = await remoteReader.read();
                 if (done) break;
                 if (webSocket.readyState !== 1) break;
-                if (value?.byteLength > 0) webSocket.send(value);
+                if (value?.byteLength > 0) {
+                    let payload = session.compression !== 'none' ? await compressMessage(value) : value;
+                    if (session.aead) payload = session.aead.seal(payload);
+                    webSocket.send(payload);
+                }
             }
         } catch (err) {
             console.error('Remote to WebSocket pump error:', err);
+            pumpError = err;
             if (!isClosed && connectionAttempts < 3) {
                 connectionAttempts++;
                 try {
@@ -72,7 +133,18 @@ async function handleSession(webSocket) {
         }
 
         if (!isClosed) {
-            try { webSocket.send('CLOSE'); } catch { }
+            if (pumpError) {
+                sendClose(CLOSE_RESET, pumpError.message);
+                cleanup();
+                return;
+            }
+            if (session.features.has('halfclose')) {
+                remoteFin = true;
+                try { webSocket.send('FIN'); } catch { }
+                if (localFin) cleanup();
+                return;
+            }
+            sendClose(CLOSE_NORMAL);
             cleanup();
         }
     };
@@ -151,15 +223,17 @@ async function handleSession(webSocket) {
                     remoteSocket = connect({
                         hostname: attemptHost,
                         port: attemptPort
-                    });
+                    }, { allowHalfOpen: session.features.has('halfclose') });
                     
                     if (remoteSocket.opened) await remoteSocket.opened;
                     
                     remoteWriter = remoteSocket.writable.getWriter();
                     remoteReader = remoteSocket.readable.getReader();
                     
-                    if (firstFrameData) {
-                        await remoteWriter.write(encoder.encode(firstFrameData));
+                    if (firstFrameData && firstFrameData.length > 0) {
+                        await remoteWriter.write(typeof firstFrameData === 'string'
+                            ? encoder.encode(firstFrameData)
+                            : firstFrameData);
                     }
                     
                     isConnecting = false;
@@ -183,13 +257,109 @@ async function handleSession(webSocket) {
         }
     };
 
-    webSocket.addEventListener('message', async (event) => {
+    // 解析二进制地址帧: VER | NETWORK | ATYP | ADDR | PORT | FALLBACK_LEN | FALLBACK | EARLY_DATA
+    // 测试向量（与 protocol/connect_test.go 相同）:
+    //   0101030b6578616d706c652e636f6d01bb1270726f78792e6578616d706c653a38343433474554
+    //     -> example.com:443，回退 proxy.example:8443，首帧 "GET"
+    //   010101c0000201005000 -> 192.0.2.1:80
+    //   01010420010db800000000000000000000000101bb000102 -> [2001:db8:0:0:0:0:0:1]:443，首帧 01 02
+    const parseAddressFrame = (buf) => {
+        if (buf.length < 3 || buf[0] !== 1) throw new Error('无效的地址帧');
+        if (buf[1] !== 1) throw new Error('不支持的网络类型');
+        let offset = 3;
+        let host;
+        const need = (n) => {
+            if (buf.length < offset + n) throw new Error('地址帧被截断');
+        };
+        switch (buf[2]) {
+            case 1:
+                need(4);
+                host = Array.from(buf.subarray(offset, offset + 4)).join('.');
+                offset += 4;
+                break;
+            case 4: {
+                need(16);
+                const groups = [];
+                for (let i = 0; i < 16; i += 2) {
+                    groups.push(((buf[offset + i] << 8) | buf[offset + i + 1]).toString(16));
+                }
+                host = `[${groups.join(':')}]`;
+                offset += 16;
+                break;
+            }
+            case 3: {
+                need(1);
+                const len = buf[offset++];
+                need(len);
+                host = new TextDecoder().decode(buf.subarray(offset, offset + len));
+                offset += len;
+                break;
+            }
+            default:
+                throw new Error('不支持的地址类型');
+        }
+        need(3);
+        const port = (buf[offset] << 8) | buf[offset + 1];
+        offset += 2;
+        const fallbackLen = buf[offset++];
+        need(fallbackLen);
+        const fallback = new TextDecoder().decode(buf.subarray(offset, offset + fallbackLen));
+        offset += fallbackLen;
+        return { target: `${host}:${port}`, fallback, earlyData: buf.subarray(offset) };
+    };
+
+    // 握手示例（与 protocol/protocol_test.go 相同）:
+    //   客户端 HELLO:{"v":1,"min_v":1,"features":["mux","aead","closecode"],"salt":"...","compression":["zstd","deflate"],"level":3}
+    //   回复   HELLO:{"v":1,"features":["mux","aead"],"compression":["deflate"]}
+    // 回复中的功能与压缩算法必须是客户端请求的子集，且最多选定一个压缩算法
+    const negotiate = async (payload) => {
+        let hello;
+        try {
+            hello = JSON.parse(payload);
+        } catch {
+            throw new Error('握手格式错误');
+        }
+        const peerMax = parseInt(hello.v, 10);
+        const peerMin = parseInt(hello.min_v || hello.v, 10);
+        const version = Math.min(peerMax, PROTOCOL_MAX_VERSION);
+        if (isNaN(version) || version < PROTOCOL_MIN_VERSION || version < peerMin) {
+            throw new Error(`协议版本不兼容: 对端 v${peerMin}-v${peerMax}，Worker 支持 v${PROTOCOL_MIN_VERSION}-v${PROTOCOL_MAX_VERSION}`);
+        }
+        const requested = Array.isArray(hello.features) ? hello.features : [];
+        session.version = version;
+        session.features = new Set(requested.filter(f => SUPPORTED_FEATURES.includes(f)));
+        if (session.features.has('aead')) {
+            const salt = hello.salt ? Uint8Array.from(atob(hello.salt), c => c.charCodeAt(0)) : null;
+            if (!session.token || !salt || salt.length !== 16 || !session.features.has('addrframe')) {
+                session.features.delete('aead');
+            } else {
+                session.aead = await createAEAD(session.token, salt);
+            }
+        }
+        const reply = { v: version, features: [...session.features] };
+        if (Array.isArray(hello.compression)) {
+            const chosen = hello.compression.find(c => SUPPORTED_COMPRESSION.includes(c));
+            if (chosen) {
+                session.compression = chosen;
+                reply.compression = [chosen];
+            }
+        }
+        webSocket.send('HELLO:' + JSON.stringify(reply));
+    };
+
+    webSocket.addEventListener('message', (event) => {
+        inbound = inbound.then(() => handleMessage(event.data));
+    });
+
+    const handleMessage = async (data) => {
         if (isClosed) return;
         
         try {
-            const data = event.data;
             if (typeof data === 'string') {
-                if (data.startsWith('CONNECT:')) {
+                if (data.startsWith('HELLO:')) {
+                    await negotiate(data.substring(6));
+                }
+                else if (data.startsWith('CONNECT:')) {
                     const parts = data.split('|');
                     const targetAddr = parts[0].substring(8);
                     const firstFrameData = parts[1] || '';
@@ -206,21 +376,224 @@ async function handleSession(webSocket) {
                         await remoteWriter.write(encoder.encode(data.substring(5)));
                     }
                 }
-                else if (data === 'CLOSE') {
+                // "CLOSE" 与 "CLOSE:0" 为正常关闭，"CLOSE:3:connection refused" 为原因码 3 加说明，
+                // 说明中可以包含冒号（与 protocol/close_test.go 相同）
+                else if (data === 'CLOSE' || data.startsWith('CLOSE:')) {
+                    const code = parseInt(data.split(':')[1] || '0', 10);
+                    if (code > 1) console.log('客户端关闭流:', data.substring(6));
                     cleanup();
                 }
+                else if (data.startsWith('AUTH:') && session.features.has('reauth')) {
+                    // 令牌轮换：已建立的会话在隧道内用新令牌重新认证，内层加密密钥保持不变
+                    if (await isValidToken(data.substring(5))) {
+                        webSocket.send('AUTH:OK');
+                    } else {
+                        webSocket.send('AUTH:FAIL:令牌无效');
+                        sendClose(CLOSE_AUTH_FAILED, '令牌无效');
+                        cleanup(CLOSE_AUTH_FAILED);
+                    }
+                }
+                else if (data.startsWith('PING:') && session.features.has('heartbeat')) {
+                    // 原样回显客户端时间，并附带 Worker 时间用于估算时钟偏差
+                    webSocket.send('PONG:' + data.substring(5) + '|' + Date.now());
+                }
+                else if (data === 'FIN' && session.features.has('halfclose')) {
+                    localFin = true;
+                    try { await remoteWriter?.close(); } catch { }
+                    if (remoteFin) cleanup();
+                }
             }
-            else if (data instanceof ArrayBuffer && remoteWriter) {
-                await remoteWriter.write(new Uint8Array(data));
+            else if (data instanceof ArrayBuffer) {
+                let payload = new Uint8Array(data);
+                if (session.aead) payload = session.aead.open(payload);
+                if (!remoteSocket && !isConnecting && session.features.has('addrframe')) {
+                    const req = parseAddressFrame(payload);
+                    await connectToRemote(req.target, req.earlyData, req.fallback);
+                } else if (remoteWriter) {
+                    if (session.compression !== 'none') payload = await decompressMessage(payload);
+                    await remoteWriter.write(payload);
+                }
             }
         } catch (err) {
-            try { webSocket.send('ERROR:' + err.message); } catch { }
-            cleanup();
+            // 流建立前以 ERROR 作为连接响应，建立后以关闭消息告知原因
+            if (remoteSocket && session.features.has('closecode')) {
+                sendClose(CLOSE_INTERNAL_ERROR, err.message);
+                cleanup(CLOSE_INTERNAL_ERROR);
+            } else {
+                try { webSocket.send('ERROR:' + err.message); } catch { }
+                cleanup();
+            }
         }
-    });
+    };
+
+    webSocket.addEventListener('close', () => cleanup());
+    webSocket.addEventListener('error', () => cleanup());
+}
+
+// ---- 压缩 ----
+// 每条消息独立压缩，首字节 0 表示原样、1 表示 deflate 压缩
+
+const streamBytes = async (stream, limit) => {
+    const reader = stream.getReader();
+    const chunks = [];
+    let total = 0;
+    for (;;) {
+        const { done, value } = await reader.read();
+        if (done) break;
+        total += value.length;
+        if (total > limit) {
+            reader.cancel();
+            throw new Error('解压后消息过大');
+        }
+        chunks.push(value);
+    }
+    const out = new Uint8Array(total);
+    let offset = 0;
+    for (const c of chunks) {
+        out.set(c, offset);
+        offset += c.length;
+    }
+    return out;
+};
+
+async function compressMessage(data) {
+    const compressed = await streamBytes(new Blob([data]).stream().pipeThrough(new CompressionStream('deflate-raw')), Infinity);
+    const useRaw = compressed.length >= data.length;
+    const body = useRaw ? data : compressed;
+    const out = new Uint8Array(body.length + 1);
+    out[0] = useRaw ? 0 : 1;
+    out.set(body, 1);
+    return out;
+}
+
+// 测试向量（与 protocol/compress_test.go 相同）:
+//   014a4dced02dcf2fca4e2d2a5618658fb2471a1b3000 解压为 "ech-workers " 重复 64 次（768 字节）
+async function decompressMessage(msg) {
+    if (msg.length === 0) throw new Error('空消息');
+    const body = msg.subarray(1);
+    if (msg[0] === 0) return body;
+    if (msg[0] !== 1) throw new Error('未知的消息标记');
+    return streamBytes(new Blob([body]).stream().pipeThrough(new DecompressionStream('deflate-raw')), MAX_MESSAGE_SIZE);
+}
+
+// ---- 内层加密 (ChaCha20-Poly1305, RFC 8439) ----
+// WebCrypto 不支持 ChaCha20-Poly1305，这里是一个精简的纯 JS 实现
 
-    webSocket.addEventListener('close', cleanup);
-    webSocket.addEventListener('error', cleanup);
+const rotl = (x, n) => (x << n) | (x >>> (32 - n));
+
+function chachaBlock(key, counter, nonce, out) {
+    const s = new Uint32Array(16);
+    s[0] = 0x61707865; s[1] = 0x3320646e; s[2] = 0x79622d32; s[3] = 0x6b206574;
+    const kv = new DataView(key.buffer, key.byteOffset, 32);
+    for (let i = 0; i < 8; i++) s[4 + i] = kv.getUint32(i * 4, true);
+    s[12] = counter;
+    const nv = new DataView(nonce.buffer, nonce.byteOffset, 12);
+    for (let i = 0; i < 3; i++) s[13 + i] = nv.getUint32(i * 4, true);
+
+    const x = new Uint32Array(s);
+    const qr = (a, b, c, d) => {
+        x[a] += x[b]; x[d] = rotl(x[d] ^ x[a], 16);
+        x[c] += x[d]; x[b] = rotl(x[b] ^ x[c], 12);
+        x[a] += x[b]; x[d] = rotl(x[d] ^ x[a], 8);
+        x[c] += x[d]; x[b] = rotl(x[b] ^ x[c], 7);
+    };
+    for (let i = 0; i < 10; i++) {
+        qr(0, 4, 8, 12); qr(1, 5, 9, 13); qr(2, 6, 10, 14); qr(3, 7, 11, 15);
+        qr(0, 5, 10, 15); qr(1, 6, 11, 12); qr(2, 7, 8, 13); qr(3, 4, 9, 14);
+    }
+    const ov = new DataView(out.buffer, out.byteOffset, 64);
+    for (let i = 0; i < 16; i++) ov.setUint32(i * 4, (x[i] + s[i]) >>> 0, true);
+}
+
+function chachaXor(key, nonce, counter, input) {
+    const out = new Uint8Array(input.length);
+    const block = new Uint8Array(64);
+    for (let i = 0; i < input.length; i += 64) {
+        chachaBlock(key, counter++, nonce, block);
+        const n = Math.min(64, input.length - i);
+        for (let j = 0; j < n; j++) out[i + j] = input[i + j] ^ block[j];
+    }
+    return out;
+}
+
+const leToBigInt = (b) => {
+    let v = 0n;
+    for (let i = b.length - 1; i >= 0; i--) v = (v << 8n) | BigInt(b[i]);
+    return v;
+};
+
+function poly1305(otk, msg) {
+    const r = leToBigInt(otk.subarray(0, 16)) & 0x0ffffffc0ffffffc0ffffffc0fffffffn;
+    const s = leToBigInt(otk.subarray(16, 32));
+    const p = (1n << 130n) - 5n;
+    let acc = 0n;
+    for (let i = 0; i < msg.length; i += 16) {
+        const block = msg.subarray(i, i + 16);
+        acc = ((acc + leToBigInt(block) + (1n << BigInt(8 * block.length))) * r) % p;
+    }
+    acc = (acc + s) & ((1n << 128n) - 1n);
+    const tag = new Uint8Array(16);
+    for (let i = 0; i < 16; i++) {
+        tag[i] = Number(acc & 0xffn);
+        acc >>= 8n;
+    }
+    return tag;
+}
+
+function aeadTag(key, nonce, ciphertext) {
+    const block = new Uint8Array(64);
+    chachaBlock(key, 0, nonce, block);
+    const padded = (ciphertext.length + 15) & ~15;
+    const macData = new Uint8Array(padded + 16);
+    macData.set(ciphertext, 0);
+    new DataView(macData.buffer).setBigUint64(padded + 8, BigInt(ciphertext.length), true);
+    return poly1305(block.subarray(0, 32), macData);
+}
+
+// 序号按大端序写入 nonce 的后 8 字节: seqNonce(0x0102030405060708n) = 000000000102030405060708
+const seqNonce = (seq) => {
+    const nonce = new Uint8Array(12);
+    new DataView(nonce.buffer).setBigUint64(4, seq, false);
+    return nonce;
+};
+
+async function deriveKey(secret, salt, info) {
+    const base = await crypto.subtle.importKey('raw', encoder.encode(secret), 'HKDF', false, ['deriveBits']);
+    const bits = await crypto.subtle.deriveBits(
+        { name: 'HKDF', hash: 'SHA-256', salt, info: encoder.encode(info) }, base, 256);
+    return new Uint8Array(bits);
+}
+
+// 测试向量（与 protocol/aead_test.go 相同），令牌 "ech-workers-test-token"，盐为 00 01 … 0f:
+//   客户端发送 "hello"，序号 0: 03a5fc0582678cde13d005f8863ec1f63131947e7a
+//                       序号 1: b1736a108b3840884c80a78737b9efae4903dd2f4a
+//   Worker 发送 "world"，序号 0: 337d819f29a095f69e1baeb6c07bac640e053be063
+//                       序号 1: 55649cc7c240c43ecd06e3ab03a2ff08d54a8d3f09
+async function createAEAD(secret, salt) {
+    const sealKey = await deriveKey(secret, salt, 'ech-workers aead s2c');
+    const openKey = await deriveKey(secret, salt, 'ech-workers aead c2s');
+    let sendSeq = 0n;
+    let recvSeq = 0n;
+    return {
+        seal(plain) {
+            const nonce = seqNonce(sendSeq++);
+            const ct = chachaXor(sealKey, nonce, 1, plain);
+            const out = new Uint8Array(ct.length + 16);
+            out.set(ct, 0);
+            out.set(aeadTag(sealKey, nonce, ct), ct.length);
+            return out;
+        },
+        open(sealed) {
+            if (sealed.length < 16) throw new Error('内层解密失败');
+            const nonce = seqNonce(recvSeq++);
+            const ct = sealed.subarray(0, sealed.length - 16);
+            const tag = aeadTag(openKey, nonce, ct);
+            let diff = 0;
+            for (let i = 0; i < 16; i++) diff |= tag[i] ^ sealed[ct.length + i];
+            if (diff !== 0) throw new Error('内层解密失败');
+            return chachaXor(openKey, nonce, 1, ct);
+        },
+    };
 }
 
 function safeCloseWebSocket(ws) {
@@ -0,0 +1,116 @@
+// Package admin 提供本地管理接口 (HTTP)。
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Server struct {
+	addr string
+	mux  *http.ServeMux
+	// token 修改状态的请求（GET/HEAD 以外）须在 Authorization 头中携带的令牌，为空时拒绝所有此类请求
+	token string
+}
+
+// NewServer 创建管理接口。GET 与 HEAD 以外的请求须携带 "Authorization: Bearer <token>" 与
+// "Content-Type: application/json"，且不能带有 Origin 头：浏览器中的网页可以向本机端口发送跨站的
+// 简单 POST 请求，但无法在不触发预检的情况下设置这些头部。token 为空时拒绝所有修改状态的请求。
+// 所有请求的 Host 须为 IP 地址、localhost 或 addr 中的主机名，见 allowedHost
+func NewServer(addr, token string) *Server {
+	return &Server{
+		addr:  addr,
+		mux:   http.NewServeMux(),
+		token: token,
+	}
+}
+
+// Handle 注册管理接口路径
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start 在后台启动管理接口
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("管理接口监听失败: %v", err)
+	}
+	srv := &http.Server{
+		Handler:           s.guard(s.mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("[管理] 接口已启动: http://%s", listener.Addr())
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("[管理] 接口异常退出: %v", err)
+		}
+	}()
+	return nil
+}
+
+// guard 拒绝 Host 不在允许范围内的请求并检查修改状态的请求，只读请求直接交给 next
+func (s *Server) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowedHost(r.Host) {
+			log.Printf("[管理] 拒绝来自 %s 的请求 %s %s: Host %q 不在允许范围内", r.RemoteAddr, r.Method, r.URL.Path, r.Host)
+			http.Error(w, "Host 不在允许范围内", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if code, err := s.authorize(r); err != nil {
+			log.Printf("[管理] 拒绝来自 %s 的请求 %s %s: %v", r.RemoteAddr, r.Method, r.URL.Path, err)
+			if code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize 返回修改状态的请求被拒绝时的状态码与原因
+func (s *Server) authorize(r *http.Request) (int, error) {
+	if r.Header.Get("Origin") != "" {
+		return http.StatusForbidden, errors.New("不接受来自网页的跨站请求")
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		return http.StatusUnsupportedMediaType, errors.New("Content-Type 必须为 application/json")
+	}
+	if s.token == "" {
+		return http.StatusForbidden, errors.New("未设置管理令牌 (-admin-token)，修改状态的接口已禁用")
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) != 1 {
+		return http.StatusUnauthorized, errors.New("管理令牌无效")
+	}
+	return 0, nil
+}
+
+// allowedHost 只接受 IP 地址、localhost 与监听地址中的主机名。DNS 重绑定的网页把自己的域名解析到
+// 本机后可以读取管理接口的应答，但请求中的 Host 仍是该域名
+func (s *Server) allowedHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if host == "" {
+		return false
+	}
+	if net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	listenHost, _, _ := net.SplitHostPort(s.addr)
+	return listenHost != "" && strings.EqualFold(host, listenHost)
+}
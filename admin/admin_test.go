@@ -0,0 +1,88 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	s := NewServer("", "secret")
+	s.Handle("/x", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	h := s.guard(s.mux)
+
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+	}{
+		{"get", http.MethodGet, nil, http.StatusNoContent},
+		{"authorized", http.MethodPost, map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json"}, http.StatusNoContent},
+		{"json-charset", http.MethodDelete, map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json; charset=utf-8"}, http.StatusNoContent},
+		{"no-token", http.MethodPost, map[string]string{"Content-Type": "application/json"}, http.StatusUnauthorized},
+		{"wrong-token", http.MethodPost, map[string]string{"Authorization": "Bearer nope", "Content-Type": "application/json"}, http.StatusUnauthorized},
+		{"form", http.MethodPost, map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"text", http.MethodPost, map[string]string{"Authorization": "Bearer secret", "Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{"origin", http.MethodPost, map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json", "Origin": "https://evil.example"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://127.0.0.1:30001/x", strings.NewReader("{}"))
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("状态码 %d，应为 %d (%s)", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestGuardWithoutToken(t *testing.T) {
+	s := NewServer("", "")
+	s.Handle("/x", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:30001/x", nil)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	s.guard(s.mux).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("未设置令牌时状态码 %d，应为 %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestGuardHost(t *testing.T) {
+	s := NewServer("admin.lan:30001", "secret")
+	s.Handle("/x", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	h := s.guard(s.mux)
+
+	tests := []struct {
+		host string
+		want int
+	}{
+		{"127.0.0.1:30001", http.StatusNoContent},
+		{"[::1]:30001", http.StatusNoContent},
+		{"localhost:30001", http.StatusNoContent},
+		{"LOCALHOST.", http.StatusNoContent},
+		{"admin.lan:30001", http.StatusNoContent},
+		{"rebind.example:30001", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/x", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("Host %q: 状态码 %d，应为 %d", tt.host, w.Code, tt.want)
+		}
+	}
+}
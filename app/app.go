@@ -0,0 +1,129 @@
+// Package app 查找本地代理连接所属的应用程序，用于按应用分流：
+// 只有匹配规则的应用经过隧道，其余应用直连。
+// Linux 通过 /proc 查找套接字所属进程与用户，Windows 通过 GetExtendedTcpTable 查找进程。
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupported 当前系统不支持按应用分流
+var ErrUnsupported = errors.New("当前系统不支持按应用分流")
+
+// ErrNotFound 找不到连接所属的进程（如连接来自其他主机）
+var ErrNotFound = errors.New("未找到连接所属的进程")
+
+// Process 连接所属的进程，UID 在不支持的系统上为 -1
+type Process struct {
+	PID  int
+	Path string
+	UID  int
+}
+
+// Name 返回可执行文件名
+func (p Process) Name() string {
+	return filepath.Base(p.Path)
+}
+
+// Lookup 根据本地代理收到的连接查找发起连接的进程。
+// client 为连接的 RemoteAddr，server 为 LocalAddr。m 为将要匹配的规则，
+// 其中没有可执行文件名与路径规则时只查找 UID，不查找进程号与路径；m 为 nil 时完整查找
+func Lookup(client, server net.Addr, m *Matcher) (Process, error) {
+	c, ok1 := client.(*net.TCPAddr)
+	s, ok2 := server.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return Process{}, ErrNotFound
+	}
+	if !c.IP.IsLoopback() && !isLocalIP(c.IP) {
+		return Process{}, ErrNotFound
+	}
+	return lookup(c, s, m == nil || m.needsPath())
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matcher 应用规则：可执行文件名（不区分大小写）、完整路径或 uid:N
+type Matcher struct {
+	names []string
+	paths []string
+	uids  []int
+}
+
+// ParseRules 解析逗号分隔的应用规则
+func ParseRules(spec string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+		case strings.HasPrefix(item, "uid:"):
+			uid, err := strconv.Atoi(strings.TrimPrefix(item, "uid:"))
+			if err != nil || uid < 0 {
+				return nil, fmt.Errorf("无效的应用规则 %q", item)
+			}
+			m.uids = append(m.uids, uid)
+		case strings.ContainsAny(item, `/\`):
+			m.paths = append(m.paths, filepath.Clean(item))
+		default:
+			m.names = append(m.names, item)
+		}
+	}
+	if m.Empty() {
+		return nil, errors.New("未指定应用规则")
+	}
+	return m, nil
+}
+
+// Empty 返回是否没有任何规则
+func (m *Matcher) Empty() bool {
+	return m == nil || len(m.names)+len(m.paths)+len(m.uids) == 0
+}
+
+// needsPath 返回规则是否需要进程的可执行文件路径
+func (m *Matcher) needsPath() bool {
+	return len(m.names)+len(m.paths) > 0
+}
+
+// Match 返回进程是否匹配任一规则
+func (m *Matcher) Match(p Process) bool {
+	if m.Empty() {
+		return false
+	}
+	for _, uid := range m.uids {
+		if p.UID == uid {
+			return true
+		}
+	}
+	if p.Path == "" {
+		return false
+	}
+	name := p.Name()
+	for _, n := range m.names {
+		// Windows 上允许省略 .exe
+		if strings.EqualFold(name, n) || strings.EqualFold(name, n+".exe") {
+			return true
+		}
+	}
+	for _, path := range m.paths {
+		if strings.EqualFold(filepath.Clean(p.Path), path) {
+			return true
+		}
+	}
+	return false
+}
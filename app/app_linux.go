@@ -0,0 +1,114 @@
+package app
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Linux 从 /proc/net/tcp{,6} 找到客户端套接字的 inode 与 uid，
+// 再扫描 /proc/<pid>/fd 找到持有该套接字的进程。扫描需遍历所有进程的文件描述符，
+// 只按 UID 匹配时 (withPath 为 false) 跳过，PID 为 -1
+
+func lookup(client, server *net.TCPAddr, withPath bool) (Process, error) {
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		inode, uid, err := findSocket(table, client, server)
+		if err != nil {
+			return Process{}, err
+		}
+		if inode == "" {
+			continue
+		}
+		p := Process{UID: uid, PID: -1}
+		if !withPath {
+			return p, nil
+		}
+		if pid, ok := findPID(inode); ok {
+			p.PID = pid
+			p.Path, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+		}
+		return p, nil
+	}
+	return Process{}, ErrNotFound
+}
+
+// findSocket 在 table 中查找本地地址为 client、远端地址为 server 的套接字
+func findSocket(table string, client, server *net.TCPAddr) (inode string, uid int, err error) {
+	f, err := os.Open(table)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", 0, nil
+		}
+		return "", 0, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Scan() // 表头
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if !addrEqual(fields[1], client) || !addrEqual(fields[2], server) {
+			continue
+		}
+		uid, _ = strconv.Atoi(fields[7])
+		return fields[9], uid, nil
+	}
+	return "", 0, sc.Err()
+}
+
+// addrEqual 比较 /proc/net/tcp 中 "IP:端口" 形式的十六进制地址。
+// IP 按 32 位字以主机字节序存储，IPv4 映射的 IPv6 地址与 IPv4 地址视为相同
+func addrEqual(field string, addr *net.TCPAddr) bool {
+	hexIP, hexPort, ok := strings.Cut(field, ":")
+	if !ok {
+		return false
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil || int(port) != addr.Port {
+		return false
+	}
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || len(raw)%4 != 0 {
+		return false
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+	return ip.Equal(addr.IP)
+}
+
+// findPID 扫描所有进程的文件描述符，返回持有该套接字的进程
+func findPID(inode string) (int, bool) {
+	target := "socket:[" + inode + "]"
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, false
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				return pid, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLookupSkipsPIDForUIDRules(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	exe, _ := os.Executable()
+	byName, _ := ParseRules(filepath.Base(exe))
+	byUID, _ := ParseRules("uid:" + strconv.Itoa(os.Getuid()))
+
+	p, err := Lookup(server.RemoteAddr(), server.LocalAddr(), byName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.PID != os.Getpid() || p.UID != os.Getuid() || !byName.Match(p) {
+		t.Fatalf("按名称查找得到 %+v", p)
+	}
+
+	p, err = Lookup(server.RemoteAddr(), server.LocalAddr(), byUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.PID != -1 || p.Path != "" || p.UID != os.Getuid() || !byUID.Match(p) {
+		t.Fatalf("只按 UID 查找得到 %+v", p)
+	}
+}
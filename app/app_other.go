@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package app
+
+import "net"
+
+func lookup(client, server *net.TCPAddr, withPath bool) (Process, error) {
+	return Process{}, ErrUnsupported
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows 通过 iphlpapi 的 GetExtendedTcpTable 找到客户端连接所属的进程，
+// 再用 QueryFullProcessImageNameW 读取可执行文件路径。Windows 没有 UID，总是查找路径
+
+var (
+	iphlpapi                = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetExtendedTcpTable = iphlpapi.NewProc("GetExtendedTcpTable")
+)
+
+const (
+	tcpTableOwnerPIDAll = 5
+	afINET              = 2
+	afINET6             = 23
+	// 行结构 MIB_TCPROW_OWNER_PID 与 MIB_TCP6ROW_OWNER_PID 的大小
+	tcpRowSize  = 24
+	tcp6RowSize = 56
+)
+
+func lookup(client, server *net.TCPAddr, _ bool) (Process, error) {
+	pid, ok, err := findPID(client, server)
+	if err != nil {
+		return Process{}, err
+	}
+	if !ok {
+		return Process{}, ErrNotFound
+	}
+	p := Process{PID: pid, UID: -1}
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return p, nil
+	}
+	defer windows.CloseHandle(h)
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err == nil {
+		p.Path = windows.UTF16ToString(buf[:size])
+	}
+	return p, nil
+}
+
+func findPID(client, server *net.TCPAddr) (int, bool, error) {
+	family, rowSize := afINET, tcpRowSize
+	if client.IP.To4() == nil {
+		family, rowSize = afINET6, tcp6RowSize
+	}
+	table, err := tcpTable(family)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(table) < 4 {
+		return 0, false, nil
+	}
+	n := int(binary.LittleEndian.Uint32(table))
+	rows := table[4:]
+	for i := 0; i < n && (i+1)*rowSize <= len(rows); i++ {
+		row := rows[i*rowSize : (i+1)*rowSize]
+		var localIP, remoteIP net.IP
+		var localPort, remotePort, pid uint32
+		if family == afINET {
+			localIP = net.IP(row[4:8])
+			localPort = binary.LittleEndian.Uint32(row[8:])
+			remoteIP = net.IP(row[12:16])
+			remotePort = binary.LittleEndian.Uint32(row[16:])
+			pid = binary.LittleEndian.Uint32(row[20:])
+		} else {
+			localIP = net.IP(row[0:16])
+			localPort = binary.LittleEndian.Uint32(row[20:])
+			remoteIP = net.IP(row[24:40])
+			remotePort = binary.LittleEndian.Uint32(row[44:])
+			pid = binary.LittleEndian.Uint32(row[52:])
+		}
+		// 端口以网络字节序存放在低 16 位
+		if ntohs(localPort) == client.Port && ntohs(remotePort) == server.Port &&
+			localIP.Equal(client.IP) && remoteIP.Equal(server.IP) {
+			return int(pid), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func ntohs(port uint32) int {
+	return int(port&0xff)<<8 | int(port>>8&0xff)
+}
+
+// tcpTable 返回 MIB_TCPTABLE_OWNER_PID（或 IPv6 版本）的原始字节
+func tcpTable(family int) ([]byte, error) {
+	var size uint32
+	for {
+		var buf []byte
+		var ptr uintptr
+		if size > 0 {
+			buf = make([]byte, size)
+			ptr = uintptr(unsafe.Pointer(&buf[0]))
+		}
+		r, _, _ := procGetExtendedTcpTable.Call(ptr, uintptr(unsafe.Pointer(&size)), 0, uintptr(family), tcpTableOwnerPIDAll, 0)
+		switch windows.Errno(r) {
+		case 0:
+			return buf, nil
+		case windows.ERROR_INSUFFICIENT_BUFFER:
+			continue
+		default:
+			return nil, windows.Errno(r)
+		}
+	}
+}
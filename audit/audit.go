@@ -0,0 +1,134 @@
+// Package audit 记录每次隧道 TLS 握手的 ECH 结果（接受、拒绝、GREASE、回退到普通 TLS），
+// 供管理接口查询，用于确认真实 SNI 没有在握手中泄露。
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Outcome string
+
+const (
+	// Accepted 服务器接受了 ECH，外层只暴露 public_name
+	Accepted Outcome = "accepted"
+	// Rejected 服务器拒绝了 ECH
+	Rejected Outcome = "rejected"
+	// GREASE 仅发送了 GREASE ECH 扩展，真实 SNI 未受保护
+	GREASE Outcome = "grease"
+	// Fallback 未使用 ECH，以普通 TLS 连接
+	Fallback Outcome = "fallback"
+)
+
+// DefaultCapacity 默认保留的最近记录条数
+const DefaultCapacity = 256
+
+// Entry 单次握手的记录
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Server  string    `json:"server"`
+	Outcome Outcome   `json:"outcome"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Log 保存最近的握手记录与各结果的累计次数
+type Log struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+	counts  map[Outcome]uint64
+}
+
+func NewLog(capacity int) *Log {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Log{
+		entries: make([]Entry, capacity),
+		counts:  make(map[Outcome]uint64),
+	}
+}
+
+// Record 记录一次握手结果
+func (l *Log) Record(server string, outcome Outcome, detail string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = Entry{Time: time.Now(), Server: server, Outcome: outcome, Detail: detail}
+	l.next++
+	if l.next == len(l.entries) {
+		l.next = 0
+		l.full = true
+	}
+	l.counts[outcome]++
+}
+
+// Entries 按时间顺序返回最近的记录，outcome 非空时只返回该结果的记录
+func (l *Log) Entries(outcome Outcome) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ordered []Entry
+	if l.full {
+		ordered = append(ordered, l.entries[l.next:]...)
+	}
+	ordered = append(ordered, l.entries[:l.next]...)
+	if outcome == "" {
+		return ordered
+	}
+	out := ordered[:0]
+	for _, e := range ordered {
+		if e.Outcome == outcome {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Counts 返回各结果的累计次数
+func (l *Log) Counts() map[Outcome]uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[Outcome]uint64, len(l.counts))
+	for k, v := range l.counts {
+		out[k] = v
+	}
+	return out
+}
+
+// Report 管理接口的输出
+type Report struct {
+	Counts  map[Outcome]uint64 `json:"counts"`
+	Entries []Entry            `json:"entries"`
+}
+
+// Handler 以JSON格式输出记录，支持 ?outcome=rejected 过滤与 ?limit=N 只返回最近 N 条
+func (l *Log) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries := l.Entries(Outcome(r.URL.Query().Get("outcome")))
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n >= 0 && n < len(entries) {
+			entries = entries[len(entries)-n:]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(Report{Counts: l.Counts(), Entries: entries})
+	})
+}
+
+var defaultLog = NewLog(DefaultCapacity)
+
+// Default 返回全局审计记录
+func Default() *Log {
+	return defaultLog
+}
+
+func Record(server string, outcome Outcome, detail string) {
+	defaultLog.Record(server, outcome, detail)
+}
+
+func Handler() http.Handler {
+	return defaultLog.Handler()
+}
@@ -0,0 +1,60 @@
+// Package auth 生成与校验握手时使用的基于时间的一次性令牌。
+//
+// 令牌格式为 "totp.<时间步>.<HMAC>"，其中时间步为 unix 秒 / TOTPStep，
+// HMAC 为 HMAC-SHA256(密钥, "ech-workers totp <时间步>") 的前 16 字节十六进制。
+// Worker 接受当前时间步前后各 TOTPSkew 步内的令牌，泄露的令牌在数十秒后即失效。
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TOTPStep = 30 * time.Second
+	TOTPSkew = 1
+
+	totpPrefix = "totp."
+	macSize    = 16
+)
+
+func totpMAC(secret string, step int64) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("ech-workers totp " + strconv.FormatInt(step, 10)))
+	return mac.Sum(nil)[:macSize]
+}
+
+// TOTPToken 返回 now 所在时间步的一次性令牌
+func TOTPToken(secret string, now time.Time) string {
+	step := now.Unix() / int64(TOTPStep/time.Second)
+	return totpPrefix + strconv.FormatInt(step, 10) + "." + hex.EncodeToString(totpMAC(secret, step))
+}
+
+// VerifyTOTP 校验一次性令牌，允许前后 TOTPSkew 个时间步的时钟误差
+func VerifyTOTP(secret, token string, now time.Time) bool {
+	rest, ok := strings.CutPrefix(token, totpPrefix)
+	if !ok {
+		return false
+	}
+	stepStr, macHex, ok := strings.Cut(rest, ".")
+	if !ok {
+		return false
+	}
+	step, err := strconv.ParseInt(stepStr, 10, 64)
+	if err != nil {
+		return false
+	}
+	current := now.Unix() / int64(TOTPStep/time.Second)
+	if step < current-TOTPSkew || step > current+TOTPSkew {
+		return false
+	}
+	mac, err := hex.DecodeString(macHex)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac, totpMAC(secret, step))
+}
@@ -0,0 +1,168 @@
+// Package breaker 按节点统计连续失败次数，超过预算时熔断该节点一段冷却时间，
+// 避免每条新连接都在已失效的节点上浪费数秒。冷却结束后放行一次试探连接（半开），
+// 成功则恢复，失败则重新熔断。
+package breaker
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	Closed   State = "closed"
+	Open     State = "open"
+	HalfOpen State = "half_open"
+)
+
+const (
+	// DefaultBudget 默认允许的连续失败次数
+	DefaultBudget = 3
+	// DefaultCooldown 默认的熔断冷却时间
+	DefaultCooldown = 30 * time.Second
+)
+
+// endpoint 单个节点的熔断状态
+type endpoint struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+	trips    uint64
+	lastErr  string
+}
+
+// Breaker 管理各节点的熔断状态，budget 不大于 0 时不熔断
+type Breaker struct {
+	budget   int
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	endpoints map[string]*endpoint
+}
+
+func New(budget int, cooldown time.Duration) *Breaker {
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+	return &Breaker{
+		budget:    budget,
+		cooldown:  cooldown,
+		endpoints: make(map[string]*endpoint),
+	}
+}
+
+func (b *Breaker) get(addr string) *endpoint {
+	e, ok := b.endpoints[addr]
+	if !ok {
+		e = &endpoint{}
+		b.endpoints[addr] = e
+	}
+	return e
+}
+
+// Allow 判断是否可以向该节点发起连接。冷却结束后只放行一次试探，
+// 调用方必须随后调用 Success、Failure 或 Abort 之一
+func (b *Breaker) Allow(addr string) bool {
+	if b == nil || b.budget <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.get(addr)
+	if e.openedAt.IsZero() {
+		return true
+	}
+	if e.probing || time.Since(e.openedAt) < b.cooldown {
+		return false
+	}
+	e.probing = true
+	return true
+}
+
+// Success 记录一次成功，节点恢复正常
+func (b *Breaker) Success(addr string) {
+	if b == nil || b.budget <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.get(addr)
+	e.failures = 0
+	e.openedAt = time.Time{}
+	e.probing = false
+}
+
+// Failure 记录一次失败，返回该节点是否因此被熔断
+func (b *Breaker) Failure(addr string, err error) bool {
+	if b == nil || b.budget <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.get(addr)
+	e.failures++
+	if err != nil {
+		e.lastErr = err.Error()
+	}
+	if e.probing || (e.openedAt.IsZero() && e.failures >= b.budget) {
+		e.openedAt = time.Now()
+		e.probing = false
+		e.trips++
+		return true
+	}
+	return false
+}
+
+// Abort 放弃一次连接（如调用方取消），不改变节点状态，只释放半开试探的名额
+func (b *Breaker) Abort(addr string) {
+	if b == nil || b.budget <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.get(addr).probing = false
+}
+
+// Status 单个节点的熔断状态
+type Status struct {
+	Endpoint  string    `json:"endpoint"`
+	State     State     `json:"state"`
+	Failures  int       `json:"consecutive_failures"`
+	Trips     uint64    `json:"trips"`
+	RetryAt   time.Time `json:"retry_at,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Status 返回各节点的熔断状态，按地址排序
+func (b *Breaker) Status() []Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]Status, 0, len(b.endpoints))
+	for addr, e := range b.endpoints {
+		st := Status{Endpoint: addr, State: Closed, Failures: e.failures, Trips: e.trips, LastError: e.lastErr}
+		switch {
+		case e.probing:
+			st.State = HalfOpen
+		case !e.openedAt.IsZero():
+			st.State = Open
+			st.RetryAt = e.openedAt.Add(b.cooldown)
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Endpoint < out[j].Endpoint })
+	return out
+}
+
+// Handler 以JSON格式输出各节点的熔断状态
+func (b *Breaker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(b.Status())
+	})
+}
@@ -0,0 +1,121 @@
+// Package bufpool 提供按大小分级、基于 sync.Pool 的共享缓冲区池，
+// 供转发与封帧代码复用，减少高负载下的内存分配与GC压力。
+package bufpool
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// DefaultSizes 默认的缓冲区大小等级
+var DefaultSizes = []int{2 * 1024, 16 * 1024, 32 * 1024, 64 * 1024}
+
+// Pool 是按大小等级划分的缓冲区池
+type Pool struct {
+	sizes []int
+	pools []sync.Pool
+}
+
+// New 使用给定的大小等级创建缓冲区池，未指定时使用 DefaultSizes
+func New(sizes ...int) (*Pool, error) {
+	if len(sizes) == 0 {
+		sizes = DefaultSizes
+	}
+	sorted := append([]int(nil), sizes...)
+	sort.Ints(sorted)
+	for i, size := range sorted {
+		if size <= 0 {
+			return nil, errors.New("缓冲区大小必须为正数")
+		}
+		if i > 0 && sorted[i-1] == size {
+			return nil, errors.New("缓冲区大小等级重复")
+		}
+	}
+
+	p := &Pool{
+		sizes: sorted,
+		pools: make([]sync.Pool, len(sorted)),
+	}
+	for i := range p.pools {
+		size := sorted[i]
+		p.pools[i].New = func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+	return p, nil
+}
+
+// Get 返回长度为 size 的缓冲区，容量为不小于 size 的最小等级；
+// 超过最大等级时直接分配，Put 时会被丢弃
+func (p *Pool) Get(size int) []byte {
+	idx := p.classFor(size)
+	if idx < 0 {
+		return make([]byte, size)
+	}
+	b := *(p.pools[idx].Get().(*[]byte))
+	return b[:size]
+}
+
+// Put 归还由 Get 获取的缓冲区
+func (p *Pool) Put(b []byte) {
+	c := cap(b)
+	idx := p.classFor(c)
+	if idx < 0 || p.sizes[idx] != c {
+		return
+	}
+	b = b[:c]
+	p.pools[idx].Put(&b)
+}
+
+// Sizes 返回当前的大小等级
+func (p *Pool) Sizes() []int {
+	return append([]int(nil), p.sizes...)
+}
+
+func (p *Pool) classFor(size int) int {
+	idx := sort.SearchInts(p.sizes, size)
+	if idx >= len(p.sizes) {
+		return -1
+	}
+	return idx
+}
+
+var (
+	defaultMu   sync.RWMutex
+	defaultPool *Pool
+)
+
+func init() {
+	defaultPool, _ = New()
+}
+
+// SetSizes 替换全局缓冲区池的大小等级，应在启动时调用
+func SetSizes(sizes ...int) error {
+	p, err := New(sizes...)
+	if err != nil {
+		return err
+	}
+	defaultMu.Lock()
+	defaultPool = p
+	defaultMu.Unlock()
+	return nil
+}
+
+// Default 返回全局缓冲区池
+func Default() *Pool {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultPool
+}
+
+// Get 从全局缓冲区池获取缓冲区
+func Get(size int) []byte {
+	return Default().Get(size)
+}
+
+// Put 将缓冲区归还到全局缓冲区池
+func Put(b []byte) {
+	Default().Put(b)
+}
@@ -2,8 +2,22 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"time"
+
+	"ech-workers/app"
+	"ech-workers/dialer"
+	"ech-workers/ech"
+	"ech-workers/keychain"
+	"ech-workers/protocol"
+	"ech-workers/route"
+	"ech-workers/transport"
+	"ech-workers/websocket"
 )
 
 type Config struct {
@@ -11,9 +25,307 @@ type Config struct {
 	ServerAddr string
 	ServerIP   string
 	Token      string
-	DNSServer  string
-	ECHDomain  string
-	ProxyIP    string
+	TokenFile  string
+	// TokenFileContent Validate 时令牌文件的原始内容（可能是 enc: 加密形式），用于监视文件变化
+	TokenFileContent string
+	TOTPSecret       string
+	// PassphraseFile 解密加密字段的口令文件，Passphrase 为 Validate 时读取到的口令
+	PassphraseFile string
+	Passphrase     string
+	DNSServer      string
+	// DoHPost 以 POST 发送 DoH 查询
+	DoHPost bool
+	// DoHHTTP3 DoH 优先使用 HTTP/3，失败时改用 HTTP/2
+	DoHHTTP3 bool
+	// DoHProxy 非空时 DoH 请求经该代理 (http/https/socks5) 发送
+	DoHProxy string
+	// DoHBootstrap DNS服务器主机名的固定地址，格式 "host=ip,ip;host2=ip"
+	DoHBootstrap string
+	// DNSFallback 所有DoH服务器都不可达时改用的明文DNS服务器
+	DNSFallback string
+	// DNS0x20 明文DNS后备查询随机改变域名大小写并校验应答
+	DNS0x20 bool
+	// DNSDebug 大于 0 时保留最近该数量的DNS查询原始报文，并以 dig 格式写入日志
+	DNSDebug int
+	// EDNSBufferSize 查询声明的UDP载荷大小，0 表示默认；DNSSECOK 在查询中设置 DO 位
+	EDNSBufferSize int
+	DNSSECOK       bool
+	// DNSSEC 验证ECH记录的 DNSSEC 签名链；DNSSECAnchors 为分号分隔的信任锚 (DS 格式)，为空时使用根区信任锚
+	DNSSEC        bool
+	DNSSECAnchors string
+	// ODoHProxy 非空时HTTPS记录查询经该 Oblivious DoH 代理转发，DNSServer 作为目标解析器
+	ODoHProxy string
+	ECHDomain string
+	// ECHStandby 逗号分隔的备用ECH域名，默认域名的配置不可用或被持续拒绝时依次改用
+	ECHStandby string
+	// ECHRecordType 获取ECH配置的记录类型 ("https" 或 "svcb")，为空时为 HTTPS
+	ECHRecordType string
+	ProxyIP       string
+	Direct        string
+	// GeoIP 与 GeoSite 为 -direct 中 geoip:/geosite: 规则使用的数据库文件与分类目录
+	GeoIP   string
+	GeoSite string
+	// Apps 非空时只有匹配的应用（进程名、路径或 uid:N，逗号分隔）经过隧道
+	Apps      string
+	AdminAddr string
+	// Transport 隧道传输方式名称，为空时使用 WebSocket
+	Transport string
+	// BreakerBudget 节点连续失败多少次后熔断，0 表示不熔断；BreakerCooldown 为熔断冷却时间
+	BreakerBudget   int
+	BreakerCooldown time.Duration
+	// Dialer 隧道底层拨号方式，"名称" 或 "名称:选项"，为空时使用 TCP
+	Dialer string
+	// AdminToken 管理接口修改状态的请求须携带的 Bearer 令牌，为空时这些接口禁用；可为 enc: 加密字段
+	AdminToken string
+	Protocol   int
+	VLESSUUID  string
+	AEAD       bool
+	// ECHDiscover DNS 没有 ECH 配置时以 GREASE 握手向服务端探测 retry_configs
+	ECHDiscover bool
+	// ECHGrease 没有可用的ECH配置时发送 GREASE ECH 而不是报错
+	ECHGrease bool
+	// ECHConfig 静态ECH配置，见 StaticECHConfig
+	ECHConfig string
+	// ECHCache 非空时把获取到的ECH配置缓存到该文件，启动时先使用缓存
+	ECHCache string
+	// ECHOuterSNI 非空时只使用 public_name 为该名称的ECH配置
+	ECHOuterSNI string
+	// ECHSuites 可接受的 HPKE 算法组合，按偏好排列，见 ech.ParseHPKESuites
+	ECHSuites string
+	// TLSCA 附加CA证书文件；TLSCert/TLSKey 客户端证书与私钥文件 (mTLS)；TLSInsecure 不验证服务端证书；
+	// TLSALPN 逗号分隔的 ALPN 协议
+	TLSCA       string
+	TLSCert     string
+	TLSKey      string
+	TLSInsecure bool
+	TLSALPN     string
+	// ECHFallback 允许 ECH 不可用时回退到普通 TLS（会暴露真实服务器名称）
+	ECHFallback bool
+	// HTTPSTarget 按HTTPS记录的 TargetName 与 port 参数连接服务器（未指定 ServerIP 时）
+	HTTPSTarget bool
+	// AddressFamily 连接服务器使用的地址族：auto（IPv4 与 IPv6 按 Happy Eyeballs 竞速）、v4only 或 v6only
+	AddressFamily string
+	// Compression 逗号分隔的压缩算法偏好，CompressionLevel 为 0 时使用默认级别
+	Compression      string
+	CompressionLevel int
+
+	// KeychainAccount 非空时从系统凭据存储读取该账户的令牌
+	KeychainAccount string
+
+	StreamBuffer int
+	// Listeners 本地监听套接字数量，大于 1 时在 Linux/FreeBSD 上打开多个共享端口的套接字
+	Listeners    int
+	StallTimeout time.Duration
+	Heartbeat    time.Duration
+	// CoverTraffic 大于 0 时隧道空闲期间以该平均间隔发送随机长度的 ping
+	CoverTraffic time.Duration
+	// Keepalive 大于 0 时每条隧道连接以该间隔发送 ping，KeepaliveTimeout 内未收到 pong 则关闭连接
+	Keepalive        time.Duration
+	KeepaliveTimeout time.Duration
+	// Headers WebSocket 升级请求附加的请求头，每项格式为 "名称: 值"
+	Headers []string
+	// PoolSize 预先建立的空闲隧道连接数，0 表示不使用连接池；PoolPolicy 为取出策略：round-robin 或 least-loaded
+	PoolSize   int
+	PoolPolicy string
+	// LogDedup 日志去重限速的窗口，0 表示不处理
+	LogDedup time.Duration
+	// ECHAutoRefresh 按HTTPS记录的 TTL 在后台自动刷新ECH配置
+	ECHAutoRefresh bool
+	// DNSBenchmark 大于 0 时按该间隔测量各DoH服务器并自动选择最佳者
+	DNSBenchmark time.Duration
+	// DNSStrategy 多个DNS服务器之间的查询策略 ("failover" 或 "race")，为空时为 failover
+	DNSStrategy string
+	// DNSTimeout 单次DNS查询的超时，0 表示默认
+	DNSTimeout time.Duration
+	// DNSRetries 获取ECH配置的最多尝试次数，DNSDeadline 含重试在内的总时限，0 表示默认
+	DNSRetries  int
+	DNSDeadline time.Duration
+}
+
+// ECHOptions 返回创建 ECH 管理器时的可选设置
+func (c *Config) ECHOptions() []ech.Option {
+	var opts []ech.Option
+	if c.DoHPost {
+		opts = append(opts, ech.WithDoHPost())
+	}
+	if c.DoHHTTP3 {
+		opts = append(opts, ech.WithDoHHTTP3())
+	}
+	if c.ODoHProxy != "" {
+		opts = append(opts, ech.WithODoHProxy(c.ODoHProxy))
+	}
+	if list, err := c.StaticECHConfig(); err == nil && list != nil {
+		opts = append(opts, ech.WithECHConfigList(list))
+	}
+	if c.ECHCache != "" {
+		opts = append(opts, ech.WithCacheFile(c.ECHCache))
+	}
+	if tlsOpts, err := c.tlsOptions(); err == nil {
+		opts = append(opts, ech.WithTLSOptions(tlsOpts))
+	}
+	if c.ECHOuterSNI != "" {
+		opts = append(opts, ech.WithOuterServerName(c.ECHOuterSNI))
+	}
+	if suites, err := ech.ParseHPKESuites(c.ECHSuites); err == nil && len(suites) > 0 {
+		opts = append(opts, ech.WithHPKESuites(suites...))
+	}
+	if c.ECHGrease {
+		opts = append(opts, ech.WithGREASE())
+	}
+	if c.DNSFallback != "" {
+		opts = append(opts, ech.WithPlainDNSFallback(c.DNSFallback))
+	}
+	if c.DNS0x20 {
+		opts = append(opts, ech.WithDNS0x20())
+	}
+	if c.DNSDebug > 0 {
+		opts = append(opts, ech.WithDNSDebug(c.DNSDebug))
+	}
+	if domains := c.standbyDomains(); len(domains) > 0 {
+		opts = append(opts, ech.WithStandbyDomains(domains...))
+	}
+	if c.EDNSBufferSize > 0 {
+		opts = append(opts, ech.WithEDNSBufferSize(uint16(c.EDNSBufferSize)))
+	}
+	if proxy, err := c.dohProxy(); err == nil && proxy != nil {
+		opts = append(opts, ech.WithDoHProxy(proxy))
+	}
+	if bootstrap, err := ech.ParseBootstrap(c.DoHBootstrap); err == nil {
+		for host, addrs := range bootstrap {
+			opts = append(opts, ech.WithBootstrap(host, addrs...))
+		}
+	}
+	if c.DNSTimeout > 0 {
+		opts = append(opts, ech.WithQueryTimeout(c.DNSTimeout))
+	}
+	if c.DNSRetries > 0 || c.DNSDeadline > 0 {
+		opts = append(opts, ech.WithRetryPolicy(ech.RetryPolicy{Attempts: c.DNSRetries, Deadline: c.DNSDeadline}))
+	}
+	if c.DNSSECOK {
+		opts = append(opts, ech.WithDNSSECOK())
+	}
+	if c.DNSSEC || c.DNSSECAnchors != "" {
+		anchors, _ := c.trustAnchors()
+		opts = append(opts, ech.WithDNSSEC(anchors...))
+	}
+	if rrType, err := ech.ParseRecordType(c.ECHRecordType); err == nil && rrType != ech.TypeHTTPS {
+		opts = append(opts, ech.WithRecordType(rrType))
+	}
+	if strategy, err := ech.ParseResolverStrategy(c.DNSStrategy); err == nil && strategy != ech.StrategyFailover {
+		opts = append(opts, ech.WithResolverStrategy(strategy))
+	}
+	return opts
+}
+
+// standbyDomains 解析 ECHStandby，忽略空项
+func (c *Config) standbyDomains() []string {
+	var out []string
+	for _, domain := range strings.Split(c.ECHStandby, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			out = append(out, domain)
+		}
+	}
+	return out
+}
+
+// ECHConfigEnv 未指定 -ech-config 时从该环境变量读取静态ECH配置
+const ECHConfigEnv = "ECH_WORKERS_ECH_CONFIG"
+
+// StaticECHConfig 返回静态ECH配置：ECHConfig 为 Base64 形式的 ECHConfigList，以 @ 开头时为文件路径
+// （文件内容为 Base64 或二进制），为空时读取环境变量 ECHConfigEnv；都未设置时返回 nil
+func (c *Config) StaticECHConfig() ([]byte, error) {
+	value := c.ECHConfig
+	if value == "" {
+		value = os.Getenv(ECHConfigEnv)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	path, ok := strings.CutPrefix(value, "@")
+	if !ok {
+		return ech.DecodeConfigList(value)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取ECH配置文件失败: %w", err)
+	}
+	if list, err := ech.DecodeConfigList(string(data)); err == nil {
+		return list, nil
+	}
+	if err := ech.ValidateConfigList(data); err != nil {
+		return nil, fmt.Errorf("ECH配置文件 %s 无效: %w", path, err)
+	}
+	return data, nil
+}
+
+// tlsOptions 读取 TLSCA、TLSCert 与 TLSKey 并合并其余 TLS 设置
+func (c *Config) tlsOptions() (ech.TLSOptions, error) {
+	opts, err := ech.LoadTLSOptions(c.TLSCA, c.TLSCert, c.TLSKey)
+	if err != nil {
+		return ech.TLSOptions{}, err
+	}
+	opts.InsecureSkipVerify = c.TLSInsecure
+	for _, proto := range strings.Split(c.TLSALPN, ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			opts.NextProtos = append(opts.NextProtos, proto)
+		}
+	}
+	return opts, nil
+}
+
+// dohProxy 解析 DoHProxy，为空时返回 nil
+func (c *Config) dohProxy() (*url.URL, error) {
+	if c.DoHProxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.DoHProxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("无效的DoH代理地址: %s", c.DoHProxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("不支持的DoH代理协议: %s (可选 http、https、socks5)", u.Scheme)
+}
+
+// trustAnchors 解析 DNSSECAnchors
+func (c *Config) trustAnchors() ([]ech.TrustAnchor, error) {
+	var anchors []ech.TrustAnchor
+	for _, s := range strings.Split(c.DNSSECAnchors, ";") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		a, err := ech.ParseTrustAnchor(s)
+		if err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, a)
+	}
+	return anchors, nil
+}
+
+// Family 返回连接服务器使用的地址族，名称无效时为 websocket.FamilyAuto（Validate 会报告该错误）
+func (c *Config) Family() websocket.AddressFamily {
+	f, _ := websocket.ParseAddressFamily(c.AddressFamily)
+	return f
+}
+
+// Header 返回升级请求附加的请求头，格式错误时为空（Validate 会报告该错误）
+func (c *Config) Header() http.Header {
+	h, _ := websocket.ParseHeader(c.Headers)
+	return h
+}
+
+// Pool 返回连接池的取出策略，名称无效时为 websocket.PoolRoundRobin（Validate 会报告该错误）
+func (c *Config) Pool() websocket.PoolPolicy {
+	p, _ := websocket.ParsePoolPolicy(c.PoolPolicy)
+	return p
+}
+
+// RouteOptions 返回直连规则使用的数据库位置
+func (c *Config) RouteOptions() route.Options {
+	return route.Options{GeoIP: c.GeoIP, GeoSite: c.GeoSite}
 }
 
 func (c *Config) Validate() error {
@@ -21,6 +333,180 @@ func (c *Config) Validate() error {
 		return errors.New("必须指定服务端地址 (-f)")
 	}
 
+	if c.TokenFile != "" {
+		if c.Token != "" {
+			return errors.New("-token 与 -token-file 不能同时使用")
+		}
+		token, err := ReadTokenFile(c.TokenFile)
+		if err != nil {
+			return err
+		}
+		c.Token = token
+		c.TokenFileContent = token
+	}
+
+	if c.KeychainAccount != "" {
+		if c.Token != "" {
+			return errors.New("-keychain 不能与 -token 或 -token-file 同时使用")
+		}
+		token, err := keychain.Get(c.KeychainAccount)
+		if err != nil {
+			return fmt.Errorf("从凭据存储读取令牌失败: %w", err)
+		}
+		c.Token = token
+	}
+
+	if err := c.decryptSecrets(); err != nil {
+		return err
+	}
+
+	if c.TOTPSecret != "" && c.Token != "" {
+		return errors.New("TOTP 认证不能与固定令牌同时使用")
+	}
+
+	if c.Protocol != protocol.Legacy && (c.Protocol < protocol.MinVersion || c.Protocol > protocol.MaxVersion) {
+		return fmt.Errorf("不支持的隧道协议版本: %d", c.Protocol)
+	}
+
+	if c.AEAD {
+		if c.Protocol == protocol.Legacy {
+			return errors.New("内层加密需要启用协议协商 (-proto 1)")
+		}
+		if c.Token == "" && c.TOTPSecret == "" {
+			return errors.New("内层加密需要设置令牌 (-token) 或 TOTP 密钥 (-totp)")
+		}
+	}
+
+	algs, err := protocol.ParseCompression(c.Compression)
+	if err != nil {
+		return err
+	}
+	if len(algs) > 0 && c.Protocol == protocol.Legacy {
+		return errors.New("压缩需要启用协议协商 (-proto 1)")
+	}
+	if err := protocol.CheckCompression(algs, c.CompressionLevel); err != nil {
+		return err
+	}
+
+	if c.Heartbeat < 0 {
+		return errors.New("心跳间隔不能为负数")
+	}
+	if c.Listeners < 0 {
+		return errors.New("监听套接字数量不能为负数")
+	}
+	if c.CoverTraffic < 0 {
+		return errors.New("填充流量间隔不能为负数")
+	}
+	if c.Keepalive < 0 || c.KeepaliveTimeout < 0 {
+		return errors.New("保活间隔与超时不能为负数")
+	}
+	if _, err := websocket.ParseHeader(c.Headers); err != nil {
+		return err
+	}
+	if c.PoolSize < 0 {
+		return errors.New("连接池大小不能为负数")
+	}
+	if _, err := websocket.ParsePoolPolicy(c.PoolPolicy); err != nil {
+		return err
+	}
+
+	if c.Direct != "" {
+		router, err := route.ParseOptions(c.Direct, c.RouteOptions())
+		if err != nil {
+			return err
+		}
+		router.Close()
+	}
+
+	if c.Apps != "" {
+		if _, err := app.ParseRules(c.Apps); err != nil {
+			return err
+		}
+	}
+
+	if c.BreakerBudget < 0 || c.BreakerCooldown < 0 {
+		return errors.New("熔断预算与冷却时间不能为负数")
+	}
+	if _, err := transport.Lookup(c.Transport); err != nil {
+		return err
+	}
+	if _, err := dialer.New(c.Dialer); err != nil {
+		return err
+	}
+
+	servers, err := ech.ParseResolvers(c.DNSServer)
+	if err != nil {
+		return err
+	}
+	if c.ODoHProxy != "" {
+		for _, server := range servers {
+			if strings.Contains(server, "://") && !strings.HasPrefix(server, "https://") && !strings.HasPrefix(server, "http://") {
+				return fmt.Errorf("使用 ODoH 代理时DNS服务器须为 DoH 服务器: %s", server)
+			}
+		}
+	}
+	if _, err := ech.ParseRecordType(c.ECHRecordType); err != nil {
+		return err
+	}
+	if _, err := websocket.ParseAddressFamily(c.AddressFamily); err != nil {
+		return err
+	}
+	if _, err := ech.ParseResolverStrategy(c.DNSStrategy); err != nil {
+		return err
+	}
+	if c.ECHDomain != "" {
+		if _, err := ech.CanonicalName(c.ECHDomain); err != nil {
+			return err
+		}
+	}
+	for _, domain := range c.standbyDomains() {
+		if _, err := ech.CanonicalName(domain); err != nil {
+			return fmt.Errorf("备用ECH域名无效: %w", err)
+		}
+	}
+	if c.EDNSBufferSize < 0 || c.EDNSBufferSize > 65535 {
+		return errors.New("EDNS0 UDP载荷大小应在 0-65535 之间")
+	}
+	if _, err := c.trustAnchors(); err != nil {
+		return err
+	}
+	if _, err := c.StaticECHConfig(); err != nil {
+		return err
+	}
+	if _, err := ech.ParseHPKESuites(c.ECHSuites); err != nil {
+		return err
+	}
+	if _, err := c.tlsOptions(); err != nil {
+		return err
+	}
+	if _, err := c.dohProxy(); err != nil {
+		return err
+	}
+	if _, err := ech.ParseBootstrap(c.DoHBootstrap); err != nil {
+		return err
+	}
+	if c.DNSTimeout < 0 {
+		return errors.New("DNS查询超时不能为负数")
+	}
+	if c.DNSRetries < 0 || c.DNSDeadline < 0 {
+		return errors.New("DNS重试次数与总时限不能为负数")
+	}
+	if c.DNSDebug < 0 {
+		return errors.New("DNS调试记录数不能为负数")
+	}
+	if c.DNSBenchmark < 0 {
+		return errors.New("DoH测速间隔不能为负数")
+	}
+
+	if c.VLESSUUID != "" {
+		if c.Protocol != protocol.Legacy {
+			return errors.New("VLESS 兼容模式不能与 -proto 同时使用")
+		}
+		if _, err := protocol.ParseUUID(c.VLESSUUID); err != nil {
+			return err
+		}
+	}
+
 	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
 		if !strings.Contains(err.Error(), "missing port") {
 			return errors.New("监听地址格式无效")
@@ -40,3 +526,34 @@ func (c *Config) Validate() error {
 
 	return nil
 }
+
+// decryptSecrets 解密以 EncryptedPrefix 开头的敏感字段。指定了口令文件时总是读取口令，
+// 运行中从令牌文件读到的加密令牌同样需要它
+func (c *Config) decryptSecrets() error {
+	if c.Passphrase == "" && c.PassphraseFile != "" {
+		passphrase, err := LoadPassphrase(c.PassphraseFile)
+		if err != nil {
+			return err
+		}
+		c.Passphrase = passphrase
+	}
+	fields := []*string{&c.Token, &c.TOTPSecret, &c.VLESSUUID, &c.AdminToken}
+	for _, f := range fields {
+		if !IsEncrypted(*f) {
+			continue
+		}
+		if c.Passphrase == "" {
+			passphrase, err := LoadPassphrase(c.PassphraseFile)
+			if err != nil {
+				return err
+			}
+			c.Passphrase = passphrase
+		}
+		plain, err := DecryptSecret(*f, c.Passphrase)
+		if err != nil {
+			return err
+		}
+		*f = plain
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// EncryptedPrefix 加密字段的前缀，格式为 "enc:v1:" + base64(盐 | 随机数 | 密文)。
+// 密钥由口令经 scrypt 派生，使用 XChaCha20-Poly1305 加密。
+const EncryptedPrefix = "enc:v1:"
+
+// PassphraseEnv 未指定口令文件时从该环境变量读取口令
+const PassphraseEnv = "ECH_WORKERS_PASSPHRASE"
+
+const (
+	secretSaltSize = 16
+	scryptN        = 1 << 15
+	scryptR        = 8
+	scryptP        = 1
+)
+
+// IsEncrypted 返回字段是否为加密格式
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, EncryptedPrefix)
+}
+
+func secretKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+}
+
+// EncryptSecret 用口令加密敏感字段，结果可直接写入命令行参数或令牌文件
+func EncryptSecret(plaintext, passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", errors.New("口令不能为空")
+	}
+	buf := make([]byte, secretSaltSize+chacha20poly1305.NonceSizeX, secretSaltSize+chacha20poly1305.NonceSizeX+len(plaintext)+chacha20poly1305.Overhead)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	key, err := secretKey(passphrase, buf[:secretSaltSize])
+	if err != nil {
+		return "", err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+	out := aead.Seal(buf, buf[secretSaltSize:], []byte(plaintext), []byte(EncryptedPrefix))
+	return EncryptedPrefix + base64.RawStdEncoding.EncodeToString(out), nil
+}
+
+// DecryptSecret 解密加密字段，未加密的字段原样返回
+func DecryptSecret(value, passphrase string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("配置包含加密字段，需要通过 -passphrase-file 或环境变量 %s 提供口令", PassphraseEnv)
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, EncryptedPrefix))
+	if err != nil || len(raw) < secretSaltSize+chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return "", errors.New("加密字段格式无效")
+	}
+	key, err := secretKey(passphrase, raw[:secretSaltSize])
+	if err != nil {
+		return "", err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := raw[secretSaltSize : secretSaltSize+chacha20poly1305.NonceSizeX]
+	plain, err := aead.Open(nil, nonce, raw[secretSaltSize+chacha20poly1305.NonceSizeX:], []byte(EncryptedPrefix))
+	if err != nil {
+		return "", errors.New("解密配置失败，口令错误或数据已损坏")
+	}
+	return string(plain), nil
+}
+
+// LoadPassphrase 从口令文件读取口令，path 为空时读取环境变量 PassphraseEnv
+func LoadPassphrase(path string) (string, error) {
+	if path == "" {
+		return os.Getenv(PassphraseEnv), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("读取口令文件失败: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
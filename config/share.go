@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"ech-workers/protocol"
+)
+
+// ShareScheme 分享链接的协议名，格式为
+// ech://<令牌>@<服务端地址>[/路径]?ech=<域名>&dns=<DoH>&ip=...&pyip=...&proto=1&aead=1&compress=...#<名称>
+const ShareScheme = "ech"
+
+// ShareLink 把连接相关的配置编码为分享链接，本地监听地址等与设备相关的选项不包含在内
+func (c *Config) ShareLink(name string) (string, error) {
+	if c.ServerAddr == "" {
+		return "", errors.New("必须指定服务端地址 (-f)")
+	}
+	host, path := c.ServerAddr, ""
+	if i := strings.Index(host, "/"); i >= 0 {
+		host, path = host[:i], host[i:]
+	}
+
+	q := url.Values{}
+	setIf := func(key, value string) {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	setIf("ech", c.ECHDomain)
+	if !strings.EqualFold(c.ECHRecordType, "https") {
+		setIf("rr", c.ECHRecordType)
+	}
+	setIf("dns", c.DNSServer)
+	setIf("ip", c.ServerIP)
+	setIf("pyip", c.ProxyIP)
+	setIf("totp", c.TOTPSecret)
+	setIf("vless", c.VLESSUUID)
+	if c.Protocol != protocol.Legacy {
+		q.Set("proto", strconv.Itoa(c.Protocol))
+	}
+	if c.AEAD {
+		q.Set("aead", "1")
+	}
+	if c.Compression != "" && c.Compression != protocol.CompressionNone {
+		q.Set("compress", c.Compression)
+	}
+
+	u := url.URL{
+		Scheme:   ShareScheme,
+		Host:     host,
+		Path:     path,
+		RawQuery: q.Encode(),
+		Fragment: name,
+	}
+	if c.Token != "" {
+		u.User = url.User(c.Token)
+	}
+	return u.String(), nil
+}
+
+// ParseShareLink 解析分享链接并写入 c，返回链接中的名称
+func ParseShareLink(link string, c *Config) (name string, err error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return "", fmt.Errorf("分享链接格式无效: %v", err)
+	}
+	if u.Scheme != ShareScheme {
+		return "", fmt.Errorf("不支持的分享链接协议: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", errors.New("分享链接缺少服务端地址")
+	}
+	c.ServerAddr = u.Host
+	if u.Path != "" && u.Path != "/" {
+		c.ServerAddr += u.Path
+	}
+	if u.User != nil {
+		c.Token = u.User.Username()
+	}
+
+	q := u.Query()
+	getIf := func(key string, dst *string) {
+		if v := q.Get(key); v != "" {
+			*dst = v
+		}
+	}
+	getIf("ech", &c.ECHDomain)
+	getIf("rr", &c.ECHRecordType)
+	getIf("dns", &c.DNSServer)
+	getIf("ip", &c.ServerIP)
+	getIf("pyip", &c.ProxyIP)
+	getIf("totp", &c.TOTPSecret)
+	getIf("vless", &c.VLESSUUID)
+	getIf("compress", &c.Compression)
+	if v := q.Get("proto"); v != "" {
+		if c.Protocol, err = strconv.Atoi(v); err != nil {
+			return "", fmt.Errorf("分享链接中的协议版本无效: %s", v)
+		}
+	}
+	c.AEAD = q.Get("aead") == "1"
+	return u.Fragment, nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultTokenPollInterval 令牌文件的默认检查间隔
+const DefaultTokenPollInterval = 10 * time.Second
+
+// ReadTokenFile 读取令牌文件，忽略首尾空白
+func ReadTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("读取令牌文件失败: %w", err)
+	}
+	token := string(bytes.TrimSpace(data))
+	if token == "" {
+		return "", errors.New("令牌文件为空")
+	}
+	return token, nil
+}
+
+// WatchTokenFile 定期检查令牌文件，内容变化时调用 onChange，返回的函数用于停止检查。
+// 读取失败时保留当前令牌，避免文件被替换的瞬间导致认证中断。
+func WatchTokenFile(path, current string, interval time.Duration, onChange func(token string)) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultTokenPollInterval
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				token, err := ReadTokenFile(path)
+				if err != nil {
+					log.Printf("[配置] %v，继续使用当前令牌", err)
+					continue
+				}
+				if token != current {
+					current = token
+					onChange(token)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncryptedTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "pass")
+	if err := os.WriteFile(passFile, []byte("passphrase\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := EncryptSecret("secret-token", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte(enc+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{ServerAddr: "example.com:443", DNSServer: "dns.alidns.com/dns-query", TokenFile: tokenFile, PassphraseFile: passFile}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Token != "secret-token" || c.TokenFileContent != enc {
+		t.Fatalf("Token %q, TokenFileContent %q", c.Token, c.TokenFileContent)
+	}
+	if c.Passphrase != "passphrase" {
+		t.Fatalf("口令未读取: %q", c.Passphrase)
+	}
+
+	changed := make(chan string, 1)
+	stop := WatchTokenFile(tokenFile, c.TokenFileContent, 10*time.Millisecond, func(token string) { changed <- token })
+	defer stop()
+	select {
+	case token := <-changed:
+		t.Fatalf("令牌文件未变化时触发了轮换: %q", token)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := os.WriteFile(tokenFile, []byte("new-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case token := <-changed:
+		if token != "new-token" {
+			t.Fatalf("轮换到 %q", token)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("令牌文件变化后没有轮换")
+	}
+}
+
+func TestPassphraseLoadedWithoutEncryptedFields(t *testing.T) {
+	passFile := filepath.Join(t.TempDir(), "pass")
+	if err := os.WriteFile(passFile, []byte("passphrase"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{ServerAddr: "example.com:443", DNSServer: "dns.alidns.com/dns-query", Token: "plain", PassphraseFile: passFile}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Passphrase != "passphrase" {
+		t.Fatalf("指定了口令文件但未读取口令: %q", c.Passphrase)
+	}
+}
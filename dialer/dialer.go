@@ -0,0 +1,89 @@
+// Package dialer 管理隧道底层连接的拨号方式。默认使用 TCP，
+// 其他承载方式（用户态 WireGuard、tsnet、自定义混淆 TCP 等）可以通过 Register 注册，
+// 并在配置中按名称选择。
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultName 默认的底层拨号方式
+const DefaultName = "tcp"
+
+// UnderlyingDialer 建立隧道的底层连接，TLS 与 WebSocket 在其之上建立
+type UnderlyingDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Factory 根据选项创建拨号器，选项为配置中名称之后 ":" 后的部分（可能为空）
+type Factory func(options string) (UnderlyingDialer, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register 注册拨号方式，同名的注册会覆盖之前的
+func Register(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = f
+}
+
+// Names 返回已注册的拨号方式名称
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New 按 "名称" 或 "名称:选项" 创建拨号器，spec 为空时使用 DefaultName
+func New(spec string) (UnderlyingDialer, error) {
+	if spec == "" {
+		spec = DefaultName
+	}
+	name, options, _ := strings.Cut(spec, ":")
+	registryMu.RLock()
+	f, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("未知的底层拨号方式 %q (可用: %s)", name, strings.Join(Names(), ", "))
+	}
+	d, err := f(options)
+	if err != nil {
+		return nil, fmt.Errorf("底层拨号方式 %s: %w", name, err)
+	}
+	return d, nil
+}
+
+// tcpDialer 直接建立 TCP 连接，选项为连接超时（如 "tcp:5s"）
+type tcpDialer struct {
+	net.Dialer
+}
+
+func newTCP(options string) (UnderlyingDialer, error) {
+	d := &tcpDialer{net.Dialer{Timeout: 10 * time.Second}}
+	if options != "" {
+		timeout, err := time.ParseDuration(options)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("无效的超时 %q", options)
+		}
+		d.Timeout = timeout
+	}
+	return d, nil
+}
+
+func init() {
+	Register(DefaultName, newTCP)
+}
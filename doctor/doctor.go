@@ -0,0 +1,218 @@
+// Package doctor 按依赖顺序逐项检查连接链路，定位连接失败的环节。
+package doctor
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"ech-workers/auth"
+	"ech-workers/config"
+	"ech-workers/dialer"
+	"ech-workers/ech"
+	"ech-workers/protocol"
+	"ech-workers/websocket"
+)
+
+const stepTimeout = 10 * time.Second
+
+// Result 单项检查结果，Skipped 表示因前置检查失败而未执行
+type Result struct {
+	Name     string
+	OK       bool
+	Skipped  bool
+	Detail   string
+	Duration time.Duration
+}
+
+type runner struct {
+	w       io.Writer
+	results []Result
+	failed  bool
+}
+
+// step 执行一项检查；之前已有检查失败时跳过
+func (r *runner) step(name string, fn func() (string, error)) {
+	if r.failed {
+		r.report(Result{Name: name, Skipped: true, Detail: "前置检查未通过"})
+		return
+	}
+	start := time.Now()
+	detail, err := fn()
+	res := Result{Name: name, OK: err == nil, Detail: detail, Duration: time.Since(start)}
+	if err != nil {
+		res.Detail = err.Error()
+		r.failed = true
+	}
+	r.report(res)
+}
+
+func (r *runner) report(res Result) {
+	r.results = append(r.results, res)
+	mark := "通过"
+	switch {
+	case res.Skipped:
+		mark = "跳过"
+	case !res.OK:
+		mark = "失败"
+	}
+	line := fmt.Sprintf("[%s] %-14s %s", mark, res.Name, res.Detail)
+	if !res.Skipped {
+		line += fmt.Sprintf(" (%v)", res.Duration.Round(time.Millisecond))
+	}
+	fmt.Fprintln(r.w, line)
+}
+
+// Run 依次检查 DoH、HTTPS记录、ECH配置、TCP、TLS+ECH、WebSocket升级与令牌，
+// 输出报告到 w，全部通过时 ok 为 true
+func Run(cfg *config.Config, w io.Writer) (results []Result, ok bool) {
+	r := &runner{w: w}
+	m := ech.NewECHManager(cfg.ECHDomain, cfg.DNSServer, cfg.ECHOptions()...)
+	m.SetODoHProxy(cfg.ODoHProxy)
+	servers, _ := ech.ParseResolvers(cfg.DNSServer)
+
+	var probes []ech.ProbeResult
+	r.step("DoH 可达", func() (string, error) {
+		var ok []string
+		var errs []string
+		for _, server := range servers {
+			p := m.Probe(server)
+			probes = append(probes, p)
+			if p.Reachable {
+				ok = append(ok, fmt.Sprintf("%s %v", server, p.Latency.Round(time.Millisecond)))
+			} else {
+				errs = append(errs, p.Err.Error())
+			}
+		}
+		if len(ok) == 0 {
+			return "", fmt.Errorf("所有DoH服务器均不可达: %s", strings.Join(errs, "; "))
+		}
+		return strings.Join(ok, ", "), nil
+	})
+
+	var echBase64 string
+	r.step("HTTPS 记录", func() (string, error) {
+		var lastErr error
+		for _, p := range probes {
+			if p.Reachable && p.Err == nil {
+				echBase64 = p.ECH
+				return fmt.Sprintf("%s (来自 %s)", cfg.ECHDomain, p.Server), nil
+			}
+			if p.Reachable {
+				lastErr = p.Err
+			}
+		}
+		return "", fmt.Errorf("%s 的 HTTPS 记录无效: %v", cfg.ECHDomain, lastErr)
+	})
+
+	r.step("ECH 配置", func() (string, error) {
+		raw, err := base64.StdEncoding.DecodeString(echBase64)
+		if err != nil {
+			return "", fmt.Errorf("Base64 解码失败: %v", err)
+		}
+		configs, err := ech.DescribeConfigList(raw)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range configs {
+			if c.Version == ech.ECHConfigVersion {
+				return c.String(), nil
+			}
+		}
+		return "", errors.New("没有受支持版本的 ECHConfig")
+	})
+
+	client := websocket.NewWebSocketClient(cfg.ServerAddr, cfg.Token, m, cfg.ServerIP)
+	client.SetECHFallback(cfg.ECHFallback)
+	client.SetServiceEndpoint(cfg.HTTPSTarget)
+	client.SetAddressFamily(cfg.Family())
+	client.SetHeader(cfg.Header())
+	host, _, _, _ := client.ParseServerAddr()
+	var tcpConn net.Conn
+	r.step("TCP 连接", func() (string, error) {
+		addr, err := client.TargetAddr()
+		if err != nil {
+			return "", err
+		}
+		d, err := dialer.New(cfg.Dialer)
+		if err != nil {
+			return "", err
+		}
+		client.SetUnderlyingDialer(d)
+		ctx, cancel := context.WithTimeout(context.Background(), stepTimeout)
+		defer cancel()
+		tcpConn, err = d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		return addr, nil
+	})
+
+	r.step("TLS+ECH 握手", func() (string, error) {
+		defer tcpConn.Close()
+		if err := m.Prepare(); err != nil {
+			return "", err
+		}
+		tlsCfg, err := m.BuildTLSConfig(host)
+		if err != nil {
+			return "", err
+		}
+		tlsConn := tls.Client(tcpConn, tlsCfg)
+		tlsConn.SetDeadline(time.Now().Add(stepTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return "", err
+		}
+		st := tlsConn.ConnectionState()
+		if !st.ECHAccepted {
+			return "", ech.ErrECHRejected
+		}
+		return fmt.Sprintf("%s, ECH 已接受", tls.VersionName(st.Version)), nil
+	})
+
+	if cfg.TOTPSecret != "" {
+		secret := cfg.TOTPSecret
+		client.SetTokenSource(func() string { return auth.TOTPToken(secret, time.Now()) })
+	}
+	var authErr error
+	var wsConn io.Closer
+	r.step("WebSocket 升级", func() (string, error) {
+		conn, info, err := client.DialWithECHInfo(1)
+		if errors.Is(err, websocket.ErrAuthFailed) {
+			authErr = err
+			return "服务端已响应", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		wsConn = conn
+		if cfg.Protocol != protocol.Legacy {
+			session, err := protocol.Negotiate(conn, protocol.Offer{}, stepTimeout)
+			if err != nil {
+				conn.Close()
+				return "", fmt.Errorf("协议协商失败: %w", err)
+			}
+			return fmt.Sprintf("协议 %s (%s)", session, info), nil
+		}
+		return fmt.Sprintf("%s (%s)", cfg.ServerAddr, info), nil
+	})
+	r.step("令牌", func() (string, error) {
+		if wsConn != nil {
+			wsConn.Close()
+		}
+		if authErr != nil {
+			return "", authErr
+		}
+		if cfg.Token == "" && cfg.TOTPSecret == "" {
+			return "未设置令牌，服务端未要求认证", nil
+		}
+		return "服务端已接受", nil
+	})
+
+	return r.results, !r.failed
+}
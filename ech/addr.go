@@ -0,0 +1,208 @@
+package ech
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	typeA    = 1
+	typeAAAA = 28
+	// addrCacheMin 地址缓存的最短时间，避免 TTL 很小的记录使每次拨号都查询
+	addrCacheMin = 30 * time.Second
+)
+
+// addrEntry QueryAddr 缓存的结果
+type addrEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// QueryAddr 经与ECH配置查询相同的加密DNS服务器查询 domain 的 A 与 AAAA 记录（IPv4 在前），
+// 使连接服务器时的域名解析同样不经过明文的系统DNS。服务器按当前顺序故障转移，
+// 结果按记录的 TTL 缓存；domain 为IP地址时直接返回该地址
+func (m *ECHManager) QueryAddr(ctx context.Context, domain string) ([]net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(domain, "[]")); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if ascii, err := ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	key := domainKey(domain)
+	m.addrMu.Lock()
+	entry, ok := m.addrs[key]
+	m.addrMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	if m.resolver != nil {
+		ips, err := m.queryAddrResolver(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		m.cacheAddr(key, ips, 0)
+		return ips, nil
+	}
+
+	if ips, ttl, ok := m.cachedAddrs(domain); ok {
+		m.cacheAddr(key, ips, ttl)
+		return ips, nil
+	}
+	var lastErr error
+	for _, server := range m.resolvers.Ordered() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		ips, ttl, err := m.queryAddrFrom(ctx, domain, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(ips) == 0 {
+			lastErr = fmt.Errorf("%s 没有 A/AAAA 记录", domain)
+			continue
+		}
+		m.cacheAddr(key, ips, ttl)
+		return ips, nil
+	}
+	if lastErr == nil {
+		lastErr = ErrDoHFailed
+	}
+	return nil, lastErr
+}
+
+// cacheAddr 缓存 QueryAddr 的结果，ttl 以秒为单位，不足 addrCacheMin 时按 addrCacheMin
+func (m *ECHManager) cacheAddr(key string, ips []net.IP, ttl uint32) {
+	m.addrMu.Lock()
+	defer m.addrMu.Unlock()
+	if m.addrs == nil {
+		m.addrs = make(map[string]addrEntry)
+	}
+	m.addrs[key] = addrEntry{ips: ips, expires: time.Now().Add(max(time.Duration(ttl)*time.Second, addrCacheMin))}
+}
+
+// queryAddrResolver 经注入的解析器查询 A 与 AAAA 记录，任一查询成功即返回
+func (m *ECHManager) queryAddrResolver(ctx context.Context, domain string) ([]net.IP, error) {
+	v4, err4 := m.resolver.QueryA(ctx, domain)
+	v6, err6 := m.resolver.QueryAAAA(ctx, domain)
+	if err4 != nil && err6 != nil {
+		return nil, err4
+	}
+	ips := append(v4, v6...)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s 没有 A/AAAA 记录", domain)
+	}
+	return ips, nil
+}
+
+// cachedAddrs 从应答缓存读取 A 与 AAAA 记录，两者都命中且至少有一个地址时返回 true
+func (m *ECHManager) cachedAddrs(domain string) ([]net.IP, uint32, bool) {
+	var ips []net.IP
+	var minTTL uint32
+	for _, qtype := range []uint16{typeA, typeAAAA} {
+		var server string
+		found, ttl, err := m.lookupAddr(domain, qtype, m.cachedExchange(&server))
+		if err != nil {
+			return nil, 0, false
+		}
+		if len(found) > 0 && (len(ips) == 0 || ttl < minTTL) {
+			minTTL = ttl
+		}
+		ips = append(ips, found...)
+	}
+	return ips, minTTL, len(ips) > 0
+}
+
+// queryAddrFrom 向 server 查询 A 与 AAAA 记录，任一查询成功即返回其结果与其中最小的 TTL
+func (m *ECHManager) queryAddrFrom(ctx context.Context, domain, server string) ([]net.IP, uint32, error) {
+	var ips []net.IP
+	var minTTL uint32
+	var lastErr error
+	succeeded := false
+	for _, qtype := range []uint16{typeA, typeAAAA} {
+		start := time.Now()
+		found, ttl, err := m.queryAddrType(ctx, domain, server, qtype)
+		if err != nil && ctx.Err() != nil {
+			return nil, 0, fmt.Errorf("%s: %w", server, ctx.Err())
+		}
+		m.resolvers.Record(server, time.Since(start), err)
+		m.recordQuery(server, time.Since(start), err)
+		if err != nil {
+			lastErr = fmt.Errorf("%w: %s: %v", ErrDoHFailed, server, err)
+			continue
+		}
+		succeeded = true
+		if len(found) > 0 && (len(ips) == 0 || ttl < minTTL) {
+			minTTL = ttl
+		}
+		ips = append(ips, found...)
+	}
+	if !succeeded {
+		return nil, 0, lastErr
+	}
+	return ips, minTTL, nil
+}
+
+// queryAddrType 查询一种地址记录。应答中经 CNAME 得到的地址一并返回，应答只有 CNAME 时继续查询其目标；
+// 启用 DNSSEC 验证时，CNAME 链与终点的地址记录集须通过验证
+func (m *ECHManager) queryAddrType(ctx context.Context, domain, server string, qtype uint16) ([]net.IP, uint32, error) {
+	return m.lookupAddr(domain, qtype, func(name string, qtype uint16) ([]byte, error) {
+		return m.fetchDoH(ctx, name, server, qtype)
+	})
+}
+
+// lookupAddr 经 exchange 查询一种地址记录，其余同 queryAddrType
+func (m *ECHManager) lookupAddr(domain string, qtype uint16, exchange queryFunc) ([]net.IP, uint32, error) {
+	seen := map[string]bool{}
+	// chainTTL 为经过的 CNAME 中最小的 TTL
+	var chainTTL uint32
+	chained := false
+	for depth := 0; ; depth++ {
+		body, err := exchange(domain, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		target, cnameTTL, err := m.followCNAMEs(body, domain, qtype, exchange)
+		if err != nil {
+			return nil, 0, err
+		}
+		if target != domain && (!chained || cnameTTL < chainTTL) {
+			chainTTL, chained = cnameTTL, true
+		}
+		answers, err := parseAnswers(body)
+		if err != nil {
+			// 没有应答记录表示该地址族不存在，不算查询失败
+			return nil, 0, nil
+		}
+		var ips []net.IP
+		var minTTL uint32
+		for _, rr := range answers {
+			if rr.Type != qtype || (qtype == typeA && len(rr.Data) != net.IPv4len) || (qtype == typeAAAA && len(rr.Data) != net.IPv6len) {
+				continue
+			}
+			if len(ips) == 0 || rr.TTL < minTTL {
+				minTTL = rr.TTL
+			}
+			ips = append(ips, net.IP(append([]byte(nil), rr.Data...)))
+		}
+		if len(ips) > 0 || target == domain {
+			if chained && len(ips) > 0 {
+				minTTL = min(minTTL, chainTTL)
+			}
+			return ips, minTTL, nil
+		}
+		// 应答只有 CNAME，继续查询其目标
+		seen[domainKey(domain)] = true
+		domain = target
+		if seen[domainKey(domain)] {
+			return nil, 0, fmt.Errorf("CNAME 记录出现循环: %s", domain)
+		}
+		if depth+1 >= maxAliasDepth {
+			return nil, 0, fmt.Errorf("CNAME 链超过 %d 层", maxAliasDepth)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package ech
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// answerCacheSize 应答缓存的最大条目数
+	answerCacheSize = 1024
+	// negativeCacheMax 否定应答 (NXDOMAIN/NODATA) 的最长缓存时间，使新发布的记录能较快生效
+	negativeCacheMax = 5 * time.Minute
+	// typeSOA SOA 记录类型，否定应答的缓存时间取自授权部分的 SOA (RFC 2308)
+	typeSOA = 6
+)
+
+// errCacheMiss 应答缓存中没有该查询
+var errCacheMiss = errors.New("应答缓存未命中")
+
+// answerEntry 缓存的应答报文。rcode 不为 0 时（NXDOMAIN）命中返回对应的 *RcodeError
+type answerEntry struct {
+	body    []byte
+	rcode   int
+	server  string
+	stored  time.Time
+	expires time.Time
+}
+
+// answerCache 按 (域名, 类型) 缓存DNS应答，遵循记录的 TTL；否定应答按 SOA 的 MINIMUM 缓存。
+// 缓存在服务器轮询之前查询，命中时不产生网络请求，也不计入各服务器的统计
+type answerCache struct {
+	mu      sync.Mutex
+	entries map[string]answerEntry
+}
+
+func answerKey(domain string, qtype uint16) string {
+	return domainKey(domain) + "/" + strconv.Itoa(int(qtype))
+}
+
+// store 缓存 server 对 domain 的 qtype 查询的应答；TTL 为 0 或否定应答没有 SOA 时不缓存
+func (c *answerCache) store(domain string, qtype uint16, server string, body []byte) {
+	if len(body) < 12 {
+		return
+	}
+	rcode := int(body[3] & 0x0F)
+	var ttl time.Duration
+	switch {
+	case rcode == 0 && binary.BigEndian.Uint16(body[6:8]) > 0:
+		minTTL, ok := answerTTL(body)
+		if !ok {
+			return
+		}
+		ttl = time.Duration(minTTL) * time.Second
+	case rcode == 0 || rcode == 3:
+		soaTTL, ok := negativeTTL(body)
+		if !ok {
+			return
+		}
+		ttl = min(time.Duration(soaTTL)*time.Second, negativeCacheMax)
+	default:
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]answerEntry)
+	}
+	if len(c.entries) >= answerCacheSize {
+		c.evictLocked(now)
+	}
+	c.entries[answerKey(domain, qtype)] = answerEntry{
+		body:    append([]byte(nil), body...),
+		rcode:   rcode,
+		server:  server,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+}
+
+// evictLocked 删除过期的条目，仍然已满时任意删除一条
+func (c *answerCache) evictLocked(now time.Time) {
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < answerCacheSize {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// lookup 返回未过期的缓存应答，其中记录的 TTL 已减去缓存经过的时间
+func (c *answerCache) lookup(domain string, qtype uint16) (body []byte, server string, err error) {
+	c.mu.Lock()
+	e, ok := c.entries[answerKey(domain, qtype)]
+	c.mu.Unlock()
+	now := time.Now()
+	if !ok || !now.Before(e.expires) {
+		return nil, "", errCacheMiss
+	}
+	if e.rcode != 0 {
+		return nil, e.server, &RcodeError{Rcode: e.rcode}
+	}
+	return ageTTLs(e.body, uint32(now.Sub(e.stored)/time.Second)), e.server, nil
+}
+
+// forget 删除 domain 的 qtype 应答
+func (c *answerCache) forget(domain string, qtype uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, answerKey(domain, qtype))
+}
+
+func (c *answerCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// FlushAnswerCache 清空DNS应答缓存，之后的查询重新向服务器发送
+func (m *ECHManager) FlushAnswerCache() {
+	m.answers.flush()
+}
+
+// cachedExchange 返回只从应答缓存读取的 queryFunc，未命中时返回 errCacheMiss；
+// 首次命中的应答来自的服务器写入 server
+func (m *ECHManager) cachedExchange(server *string) queryFunc {
+	return func(name string, qtype uint16) ([]byte, error) {
+		body, from, err := m.answers.lookup(name, qtype)
+		if errors.Is(err, errCacheMiss) {
+			return nil, err
+		}
+		m.cacheHits.Add(1)
+		if *server == "" {
+			*server = from
+		}
+		return body, err
+	}
+}
+
+// walkRecords 依次对应答、授权与附加部分的每条记录调用 fn，ttlOff 为记录 TTL 字段的偏移；报文格式错误时返回 false
+func walkRecords(msg []byte, fn func(section int, name string, rrType uint16, ttlOff int, rdata []byte)) bool {
+	if len(msg) < 12 {
+		return false
+	}
+	offset := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:6])); i++ {
+		_, next, err := readName(msg, offset)
+		if err != nil || next+4 > len(msg) {
+			return false
+		}
+		offset = next + 4
+	}
+	for section := 0; section < 3; section++ {
+		count := int(binary.BigEndian.Uint16(msg[6+2*section:]))
+		for i := 0; i < count; i++ {
+			name, next, err := readName(msg, offset)
+			if err != nil || next+10 > len(msg) {
+				return false
+			}
+			rrType := binary.BigEndian.Uint16(msg[next:])
+			dataLen := int(binary.BigEndian.Uint16(msg[next+8:]))
+			if next+10+dataLen > len(msg) {
+				return false
+			}
+			fn(section, name, rrType, next+4, msg[next+10:next+10+dataLen])
+			offset = next + 10 + dataLen
+		}
+	}
+	return true
+}
+
+// answerTTL 返回应答部分记录中最小的 TTL
+func answerTTL(msg []byte) (uint32, bool) {
+	var minTTL uint32
+	found := false
+	ok := walkRecords(msg, func(section int, _ string, _ uint16, ttlOff int, _ []byte) {
+		if ttl := binary.BigEndian.Uint32(msg[ttlOff:]); section == 0 && (!found || ttl < minTTL) {
+			minTTL, found = ttl, true
+		}
+	})
+	return minTTL, ok && found
+}
+
+// negativeTTL 返回否定应答的缓存时间：授权部分 SOA 记录的 TTL 与其 MINIMUM 字段中较小者 (RFC 2308)
+func negativeTTL(msg []byte) (uint32, bool) {
+	var ttl uint32
+	found := false
+	ok := walkRecords(msg, func(section int, _ string, rrType uint16, ttlOff int, rdata []byte) {
+		if section == 1 && rrType == typeSOA && len(rdata) >= 20 && !found {
+			ttl = min(binary.BigEndian.Uint32(msg[ttlOff:]), binary.BigEndian.Uint32(rdata[len(rdata)-4:]))
+			found = true
+		}
+	})
+	return ttl, ok && found
+}
+
+// ageTTLs 返回 msg 的副本，其中各记录（OPT 除外）的 TTL 减去 elapsed 秒
+func ageTTLs(msg []byte, elapsed uint32) []byte {
+	out := append([]byte(nil), msg...)
+	if elapsed == 0 {
+		return out
+	}
+	walkRecords(out, func(_ int, _ string, rrType uint16, ttlOff int, _ []byte) {
+		if rrType == typeOPT {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(out[ttlOff:])
+		binary.BigEndian.PutUint32(out[ttlOff:], ttl-min(ttl, elapsed))
+	})
+	return out
+}
@@ -0,0 +1,80 @@
+package ech
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// WithBootstrap 把DNS服务器的主机名 host 固定解析为 addrs，连接时按顺序尝试这些地址而不经过系统DNS，
+// 用于DoH服务器的域名本身被污染的网络。TLS 仍以 host 验证证书。可多次使用以设置多个主机。
+// 作用于 DoH（含 JSON 格式与 ODoH）与 DoT；使用 WithHTTPClient 时 DoH 请求不受影响
+func WithBootstrap(host string, addrs ...net.IP) Option {
+	return func(m *ECHManager) {
+		if m.bootstrap == nil {
+			m.bootstrap = make(map[string][]net.IP)
+		}
+		host = bootstrapKey(host)
+		m.bootstrap[host] = append(m.bootstrap[host], addrs...)
+	}
+}
+
+// ParseBootstrap 解析 "host=ip,ip;host2=ip" 形式的引导地址表
+func ParseBootstrap(spec string) (map[string][]net.IP, error) {
+	out := make(map[string][]net.IP)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, list, ok := strings.Cut(entry, "=")
+		host = strings.TrimSpace(host)
+		if !ok || host == "" {
+			return nil, fmt.Errorf("无效的引导地址 %q，格式为 主机名=IP[,IP]", entry)
+		}
+		for _, s := range strings.Split(list, ",") {
+			ip := net.ParseIP(strings.Trim(strings.TrimSpace(s), "[]"))
+			if ip == nil {
+				return nil, fmt.Errorf("%s 的引导地址 %q 不是IP地址", host, s)
+			}
+			out[host] = append(out[host], ip)
+		}
+	}
+	return out, nil
+}
+
+func bootstrapKey(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// dialContext 连接 addr；主机名设置了引导地址时依次连接这些地址，全部失败时返回最后一个错误
+func (m *ECHManager) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || len(m.bootstrap[bootstrapKey(host)]) == 0 {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	var lastErr error
+	for _, ip := range m.bootstrap[bootstrapKey(host)] {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// newHTTPClient 按 WithDoHProxy 与 WithBootstrap 的设置创建 DoH 请求使用的客户端
+func (m *ECHManager) newHTTPClient() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if m.dohProxy != nil {
+		t.Proxy = http.ProxyURL(m.dohProxy)
+	}
+	if len(m.bootstrap) > 0 {
+		t.DialContext = m.dialContext
+	}
+	return &http.Client{Transport: t}
+}
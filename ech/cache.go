@@ -0,0 +1,101 @@
+package ech
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ech-workers/events"
+)
+
+// cacheEntry 缓存文件的内容
+type cacheEntry struct {
+	Domain     string    `json:"domain"`
+	ConfigList []byte    `json:"config_list"`
+	Source     string    `json:"source"`
+	FetchedAt  time.Time `json:"fetched_at"`
+	// TTL 以秒计，0 表示未知
+	TTL int64 `json:"ttl"`
+}
+
+// WithCacheFile 每次成功获取ECH配置后写入缓存文件 path，重启后可用 LoadCache 立即恢复上次的配置，
+// 无需等待DNS查询。静态配置不写入缓存
+func WithCacheFile(path string) Option {
+	return func(m *ECHManager) {
+		m.cacheFile = path
+	}
+}
+
+// LoadCache 从缓存文件恢复上次获取的ECH配置，返回是否恢复成功；文件不存在时返回 false 与 nil。
+// 缓存的获取时间与 TTL 保持不变，已过期的配置同样会恢复（作为最后可用的配置），
+// 调用方应随后在后台调用 Prepare 或启用自动刷新以取得最新配置
+func (m *ECHManager) LoadCache() (bool, error) {
+	if m.cacheFile == "" {
+		return false, nil
+	}
+	data, err := os.ReadFile(m.cacheFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("读取ECH配置缓存失败: %w", err)
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return false, fmt.Errorf("解析ECH配置缓存失败: %w", err)
+	}
+	if !strings.EqualFold(entry.Domain, m.echDomain) {
+		return false, fmt.Errorf("ECH配置缓存属于 %s 而不是 %s", entry.Domain, m.echDomain)
+	}
+	if err := ValidateConfigList(entry.ConfigList); err != nil {
+		return false, fmt.Errorf("ECH配置缓存无效: %w", err)
+	}
+	m.publish(m.echDomain, entry.ConfigList, nil, "cache:"+entry.Source, time.Duration(entry.TTL)*time.Second, entry.FetchedAt)
+	events.Emit(events.ECHRefreshed, m.echDomain, nil)
+	return true, nil
+}
+
+// saveCache 把当前配置写入缓存文件。先写临时文件再重命名，避免中途退出留下残缺的缓存
+func (m *ECHManager) saveCache() {
+	s := m.SnapshotFor(m.echDomain)
+	if s == nil {
+		return
+	}
+	entry := cacheEntry{
+		Domain:     m.echDomain,
+		ConfigList: s.ECHList,
+		Source:     s.Source,
+		FetchedAt:  s.FetchedAt,
+		TTL:        int64(s.TTL / time.Second),
+	}
+	if err := writeCacheFile(m.cacheFile, entry); err != nil {
+		log.Printf("[客户端] 写入ECH配置缓存失败: %v", err)
+	}
+}
+
+func writeCacheFile(path string, entry cacheEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ech-cache-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
@@ -0,0 +1,116 @@
+package ech
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Discovery GREASE 探测的目标。DNS 查不到 HTTPS 记录（例如被本地解析器过滤）时，
+// 以一个服务器无法解密的 ECH 配置与目标握手，支持 ECH 的服务器会拒绝它并在
+// retry_configs 中返回真正的 ECHConfigList，探测即以此作为可用的配置。
+type Discovery struct {
+	// ServerName 探测握手的 SNI，同时作为探测配置的 public_name，服务器证书需覆盖该名称
+	ServerName string
+	// Addr 连接地址 (host:port)，为空时连接 ServerName:443
+	Addr string
+	// RootCAs 验证服务器证书的根证书，为空时使用系统根证书
+	RootCAs *x509.CertPool
+	// Timeout 单次探测的超时，0 表示 10 秒
+	Timeout time.Duration
+}
+
+// SetDiscovery 启用 GREASE 探测，DNS 没有返回 ECH 配置时改为从 d 指定的服务器获取；
+// d 为 nil 时关闭
+func (m *ECHManager) SetDiscovery(d *Discovery) {
+	m.echListMu.Lock()
+	defer m.echListMu.Unlock()
+	m.discovery = d
+}
+
+// discover 执行 GREASE 探测，返回服务器提供的 ECHConfigList
+func (d *Discovery) discover(ctx context.Context) ([]byte, error) {
+	addr := d.Addr
+	if addr == "" {
+		addr = net.JoinHostPort(d.ServerName, "443")
+	}
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	roots := d.RootCAs
+	if roots == nil {
+		var err error
+		if roots, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("加载系统根证书失败: %w", err)
+		}
+	}
+	grease, err := greaseConfigList(d.ServerName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	dialer := &tls.Dialer{Config: &tls.Config{
+		MinVersion:                     tls.VersionTLS13,
+		ServerName:                     d.ServerName,
+		EncryptedClientHelloConfigList: grease,
+		RootCAs:                        roots,
+	}}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err == nil {
+		// 服务器不可能解密探测配置，握手成功说明它没有启用 ECH 而是忽略了扩展
+		conn.Close()
+		return nil, fmt.Errorf("%s 未启用 ECH", d.ServerName)
+	}
+	var rejection *tls.ECHRejectionError
+	if !errors.As(err, &rejection) {
+		return nil, fmt.Errorf("GREASE 探测握手失败: %w", err)
+	}
+	if len(rejection.RetryConfigList) == 0 {
+		return nil, fmt.Errorf("%w: %s 没有提供 retry_configs", ErrECHRejected, d.ServerName)
+	}
+	if err := ValidateConfigList(rejection.RetryConfigList); err != nil {
+		return nil, fmt.Errorf("retry_configs 无效: %w", err)
+	}
+	return rejection.RetryConfigList, nil
+}
+
+// greaseConfigList 生成只含一个随机 X25519 公钥配置的 ECHConfigList，
+// 格式合法但没有对应的私钥，public_name 为 publicName。用于 GREASE 探测与 GREASE 模式
+func greaseConfigList(publicName string) ([]byte, error) {
+	if publicName == "" || len(publicName) > 255 {
+		return nil, fmt.Errorf("无效的探测服务器名称 %q", publicName)
+	}
+	var id [1]byte
+	key := make([]byte, 32)
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	contents := []byte{id[0]}
+	contents = binary.BigEndian.AppendUint16(contents, hpkeKEMX25519)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(key)))
+	contents = append(contents, key...)
+	contents = binary.BigEndian.AppendUint16(contents, 4)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeKDFHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeAEADAES128GCM)
+	contents = append(contents, 0, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // 无扩展
+
+	config := binary.BigEndian.AppendUint16(nil, ECHConfigVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(config))), config...), nil
+}
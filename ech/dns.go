@@ -0,0 +1,521 @@
+package ech
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// ParseDNSResponse 解析DNS应答报文，返回首个HTTPS记录中ech参数的Base64编码，
+// 未找到时返回空字符串。畸形报文返回错误而不会越界。
+func ParseDNSResponse(response []byte) (string, error) {
+	ech, _, err := ParseDNSAnswer(response)
+	return ech, err
+}
+
+// ParseDNSAnswer 同 ParseDNSResponse，另外返回该HTTPS记录的 TTL（秒）
+func ParseDNSAnswer(response []byte) (string, uint32, error) {
+	rec, ttl, err := ParseHTTPSAnswer(response)
+	if err != nil || rec == nil || len(rec.ECH) == 0 {
+		return "", 0, err
+	}
+	return base64.StdEncoding.EncodeToString(rec.ECH), ttl, nil
+}
+
+// ParseHTTPSAnswer 解析DNS应答报文，返回首个带ech参数的HTTPS记录及其 TTL（秒），
+// 没有这样的记录时返回 nil
+func ParseHTTPSAnswer(response []byte) (*HTTPSRecord, uint32, error) {
+	return ParseSVCBAnswer(response, TypeHTTPS)
+}
+
+// ParseSVCBAnswer 同 ParseHTTPSAnswer，只接受 rrType (TypeSVCB 或 TypeHTTPS) 类型的记录。
+// 两种记录的 RDATA 格式相同。有多条记录时按 SvcPriority 选择；应答中没有带ech参数的记录
+// 但有 AliasMode 记录时返回该记录 (Priority 为 0)，由调用方继续查询其 Target
+func ParseSVCBAnswer(response []byte, rrType uint16) (*HTTPSRecord, uint32, error) {
+	records, ttl, err := ParseSVCBRecords(response, rrType)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rec := RecordSet(records).Primary(); rec != nil {
+		return rec, ttl, nil
+	}
+	if len(records) > 0 && records[0].Priority == 0 {
+		return records[0], ttl, nil
+	}
+	return nil, 0, nil
+}
+
+// ParseSVCBRecords 解析应答中全部 rrType 类型的记录，按 SvcPriority 升序排列（AliasMode 在最前），
+// 同时返回这些记录中最小的 TTL（秒）。无法解析的记录被跳过
+func ParseSVCBRecords(response []byte, rrType uint16) ([]*HTTPSRecord, uint32, error) {
+	answers, err := parseAnswers(response)
+	if err != nil {
+		return nil, 0, err
+	}
+	var records []*HTTPSRecord
+	var minTTL uint32
+	for _, rr := range answers {
+		if rr.Type != rrType {
+			continue
+		}
+		rec, err := ParseHTTPSRData(rr.Data)
+		if err != nil {
+			continue
+		}
+		if len(records) == 0 || rr.TTL < minTTL {
+			minTTL = rr.TTL
+		}
+		records = append(records, rec)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+	return records, minTTL, nil
+}
+
+// resourceRecord 应答部分的一条资源记录，Data 为未经处理的 RDATA
+type resourceRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+	// dataOff 为 Data 在报文中的偏移，用于解压 RDATA 中的域名
+	dataOff int
+}
+
+// errNoAnswer 应答中没有任何记录
+var errNoAnswer = errors.New("无应答记录")
+
+// parseAnswers 解析应答报文的应答部分，记录被截断时返回已解析的部分
+func parseAnswers(response []byte) ([]resourceRecord, error) {
+	if len(response) < 12 {
+		return nil, errors.New("响应过短")
+	}
+
+	qdcount := binary.BigEndian.Uint16(response[4:6])
+	ancount := binary.BigEndian.Uint16(response[6:8])
+	if ancount == 0 {
+		return nil, errNoAnswer
+	}
+
+	offset := 12
+	for i := 0; i < int(qdcount); i++ {
+		_, next, err := readName(response, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next + 4
+		if offset > len(response) {
+			return nil, errors.New("问题部分被截断")
+		}
+	}
+
+	var answers []resourceRecord
+	for i := 0; i < int(ancount); i++ {
+		name, next, err := readName(response, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+
+		if offset+10 > len(response) {
+			break
+		}
+
+		rr := resourceRecord{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(response[offset : offset+2]),
+			Class: binary.BigEndian.Uint16(response[offset+2 : offset+4]),
+			TTL:   binary.BigEndian.Uint32(response[offset+4 : offset+8]),
+		}
+		dataLen := int(binary.BigEndian.Uint16(response[offset+8 : offset+10]))
+		offset += 10
+
+		if offset+dataLen > len(response) {
+			break
+		}
+		rr.Data = response[offset : offset+dataLen]
+		rr.dataOff = offset
+		offset += dataLen
+		answers = append(answers, rr)
+	}
+	return answers, nil
+}
+
+// typeCNAME CNAME 记录类型
+const typeCNAME = 5
+
+// cnameChain 从 name 开始沿应答部分的 CNAME 记录前进，返回链的终点、链上各 CNAME 记录的所有者
+// 与其中最小的 TTL。递归解析器通常把 CNAME 与目标的记录一并返回，也可能只返回 CNAME，
+// 此时调用方需要再查询 target。没有 CNAME 时 target 为 name；应答内出现循环时返回错误
+func cnameChain(response []byte, name string) (target string, owners []string, ttl uint32, err error) {
+	answers, err := parseAnswers(response)
+	if err != nil {
+		return name, nil, 0, nil
+	}
+	target = name
+	for {
+		var next *resourceRecord
+		for i := range answers {
+			if answers[i].Type == typeCNAME && domainKey(answers[i].Name) == domainKey(target) {
+				next = &answers[i]
+				break
+			}
+		}
+		if next == nil {
+			return target, owners, ttl, nil
+		}
+		alias, _, err := readName(response, next.dataOff)
+		if err != nil {
+			return "", nil, 0, fmt.Errorf("CNAME 记录格式错误: %w", err)
+		}
+		if len(owners) == 0 || next.TTL < ttl {
+			ttl = next.TTL
+		}
+		owners = append(owners, target)
+		for _, owner := range owners {
+			if domainKey(owner) == domainKey(alias) {
+				return "", nil, 0, fmt.Errorf("CNAME 记录出现循环: %s", alias)
+			}
+		}
+		target = alias
+	}
+}
+
+// RecordSet 同一服务的 ServiceMode 记录，按 SvcPriority 升序（优先级从高到低）排列
+type RecordSet []*HTTPSRecord
+
+// Primary 返回优先级最高的带ech参数的 ServiceMode 记录，没有时返回 nil
+func (s RecordSet) Primary() *HTTPSRecord {
+	for _, rec := range s {
+		if rec.Priority != 0 && len(rec.ECH) > 0 {
+			return rec
+		}
+	}
+	return nil
+}
+
+// SvcParamKey 取值 (RFC 9460)
+const (
+	svcParamMandatory     = 0
+	svcParamALPN          = 1
+	svcParamNoDefaultALPN = 2
+	svcParamPort          = 3
+	svcParamIPv4Hint      = 4
+	svcParamECH           = 5
+	svcParamIPv6Hint      = 6
+)
+
+// HTTPSRecord 解析后的HTTPS或SVCB记录 (RFC 9460)
+type HTTPSRecord struct {
+	// Priority 为 0 表示 AliasMode，此时 Target 是别名目标且没有其他参数
+	Priority uint16
+	// Target 服务所在的域名，"." 表示与查询的域名相同
+	Target string
+	// ALPN 支持的应用层协议，NoDefaultALPN 为 true 时不隐含 http/1.1
+	ALPN          []string
+	NoDefaultALPN bool
+	// Port 服务端口，0 表示未指定
+	Port uint16
+	// IPv4Hint 与 IPv6Hint 为 Target 的地址提示
+	IPv4Hint []net.IP
+	IPv6Hint []net.IP
+	// ECH 为 ech 参数中的 ECHConfigList
+	ECH []byte
+}
+
+// ParseHTTPSRData 解析HTTPS记录的RDATA。未知的参数被忽略，参数长度与格式不正确时返回错误
+func ParseHTTPSRData(data []byte) (*HTTPSRecord, error) {
+	if len(data) < 3 {
+		return nil, errors.New("HTTPS记录过短")
+	}
+	rec := &HTTPSRecord{Priority: binary.BigEndian.Uint16(data)}
+
+	// SvcPriority 之后是未压缩的 TargetName
+	offset := 2
+	var labels []string
+	for {
+		if offset >= len(data) {
+			return nil, errors.New("TargetName 被截断")
+		}
+		l := int(data[offset])
+		offset++
+		if l == 0 {
+			break
+		}
+		if l > 63 || offset+l > len(data) {
+			return nil, errors.New("TargetName 格式错误")
+		}
+		labels = append(labels, string(data[offset:offset+l]))
+		offset += l
+	}
+	rec.Target = "."
+	if len(labels) > 0 {
+		rec.Target = strings.Join(labels, ".")
+	}
+
+	for offset < len(data) {
+		if offset+4 > len(data) {
+			return nil, errors.New("SvcParam 被截断")
+		}
+		key := binary.BigEndian.Uint16(data[offset : offset+2])
+		length := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		offset += 4
+		if offset+length > len(data) {
+			return nil, fmt.Errorf("SvcParam %d 被截断", key)
+		}
+		value := data[offset : offset+length]
+		offset += length
+
+		if err := rec.setParam(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+func (r *HTTPSRecord) setParam(key uint16, value []byte) error {
+	switch key {
+	case svcParamMandatory:
+		if len(value) == 0 || len(value)%2 != 0 {
+			return errors.New("mandatory 参数格式错误")
+		}
+		for ; len(value) > 0; value = value[2:] {
+			// 记录要求客户端理解的参数不在支持范围内时整条记录不可用
+			if k := binary.BigEndian.Uint16(value); k == svcParamMandatory || k > svcParamIPv6Hint {
+				return fmt.Errorf("记录要求不支持的参数 %d", k)
+			}
+		}
+	case svcParamALPN:
+		for len(value) > 0 {
+			l := int(value[0])
+			if l == 0 || 1+l > len(value) {
+				return errors.New("alpn 参数格式错误")
+			}
+			r.ALPN = append(r.ALPN, string(value[1:1+l]))
+			value = value[1+l:]
+		}
+		if len(r.ALPN) == 0 {
+			return errors.New("alpn 参数为空")
+		}
+	case svcParamNoDefaultALPN:
+		if len(value) != 0 {
+			return errors.New("no-default-alpn 参数应为空")
+		}
+		r.NoDefaultALPN = true
+	case svcParamPort:
+		if len(value) != 2 {
+			return errors.New("port 参数长度错误")
+		}
+		r.Port = binary.BigEndian.Uint16(value)
+	case svcParamIPv4Hint, svcParamIPv6Hint:
+		size := net.IPv4len
+		if key == svcParamIPv6Hint {
+			size = net.IPv6len
+		}
+		if len(value) == 0 || len(value)%size != 0 {
+			return fmt.Errorf("SvcParam %d 地址长度错误", key)
+		}
+		for ; len(value) > 0; value = value[size:] {
+			ip := net.IP(append([]byte(nil), value[:size]...))
+			if key == svcParamIPv4Hint {
+				r.IPv4Hint = append(r.IPv4Hint, ip)
+			} else {
+				r.IPv6Hint = append(r.IPv6Hint, ip)
+			}
+		}
+	case svcParamECH:
+		if len(value) == 0 {
+			return errors.New("ech 参数为空")
+		}
+		r.ECH = append([]byte(nil), value...)
+	}
+	return nil
+}
+
+// ParseHTTPSRecord 解析HTTPS记录的RDATA，返回ech参数(key=5)的Base64编码，
+// 未找到或数据畸形时返回空字符串。
+func ParseHTTPSRecord(data []byte) string {
+	rec, err := ParseHTTPSRData(data)
+	if err != nil || len(rec.ECH) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(rec.ECH)
+}
+
+// ErrNXDomain 与 ErrServFail 对应应答的 RCODE 3 与 2，可用 errors.Is 判断查询返回的错误
+var (
+	ErrNXDomain = errors.New("域名不存在 (NXDOMAIN)")
+	ErrServFail = errors.New("DNS服务器解析失败 (SERVFAIL)")
+)
+
+// RcodeError DNS应答的 RCODE 不为 NOERROR
+type RcodeError struct {
+	Rcode int
+}
+
+func (e *RcodeError) Error() string {
+	switch e.Rcode {
+	case 2:
+		return ErrServFail.Error()
+	case 3:
+		return ErrNXDomain.Error()
+	}
+	return fmt.Sprintf("DNS应答错误 (RCODE %d)", e.Rcode)
+}
+
+func (e *RcodeError) Is(target error) bool {
+	return target == ErrServFail && e.Rcode == 2 || target == ErrNXDomain && e.Rcode == 3
+}
+
+// checkResponse 确认 response 是 query 的应答：ID 相同、QR 置位、未被截断、问题部分与查询一致（域名不区分大小写），
+// 且 RCODE 为 NOERROR，否则返回 *RcodeError
+func checkResponse(query, response []byte) error {
+	if len(response) < 12 || len(query) < 12 {
+		return errors.New("响应过短")
+	}
+	if response[0] != query[0] || response[1] != query[1] {
+		return errors.New("响应ID不匹配")
+	}
+	if response[2]&0x80 == 0 {
+		return errors.New("收到的报文不是应答")
+	}
+	if response[2]&0x02 != 0 {
+		// 明文传输已改用 TCP 重新查询，仍被截断的应答可能缺少部分记录，不能当作完整结果
+		return errors.New("DNS应答被截断 (TC)")
+	}
+	if rcode := int(response[3] & 0x0F); rcode != 0 {
+		return &RcodeError{Rcode: rcode}
+	}
+	if binary.BigEndian.Uint16(response[4:6]) != 1 {
+		return errors.New("应答的问题部分与查询不一致")
+	}
+	qname, qend, err := readName(query, 12)
+	if err != nil || qend+4 > len(query) {
+		return errors.New("查询报文无效")
+	}
+	rname, rend, err := readName(response, 12)
+	if err != nil {
+		return err
+	}
+	if rend+4 > len(response) {
+		return errors.New("问题部分被截断")
+	}
+	if !strings.EqualFold(qname, rname) || !bytes.Equal(query[qend:qend+4], response[rend:rend+4]) {
+		return errors.New("应答的问题部分与查询不一致")
+	}
+	return nil
+}
+
+// maxNameLength 域名线格式的最大长度 (RFC 1035)
+const maxNameLength = 255
+
+// ToASCII 把域名转换为 DNS 查询使用的 A-label 形式：含非 ASCII 字符的标签 (U-label)
+// 按 IDNA2008 规范化后编码为 punycode ("xn--")，纯 ASCII 的域名原样返回（末尾的 "." 保留）
+func ToASCII(domain string) (string, error) {
+	name, dot := strings.CutSuffix(domain, ".")
+	ascii := true
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return domain, nil
+	}
+	name, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("无效的国际化域名 %q: %w", domain, err)
+	}
+	if dot {
+		name += "."
+	}
+	return name, nil
+}
+
+// CanonicalName 返回 domain 用于查询的规范形式：A-label、小写、去掉末尾的点（根域为空字符串）。
+// 出现空标签（如 "a..b" 或 "..")、标签超过 63 字节或线格式超过 255 字节时返回错误
+func CanonicalName(domain string) (string, error) {
+	name, err := ToASCII(strings.TrimSpace(domain))
+	if err != nil {
+		return "", err
+	}
+	if name == "." {
+		return "", nil
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return "", errors.New("域名为空")
+	}
+	length := 1
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return "", fmt.Errorf("域名 %q 含有空标签", domain)
+		}
+		if len(label) > 63 {
+			return "", fmt.Errorf("域名 %q 的标签超过 63 字节", domain)
+		}
+		length += len(label) + 1
+	}
+	if length > maxNameLength {
+		return "", fmt.Errorf("域名 %q 超过 %d 字节", domain, maxNameLength)
+	}
+	return name, nil
+}
+
+// readName 解压从 offset 开始的域名（标签与压缩指针可以任意混合），返回点分形式（根域为 "."）
+// 与报文中该域名之后的偏移。压缩指针只能指向比当前位置更靠前的数据，因此不会形成循环
+func readName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	length := 1
+	limit := offset
+	for {
+		if offset >= len(msg) {
+			return "", 0, errors.New("域名被截断")
+		}
+		l := int(msg[offset])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			if len(labels) == 0 {
+				return ".", next, nil
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xC0 == 0xC0:
+			if offset+2 > len(msg) {
+				return "", 0, errors.New("域名指针被截断")
+			}
+			ptr := int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			if ptr >= limit {
+				return "", 0, errors.New("域名压缩指针无效")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset, limit = ptr, ptr
+			continue
+		case l&0xC0 != 0:
+			return "", 0, errors.New("不支持的标签类型")
+		}
+		if offset+1+l > len(msg) {
+			return "", 0, errors.New("域名被截断")
+		}
+		if length += l + 1; length > maxNameLength {
+			return "", 0, errors.New("域名过长")
+		}
+		labels = append(labels, string(msg[offset+1:offset+1+l]))
+		offset += l + 1
+	}
+}
@@ -0,0 +1,79 @@
+package ech_test
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"ech-workers/ech"
+	"ech-workers/echtest"
+)
+
+// httpsQuery 构造 domain 的 HTTPS 查询报文（头部与问题部分）
+func httpsQuery(domain string) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(domain, ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, ech.TypeHTTPS)
+	return binary.BigEndian.AppendUint16(q, 1)
+}
+
+// seedResponses 模糊测试的初始语料：带 ECH 与地址提示的应答、没有 ECH 的应答与只有问题部分的报文
+func seedResponses(f *testing.F) [][]byte {
+	key, err := echtest.GenerateECHKey("public.example", 1)
+	if err != nil {
+		f.Fatal(err)
+	}
+	query := httpsQuery("ech.example")
+	return [][]byte{
+		echtest.BuildHTTPSResponse(query, []echtest.Record{{
+			Priority: 1, Target: ".", ALPN: []string{"h2", "http/1.1"}, Port: 443,
+			IPv4Hint: []net.IP{net.IPv4(192, 0, 2, 1)}, IPv6Hint: []net.IP{net.ParseIP("2001:db8::1")},
+			ECH: key.ConfigList(), TTL: 300,
+		}}),
+		echtest.BuildHTTPSResponse(query, []echtest.Record{{Priority: 1, Target: "svc.example", TTL: 60}}),
+		query,
+	}
+}
+
+func FuzzDNSResponse(f *testing.F) {
+	for _, seed := range seedResponses(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ech.ParseDNSResponse(data)
+		ech.ParseSVCBRecords(data, ech.TypeHTTPS)
+		ech.FormatDNSMessage(data)
+	})
+}
+
+func FuzzHTTPSRecord(f *testing.F) {
+	for _, seed := range seedResponses(f) {
+		// 应答中第一条记录的 rdata 位于问题部分之后的记录头部之后
+		if off := len(httpsQuery("ech.example")) + 12; off < len(seed) {
+			f.Add(seed[off:])
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ech.ParseHTTPSRecord(data)
+		if rec, err := ech.ParseHTTPSRData(data); err == nil {
+			_ = rec.String()
+		}
+	})
+}
+
+func FuzzConfigList(f *testing.F) {
+	key, err := echtest.GenerateECHKey("public.example", 1)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(key.ConfigList())
+	f.Add([]byte{0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ech.DescribeConfigList(data)
+	})
+}
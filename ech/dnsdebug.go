@@ -0,0 +1,225 @@
+package ech
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSTransaction 一次DNS查询的原始报文，用于排查“未找到 ECH 参数”等问题，见 WithDNSDebug
+type DNSTransaction struct {
+	Time    time.Time     `json:"time"`
+	Server  string        `json:"server"`
+	Latency time.Duration `json:"latency"`
+	// Query 与 Response 为线格式报文，查询失败时 Response 可能为空
+	Query    []byte `json:"query"`
+	Response []byte `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// WithDNSDebug 保留最近 n 次经网络发送的DNS查询的原始报文（可由 DNSTransactions 读取），
+// 并把每次查询以 dig 的格式写入日志。n 为 0 时关闭
+func WithDNSDebug(n int) Option {
+	return func(m *ECHManager) {
+		m.debugSize = max(n, 0)
+	}
+}
+
+// DNSTransactions 返回保留的最近几次DNS查询，按时间先后排列；未启用 WithDNSDebug 时返回空
+func (m *ECHManager) DNSTransactions() []DNSTransaction {
+	m.debugMu.Lock()
+	defer m.debugMu.Unlock()
+	return append([]DNSTransaction(nil), m.debugLog...)
+}
+
+// recordTransaction 保存一次查询的原始报文
+func (m *ECHManager) recordTransaction(server string, query, response []byte, latency time.Duration, err error) {
+	if m.debugSize == 0 {
+		return
+	}
+	tx := DNSTransaction{
+		Time:     time.Now(),
+		Server:   server,
+		Latency:  latency,
+		Query:    append([]byte(nil), query...),
+		Response: append([]byte(nil), response...),
+	}
+	if err != nil {
+		tx.Error = err.Error()
+	}
+	log.Printf("[DNS] %s", tx)
+	m.debugMu.Lock()
+	defer m.debugMu.Unlock()
+	if len(m.debugLog) >= m.debugSize {
+		m.debugLog = append(m.debugLog[:0], m.debugLog[len(m.debugLog)-m.debugSize+1:]...)
+	}
+	m.debugLog = append(m.debugLog, tx)
+}
+
+// String 以类似 dig 的文本格式输出查询与应答
+func (t DNSTransaction) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, ";; SERVER: %s\n;; WHEN: %s, Query time: %v\n", t.Server, t.Time.Format(time.RFC3339), t.Latency.Round(time.Millisecond))
+	b.WriteString(";; QUERY:\n")
+	b.WriteString(FormatDNSMessage(t.Query))
+	if len(t.Response) > 0 {
+		b.WriteString(";; RESPONSE:\n")
+		b.WriteString(FormatDNSMessage(t.Response))
+	}
+	if t.Error != "" {
+		fmt.Fprintf(&b, ";; ERROR: %s\n", t.Error)
+	}
+	return b.String()
+}
+
+// rrTypeNames 输出时使用的记录类型名称
+var rrTypeNames = map[uint16]string{
+	typeA: "A", 2: "NS", typeCNAME: "CNAME", typeSOA: "SOA", typeAAAA: "AAAA", typeOPT: "OPT",
+	typeDS: "DS", typeRRSIG: "RRSIG", 47: "NSEC", typeDNSKEY: "DNSKEY", 50: "NSEC3",
+	TypeSVCB: "SVCB", TypeHTTPS: "HTTPS",
+}
+
+func rrTypeName(t uint16) string {
+	if name, ok := rrTypeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// rcodeNames RCODE 的名称
+var rcodeNames = []string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED"}
+
+// FormatDNSMessage 以类似 dig 的文本格式输出线格式的DNS报文：头部、问题部分与各部分的记录。
+// 报文格式错误时输出已解析的部分与错误位置
+func FormatDNSMessage(msg []byte) string {
+	var b strings.Builder
+	if len(msg) < 12 {
+		fmt.Fprintf(&b, ";; 报文过短 (%d 字节): %x\n", len(msg), msg)
+		return b.String()
+	}
+	rcode := int(msg[3] & 0x0F)
+	status := "RCODE" + strconv.Itoa(rcode)
+	if rcode < len(rcodeNames) {
+		status = rcodeNames[rcode]
+	}
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", msg[2]&0x80 != 0}, {"aa", msg[2]&0x04 != 0}, {"tc", msg[2]&0x02 != 0},
+		{"rd", msg[2]&0x01 != 0}, {"ra", msg[3]&0x80 != 0}, {"ad", msg[3]&0x20 != 0}, {"cd", msg[3]&0x10 != 0},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	counts := [4]uint16{}
+	for i := range counts {
+		counts[i] = binary.BigEndian.Uint16(msg[4+2*i:])
+	}
+	fmt.Fprintf(&b, ";; ->>HEADER<<- status: %s, id: %d\n", status, binary.BigEndian.Uint16(msg))
+	fmt.Fprintf(&b, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), counts[0], counts[1], counts[2], counts[3])
+
+	offset := 12
+	b.WriteString(";; QUESTION SECTION:\n")
+	for i := 0; i < int(counts[0]); i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil || next+4 > len(msg) {
+			fmt.Fprintf(&b, ";; 问题部分在偏移 %d 处格式错误\n", offset)
+			return b.String()
+		}
+		fmt.Fprintf(&b, ";%s\tIN\t%s\n", fqdn(name), rrTypeName(binary.BigEndian.Uint16(msg[next:])))
+		offset = next + 4
+	}
+	sections := []string{"ANSWER", "AUTHORITY", "ADDITIONAL"}
+	current := -1
+	ok := walkRecords(msg, func(section int, name string, rrType uint16, ttlOff int, rdata []byte) {
+		if section != current {
+			current = section
+			fmt.Fprintf(&b, ";; %s SECTION:\n", sections[section])
+		}
+		ttl := binary.BigEndian.Uint32(msg[ttlOff:])
+		if rrType == typeOPT {
+			fmt.Fprintf(&b, "; EDNS: udp: %d, flags:%s\n", binary.BigEndian.Uint16(msg[ttlOff-2:]), doFlag(ttl))
+			return
+		}
+		fmt.Fprintf(&b, "%s\t%d\tIN\t%s\t%s\n", fqdn(name), ttl, rrTypeName(rrType), formatRData(msg, rrType, rdata, ttlOff+6))
+	})
+	if !ok {
+		b.WriteString(";; 记录部分格式错误或被截断\n")
+	}
+	return b.String()
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func doFlag(ttl uint32) string {
+	if ttl&0x8000 != 0 {
+		return " do"
+	}
+	return ""
+}
+
+// formatRData 输出记录数据的表示格式，rdataOff 为 rdata 在 msg 中的偏移（用于解压域名）。
+// 不认识的类型使用 RFC 3597 的通用格式
+func formatRData(msg []byte, rrType uint16, rdata []byte, rdataOff int) string {
+	switch rrType {
+	case typeA, typeAAAA:
+		if len(rdata) == net.IPv4len || len(rdata) == net.IPv6len {
+			return net.IP(rdata).String()
+		}
+	case 2, typeCNAME:
+		if name, _, err := readName(msg, rdataOff); err == nil {
+			return fqdn(name)
+		}
+	case TypeSVCB, TypeHTTPS:
+		if rec, err := ParseHTTPSRData(rdata); err == nil {
+			return rec.String()
+		}
+	}
+	return fmt.Sprintf(`\# %d %s`, len(rdata), hex.EncodeToString(rdata))
+}
+
+// String 以 RFC 9460 的表示格式输出记录，如 `1 . alpn="h3,h2" ech=AEX+...`
+func (r *HTTPSRecord) String() string {
+	parts := []string{strconv.Itoa(int(r.Priority)), fqdn(r.Target)}
+	if len(r.ALPN) > 0 {
+		parts = append(parts, `alpn="`+strings.Join(r.ALPN, ",")+`"`)
+	}
+	if r.NoDefaultALPN {
+		parts = append(parts, "no-default-alpn")
+	}
+	if r.Port != 0 {
+		parts = append(parts, "port="+strconv.Itoa(int(r.Port)))
+	}
+	for _, hint := range []struct {
+		key string
+		ips []net.IP
+	}{{"ipv4hint", r.IPv4Hint}, {"ipv6hint", r.IPv6Hint}} {
+		if len(hint.ips) == 0 {
+			continue
+		}
+		ips := make([]string, len(hint.ips))
+		for i, ip := range hint.ips {
+			ips[i] = ip.String()
+		}
+		parts = append(parts, hint.key+"="+strings.Join(ips, ","))
+	}
+	if len(r.ECH) > 0 {
+		parts = append(parts, "ech="+base64.StdEncoding.EncodeToString(r.ECH))
+	}
+	return strings.Join(parts, " ")
+}
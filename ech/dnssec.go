@@ -0,0 +1,552 @@
+package ech
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSSEC 验证 (RFC 4033-4035)。ECH 配置决定了用哪个公钥加密真实的 SNI，伪造的应答可以让
+// 攻击者换成自己的密钥，因此在验证模式下，携带ECH配置的记录集必须带有有效签名，并能沿
+// DNSKEY/DS 链一直验证到信任锚。只验证肯定应答，不处理 NSEC/NSEC3 否定证明。
+
+const (
+	typeDS     = 43
+	typeRRSIG  = 46
+	typeDNSKEY = 48
+
+	// maxChainDepth 验证链中区域的最大层数
+	maxChainDepth = 16
+	// maxKeyCacheTTL 已验证的 DNSKEY 最长缓存时间
+	maxKeyCacheTTL = time.Hour
+)
+
+// DNSSEC 签名算法
+const (
+	algRSASHA256       = 8
+	algRSASHA512       = 10
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+)
+
+// RootTrustAnchors 默认的根区信任锚：根区 KSK-2017 与 KSK-2024 的 DS 记录
+var RootTrustAnchors = []string{
+	". 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// TrustAnchor 以 DS 记录形式给出的信任锚
+type TrustAnchor struct {
+	Zone       string
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// ParseTrustAnchor 解析 "区域 密钥标签 算法 摘要类型 摘要(十六进制)" 形式的信任锚，
+// 如 ". 20326 8 2 E06D44B8..."
+func ParseTrustAnchor(s string) (TrustAnchor, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 5 {
+		return TrustAnchor{}, fmt.Errorf("信任锚格式应为 \"区域 密钥标签 算法 摘要类型 摘要\": %s", s)
+	}
+	tag, err1 := strconv.ParseUint(fields[1], 10, 16)
+	alg, err2 := strconv.ParseUint(fields[2], 10, 8)
+	digestType, err3 := strconv.ParseUint(fields[3], 10, 8)
+	digest, err4 := hex.DecodeString(strings.Join(fields[4:], ""))
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return TrustAnchor{}, fmt.Errorf("信任锚无效: %s: %v", s, err)
+	}
+	return TrustAnchor{
+		Zone:       canonicalZone(fields[0]),
+		KeyTag:     uint16(tag),
+		Algorithm:  uint8(alg),
+		DigestType: uint8(digestType),
+		Digest:     digest,
+	}, nil
+}
+
+// WithDNSSEC 启用 DNSSEC 验证：查询设置 DO 位，ECH记录集（以及别名链上的每一跳）的签名必须
+// 能验证到 anchors 中的某个信任锚，否则视为查询失败。anchors 为空时使用 RootTrustAnchors。
+// 所用的解析器需返回 RRSIG 记录
+func WithDNSSEC(anchors ...TrustAnchor) Option {
+	return func(m *ECHManager) {
+		if len(anchors) == 0 {
+			for _, s := range RootTrustAnchors {
+				a, _ := ParseTrustAnchor(s)
+				anchors = append(anchors, a)
+			}
+		}
+		v := &validator{anchors: make(map[string][]TrustAnchor), keys: make(map[string]zoneKeys)}
+		for _, a := range anchors {
+			zone := canonicalZone(a.Zone)
+			v.anchors[zone] = append(v.anchors[zone], a)
+		}
+		m.dnssec = v
+	}
+}
+
+// queryFunc 向当前使用的解析器查询 name 的 qtype 记录，返回已校验的应答报文
+type queryFunc func(name string, qtype uint16) ([]byte, error)
+
+// validator 验证应答签名，并缓存已验证的各区域 DNSKEY
+type validator struct {
+	anchors map[string][]TrustAnchor
+
+	mu   sync.Mutex
+	keys map[string]zoneKeys
+}
+
+type zoneKeys struct {
+	keys    []dnskey
+	expires time.Time
+}
+
+type dnskey struct {
+	flags     uint16
+	algorithm uint8
+	publicKey []byte
+	rdata     []byte
+	tag       uint16
+}
+
+type rrsig struct {
+	typeCovered uint16
+	algorithm   uint8
+	labels      uint8
+	originalTTL uint32
+	expiration  uint32
+	inception   uint32
+	keyTag      uint16
+	signer      string
+	// signed 为 RRSIG RDATA 中除签名外的部分（签名者名称为规范形式）
+	signed    []byte
+	signature []byte
+}
+
+// verifyAnswer 验证应答中 name 的 qtype 记录集。应答中没有该记录集时无需验证
+func (v *validator) verifyAnswer(response []byte, name string, qtype uint16, query queryFunc) error {
+	answers, err := parseAnswers(response)
+	if err != nil {
+		return nil
+	}
+	rrset, sigs := selectRRset(answers, name, qtype)
+	if len(rrset) == 0 {
+		return nil
+	}
+	return v.verifyRRset(name, qtype, rrset, sigs, query, 0)
+}
+
+// selectRRset 从应答中取出 owner 的 rrType 记录集与覆盖它的 RRSIG
+func selectRRset(answers []resourceRecord, owner string, rrType uint16) (rrset []resourceRecord, sigs []rrsig) {
+	owner = canonicalZone(owner)
+	for _, rr := range answers {
+		if canonicalZone(rr.Name) != owner {
+			continue
+		}
+		switch rr.Type {
+		case rrType:
+			rrset = append(rrset, rr)
+		case typeRRSIG:
+			if sig, err := parseRRSIG(rr.Data); err == nil && sig.typeCovered == rrType {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	return rrset, sigs
+}
+
+// verifyRRset 只要有一个签名能由签名区域已验证的密钥验证即通过
+func (v *validator) verifyRRset(owner string, rrType uint16, rrset []resourceRecord, sigs []rrsig, query queryFunc, depth int) error {
+	owner = canonicalZone(owner)
+	if len(sigs) == 0 {
+		return fmt.Errorf("%s 的类型 %d 记录没有签名", owner, rrType)
+	}
+	lastErr := fmt.Errorf("%s 的类型 %d 记录签名无效", owner, rrType)
+	for _, sig := range sigs {
+		signer := canonicalZone(sig.signer)
+		if !isSubdomain(owner, signer) || (rrType == typeDS && signer == owner) {
+			lastErr = fmt.Errorf("%s 的签名者 %s 不是其所在区域", owner, signer)
+			continue
+		}
+		if err := sig.checkValidity(time.Now()); err != nil {
+			lastErr = err
+			continue
+		}
+		keys, err := v.zoneKeys(signer, query, depth+1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, key := range keys {
+			if key.tag != sig.keyTag || key.algorithm != sig.algorithm {
+				continue
+			}
+			err := verifySignature(key, sig, owner, rrset)
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// zoneKeys 返回区域已验证的 DNSKEY：DNSKEY 记录集须由与 DS（来自信任锚或已验证的上级区域）
+// 匹配的密钥签名
+func (v *validator) zoneKeys(zone string, query queryFunc, depth int) ([]dnskey, error) {
+	if depth > maxChainDepth {
+		return nil, errors.New("DNSSEC 验证链过长")
+	}
+	v.mu.Lock()
+	cached, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.keys, nil
+	}
+
+	ds, err := v.delegation(zone, query, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := query(zone, typeDNSKEY)
+	if err != nil {
+		return nil, fmt.Errorf("查询 %s 的 DNSKEY 失败: %w", zone, err)
+	}
+	answers, err := parseAnswers(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s 的 DNSKEY: %w", zone, err)
+	}
+	rrset, sigs := selectRRset(answers, zone, typeDNSKEY)
+	var keys, entry []dnskey
+	ttl := maxKeyCacheTTL
+	for _, rr := range rrset {
+		key, err := parseDNSKEY(rr.Data)
+		if err != nil || key.flags&0x0100 == 0 {
+			continue
+		}
+		keys = append(keys, key)
+		if matchDS(zone, key, ds) {
+			entry = append(entry, key)
+		}
+		ttl = min(ttl, time.Duration(rr.TTL)*time.Second)
+	}
+	if len(entry) == 0 {
+		return nil, fmt.Errorf("%s 没有与 DS 匹配的 DNSKEY", zone)
+	}
+
+	// DNSKEY 记录集必须由与 DS 匹配的密钥自签名
+	verified := false
+	for _, sig := range sigs {
+		if canonicalZone(sig.signer) != zone || sig.checkValidity(time.Now()) != nil {
+			continue
+		}
+		for _, key := range entry {
+			if key.tag == sig.keyTag && key.algorithm == sig.algorithm && verifySignature(key, sig, zone, rrset) == nil {
+				verified = true
+			}
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%s 的 DNSKEY 记录集签名无效", zone)
+	}
+
+	v.mu.Lock()
+	v.keys[zone] = zoneKeys{keys: keys, expires: time.Now().Add(ttl)}
+	v.mu.Unlock()
+	return keys, nil
+}
+
+// delegation 返回区域的 DS：信任锚所在的区域直接使用信任锚，其余区域向上级查询并验证 DS 记录集
+func (v *validator) delegation(zone string, query queryFunc, depth int) ([]TrustAnchor, error) {
+	if anchors, ok := v.anchors[zone]; ok {
+		return anchors, nil
+	}
+	if zone == "." {
+		return nil, errors.New("没有可用的信任锚")
+	}
+	body, err := query(zone, typeDS)
+	if err != nil {
+		return nil, fmt.Errorf("查询 %s 的 DS 失败: %w", zone, err)
+	}
+	answers, err := parseAnswers(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s 没有 DS 记录，区域未签名或委派不安全", zone)
+	}
+	rrset, sigs := selectRRset(answers, zone, typeDS)
+	if len(rrset) == 0 {
+		return nil, fmt.Errorf("%s 没有 DS 记录，区域未签名或委派不安全", zone)
+	}
+	if err := v.verifyRRset(zone, typeDS, rrset, sigs, query, depth); err != nil {
+		return nil, err
+	}
+	var ds []TrustAnchor
+	for _, rr := range rrset {
+		if len(rr.Data) < 5 {
+			continue
+		}
+		ds = append(ds, TrustAnchor{
+			Zone:       zone,
+			KeyTag:     binary.BigEndian.Uint16(rr.Data),
+			Algorithm:  rr.Data[2],
+			DigestType: rr.Data[3],
+			Digest:     rr.Data[4:],
+		})
+	}
+	return ds, nil
+}
+
+// matchDS 判断 key 是否与某条 DS 的密钥标签、算法与摘要一致
+func matchDS(zone string, key dnskey, ds []TrustAnchor) bool {
+	for _, d := range ds {
+		if d.KeyTag != key.tag || d.Algorithm != key.algorithm {
+			continue
+		}
+		data := append(canonicalWire(zone), key.rdata...)
+		var sum []byte
+		switch d.DigestType {
+		case 1:
+			h := sha1.Sum(data)
+			sum = h[:]
+		case 2:
+			h := sha256.Sum256(data)
+			sum = h[:]
+		case 4:
+			h := sha512.Sum384(data)
+			sum = h[:]
+		default:
+			continue
+		}
+		if bytes.Equal(sum, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDNSKEY(data []byte) (dnskey, error) {
+	if len(data) < 5 || data[2] != 3 {
+		return dnskey{}, errors.New("DNSKEY 格式错误")
+	}
+	return dnskey{
+		flags:     binary.BigEndian.Uint16(data),
+		algorithm: data[3],
+		publicKey: data[4:],
+		rdata:     data,
+		tag:       keyTag(data),
+	}, nil
+}
+
+// keyTag 计算密钥标签 (RFC 4034 附录 B)
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac)
+}
+
+func parseRRSIG(data []byte) (rrsig, error) {
+	if len(data) < 19 {
+		return rrsig{}, errors.New("RRSIG 格式错误")
+	}
+	signer, next, err := readName(data, 18)
+	if err != nil {
+		return rrsig{}, err
+	}
+	signed := append(append([]byte(nil), data[:18]...), canonicalWire(signer)...)
+	return rrsig{
+		typeCovered: binary.BigEndian.Uint16(data),
+		algorithm:   data[2],
+		labels:      data[3],
+		originalTTL: binary.BigEndian.Uint32(data[4:]),
+		expiration:  binary.BigEndian.Uint32(data[8:]),
+		inception:   binary.BigEndian.Uint32(data[12:]),
+		keyTag:      binary.BigEndian.Uint16(data[16:]),
+		signer:      signer,
+		signed:      signed,
+		signature:   data[next:],
+	}, nil
+}
+
+// checkValidity 按序号算术 (RFC 1982) 检查签名的有效期
+func (s rrsig) checkValidity(now time.Time) error {
+	t := uint32(now.Unix())
+	if int32(t-s.inception) < 0 {
+		return fmt.Errorf("%s 的签名尚未生效", s.signer)
+	}
+	if int32(s.expiration-t) < 0 {
+		return fmt.Errorf("%s 的签名已过期", s.signer)
+	}
+	return nil
+}
+
+// verifySignature 以 key 验证 sig 对 owner 的记录集 rrset 的签名
+func verifySignature(key dnskey, sig rrsig, owner string, rrset []resourceRecord) error {
+	name, err := signedOwner(owner, sig.labels)
+	if err != nil {
+		return err
+	}
+	// 记录按 RDATA 的规范顺序排列并去重 (RFC 4034 6.3)
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdatas = append(rdatas, rr.Data)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	data := append([]byte(nil), sig.signed...)
+	ownerWire := canonicalWire(name)
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		data = append(data, ownerWire...)
+		data = binary.BigEndian.AppendUint16(data, sig.typeCovered)
+		data = binary.BigEndian.AppendUint16(data, rrset[0].Class)
+		data = binary.BigEndian.AppendUint32(data, sig.originalTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+
+	switch key.algorithm {
+	case algRSASHA256, algRSASHA512:
+		pub, err := parseRSAKey(key.publicKey)
+		if err != nil {
+			return err
+		}
+		hash := crypto.SHA256
+		if key.algorithm == algRSASHA512 {
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		if err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig.signature); err != nil {
+			return fmt.Errorf("%s 的签名验证失败", owner)
+		}
+		return nil
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, hash := elliptic.P256(), crypto.SHA256
+		if key.algorithm == algECDSAP384SHA384 {
+			curve, hash = elliptic.P384(), crypto.SHA384
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(key.publicKey) != 2*size || len(sig.signature) != 2*size {
+			return errors.New("ECDSA 密钥或签名长度错误")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.publicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.publicKey[size:]),
+		}
+		h := hash.New()
+		h.Write(data)
+		r := new(big.Int).SetBytes(sig.signature[:size])
+		s := new(big.Int).SetBytes(sig.signature[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return fmt.Errorf("%s 的签名验证失败", owner)
+		}
+		return nil
+	case algED25519:
+		if len(key.publicKey) != ed25519.PublicKeySize || !ed25519.Verify(key.publicKey, data, sig.signature) {
+			return fmt.Errorf("%s 的签名验证失败", owner)
+		}
+		return nil
+	}
+	return fmt.Errorf("不支持的 DNSSEC 算法 %d", key.algorithm)
+}
+
+// parseRSAKey 解析 RFC 3110 格式的 RSA 公钥
+func parseRSAKey(key []byte) (*rsa.PublicKey, error) {
+	if len(key) < 3 {
+		return nil, errors.New("RSA 密钥格式错误")
+	}
+	expLen, offset := int(key[0]), 1
+	if expLen == 0 {
+		expLen, offset = int(binary.BigEndian.Uint16(key[1:])), 3
+	}
+	if expLen == 0 || expLen > 4 || offset+expLen >= len(key) {
+		return nil, errors.New("RSA 密钥格式错误")
+	}
+	var e int
+	for _, b := range key[offset : offset+expLen] {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(key[offset+expLen:]), E: e}, nil
+}
+
+// signedOwner 返回签名时使用的所有者名称：签名的标签数少于名称的标签数时记录由通配符展开而来
+func signedOwner(owner string, labels uint8) (string, error) {
+	parts := zoneLabels(owner)
+	switch {
+	case int(labels) == len(parts):
+		return owner, nil
+	case int(labels) > len(parts):
+		return "", fmt.Errorf("%s 的签名标签数无效", owner)
+	case labels == 0:
+		return "*.", nil
+	}
+	return "*." + strings.Join(parts[len(parts)-int(labels):], ".") + ".", nil
+}
+
+// canonicalZone 返回小写、以 "." 结尾的域名
+func canonicalZone(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return "."
+	}
+	return name + "."
+}
+
+// zoneLabels 返回域名的标签，不含根与开头的通配符标签
+func zoneLabels(name string) []string {
+	name = strings.TrimSuffix(canonicalZone(name), ".")
+	if name == "" {
+		return nil
+	}
+	parts := strings.Split(name, ".")
+	if parts[0] == "*" {
+		parts = parts[1:]
+	}
+	return parts
+}
+
+// canonicalWire 返回域名的规范线格式（小写、不压缩）
+func canonicalWire(name string) []byte {
+	var out []byte
+	if name = strings.TrimSuffix(canonicalZone(name), "."); name != "" {
+		for _, label := range strings.Split(name, ".") {
+			out = append(append(out, byte(len(label))), label...)
+		}
+	}
+	return append(out, 0)
+}
+
+// isSubdomain 判断 name 是否等于 zone 或位于其下
+func isSubdomain(name, zone string) bool {
+	name, zone = canonicalZone(name), canonicalZone(zone)
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
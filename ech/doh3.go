@@ -0,0 +1,53 @@
+package ech
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// h3AttemptTimeout 单次 HTTP/3 请求的超时，UDP 被丢弃时不必等满整个查询超时
+	h3AttemptTimeout = 3 * time.Second
+	// h3Backoff HTTP/3 失败后对该服务器直接使用 HTTP/2 的时间
+	h3Backoff = 5 * time.Minute
+)
+
+// WithDoHHTTP3 DoH 查询优先使用 HTTP/3 (QUIC，UDP 443)，用于 TCP 443 被限速而 UDP 畅通的网络。
+// HTTP/3 请求失败或 3 秒内没有应答时立即改用 HTTP/2 重发，此后 5 分钟内该服务器直接使用 HTTP/2。
+// 只作用于 RFC 8484 格式的 DoH；与 WithDoHProxy 或 WithHTTPClient 同时使用时不生效（HTTP 代理不能转发 QUIC）
+func WithDoHHTTP3() Option {
+	return func(m *ECHManager) {
+		m.dohHTTP3 = true
+	}
+}
+
+// newHTTP3Client 创建 HTTP/3 的 DoH 客户端，设置了引导地址的主机按这些地址连接
+func (m *ECHManager) newHTTP3Client() *http.Client {
+	t := &http3.Transport{
+		TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS13},
+	}
+	if len(m.bootstrap) > 0 {
+		t.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil || len(m.bootstrap[bootstrapKey(host)]) == 0 {
+				return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+			}
+			var lastErr error
+			for _, ip := range m.bootstrap[bootstrapKey(host)] {
+				conn, err := quic.DialAddrEarly(ctx, net.JoinHostPort(ip.String(), port), tlsCfg, cfg)
+				if err == nil {
+					return conn, nil
+				}
+				lastErr = err
+			}
+			return nil, lastErr
+		}
+	}
+	return &http.Client{Transport: t}
+}
@@ -0,0 +1,256 @@
+package ech
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonTransport 以 application/dns-json 格式查询的 DoH 服务器 (如 dns.google/resolve)。
+// 查询报文被转换为 ?name=&type= 请求，JSON 应答再组装成线格式报文，之后的处理与其他传输相同。
+// JSON 应答不含 RRSIG 的线格式数据，因此不能与 DNSSEC 验证同时使用
+type jsonTransport struct {
+	url    string
+	client *http.Client
+}
+
+// dnsJSONResponse JSON 应答中用到的字段
+type dnsJSONResponse struct {
+	Status int  `json:"Status"`
+	TC     bool `json:"TC"`
+	Answer []struct {
+		Name string `json:"name"`
+		Type uint16 `json:"type"`
+		TTL  uint32 `json:"TTL"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+func (j *jsonTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	name, qend, err := readName(query, 12)
+	if err != nil || qend+4 > len(query) {
+		return nil, errors.New("查询报文无效")
+	}
+	qtype := binary.BigEndian.Uint16(query[qend:])
+
+	u, err := url.Parse(j.url)
+	if err != nil {
+		return nil, fmt.Errorf("无效的DoH URL: %v", err)
+	}
+	q := u.Query()
+	q.Set("name", name)
+	q.Set("type", strconv.Itoa(int(qtype)))
+	if queryDO(query, qend+4) {
+		q.Set("do", "1")
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Accept", "application/dns-json")
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH服务器返回错误: %d", resp.StatusCode)
+	}
+	var answer dnsJSONResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("解析JSON应答失败: %v", err)
+	}
+
+	// 组装线格式应答：ID 与问题部分沿用查询，RCODE 取自 Status
+	msg := append([]byte(nil), query[:qend+4]...)
+	msg[2] = 0x81
+	if answer.TC {
+		msg[2] |= 0x02
+	}
+	msg[3] = 0x80 | byte(answer.Status&0x0F)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[8:], 0)
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	var count uint16
+	for _, rr := range answer.Answer {
+		rdata, err := presentationRData(rr.Type, rr.Data)
+		if err != nil {
+			continue
+		}
+		msg = append(msg, canonicalWire(rr.Name)...)
+		msg = binary.BigEndian.AppendUint16(msg, rr.Type)
+		msg = binary.BigEndian.AppendUint16(msg, 1)
+		msg = binary.BigEndian.AppendUint32(msg, rr.TTL)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+		count++
+	}
+	binary.BigEndian.PutUint16(msg[6:], count)
+	return msg, nil
+}
+
+// queryDO 判断查询的 OPT 记录（位于 offset）是否设置了 DO 位
+func queryDO(query []byte, offset int) bool {
+	if binary.BigEndian.Uint16(query[10:12]) == 0 || offset+11 > len(query) {
+		return false
+	}
+	opt := query[offset:]
+	return opt[0] == 0 && binary.BigEndian.Uint16(opt[1:]) == typeOPT && opt[7]&0x80 != 0
+}
+
+// presentationRData 把 JSON 应答中记录的文本形式转换为 RDATA。支持 RFC 3597 的通用格式
+// (\# 长度 十六进制)，以及 A、AAAA、CNAME 与 SVCB/HTTPS 的表示格式
+func presentationRData(rrType uint16, data string) ([]byte, error) {
+	data = strings.TrimSpace(data)
+	if rest, ok := strings.CutPrefix(data, `\#`); ok {
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, errors.New("通用格式缺少长度")
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rdata, err := hex.DecodeString(strings.Join(fields[1:], ""))
+		if err != nil || len(rdata) != n {
+			return nil, errors.New("通用格式的数据与长度不符")
+		}
+		return rdata, nil
+	}
+	switch rrType {
+	case 1, 28:
+		ip := net.ParseIP(data)
+		if rrType == 1 {
+			ip = ip.To4()
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("无效的地址: %s", data)
+		}
+		return ip, nil
+	case 5:
+		return canonicalWire(data), nil
+	case TypeSVCB, TypeHTTPS:
+		return svcbPresentation(data)
+	}
+	return nil, fmt.Errorf("不支持类型 %d 的表示格式", rrType)
+}
+
+// svcbKeys SvcParamKey 的名称
+var svcbKeys = map[string]uint16{
+	"mandatory":       svcParamMandatory,
+	"alpn":            svcParamALPN,
+	"no-default-alpn": svcParamNoDefaultALPN,
+	"port":            svcParamPort,
+	"ipv4hint":        svcParamIPv4Hint,
+	"ech":             svcParamECH,
+	"ipv6hint":        svcParamIPv6Hint,
+}
+
+// svcbPresentation 解析 SVCB/HTTPS 记录的表示格式 (RFC 9460 第 2.1 节)，
+// 如 `1 . alpn="h3,h2" ipv4hint=104.16.1.1 ech=AEX+DQBB...`
+func svcbPresentation(data string) ([]byte, error) {
+	fields := strings.Fields(data)
+	if len(fields) < 2 {
+		return nil, errors.New("SVCB 记录格式错误")
+	}
+	prio, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 SvcPriority: %s", fields[0])
+	}
+	rdata := binary.BigEndian.AppendUint16(nil, uint16(prio))
+	rdata = append(rdata, canonicalWire(fields[1])...)
+
+	params := make(map[uint16][]byte)
+	for _, field := range fields[2:] {
+		name, value, _ := strings.Cut(field, "=")
+		value = strings.Trim(value, `"`)
+		key, ok := svcbKeys[name]
+		if !ok {
+			n, found := strings.CutPrefix(name, "key")
+			k, err := strconv.ParseUint(n, 10, 16)
+			if !found || err != nil {
+				return nil, fmt.Errorf("未知的 SvcParam: %s", name)
+			}
+			key = uint16(k)
+		}
+		v, err := svcParamValue(key, value)
+		if err != nil {
+			return nil, err
+		}
+		params[key] = v
+	}
+
+	keys := make([]int, 0, len(params))
+	for k := range params {
+		keys = append(keys, int(k))
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(k))
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(params[uint16(k)])))
+		rdata = append(rdata, params[uint16(k)]...)
+	}
+	return rdata, nil
+}
+
+// svcParamValue 把参数的文本值编码为线格式
+func svcParamValue(key uint16, value string) ([]byte, error) {
+	switch key {
+	case svcParamMandatory:
+		var out []byte
+		for _, name := range strings.Split(value, ",") {
+			k, ok := svcbKeys[name]
+			if !ok {
+				return nil, fmt.Errorf("未知的 SvcParam: %s", name)
+			}
+			out = binary.BigEndian.AppendUint16(out, k)
+		}
+		return out, nil
+	case svcParamALPN:
+		var out []byte
+		for _, id := range strings.Split(value, ",") {
+			if id == "" || len(id) > 255 {
+				return nil, errors.New("alpn 参数格式错误")
+			}
+			out = append(append(out, byte(len(id))), id...)
+		}
+		return out, nil
+	case svcParamNoDefaultALPN:
+		return []byte{}, nil
+	case svcParamPort:
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 port 参数: %s", value)
+		}
+		return binary.BigEndian.AppendUint16(nil, uint16(port)), nil
+	case svcParamIPv4Hint, svcParamIPv6Hint:
+		var out []byte
+		for _, s := range strings.Split(value, ",") {
+			ip := net.ParseIP(s)
+			if key == svcParamIPv4Hint {
+				ip = ip.To4()
+			}
+			if ip == nil {
+				return nil, fmt.Errorf("无效的地址提示: %s", s)
+			}
+			out = append(out, ip...)
+		}
+		return out, nil
+	case svcParamECH:
+		return base64.StdEncoding.DecodeString(value)
+	}
+	return []byte(value), nil
+}
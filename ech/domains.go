@@ -0,0 +1,170 @@
+package ech
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// domainState 单个域名的ECH配置，以 ConfigSnapshot 整体替换，读取时无需加锁
+type domainState struct {
+	config atomic.Pointer[ConfigSnapshot]
+}
+
+// domainKey 域名在管理器中的键：A-label、小写、去掉末尾的点
+func domainKey(domain string) string {
+	if ascii, err := ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// AddDomain 把 domain 加入管理，返回其规范形式（A-label）；已在管理中时不做改变。
+// 同一管理器的各域名共用DNS服务器、传输连接与自动刷新循环，各自保存配置
+func (m *ECHManager) AddDomain(domain string) string {
+	if ascii, err := ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	key := domainKey(domain)
+	if key == domainKey(m.echDomain) {
+		return m.echDomain
+	}
+	m.echListMu.Lock()
+	defer m.echListMu.Unlock()
+	if m.domains[key] == nil {
+		m.domains[key] = &domainState{}
+	}
+	return domain
+}
+
+// Domains 返回管理的全部域名，默认域名在前，其余按字母顺序
+func (m *ECHManager) Domains() []string {
+	m.echListMu.RLock()
+	defer m.echListMu.RUnlock()
+	def := domainKey(m.echDomain)
+	out := []string{m.echDomain}
+	var rest []string
+	for key := range m.domains {
+		if key != def {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	return append(out, rest...)
+}
+
+// PrepareAll 并发获取全部域名的ECH配置，返回各域名的错误（带域名前缀）的合并
+func (m *ECHManager) PrepareAll(ctx context.Context) error {
+	domains := m.Domains()
+	errs := make([]error, len(domains))
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.PrepareDomain(ctx, domain); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", domain, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// GetECHListFor 返回 domain 当前的 ECHConfigList
+func (m *ECHManager) GetECHListFor(domain string) ([]byte, error) {
+	s, err := m.loadSnapshot(domain)
+	if err != nil {
+		return nil, err
+	}
+	return s.ECHList, nil
+}
+
+// StatusFor 返回 domain 的配置状态，Refreshes 为整个管理器的刷新次数
+func (m *ECHManager) StatusFor(domain string) Status {
+	m.echListMu.RLock()
+	defer m.echListMu.RUnlock()
+	status := Status{
+		Refreshes: m.refreshes,
+		Domain:    domain,
+		DNSServer: m.resolvers.Preferred(),
+	}
+	if st := m.domains[domainKey(domain)]; st != nil {
+		s := st.snapshot()
+		status.Loaded = s.Loaded()
+		status.FetchedAt = s.FetchedAt
+		status.Source = s.Source
+		status.TTL = s.TTL
+		status.Version = s.Version
+	}
+	return status
+}
+
+// RecordsFor 返回最近一次为 domain 获取的全部 ServiceMode 记录，按 SvcPriority 排列
+func (m *ECHManager) RecordsFor(domain string) RecordSet {
+	m.echListMu.RLock()
+	defer m.echListMu.RUnlock()
+	if st := m.domains[domainKey(domain)]; st != nil {
+		return append(RecordSet(nil), st.snapshot().Records...)
+	}
+	return nil
+}
+
+// DomainProvider 以管理器中的一个域名作为隧道的ECH配置来源（实现 websocket.ECHProvider
+// 及其可选接口），多条隧道可共用同一管理器
+type DomainProvider struct {
+	m      *ECHManager
+	domain string
+}
+
+// Provider 返回 domain 的配置来源，domain 尚未加入管理时自动加入
+func (m *ECHManager) Provider(domain string) *DomainProvider {
+	return &DomainProvider{m: m, domain: m.AddDomain(domain)}
+}
+
+func (p *DomainProvider) GetECHList() ([]byte, error) {
+	return p.m.GetECHListFor(p.domain)
+}
+
+func (p *DomainProvider) BuildTLSConfig(serverName string) (*tls.Config, error) {
+	return p.m.BuildTLSConfigFor(p.domain, serverName)
+}
+
+func (p *DomainProvider) BuildFallbackTLSConfig(serverName string) (*tls.Config, error) {
+	return p.m.BuildFallbackTLSConfig(serverName)
+}
+
+func (p *DomainProvider) BuildTLSConfigVersion(serverName string) (*tls.Config, uint64, error) {
+	return p.m.buildTLSConfig(p.domain, serverName)
+}
+
+// Refresh 重新获取该域名的配置，计入管理器的刷新次数
+func (p *DomainProvider) Refresh() error {
+	return p.RefreshContext(context.Background())
+}
+
+// RefreshContext 同 Refresh，ctx 结束时中止获取
+func (p *DomainProvider) RefreshContext(ctx context.Context) error {
+	p.m.echListMu.Lock()
+	p.m.refreshes++
+	p.m.echListMu.Unlock()
+	return p.m.PrepareDomain(ctx, p.domain)
+}
+
+func (p *DomainProvider) ApplyRetryConfigs(list []byte) error {
+	return p.m.ApplyRetryConfigsFor(p.domain, list)
+}
+
+func (p *DomainProvider) AddrHints(host string) []net.IP {
+	return p.m.AddrHints(host)
+}
+
+func (p *DomainProvider) ServiceEndpoint(host string) (string, uint16) {
+	return p.m.ServiceEndpoint(host)
+}
@@ -0,0 +1,116 @@
+package ech
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// doqALPN DNS-over-QUIC 的 ALPN 标识 (RFC 9250)
+const doqALPN = "doq"
+
+// doqTransport DNS-over-QUIC (RFC 9250)。每个查询使用一条独立的双向流，
+// 多个查询共享同一个 QUIC 连接，丢包只影响所在的流而不会阻塞其他查询
+type doqTransport struct {
+	addr       string
+	serverName string
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+// newDoQTransport 解析 host[:port]，端口默认为 853
+func newDoQTransport(addr string) (*doqTransport, error) {
+	addr = strings.TrimSuffix(addr, "/")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.Trim(addr, "[]"), "853"
+	}
+	if host == "" {
+		return nil, fmt.Errorf("无效的DoQ服务器: %s", addr)
+	}
+	return &doqTransport{addr: net.JoinHostPort(host, port), serverName: host}, nil
+}
+
+// connection 返回可用的连接，连接已关闭或 reconnect 为 true 时重新建立
+func (d *doqTransport) connection(ctx context.Context, reconnect bool) (*quic.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && !reconnect && d.conn.Context().Err() == nil {
+		return d.conn, nil
+	}
+	if d.conn != nil {
+		d.conn.CloseWithError(0, "")
+		d.conn = nil
+	}
+	conn, err := quic.DialAddr(ctx, d.addr, &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		ServerName: d.serverName,
+		NextProtos: []string{doqALPN},
+	}, &quic.Config{KeepAlivePeriod: 20 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("DoQ连接失败: %v", err)
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+func (d *doqTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := d.connection(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.roundTrip(ctx, conn, query)
+	if err != nil && ctx.Err() == nil {
+		// 服务器可能已关闭空闲连接，重新连接后再试一次
+		if conn, err = d.connection(ctx, true); err != nil {
+			return nil, err
+		}
+		resp, err = d.roundTrip(ctx, conn, query)
+	}
+	return resp, err
+}
+
+func (d *doqTransport) roundTrip(ctx context.Context, conn *quic.Conn, query []byte) ([]byte, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("DoQ打开流失败: %v", err)
+	}
+	defer stream.CancelRead(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// DoQ 要求报文 ID 为 0，应答的 ID 还原为原查询的 ID
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	msg = append(msg, query...)
+	msg[2], msg[3] = 0, 0
+	if _, err := stream.Write(msg); err != nil {
+		return nil, fmt.Errorf("DoQ请求失败: %v", err)
+	}
+	// 关闭发送方向表示查询结束
+	stream.Close()
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, fmt.Errorf("读取DoQ响应失败: %v", err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, fmt.Errorf("读取DoQ响应失败: %v", err)
+	}
+	if len(resp) < 2 || len(query) < 2 {
+		return nil, errors.New("DoQ响应过短")
+	}
+	copy(resp[:2], query[:2])
+	return resp, nil
+}
@@ -1,254 +1,1049 @@
 package ech
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"ech-workers/events"
 )
 
 const (
+	typeOPT       = 41
+	TypeSVCB      = 64
 	TypeHTTPS     = 65
 	MaxRetries    = 5
 	RetryInterval = 2 * time.Second
 )
 
+// ECHManager 从DNS获取并维护ECH配置。除创建时指定的默认域名外，还可经 AddDomain/Provider
+// 管理更多域名，它们共用DNS服务器与刷新循环
 type ECHManager struct {
-	echList   []byte
+	// echListMu 保护 domains、refreshes 与 discovery
 	echListMu sync.RWMutex
+	// echDomain 默认域名，不带域名参数的方法都作用于它
 	echDomain string
-	dnsServer string
+	// domains 管理的全部域名（以 domainKey 为键）的配置，包括 echDomain
+	domains map[string]*domainState
+	// standby 备用ECH域名，active 为当前使用的域名（空表示 echDomain），rejectStreak 为其配置
+	// 连续被拒绝的次数，见 WithStandbyDomains；active 与 rejectStreak 由 echListMu 保护
+	standby      []string
+	active       string
+	rejectStreak int
+	resolvers    *ResolverSet
+	// resolver 不为空时经它而不是 resolvers 查询，见 WithResolver
+	resolver Resolver
+	// strategy 多个服务器之间的查询策略，见 WithResolverStrategy
+	strategy  ResolverStrategy
+	refreshes uint64
+	// odoh 不为空时查询经 ODoH 代理转发，resolvers 中的服务器作为目标解析器
+	odoh *odohClient
+	// odohProxy 为 WithODoHProxy 设置的代理，创建管理器时据此建立 odoh
+	odohProxy string
+	// discovery 不为空时 DNS 没有 ECH 配置则改用 GREASE 探测
+	discovery *Discovery
+	// dohPost 以 POST 发送 DoH 查询
+	dohPost bool
+
+	transportsMu sync.Mutex
+	transports   map[string]dnsTransport
+	// plainFallback 不为空时所有加密DNS服务器都失败后改用该明文DNS服务器
+	plainFallback string
+	// dns0x20 明文查询随机改变域名的大小写并校验应答，见 WithDNS0x20
+	dns0x20 bool
+	// grease 没有可用配置时以 GREASE ECH 代替报错
+	grease bool
+	// rrType 查询ECH配置使用的记录类型，0 表示 HTTPS
+	rrType uint16
+	// ednsSize 查询中声明的UDP载荷大小，0 表示 DefaultEDNSBufferSize；dnssecOK 设置 DO 位
+	ednsSize uint16
+	dnssecOK bool
+	// dnssec 不为空时验证应答的 DNSSEC 签名链
+	dnssec *validator
+	// queryTimeout 单次DNS查询的超时，0 表示 dnsTimeout
+	queryTimeout time.Duration
+	// httpClient 不为空时 DoH 与 ODoH 请求使用该客户端
+	httpClient *http.Client
+	// dohProxy 不为空时 DoH 请求经该代理发送
+	dohProxy *url.URL
+	// dohHTTP3 DoH 优先使用 HTTP/3，h3Client 为创建时据此生成的客户端，见 WithDoHHTTP3
+	dohHTTP3 bool
+	h3Client *http.Client
+	// bootstrap DNS服务器主机名（小写）到固定地址的映射
+	bootstrap map[string][]net.IP
+	// cacheFile 不为空时获取到的配置写入该文件
+	cacheFile string
+	// outerName 不为空时只使用 public_name 为该名称的配置，见 WithOuterServerName
+	outerName string
+	// suites 不为空时只使用算法与其中之一相符的配置，见 WithHPKESuites
+	suites []HPKESuite
+	// retry 获取ECH配置的重试策略
+	retry RetryPolicy
+	// tlsOpts 合并到 BuildTLSConfig 结果中的附加设置
+	tlsOpts TLSOptions
+	// sessionCache BuildTLSConfig 生成的各配置共用的会话票据缓存，nil 表示不恢复会话
+	sessionCache tls.ClientSessionCache
+
+	// refreshMu 保护 refreshing、lastRefresh 与 lastRefreshErr
+	refreshMu      sync.Mutex
+	refreshing     *refreshCall
+	lastRefresh    time.Time
+	lastRefreshErr error
+	// minRefresh 两次 Refresh 之间的最短间隔，0 表示 minRefreshInterval，负数表示不限制
+	minRefresh time.Duration
+
+	// metrics 不为空时接收运行指标，见 WithMetrics
+	metrics         Metrics
+	queries         atomic.Uint64
+	queryFailures   atomic.Uint64
+	refreshFailures atomic.Uint64
+	rejections      atomic.Uint64
+	cacheHits       atomic.Uint64
+	// answers DNS应答缓存，见 answerCache
+	answers answerCache
+	// debugSize 保留的DNS查询数，debugLog 为最近的查询，见 WithDNSDebug
+	debugSize int
+	debugMu   sync.Mutex
+	debugLog  []DNSTransaction
+	// lastUpdate 任一域名最近一次更新配置的时间，configVersion 为最近发布的配置版本，由 echListMu 保护
+	lastUpdate    time.Time
+	configVersion uint64
+	// addrs QueryAddr 的结果缓存，以 domainKey 为键
+	addrMu sync.Mutex
+	addrs  map[string]addrEntry
+}
+
+// Option 创建 ECHManager 时的可选设置
+type Option func(*ECHManager)
+
+// WithDoHPost 以 POST (application/dns-message 请求体) 发送 DoH 查询而不是 GET ?dns=，
+// 避免部分DoH服务器对长URL限速或拒绝
+func WithDoHPost() Option {
+	return func(m *ECHManager) {
+		m.dohPost = true
+	}
+}
+
+// Status ECH配置的当前状态
+type Status struct {
+	Loaded    bool
+	FetchedAt time.Time
+	Refreshes uint64
+	Domain    string
+	DNSServer string
+	// Source 提供当前ECH配置的DoH服务器
+	Source string
+	// TTL HTTPS记录的有效期，0 表示未知（如配置来自 GREASE 探测）
+	TTL time.Duration
+	// Version 当前配置的版本，见 ConfigSnapshot
+	Version uint64
+}
+
+// NewECHManager 创建ECH管理器，dnsServer 可以是逗号分隔的多个DoH服务器，按顺序故障转移；
+// tls://host[:port] 与 quic://host[:port] 形式的服务器分别使用 DNS-over-TLS 与 DNS-over-QUIC，
+// json://host/path 为 application/dns-json 格式的 DoH
+func NewECHManager(echDomain, dnsServer string, opts ...Option) *ECHManager {
+	servers, err := ParseResolvers(dnsServer)
+	if err != nil {
+		servers = []string{dnsServer}
+	}
+	return NewECHManagerServers(echDomain, servers, opts...)
+}
+
+// NewECHManagerServers 同 NewECHManager，DNS服务器以列表给出。查询按顺序故障转移，
+// 并记住最近一次成功的服务器，之后的查询从它开始
+func NewECHManagerServers(echDomain string, servers []string, opts ...Option) *ECHManager {
+	if parsed, err := ParseResolvers(strings.Join(servers, ",")); err == nil {
+		servers = parsed
+	}
+	// 允许以 U-label 形式给出国际化域名，查询与比较统一使用 A-label
+	if ascii, err := ToASCII(echDomain); err == nil {
+		echDomain = ascii
+	}
+	m := &ECHManager{
+		echDomain:    echDomain,
+		domains:      map[string]*domainState{domainKey(echDomain): {}},
+		resolvers:    newResolverSet(servers),
+		sessionCache: tls.NewLRUClientSessionCache(sessionCacheSize),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.dohHTTP3 && m.httpClient == nil && m.dohProxy == nil {
+		m.h3Client = m.newHTTP3Client()
+	}
+	if m.httpClient == nil && (m.dohProxy != nil || len(m.bootstrap) > 0) {
+		m.httpClient = m.newHTTPClient()
+	}
+	if m.odohProxy != "" {
+		m.SetODoHProxy(m.odohProxy)
+	}
+	return m
+}
+
+// SetODoHProxy 通过 Oblivious DoH 代理转发HTTPS记录查询，使DoH服务器无法把客户端地址与查询的域名关联。
+// 配置的DoH服务器需支持 ODoH 目标 (RFC 9230)，proxyURL 为空时恢复直接查询
+func (m *ECHManager) SetODoHProxy(proxyURL string) {
+	if proxyURL == "" {
+		m.odoh = nil
+		return
+	}
+	m.odoh = newODoHClient(dohURL(proxyURL), m.dohClient())
+}
+
+// StartBenchmark 启用DoH服务器自动选择：每隔 interval 测量所有服务器的延迟与可靠性，
+// 之后的查询优先使用表现最好的服务器
+func (m *ECHManager) StartBenchmark(interval time.Duration) {
+	go m.BenchmarkLoop(interval, nil, func() {})
+}
+
+// BenchmarkLoop 与 StartBenchmark 相同但在当前goroutine运行，直到 stop 关闭；
+// 每轮测量完成后调用 beat，便于由外部守护检测卡死
+func (m *ECHManager) BenchmarkLoop(interval time.Duration, stop <-chan struct{}, beat func()) error {
+	m.resolvers.setAuto(true)
+	for {
+		m.benchmark()
+		beat()
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return nil
+		}
+	}
 }
 
-func NewECHManager(echDomain, dnsServer string) *ECHManager {
-	return &ECHManager{
-		echDomain: echDomain,
-		dnsServer: dnsServer,
+func (m *ECHManager) benchmark() {
+	var wg sync.WaitGroup
+	for _, server := range m.resolvers.Ordered() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.queryResolver(context.Background(), m.echDomain, server, m.recordType())
+		}()
 	}
+	wg.Wait()
+}
+
+// Resolvers 返回各DoH服务器的测量结果
+func (m *ECHManager) Resolvers() []ResolverStatus {
+	return m.resolvers.Status()
 }
 
+// Prepare 从DNS获取ECH配置，失败时按重试策略（默认最多 MaxRetries 次，见 WithRetryPolicy）重试
 func (m *ECHManager) Prepare() error {
-	for attempt := 1; attempt <= MaxRetries; attempt++ {
-		echBase64, err := m.queryHTTPSRecord(m.echDomain, m.dnsServer)
+	return m.PrepareContext(context.Background())
+}
+
+// PrepareContext 同 Prepare，ctx 结束时中止进行中的查询与重试等待并返回 ctx 的错误
+func (m *ECHManager) PrepareContext(ctx context.Context) error {
+	if len(m.standby) > 0 {
+		return m.prepareWithStandby(ctx)
+	}
+	return m.PrepareDomain(ctx, m.echDomain)
+}
+
+// PrepareDomain 获取 domain 的ECH配置，domain 尚未加入管理时自动加入。GREASE 探测只用于默认域名。
+// 全部尝试失败时返回的错误包含最后一次尝试中各DNS服务器的错误
+func (m *ECHManager) PrepareDomain(ctx context.Context, domain string) error {
+	domain = m.AddDomain(domain)
+	parent := ctx
+	if m.retry.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.retry.Deadline)
+		defer cancel()
+	}
+	attempts := m.retry.attempts()
+	cause := ErrNoECHRecord
+	for attempt := 1; attempt <= attempts && ctx.Err() == nil; attempt++ {
+		if attempt > 1 {
+			wait := m.retry.backoff(attempt - 1)
+			log.Printf("[客户端] %v后重试获取ECH配置...", wait.Round(time.Millisecond))
+			sleepContext(ctx, wait)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		set, ttl, source, err := m.querySVCBRecord(ctx, domain, m.recordType())
+		rec := set.Primary()
+		if ctx.Err() != nil {
+			break
+		}
+		if (err != nil || rec == nil) && domain == m.echDomain && m.tryDiscovery(ctx) {
+			return nil
+		}
 		if err != nil {
-			log.Printf("[客户端] DNS 查询失败 (%d/%d): %v，%v后重试...", attempt, MaxRetries, err, RetryInterval)
-			time.Sleep(RetryInterval)
+			log.Printf("[客户端] DNS 查询失败 (%d/%d): %v", attempt, attempts, err)
+			cause = fmt.Errorf("%w: %w", ErrDoHFailed, err)
 			continue
 		}
-		if echBase64 == "" {
-			log.Printf("[客户端] 未找到 ECH 参数 (%d/%d)，%v后重试...", attempt, MaxRetries, RetryInterval)
-			time.Sleep(RetryInterval)
+		if rec == nil {
+			log.Printf("[客户端] 未找到 ECH 参数 (%d/%d)", attempt, attempts)
+			cause = ErrNoECHRecord
 			continue
 		}
-		raw, err := base64.StdEncoding.DecodeString(echBase64)
-		if err != nil {
-			log.Printf("[客户端] ECH Base64 解码失败 (%d/%d): %v，%v后重试...", attempt, MaxRetries, err, RetryInterval)
-			time.Sleep(RetryInterval)
+		if err := ValidateConfigList(rec.ECH); err != nil {
+			log.Printf("[客户端] ECH 配置无效 (%d/%d): %v", attempt, attempts, err)
+			cause = fmt.Errorf("%w: %v", ErrNoECHRecord, err)
 			continue
 		}
-		m.echListMu.Lock()
-		m.echList = raw
-		m.echListMu.Unlock()
+		m.store(domain, rec.ECH, set, source, time.Duration(ttl)*time.Second)
 		return nil
 	}
-	return errors.New("ECH配置获取失败，已达最大重试次数")
+	err := fmt.Errorf("ECH配置获取失败，已达最大重试次数: %w", cause)
+	switch {
+	case parent.Err() != nil:
+		err = fmt.Errorf("ECH配置获取已中止: %w", parent.Err())
+	case ctx.Err() != nil:
+		err = fmt.Errorf("ECH配置获取超过总时限 %v: %w", m.retry.Deadline, cause)
+	}
+	events.Emit(events.ECHRefreshFailed, domain, err)
+	m.refreshFailures.Add(1)
+	if m.metrics != nil {
+		m.metrics.RefreshFailed(domain, err)
+	}
+	return err
 }
 
-func (m *ECHManager) GetECHList() ([]byte, error) {
+// sleepContext 等待 d，ctx 提前结束时立即返回
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// store 发布 domain 的新配置，缓存文件只保存默认域名的配置
+func (m *ECHManager) store(domain string, list []byte, records RecordSet, source string, ttl time.Duration) {
+	s := m.publish(domain, list, records, source, ttl, time.Now())
+	log.Printf("[ECH] %s 的配置已更新为版本 %d (来源 %s)", domain, s.Version, source)
+	if m.cacheFile != "" && source != "static" && domain == m.echDomain {
+		m.saveCache()
+	}
+	events.Emit(events.ECHRefreshed, domain, nil)
+	if m.metrics != nil {
+		m.metrics.Refreshed(domain, source)
+	}
+}
+
+// tryDiscovery 启用了 GREASE 探测时以探测结果作为 ECH 配置，返回是否成功
+func (m *ECHManager) tryDiscovery(ctx context.Context) bool {
 	m.echListMu.RLock()
-	defer m.echListMu.RUnlock()
-	if len(m.echList) == 0 {
-		return nil, errors.New("ECH配置未加载")
+	d := m.discovery
+	m.echListMu.RUnlock()
+	if d == nil {
+		return false
+	}
+	list, err := d.discover(ctx)
+	if err != nil {
+		log.Printf("[客户端] GREASE 探测失败: %v", err)
+		return false
 	}
-	return m.echList, nil
+	log.Printf("[客户端] DNS 未提供 ECH 配置，已通过 GREASE 探测从 %s 获取", d.ServerName)
+	m.store(m.echDomain, list, nil, "grease:"+d.ServerName, 0)
+	return true
 }
 
+// SetECHConfigList 直接设置ECH配置而不查询DNS，用于没有可用DoH的环境。设置后无需调用 Prepare，
+// 之后的 Prepare/Refresh 成功时仍会以DNS中的配置替换它
+func (m *ECHManager) SetECHConfigList(list []byte) error {
+	if err := ValidateConfigList(list); err != nil {
+		return err
+	}
+	m.store(m.echDomain, list, nil, "static", 0)
+	return nil
+}
+
+// WithECHConfigList 以 list 作为初始的ECH配置，见 SetECHConfigList。无效的配置被忽略
+func WithECHConfigList(list []byte) Option {
+	return func(m *ECHManager) {
+		if err := m.SetECHConfigList(list); err != nil {
+			log.Printf("[客户端] 忽略无效的静态ECH配置: %v", err)
+		}
+	}
+}
+
+func (m *ECHManager) GetECHList() ([]byte, error) {
+	return m.GetECHListFor(m.ActiveDomain())
+}
+
+// Refresh 重新从DNS获取ECH配置，计入 Status 的刷新次数。并发的调用共享同一次查询，
+// 距上一次刷新完成不足最小间隔（见 WithMinRefreshInterval）时直接返回上一次的结果
 func (m *ECHManager) Refresh() error {
-	return m.Prepare()
+	return m.RefreshContext(context.Background())
 }
 
-func (m *ECHManager) BuildTLSConfig(serverName string) (*tls.Config, error) {
-	echBytes, err := m.GetECHList()
+// RefreshContext 同 Refresh，ctx 用法与 PrepareContext 相同
+func (m *ECHManager) RefreshContext(ctx context.Context) error {
+	return m.coalesceRefresh(ctx)
+}
+
+func (m *ECHManager) Status() Status {
+	return m.StatusFor(m.ActiveDomain())
+}
+
+// Record 返回最近一次从DNS获取的、提供当前ECH配置的HTTPS记录，尚未成功查询时返回 nil
+func (m *ECHManager) Record() *HTTPSRecord {
+	return m.Records().Primary()
+}
+
+// Records 返回最近一次从DNS获取的全部 ServiceMode 记录，按 SvcPriority 排列，
+// 拨号方可按此顺序尝试各服务端点
+func (m *ECHManager) Records() RecordSet {
+	return m.RecordsFor(m.echDomain)
+}
+
+// AddrHints 按记录的 SvcPriority 顺序返回HTTPS记录中的地址提示（每条记录 ipv4hint 在前，ipv6hint 在后），
+// 重复的地址只保留第一次出现。提示只属于记录所在的域名本身，host 不是管理的域名时返回 nil
+func (m *ECHManager) AddrHints(host string) []net.IP {
+	var out []net.IP
+	seen := map[string]bool{}
+	for _, rec := range m.RecordsFor(host) {
+		for _, ip := range append(append([]net.IP(nil), rec.IPv4Hint...), rec.IPv6Hint...) {
+			if !seen[ip.String()] {
+				seen[ip.String()] = true
+				out = append(out, ip)
+			}
+		}
+	}
+	return out
+}
+
+// ServiceEndpoint 返回 host 的优先级最高的带ech参数的HTTPS记录给出的服务端点：TargetName 不为 "."
+// 时为 target，带 port 参数时为 port。没有记录或记录未指定时返回零值
+func (m *ECHManager) ServiceEndpoint(host string) (target string, port uint16) {
+	rec := m.RecordsFor(host).Primary()
+	if rec == nil {
+		return "", 0
+	}
+	if rec.Target != "." && rec.Target != "" {
+		target = strings.TrimSuffix(rec.Target, ".")
+	}
+	return target, rec.Port
+}
+
+// Export 当前ECH配置的导出内容
+type Export struct {
+	Domain     string          `json:"domain"`
+	Version    uint64          `json:"version"`
+	Source     string          `json:"source"`
+	FetchedAt  time.Time       `json:"fetched_at"`
+	ConfigList string          `json:"config_list"`
+	Configs    []ConfigSummary `json:"configs"`
+}
+
+// OuterServerName 返回以当前配置握手时明文 SNI 中的名称，即 BuildTLSConfig 所用配置的 public_name
+func (m *ECHManager) OuterServerName() (string, error) {
+	list, err := m.GetECHList()
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	if list, err = m.selectConfigs(list); err != nil {
+		return "", err
+	}
+	return OuterServerName(list)
+}
+
+// Export 导出当前加载的ECHConfigList（Base64）及其解码摘要
+func (m *ECHManager) Export() (Export, error) {
+	s := m.SnapshotFor(m.echDomain)
+	if s == nil {
+		return Export{}, ErrECHNotLoaded
 	}
-	roots, err := x509.SystemCertPool()
+	configs, err := DescribeConfigList(s.ECHList)
 	if err != nil {
-		return nil, fmt.Errorf("加载系统根证书失败: %w", err)
-	}
-	return &tls.Config{
-		MinVersion:                     tls.VersionTLS13,
-		ServerName:                     serverName,
-		EncryptedClientHelloConfigList: echBytes,
-		EncryptedClientHelloRejectionVerify: func(cs tls.ConnectionState) error {
-			return errors.New("服务器拒绝ECH")
-		},
-		RootCAs: roots,
+		return Export{}, err
+	}
+	return Export{
+		Domain:     m.echDomain,
+		Version:    s.Version,
+		Source:     s.Source,
+		FetchedAt:  s.FetchedAt,
+		ConfigList: base64.StdEncoding.EncodeToString(s.ECHList),
+		Configs:    configs,
 	}, nil
 }
 
-func (m *ECHManager) queryHTTPSRecord(domain, dnsServer string) (string, error) {
-	dohURL := dnsServer
-	if !strings.HasPrefix(dohURL, "https://") && !strings.HasPrefix(dohURL, "http://") {
-		dohURL = "https://" + dohURL
-	}
-	return m.queryDoH(domain, dohURL)
+func (m *ECHManager) BuildTLSConfig(serverName string) (*tls.Config, error) {
+	return m.BuildTLSConfigFor(m.ActiveDomain(), serverName)
+}
+
+// BuildTLSConfigFor 同 BuildTLSConfig，使用 domain 的ECH配置
+func (m *ECHManager) BuildTLSConfigFor(domain, serverName string) (*tls.Config, error) {
+	cfg, _, err := m.buildTLSConfig(domain, serverName)
+	return cfg, err
 }
 
-func (m *ECHManager) queryDoH(domain, dohURL string) (string, error) {
-	u, err := url.Parse(dohURL)
+// buildTLSConfig 以 domain 当前的配置快照构建TLS配置，返回快照的版本
+func (m *ECHManager) buildTLSConfig(domain, serverName string) (*tls.Config, uint64, error) {
+	// 整个构建过程只读取一次快照，并发的更新不影响这次握手所用的配置
+	var version uint64
+	var echBytes []byte
+	s, err := m.loadSnapshot(domain)
+	if err == nil {
+		version = s.Version
+		echBytes, err = m.selectConfigs(s.ECHList)
+	}
 	if err != nil {
-		return "", fmt.Errorf("无效的DoH URL: %v", err)
+		version = 0
+		if !m.grease {
+			return nil, 0, err
+		}
+		outer := serverName
+		if m.outerName != "" {
+			outer = m.outerName
+		}
+		if echBytes, err = greaseConfigList(outer); err != nil {
+			return nil, 0, err
+		}
+	}
+	cfg, err := m.baseTLSConfig(serverName)
+	if err != nil {
+		return nil, 0, err
 	}
+	// ECH 被拒绝时按 public_name 验证外层证书，握手返回携带 retry_configs 的 *tls.ECHRejectionError
+	cfg.EncryptedClientHelloConfigList = echBytes
+	return cfg, version, nil
+}
 
-	dnsQuery := m.buildDNSQuery(domain, TypeHTTPS)
-	dnsBase64 := base64.RawURLEncoding.EncodeToString(dnsQuery)
+// selectConfigs 按 WithOuterServerName 与 WithHPKESuites 的设置筛选配置
+func (m *ECHManager) selectConfigs(list []byte) ([]byte, error) {
+	var err error
+	if m.outerName != "" {
+		if list, err = FilterConfigList(list, m.outerName); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.suites) > 0 {
+		if list, err = SelectSuites(list, m.suites); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
 
-	q := u.Query()
-	q.Set("dns", dnsBase64)
-	u.RawQuery = q.Encode()
+// ApplyRetryConfigs 使用服务器拒绝 ECH 时在已验证的外层握手中提供的 retry_configs 替换当前配置
+func (m *ECHManager) ApplyRetryConfigs(list []byte) error {
+	return m.ApplyRetryConfigsFor(m.ActiveDomain(), list)
+}
 
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		return "", fmt.Errorf("创建请求失败: %v", err)
+// ApplyRetryConfigsFor 同 ApplyRetryConfigs，替换 domain 的配置
+func (m *ECHManager) ApplyRetryConfigsFor(domain string, list []byte) error {
+	if err := ValidateConfigList(list); err != nil {
+		return fmt.Errorf("retry_configs 无效: %w", err)
 	}
-	req.Header.Set("Accept", "application/dns-message")
-	req.Header.Set("Content-Type", "application/dns-message")
+	domain = m.AddDomain(domain)
+	m.rejections.Add(1)
+	if m.metrics != nil {
+		m.metrics.Rejected(domain)
+	}
+	// retry_configs 只替换配置，地址提示等记录参数沿用上次获取的记录
+	m.store(domain, list, m.RecordsFor(domain), "retry_configs", 0)
+	return nil
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("DoH请求失败: %v", err)
+// WithPlainDNSFallback 在所有DoH服务器都查询失败时，改用传统DNS服务器 server (host[:port]，
+// 默认端口 53) 以 UDP 查询，应答被截断时改用 TCP。用于DoH服务器本身被封锁的网络，查询内容不加密
+func WithPlainDNSFallback(server string) Option {
+	return func(m *ECHManager) {
+		m.plainFallback = server
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("DoH服务器返回错误: %d", resp.StatusCode)
+// WithDNS0x20 明文DNS后备查询时随机改变查询域名中字母的大小写 (DNS 0x20)，并要求应答的问题部分
+// 原样返回同样的大小写。与随机的报文ID及每次查询新开的UDP源端口一起，使伪造应答需要猜中更多的位。
+// 少数不保留大小写的服务器会因此查询失败
+func WithDNS0x20() Option {
+	return func(m *ECHManager) {
+		m.dns0x20 = true
 	}
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("读取DoH响应失败: %v", err)
+// WithGREASE 在没有可用的ECH配置（Prepare 失败或域名未发布）时，BuildTLSConfig 不再报错，
+// 而是生成带随机公钥的 GREASE 配置，使 ClientHello 仍带有 ECH 扩展、外形与正常连接一致。
+// crypto/tls 在 ECH 未被接受时会中止握手：支持 ECH 的服务器会在拒绝时返回 retry_configs，
+// 客户端据此换用真实配置重连；不支持 ECH 的服务器只能依靠回退到普通 TLS
+func WithGREASE() Option {
+	return func(m *ECHManager) {
+		m.grease = true
 	}
+}
 
-	return m.parseDNSResponse(body)
+// WithRecordType 从 rrType 类型的记录获取ECH配置：TypeHTTPS（默认）或 TypeSVCB。
+// 非 HTTPS 服务（如以 _port._scheme 前缀命名的服务）可能只在 SVCB 记录中发布 ECH 配置
+func WithRecordType(rrType uint16) Option {
+	return func(m *ECHManager) {
+		m.rrType = rrType
+	}
 }
 
-func (m *ECHManager) buildDNSQuery(domain string, qtype uint16) []byte {
-	query := make([]byte, 0, 512)
-	query = append(query, 0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
-	for _, label := range strings.Split(domain, ".") {
-		query = append(query, byte(len(label)))
-		query = append(query, []byte(label)...)
+// DefaultEDNSBufferSize 查询默认声明的UDP载荷大小，避免多密钥的HTTPS记录被截断且不致IP分片
+const DefaultEDNSBufferSize = 1232
+
+// WithEDNSBufferSize 设置查询的 EDNS0 OPT 记录中声明的UDP载荷大小，小于 512 时按 512
+func WithEDNSBufferSize(size uint16) Option {
+	return func(m *ECHManager) {
+		m.ednsSize = max(size, 512)
 	}
-	query = append(query, 0x00, byte(qtype>>8), byte(qtype), 0x00, 0x01)
-	return query
 }
 
-func (m *ECHManager) parseDNSResponse(response []byte) (string, error) {
-	if len(response) < 12 {
-		return "", errors.New("响应过短")
+// WithOuterServerName 指定握手的外层（明文）SNI：BuildTLSConfig 只使用 public_name 为 name 的配置，
+// 没有这样的配置时返回错误而不是改用其他名称；GREASE 配置以 name 作为 public_name
+func WithOuterServerName(name string) Option {
+	return func(m *ECHManager) {
+		m.outerName = name
 	}
+}
+
+// sessionCacheSize 默认会话票据缓存的容量
+const sessionCacheSize = 64
 
-	ancount := binary.BigEndian.Uint16(response[6:8])
-	if ancount == 0 {
-		return "", errors.New("无应答记录")
+// WithSessionCache 以 cache 保存会话票据，供 BuildTLSConfig 生成的所有配置共用，使重连与重试恢复会话：
+// 少一次往返，各次握手的形态也更一致。默认每个管理器有一个容量为 64 的 LRU 缓存，cache 为 nil 时不恢复会话
+func WithSessionCache(cache tls.ClientSessionCache) Option {
+	return func(m *ECHManager) {
+		m.sessionCache = cache
 	}
-	offset := 12
-	for offset < len(response) && response[offset] != 0 {
-		offset += int(response[offset]) + 1
+}
+
+// WithQueryTimeout 设置单次DNS查询（含连接建立）的超时，默认 10 秒，不大于 0 时使用默认值。
+// 整个获取过程的期限与取消由 PrepareContext 的 ctx 控制
+func WithQueryTimeout(d time.Duration) Option {
+	return func(m *ECHManager) {
+		m.queryTimeout = d
 	}
-	offset += 5
+}
 
-	for i := 0; i < int(ancount); i++ {
-		if offset >= len(response) {
-			break
+// WithHTTPClient 以 client 发送 DoH（含 JSON 格式与 ODoH）请求，可用于定制代理、连接池与 TLS 设置。
+// client.Timeout 与 WithQueryTimeout 中较短者生效
+func WithHTTPClient(client *http.Client) Option {
+	return func(m *ECHManager) {
+		m.httpClient = client
+	}
+}
+
+// WithDoHProxy 经代理发送 DoH 请求，proxy 可以是 http://、https:// 或 socks5:// 地址，
+// 用于直连DoH服务器被封锁而本地已有可用代理的网络。与 WithHTTPClient 同时使用时以后者为准
+func WithDoHProxy(proxy *url.URL) Option {
+	return func(m *ECHManager) {
+		m.dohProxy = proxy
+	}
+}
+
+// WithDNSSECOK 在查询中设置 DO 位，部分解析器只在请求 DNSSEC 数据时才返回带ech参数的记录
+func WithDNSSECOK() Option {
+	return func(m *ECHManager) {
+		m.dnssecOK = true
+	}
+}
+
+// ParseRecordType 解析记录类型名称 "https" 或 "svcb"（不区分大小写），空字符串为 HTTPS
+func ParseRecordType(name string) (uint16, error) {
+	switch strings.ToLower(name) {
+	case "", "https":
+		return TypeHTTPS, nil
+	case "svcb":
+		return TypeSVCB, nil
+	}
+	return 0, fmt.Errorf("不支持的ECH记录类型: %s (可选 https、svcb)", name)
+}
+
+func (m *ECHManager) recordType() uint16 {
+	if m.rrType == 0 {
+		return TypeHTTPS
+	}
+	return m.rrType
+}
+
+// querySVCBRecord 按当前顺序依次尝试各DoH服务器，返回首个带ech参数的 qtype (SVCB 或 HTTPS) 记录；
+// 全部不可达且配置了明文DNS后备时再查询后备服务器
+func (m *ECHManager) querySVCBRecord(ctx context.Context, domain string, qtype uint16) (set RecordSet, ttl uint32, server string, err error) {
+	if m.resolver != nil {
+		return m.queryWithResolver(ctx, domain, qtype)
+	}
+	var cached string
+	if set, ttl, err := m.chaseAlias(domain, qtype, m.cachedExchange(&cached)); !errors.Is(err, errCacheMiss) {
+		if err != nil || set.Primary() == nil {
+			return nil, 0, "", err
 		}
-		if response[offset]&0xC0 == 0xC0 {
-			offset += 2
-		} else {
-			for offset < len(response) && response[offset] != 0 {
-				offset += int(response[offset]) + 1
+		return set, ttl, cached, nil
+	}
+	set, ttl, server, err = m.queryEncrypted(ctx, domain, qtype)
+	if err == nil || m.plainFallback == "" || ctx.Err() != nil {
+		return set, ttl, server, err
+	}
+	fallback := "udp://" + strings.TrimPrefix(m.plainFallback, "udp://")
+	log.Printf("[客户端] DoH 查询失败，改用明文DNS %s", m.plainFallback)
+	t, ferr := m.transport(fallback)
+	if ferr == nil {
+		set, ttl, ferr = m.chaseAlias(domain, qtype, func(name string, qtype uint16) ([]byte, error) {
+			query, err := m.buildDNSQuery(name, qtype)
+			if err != nil {
+				return nil, err
+			}
+			if m.dns0x20 {
+				randomizeCase(query)
+			}
+			start := time.Now()
+			body, err := m.exchange(ctx, t, query)
+			m.recordTransaction(fallback, query, body, time.Since(start), err)
+			if err == nil {
+				err = checkResponse(query, body)
+			}
+			if err == nil && m.dns0x20 {
+				err = checkCase(query, body)
 			}
-			offset++
+			return body, err
+		})
+	}
+	if ferr != nil {
+		return nil, 0, "", fmt.Errorf("%s: %w", m.plainFallback, ferr)
+	}
+	if set.Primary() == nil {
+		return nil, 0, "", nil
+	}
+	return set, ttl, fallback, nil
+}
+
+// queryEncrypted 按当前顺序依次尝试各加密DNS服务器（StrategyRace 时同时查询）。有服务器应答但没有ECH记录时
+// 返回空结果，全部服务器都失败时返回各服务器错误的合并
+func (m *ECHManager) queryEncrypted(ctx context.Context, domain string, qtype uint16) (set RecordSet, ttl uint32, server string, err error) {
+	if m.strategy == StrategyRace {
+		return m.queryRace(ctx, domain, qtype)
+	}
+	var errs []error
+	answered := false
+	for _, server := range m.resolvers.Ordered() {
+		if ctx.Err() != nil {
+			return nil, 0, "", ctx.Err()
+		}
+		set, ttl, err := m.queryResolver(ctx, domain, server, qtype)
+		if err != nil {
+			errs = append(errs, err)
+			continue
 		}
+		if set != nil {
+			return set, ttl, server, nil
+		}
+		answered = true
+	}
+	if answered {
+		return nil, 0, "", nil
+	}
+	return nil, 0, "", errors.Join(errs...)
+}
 
-		if offset+10 > len(response) {
-			break
+// queryResolver 查询单个DoH服务器并记录延迟与结果。因 ctx 结束而失败的查询不计入服务器的统计
+func (m *ECHManager) queryResolver(ctx context.Context, domain, dnsServer string, qtype uint16) (RecordSet, uint32, error) {
+	start := time.Now()
+	set, ttl, err := m.queryDoH(ctx, domain, dnsServer, qtype)
+	if err != nil && ctx.Err() != nil {
+		return nil, 0, fmt.Errorf("%s: %w", dnsServer, ctx.Err())
+	}
+	if err == nil && set.Primary() == nil {
+		m.resolvers.Record(dnsServer, time.Since(start), ErrNoECHRecord)
+		m.recordQuery(dnsServer, time.Since(start), nil)
+		return nil, 0, nil
+	}
+	m.resolvers.Record(dnsServer, time.Since(start), err)
+	m.recordQuery(dnsServer, time.Since(start), err)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", dnsServer, err)
+	}
+	return set, ttl, nil
+}
+
+// QueryHTTPS 经配置的DNS服务器（按当前顺序故障转移）查询 domain 的HTTPS记录并跟随 AliasMode 别名，
+// 返回完整解析的 ServiceMode 记录，按 SvcPriority 排列且不要求带ech参数，便于把本包作为通用的
+// HTTPS 记录客户端使用。域名没有HTTPS记录时返回空结果；全部服务器都失败时返回各服务器错误的合并
+func (m *ECHManager) QueryHTTPS(ctx context.Context, domain string) ([]HTTPSRecord, error) {
+	if ascii, err := ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	if m.resolver != nil {
+		return m.resolver.QueryHTTPS(ctx, domain)
+	}
+	var cached string
+	if set, _, err := m.chaseAlias(domain, TypeHTTPS, m.cachedExchange(&cached)); !errors.Is(err, errCacheMiss) {
+		if errors.Is(err, errNoAnswer) {
+			err, set = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return httpsRecords(set), nil
+	}
+	var errs []error
+	for _, server := range m.resolvers.Ordered() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		start := time.Now()
+		set, _, err := m.queryDoH(ctx, domain, server, TypeHTTPS)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, errNoAnswer) {
+			err, set = nil, nil
+		}
+		m.resolvers.Record(server, time.Since(start), err)
+		m.recordQuery(server, time.Since(start), err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		return httpsRecords(set), nil
+	}
+	if len(errs) == 0 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%w: %w", ErrDoHFailed, errors.Join(errs...))
+}
 
-		rrType := binary.BigEndian.Uint16(response[offset : offset+2])
-		offset += 8
-		dataLen := binary.BigEndian.Uint16(response[offset : offset+2])
-		offset += 2
+func httpsRecords(set RecordSet) []HTTPSRecord {
+	records := make([]HTTPSRecord, len(set))
+	for i, rec := range set {
+		records[i] = *rec
+	}
+	return records
+}
 
-		if offset+int(dataLen) > len(response) {
-			break
+// ProbeResult 单个DoH服务器的诊断结果
+type ProbeResult struct {
+	Server  string
+	Latency time.Duration
+	// Reachable DoH服务器返回了有效的HTTP应答
+	Reachable bool
+	// ECH 为HTTPS记录中的ech参数 (Base64)，Err 为失败原因
+	ECH string
+	Err error
+}
+
+// Probe 查询单个DoH服务器，区分服务器不可达与缺少HTTPS记录，不影响自动选择的统计
+func (m *ECHManager) Probe(server string) ProbeResult {
+	res := ProbeResult{Server: server}
+	start := time.Now()
+	ctx := context.Background()
+	body, err := m.fetchDoH(ctx, m.echDomain, server, m.recordType())
+	res.Latency = time.Since(start)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	res.Reachable = true
+	qtype := m.recordType()
+	// 首次查询的应答已取得，别名目标再向同一服务器查询
+	set, _, err := m.chaseAlias(m.echDomain, qtype, func(name string, t uint16) ([]byte, error) {
+		if name == m.echDomain && t == qtype {
+			return body, nil
 		}
+		return m.fetchDoH(ctx, name, server, t)
+	})
+	res.Err = err
+	if rec := set.Primary(); rec != nil {
+		res.ECH = base64.StdEncoding.EncodeToString(rec.ECH)
+	}
+	if res.Err == nil && res.ECH == "" {
+		res.Err = errors.New("HTTPS记录中未找到ech参数")
+	}
+	return res
+}
+
+func (m *ECHManager) queryDoH(ctx context.Context, domain, server string, qtype uint16) (RecordSet, uint32, error) {
+	return m.chaseAlias(domain, qtype, func(name string, qtype uint16) ([]byte, error) {
+		return m.fetchDoH(ctx, name, server, qtype)
+	})
+}
 
-		data := response[offset : offset+int(dataLen)]
-		offset += int(dataLen)
+// maxAliasDepth 追踪 AliasMode 记录与 CNAME 的最大次数（合计）
+const maxAliasDepth = 8
 
-		if rrType == TypeHTTPS {
-			if ech := m.parseHTTPSRecord(data); ech != "" {
-				return ech, nil
+// chaseAlias 用 exchange 查询 domain 的 qtype 记录；应答为 AliasMode 时（按 RFC 9460 忽略同时存在的
+// ServiceMode 记录）继续查询别名目标，直到得到 ServiceMode 记录集，没有时返回 nil。
+// domain 为 CNAME 时使用应答中 CNAME 目标的记录，应答只有 CNAME 时继续查询其目标。
+// 记录集不一定带ech参数，需要ECH配置的调用方检查 Primary。
+// 返回的 TTL 为整条链中最小的 TTL。别名目标为 "." 表示服务不可用，出现循环或超过 maxAliasDepth 时返回错误。
+// 启用 DNSSEC 验证时每一跳的记录集（包括 CNAME）都须通过验证，验证所需的 DNSKEY/DS 同样经 exchange 查询
+func (m *ECHManager) chaseAlias(domain string, qtype uint16, exchange queryFunc) (RecordSet, uint32, error) {
+	seen := map[string]bool{}
+	var minTTL uint32
+	found := false
+	lower := func(ttl uint32) {
+		if !found || ttl < minTTL {
+			minTTL, found = ttl, true
+		}
+	}
+	for depth := 0; ; depth++ {
+		body, err := exchange(domain, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		target, cnameTTL, err := m.followCNAMEs(body, domain, qtype, exchange)
+		if err != nil {
+			return nil, 0, err
+		}
+		records, ttl, err := ParseSVCBRecords(body, qtype)
+		if errors.Is(err, errNoAnswer) && target != domain {
+			err = nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if target != domain {
+			lower(cnameTTL)
+		}
+		seen[domainKey(domain)] = true
+		if len(records) == 0 {
+			if target == domain {
+				return nil, 0, nil
 			}
+			// 应答只有 CNAME，继续查询其目标
+			domain = target
+		} else {
+			lower(ttl)
+			alias := records[0]
+			if alias.Priority != 0 {
+				return RecordSet(records), minTTL, nil
+			}
+			if alias.Target == "." {
+				return nil, 0, nil
+			}
+			seen[domainKey(target)] = true
+			domain = alias.Target
+		}
+		if seen[domainKey(domain)] {
+			return nil, 0, fmt.Errorf("别名链出现循环: %s", domain)
+		}
+		if depth+1 >= maxAliasDepth {
+			return nil, 0, fmt.Errorf("别名链超过 %d 层", maxAliasDepth)
 		}
 	}
-	return "", nil
 }
 
-func (m *ECHManager) parseHTTPSRecord(data []byte) string {
-	if len(data) < 2 {
-		return ""
+// followCNAMEs 返回应答中 domain 的 CNAME 链的终点与链上最小的 TTL。启用 DNSSEC 验证时
+// 验证链上的各 CNAME 记录集与终点的 qtype 记录集
+func (m *ECHManager) followCNAMEs(body []byte, domain string, qtype uint16, exchange queryFunc) (string, uint32, error) {
+	target, owners, ttl, err := cnameChain(body, domain)
+	if err != nil {
+		return "", 0, err
 	}
-
-	offset := 2
-	if offset >= len(data) {
-		return ""
+	if m.dnssec != nil {
+		for _, owner := range owners {
+			if err := m.dnssec.verifyAnswer(body, owner, typeCNAME, exchange); err != nil {
+				return "", 0, fmt.Errorf("DNSSEC 验证失败: %w", err)
+			}
+		}
+		if err := m.dnssec.verifyAnswer(body, target, qtype, exchange); err != nil {
+			return "", 0, fmt.Errorf("DNSSEC 验证失败: %w", err)
+		}
 	}
+	return target, ttl, nil
+}
 
-	if data[offset] == 0 {
-		offset++
+// fetchDoH 向 server 查询 domain 的 qtype 记录，返回应答报文
+func (m *ECHManager) fetchDoH(ctx context.Context, domain, server string, qtype uint16) ([]byte, error) {
+	query, err := m.buildDNSQuery(domain, qtype)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	start := time.Now()
+	if m.odoh != nil {
+		var target string
+		if target, err = odohTarget(server); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, m.timeout())
+		defer cancel()
+		body, err = m.odoh.exchange(ctx, target, query)
 	} else {
-		for offset < len(data) && data[offset] != 0 {
-			step := int(data[offset]) + 1
-			if step <= 0 || offset+step > len(data) {
-				return ""
-			}
-			offset += step
+		var t dnsTransport
+		if t, err = m.transport(server); err != nil {
+			return nil, err
 		}
-		offset++
+		body, err = m.exchange(ctx, t, query)
 	}
-
-	for offset+4 <= len(data) {
-		if offset+4 > len(data) {
-			return ""
+	m.recordTransaction(server, query, body, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(query, body); err != nil {
+		if errors.Is(err, ErrNXDomain) {
+			m.answers.store(domain, qtype, server, body)
 		}
+		return nil, err
+	}
+	m.answers.store(domain, qtype, server, body)
+	return body, nil
+}
 
-		key := binary.BigEndian.Uint16(data[offset : offset+2])
-		length := binary.BigEndian.Uint16(data[offset+2 : offset+4])
-		offset += 4
+// exchange 以单次查询的超时经 t 发送查询
+func (m *ECHManager) exchange(ctx context.Context, t dnsTransport, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+	return t.exchange(ctx, query)
+}
 
-		if length == 0 || offset+int(length) > len(data) {
-			break
-		}
+// dohClient 返回 DoH 请求使用的HTTP客户端
+func (m *ECHManager) dohClient() *http.Client {
+	if m.httpClient != nil {
+		return m.httpClient
+	}
+	return &http.Client{}
+}
 
-		value := data[offset : offset+int(length)]
-		offset += int(length)
+func (m *ECHManager) timeout() time.Duration {
+	if m.queryTimeout <= 0 {
+		return dnsTimeout
+	}
+	return m.queryTimeout
+}
 
-		if key == 5 {
-			return base64.StdEncoding.EncodeToString(value)
+// buildDNSQuery 构造 domain 的 qtype 查询报文，domain 先转换为 CanonicalName 的规范形式
+func (m *ECHManager) buildDNSQuery(domain string, qtype uint16) ([]byte, error) {
+	name, err := CanonicalName(domain)
+	if err != nil {
+		return nil, err
+	}
+	// 随机的报文 ID，配合 checkResponse 拒绝与查询不对应的应答
+	var id [2]byte
+	rand.Read(id[:])
+	query := make([]byte, 0, 512)
+	query = append(query, id[0], id[1], 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01)
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			query = append(query, byte(len(label)))
+			query = append(query, []byte(label)...)
 		}
 	}
-	return ""
+	query = append(query, 0x00, byte(qtype>>8), byte(qtype), 0x00, 0x01)
+
+	// EDNS0 OPT 记录 (RFC 6891)：CLASS 为可接收的UDP载荷大小，TTL 中的最高位为 DO
+	size := m.ednsSize
+	if size == 0 {
+		size = DefaultEDNSBufferSize
+	}
+	var flags uint16
+	if m.dnssecOK || m.dnssec != nil {
+		flags = 0x8000
+	}
+	query = append(query, 0x00, 0x00, typeOPT)
+	query = binary.BigEndian.AppendUint16(query, size)
+	query = append(query, 0x00, 0x00)
+	query = binary.BigEndian.AppendUint16(query, flags)
+	query = append(query, 0x00, 0x00)
+	return query, nil
 }
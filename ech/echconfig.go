@@ -0,0 +1,306 @@
+package ech
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ECHConfigVersion 当前 ECH 草案 (draft-ietf-tls-esni) 的配置版本
+const ECHConfigVersion = 0xfe0d
+
+// CipherSuite HPKE 对称密码套件
+type CipherSuite struct {
+	KDF  uint16 `json:"kdf"`
+	AEAD uint16 `json:"aead"`
+}
+
+func (c CipherSuite) String() string {
+	return fmt.Sprintf("%s/%s", kdfName(c.KDF), aeadName(c.AEAD))
+}
+
+// ConfigSummary 单个 ECHConfig 的解码结果，不认识的版本只填写 Version
+type ConfigSummary struct {
+	Version       uint16        `json:"version"`
+	ConfigID      uint8         `json:"config_id"`
+	KEM           uint16        `json:"kem"`
+	PublicKey     string        `json:"public_key"`
+	CipherSuites  []CipherSuite `json:"cipher_suites"`
+	MaxNameLength uint8         `json:"max_name_length"`
+	PublicName    string        `json:"public_name"`
+	// Extensions 配置扩展的类型，最高位为 1 的是客户端必须理解的扩展
+	Extensions []uint16 `json:"extensions,omitempty"`
+}
+
+func (c ConfigSummary) String() string {
+	if c.Version != ECHConfigVersion {
+		return fmt.Sprintf("未知版本 0x%04x", c.Version)
+	}
+	return fmt.Sprintf("id=%d kem=%s suites=%v public_name=%s", c.ConfigID, kemName(c.KEM), c.CipherSuites, c.PublicName)
+}
+
+// DescribeConfigList 解码 ECHConfigList，返回其中每个配置的摘要
+func DescribeConfigList(list []byte) ([]ConfigSummary, error) {
+	if len(list) < 2 {
+		return nil, errors.New("ECHConfigList 过短")
+	}
+	total := int(binary.BigEndian.Uint16(list))
+	if total != len(list)-2 {
+		return nil, errors.New("ECHConfigList 长度不匹配")
+	}
+
+	var out []ConfigSummary
+	data := list[2:]
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("ECHConfig 被截断")
+		}
+		version := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if 4+length > len(data) {
+			return nil, errors.New("ECHConfig 被截断")
+		}
+		contents := data[4 : 4+length]
+		data = data[4+length:]
+
+		summary := ConfigSummary{Version: version}
+		if version == ECHConfigVersion {
+			if err := parseConfigContents(contents, &summary); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, summary)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("ECHConfigList 为空")
+	}
+	return out, nil
+}
+
+// OuterServerName 返回使用 list 握手时明文 SNI 中的名称：与 crypto/tls 相同，取第一个可用配置的 public_name
+func OuterServerName(list []byte) (string, error) {
+	configs, err := DescribeConfigList(list)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range configs {
+		if c.usable() == nil {
+			return c.PublicName, nil
+		}
+	}
+	return "", errors.New("ECHConfigList 中没有可用的配置")
+}
+
+// FilterConfigList 返回只含 public_name 为 publicName（不区分大小写）的配置的 ECHConfigList，
+// 用于指定握手的外层 SNI。public_name 是 HPKE 加密上下文的一部分，不能直接改写，只能在服务器提供的配置中选择
+func FilterConfigList(list []byte, publicName string) ([]byte, error) {
+	configs, err := DescribeConfigList(list)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	data := list[2:]
+	for _, c := range configs {
+		length := 4 + int(binary.BigEndian.Uint16(data[2:]))
+		if c.Version == ECHConfigVersion && strings.EqualFold(c.PublicName, publicName) {
+			out = append(out, data[:length]...)
+		}
+		data = data[length:]
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: 没有 public_name 为 %s 的配置", ErrNoECHRecord, publicName)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...), nil
+}
+
+func parseConfigContents(b []byte, c *ConfigSummary) error {
+	errBad := errors.New("ECHConfig 格式无效")
+	if len(b) < 5 {
+		return errBad
+	}
+	c.ConfigID = b[0]
+	c.KEM = binary.BigEndian.Uint16(b[1:])
+	keyLen := int(binary.BigEndian.Uint16(b[3:]))
+	b = b[5:]
+	if keyLen > len(b) {
+		return errBad
+	}
+	c.PublicKey = hex.EncodeToString(b[:keyLen])
+	b = b[keyLen:]
+
+	if len(b) < 2 {
+		return errBad
+	}
+	suitesLen := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if suitesLen%4 != 0 || suitesLen > len(b) {
+		return errBad
+	}
+	for i := 0; i < suitesLen; i += 4 {
+		c.CipherSuites = append(c.CipherSuites, CipherSuite{
+			KDF:  binary.BigEndian.Uint16(b[i:]),
+			AEAD: binary.BigEndian.Uint16(b[i+2:]),
+		})
+	}
+	b = b[suitesLen:]
+
+	if len(b) < 2 {
+		return errBad
+	}
+	c.MaxNameLength = b[0]
+	nameLen := int(b[1])
+	b = b[2:]
+	if nameLen > len(b) {
+		return errBad
+	}
+	c.PublicName = string(b[:nameLen])
+	b = b[nameLen:]
+
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return errBad
+	}
+	for b = b[2:]; len(b) > 0; {
+		if len(b) < 4 {
+			return errBad
+		}
+		extLen := int(binary.BigEndian.Uint16(b[2:]))
+		if 4+extLen > len(b) {
+			return errBad
+		}
+		c.Extensions = append(c.Extensions, binary.BigEndian.Uint16(b))
+		b = b[4+extLen:]
+	}
+	return nil
+}
+
+// ValidateConfigList 检查 ECHConfigList 格式完整，且至少有一个配置可被本客户端使用，
+// 在获取配置时就发现错误数据，而不是等到 TLS 握手时才失败
+func ValidateConfigList(list []byte) error {
+	configs, err := DescribeConfigList(list)
+	if err != nil {
+		return err
+	}
+	var reasons []string
+	for _, c := range configs {
+		err := c.usable()
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	return fmt.Errorf("ECHConfigList 中没有可用的配置: %s", strings.Join(reasons, "; "))
+}
+
+// DecodeConfigList 解码 Base64（标准或 URL 字母表，可省略填充）形式的 ECHConfigList 并检查其可用性
+func DecodeConfigList(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	var list []byte
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if list, err = enc.DecodeString(s); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ECHConfigList 不是有效的 Base64: %v", err)
+	}
+	if err := ValidateConfigList(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// usable 检查配置的版本、HPKE 算法、public_name 与扩展是否受支持
+func (c ConfigSummary) usable() error {
+	if c.Version != ECHConfigVersion {
+		return fmt.Errorf("不支持的版本 0x%04x", c.Version)
+	}
+	if c.KEM != hpkeKEMX25519 {
+		return fmt.Errorf("不支持的 KEM %s", kemName(c.KEM))
+	}
+	if len(c.PublicKey) != 64 {
+		return errors.New("X25519 公钥长度无效")
+	}
+	suite := false
+	for _, cs := range c.CipherSuites {
+		if cs.KDF == hpkeKDFHKDFSHA256 && hpkeKeySize(cs.AEAD) != 0 {
+			suite = true
+			break
+		}
+	}
+	if !suite {
+		return fmt.Errorf("没有受支持的密码套件 %v", c.CipherSuites)
+	}
+	if !validPublicName(c.PublicName) {
+		return fmt.Errorf("public_name 无效: %q", c.PublicName)
+	}
+	for _, ext := range c.Extensions {
+		if ext&0x8000 != 0 {
+			return fmt.Errorf("包含不支持的强制扩展 0x%04x", ext)
+		}
+	}
+	return nil
+}
+
+// validPublicName public_name 必须是 DNS 主机名，不能是 IP 地址
+func validPublicName(name string) bool {
+	if name == "" || len(name) > 253 || strings.HasSuffix(name, ".") {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	// 最后一个标签全为数字时视为 IPv4 地址
+	last := name[strings.LastIndexByte(name, '.')+1:]
+	return strings.Trim(last, "0123456789") != ""
+}
+
+func kemName(id uint16) string {
+	switch id {
+	case 0x0010:
+		return "P-256"
+	case 0x0011:
+		return "P-384"
+	case 0x0012:
+		return "P-521"
+	case 0x0020:
+		return "X25519"
+	case 0x0021:
+		return "X448"
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
+
+func kdfName(id uint16) string {
+	switch id {
+	case 0x0001:
+		return "HKDF-SHA256"
+	case 0x0002:
+		return "HKDF-SHA384"
+	case 0x0003:
+		return "HKDF-SHA512"
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
+
+func aeadName(id uint16) string {
+	switch id {
+	case 0x0001:
+		return "AES-128-GCM"
+	case 0x0002:
+		return "AES-256-GCM"
+	case 0x0003:
+		return "ChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
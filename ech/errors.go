@@ -0,0 +1,15 @@
+package ech
+
+import "errors"
+
+// 本包返回的错误包装以下哨兵错误之一，调用方用 errors.Is 判断失败原因而不必匹配错误信息
+var (
+	// ErrECHNotLoaded 尚未获取到ECH配置（或域名不在管理中）
+	ErrECHNotLoaded = errors.New("ECH配置未加载")
+	// ErrNoECHRecord DNS 查询成功但没有带 ech 参数的记录
+	ErrNoECHRecord = errors.New("未找到 ECH 参数")
+	// ErrECHRejected 服务器拒绝或未接受 ECH
+	ErrECHRejected = errors.New("服务器拒绝ECH")
+	// ErrDoHFailed DNS 服务器不可达或返回了错误的应答
+	ErrDoHFailed = errors.New("DNS查询失败")
+)
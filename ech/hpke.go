@@ -0,0 +1,153 @@
+package ech
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// HPKE (RFC 9180) 发送方的基础模式，仅支持 ODoH 实际部署使用的
+// DHKEM(X25519, HKDF-SHA256) + HKDF-SHA256，AEAD 可为 AES-128-GCM、AES-256-GCM 或 ChaCha20-Poly1305。
+
+const (
+	hpkeKEMX25519     = 0x0020
+	hpkeKDFHKDFSHA256 = 0x0001
+	hpkeAEADAES128GCM = 0x0001
+	hpkeAEADAES256GCM = 0x0002
+	hpkeAEADChaCha20  = 0x0003
+
+	hpkeNh = 32 // HKDF-SHA256 输出长度
+	hpkeNn = 12 // AEAD nonce 长度
+)
+
+// hpkeKeySize 返回 AEAD 的密钥长度，不支持时返回 0
+func hpkeKeySize(aead uint16) int {
+	switch aead {
+	case hpkeAEADAES128GCM:
+		return 16
+	case hpkeAEADAES256GCM, hpkeAEADChaCha20:
+		return 32
+	}
+	return 0
+}
+
+func hpkeNewAEAD(id uint16, key []byte) (cipher.AEAD, error) {
+	switch id {
+	case hpkeAEADAES128GCM, hpkeAEADAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case hpkeAEADChaCha20:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("不支持的 HPKE AEAD 0x%04x", id)
+}
+
+func labeledExtract(suiteID []byte, salt []byte, label string, ikm []byte) []byte {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, ikm...)
+	prk, _ := hkdf.Extract(sha256.New, labeled, salt)
+	return prk
+}
+
+func labeledExpand(suiteID []byte, prk []byte, label string, info []byte, length int) []byte {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, info...)
+	out, _ := hkdf.Expand(sha256.New, prk, string(labeled), length)
+	return out
+}
+
+// hpkeSender 单次加密使用的 HPKE 上下文
+type hpkeSender struct {
+	aead     cipher.AEAD
+	nonce    []byte
+	exporter []byte
+	suiteID  []byte
+}
+
+// setupBaseS 对接收方公钥 pkR 执行 SetupBaseS，返回封装的临时公钥 enc 与发送上下文
+func setupBaseS(kem, kdf, aead uint16, pkR []byte, info []byte) (enc []byte, s *hpkeSender, err error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return setupBaseSWithKey(kem, kdf, aead, pkR, info, ephemeral)
+}
+
+// setupBaseSWithKey 同 setupBaseS，使用给定的临时私钥，供已知答案测试使用
+func setupBaseSWithKey(kem, kdf, aead uint16, pkR []byte, info []byte, ephemeral *ecdh.PrivateKey) (enc []byte, s *hpkeSender, err error) {
+	if kem != hpkeKEMX25519 || kdf != hpkeKDFHKDFSHA256 {
+		return nil, nil, fmt.Errorf("不支持的 HPKE 套件 kem=0x%04x kdf=0x%04x", kem, kdf)
+	}
+	nk := hpkeKeySize(aead)
+	if nk == 0 {
+		return nil, nil, fmt.Errorf("不支持的 HPKE AEAD 0x%04x", aead)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("无效的 HPKE 公钥: %w", err)
+	}
+	dh, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc = ephemeral.PublicKey().Bytes()
+
+	// DHKEM ExtractAndExpand
+	kemSuite := binary.BigEndian.AppendUint16([]byte("KEM"), kem)
+	kemContext := append(append([]byte(nil), enc...), pkR...)
+	eaePRK := labeledExtract(kemSuite, nil, "eae_prk", dh)
+	shared := labeledExpand(kemSuite, eaePRK, "shared_secret", kemContext, hpkeNh)
+
+	// KeySchedule，mode_base = 0
+	suiteID := []byte("HPKE")
+	suiteID = binary.BigEndian.AppendUint16(suiteID, kem)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, kdf)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, aead)
+	pskIDHash := labeledExtract(suiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(suiteID, nil, "info_hash", info)
+	ksContext := append([]byte{0}, pskIDHash...)
+	ksContext = append(ksContext, infoHash...)
+	secret := labeledExtract(suiteID, shared, "secret", nil)
+
+	key := labeledExpand(suiteID, secret, "key", ksContext, nk)
+	c, err := hpkeNewAEAD(aead, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, &hpkeSender{
+		aead:     c,
+		nonce:    labeledExpand(suiteID, secret, "base_nonce", ksContext, hpkeNn),
+		exporter: labeledExpand(suiteID, secret, "exp", ksContext, hpkeNh),
+		suiteID:  suiteID,
+	}, nil
+}
+
+// seal 加密第一条（也是唯一一条）消息，序号为 0 时 nonce 即 base_nonce
+func (s *hpkeSender) seal(aad, plaintext []byte) ([]byte, error) {
+	if s.nonce == nil {
+		return nil, errors.New("HPKE 上下文只能加密一条消息")
+	}
+	out := s.aead.Seal(nil, s.nonce, plaintext, aad)
+	s.nonce = nil
+	return out, nil
+}
+
+// export 实现 HPKE 的 Export 接口
+func (s *hpkeSender) export(context []byte, length int) []byte {
+	return labeledExpand(s.suiteID, s.exporter, "sec", context, length)
+}
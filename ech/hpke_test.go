@@ -0,0 +1,68 @@
+package ech
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestSetupBaseSKnownAnswer 使用 RFC 9180 附录 A.1.1 的测试向量
+// (DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM, mode_base)
+func TestSetupBaseSKnownAnswer(t *testing.T) {
+	// 临时密钥由 ikmE 按 DeriveKeyPair (RFC 9180 7.1.3) 派生
+	kemSuite := []byte{'K', 'E', 'M', 0x00, 0x20}
+	dkpPRK := labeledExtract(kemSuite, nil, "dkp_prk", unhex(t, "7268600d403fce431561aef583ee1613527cff655c1343f29812e66706df3234"))
+	skE, err := ecdh.X25519().NewPrivateKey(labeledExpand(kemSuite, dkpPRK, "sk", nil, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkR := unhex(t, "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+	info := unhex(t, "4f6465206f6e2061204772656369616e2055726e")
+	enc, s, err := setupBaseSWithKey(hpkeKEMX25519, hpkeKDFHKDFSHA256, hpkeAEADAES128GCM, pkR, info, skE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"); !bytes.Equal(enc, want) {
+		t.Fatalf("enc = %x，应为 %x", enc, want)
+	}
+	if want := unhex(t, "56d890e5accaaf011cff4b7d"); !bytes.Equal(s.nonce, want) {
+		t.Fatalf("base_nonce = %x，应为 %x", s.nonce, want)
+	}
+	if want := unhex(t, "45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"); !bytes.Equal(s.exporter, want) {
+		t.Fatalf("exporter_secret = %x，应为 %x", s.exporter, want)
+	}
+
+	exports := []struct{ context, value string }{
+		{"", "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee"},
+		{"00", "2e8f0b54673c7029649d4eb9d5e33bf1872cf76d623ff164ac185da9e88c21a5"},
+		{"54657374436f6e74657874", "e9e43065102c3836401bed8c3c3c75ae46be1639869391d62c61f1ec7af54931"},
+	}
+	for _, e := range exports {
+		if got := s.export(unhex(t, e.context), 32); !bytes.Equal(got, unhex(t, e.value)) {
+			t.Errorf("export(%q) = %x，应为 %s", e.context, got, e.value)
+		}
+	}
+
+	// 序号 0 的加密
+	ct, err := s.seal(unhex(t, "436f756e742d30"), unhex(t, "4265617574792069732074727574682c20747275746820626561757479"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"); !bytes.Equal(ct, want) {
+		t.Fatalf("密文 = %x，应为 %x", ct, want)
+	}
+	if _, err := s.seal(nil, nil); err == nil {
+		t.Fatal("同一上下文加密了第二条消息")
+	}
+}
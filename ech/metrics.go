@@ -0,0 +1,74 @@
+package ech
+
+import (
+	"time"
+)
+
+// Metrics 接收 ECHManager 的运行指标，便于接入 Prometheus、expvar 等监控系统，
+// 对配置过期或查询持续失败告警。各方法可能被并发调用，且不应阻塞
+type Metrics interface {
+	// DNSQuery 每次向DNS服务器查询后调用，err 为 nil 表示成功（包括记录中没有 ECH 参数）
+	DNSQuery(server string, latency time.Duration, err error)
+	// Refreshed 域名的ECH配置更新后调用，source 与 Status.Source 相同
+	Refreshed(domain, source string)
+	// RefreshFailed 重试用尽仍未获取到域名的ECH配置时调用
+	RefreshFailed(domain string, err error)
+	// Rejected 服务器拒绝ECH并提供了 retry_configs 时调用
+	Rejected(domain string)
+}
+
+// WithMetrics 把运行指标报告给 mt，见 Metrics。不设置时仍可通过 MetricsSnapshot 读取累计值
+func WithMetrics(mt Metrics) Option {
+	return func(m *ECHManager) {
+		m.metrics = mt
+	}
+}
+
+// MetricsSnapshot ECHManager 自创建以来的累计指标
+type MetricsSnapshot struct {
+	// Queries 与 QueryFailures 为DNS查询总数与失败数，各服务器的明细见 Resolvers
+	Queries       uint64
+	QueryFailures uint64
+	Resolvers     []ResolverStatus
+	// Refreshes 调用 Refresh 实际发起的刷新次数，RefreshFailures 为最终失败的次数
+	Refreshes       uint64
+	RefreshFailures uint64
+	// LastRefresh 最近一次成功更新配置的时间，ConfigAge 为默认域名当前配置的已用时间（未加载时为 0）
+	LastRefresh time.Time
+	ConfigAge   time.Duration
+	// Rejections 服务器拒绝ECH并提供 retry_configs 的次数
+	Rejections uint64
+	// CacheHits 由应答缓存直接返回、未向服务器查询的应答数
+	CacheHits uint64
+}
+
+// MetricsSnapshot 返回当前的累计指标
+func (m *ECHManager) MetricsSnapshot() MetricsSnapshot {
+	snap := MetricsSnapshot{
+		Queries:         m.queries.Load(),
+		QueryFailures:   m.queryFailures.Load(),
+		Resolvers:       m.resolvers.Status(),
+		RefreshFailures: m.refreshFailures.Load(),
+		Rejections:      m.rejections.Load(),
+		CacheHits:       m.cacheHits.Load(),
+	}
+	m.echListMu.RLock()
+	defer m.echListMu.RUnlock()
+	snap.Refreshes = m.refreshes
+	snap.LastRefresh = m.lastUpdate
+	if st := m.domains[domainKey(m.echDomain)]; st != nil && st.snapshot().Loaded() {
+		snap.ConfigAge = time.Since(st.snapshot().FetchedAt)
+	}
+	return snap
+}
+
+// recordQuery 记录一次DNS查询的结果
+func (m *ECHManager) recordQuery(server string, latency time.Duration, err error) {
+	m.queries.Add(1)
+	if err != nil {
+		m.queryFailures.Add(1)
+	}
+	if m.metrics != nil {
+		m.metrics.DNSQuery(server, latency, err)
+	}
+}
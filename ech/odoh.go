@@ -0,0 +1,279 @@
+package ech
+
+import (
+	"bytes"
+	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Oblivious DoH (RFC 9230)：查询经由代理转发给目标解析器，
+// 查询内容用目标的公钥加密，代理看不到查询内容，目标看不到客户端地址。
+
+const (
+	odohVersion      = 0x0001
+	odohTypeQuery    = 0x01
+	odohTypeResponse = 0x02
+	odohContentType  = "application/oblivious-dns-message"
+	odohConfigsPath  = "/.well-known/odohconfigs"
+	// odohConfigTTL 目标公钥配置的缓存时间
+	odohConfigTTL = time.Hour
+)
+
+// odohConfig 目标解析器的 ObliviousDoHConfigContents
+type odohConfig struct {
+	kem, kdf, aead uint16
+	publicKey      []byte
+	keyID          []byte
+	fetchedAt      time.Time
+}
+
+// parseODoHConfigs 解析 ObliviousDoHConfigs，返回第一个受支持的配置
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, errors.New("ODoH 配置长度不匹配")
+	}
+	data = data[2:]
+	for len(data) >= 4 {
+		version := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if 4+length > len(data) {
+			return nil, errors.New("ODoH 配置被截断")
+		}
+		contents := data[4 : 4+length]
+		data = data[4+length:]
+		if version != odohVersion || len(contents) < 8 {
+			continue
+		}
+		c := &odohConfig{
+			kem:  binary.BigEndian.Uint16(contents),
+			kdf:  binary.BigEndian.Uint16(contents[2:]),
+			aead: binary.BigEndian.Uint16(contents[4:]),
+		}
+		keyLen := int(binary.BigEndian.Uint16(contents[6:]))
+		if 8+keyLen != len(contents) {
+			return nil, errors.New("ODoH 配置公钥长度不匹配")
+		}
+		if c.kem != hpkeKEMX25519 || c.kdf != hpkeKDFHKDFSHA256 || hpkeKeySize(c.aead) == 0 {
+			continue
+		}
+		c.publicKey = contents[8:]
+		prk, _ := hkdf.Extract(sha256.New, contents, nil)
+		c.keyID, _ = hkdf.Expand(sha256.New, prk, "odoh key id", hpkeNh)
+		return c, nil
+	}
+	return nil, errors.New("没有受支持的 ODoH 配置")
+}
+
+// odohQuery 一次加密查询的状态，用于解密对应的响应
+type odohQuery struct {
+	plaintext []byte
+	sender    *hpkeSender
+	aead      uint16
+}
+
+// encryptODoHQuery 加密 DNS 查询，返回 ObliviousDoHMessage
+func encryptODoHQuery(c *odohConfig, dnsMessage []byte) ([]byte, *odohQuery, error) {
+	plain := binary.BigEndian.AppendUint16(nil, uint16(len(dnsMessage)))
+	plain = append(plain, dnsMessage...)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // 不填充
+
+	aad := []byte{odohTypeQuery}
+	aad = binary.BigEndian.AppendUint16(aad, uint16(len(c.keyID)))
+	aad = append(aad, c.keyID...)
+
+	enc, sender, err := setupBaseS(c.kem, c.kdf, c.aead, c.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := sender.seal(aad, plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypted := append(enc, ct...)
+
+	msg := append([]byte(nil), aad...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(encrypted)))
+	msg = append(msg, encrypted...)
+	return msg, &odohQuery{plaintext: plain, sender: sender, aead: c.aead}, nil
+}
+
+// decryptResponse 解密 ObliviousDoHMessage 响应，返回其中的 DNS 报文
+func (q *odohQuery) decryptResponse(msg []byte) ([]byte, error) {
+	errBad := errors.New("ODoH 响应格式无效")
+	if len(msg) < 3 || msg[0] != odohTypeResponse {
+		return nil, errBad
+	}
+	nonceLen := int(binary.BigEndian.Uint16(msg[1:]))
+	if 3+nonceLen+2 > len(msg) {
+		return nil, errBad
+	}
+	respNonce := msg[3 : 3+nonceLen]
+	ctLen := int(binary.BigEndian.Uint16(msg[3+nonceLen:]))
+	ct := msg[3+nonceLen+2:]
+	if ctLen != len(ct) {
+		return nil, errBad
+	}
+
+	nk := hpkeKeySize(q.aead)
+	secret := q.sender.export([]byte("odoh response"), nk)
+	salt := append([]byte(nil), q.plaintext...)
+	salt = binary.BigEndian.AppendUint16(salt, uint16(len(respNonce)))
+	salt = append(salt, respNonce...)
+	prk, _ := hkdf.Extract(sha256.New, secret, salt)
+	key, _ := hkdf.Expand(sha256.New, prk, "odoh key", nk)
+	nonce, _ := hkdf.Expand(sha256.New, prk, "odoh nonce", hpkeNn)
+
+	aead, err := hpkeNewAEAD(q.aead, key)
+	if err != nil {
+		return nil, err
+	}
+	aad := []byte{odohTypeResponse}
+	aad = binary.BigEndian.AppendUint16(aad, uint16(len(respNonce)))
+	aad = append(aad, respNonce...)
+	plain, err := aead.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, fmt.Errorf("ODoH 响应解密失败: %w", err)
+	}
+	if len(plain) < 2 {
+		return nil, errBad
+	}
+	dnsLen := int(binary.BigEndian.Uint16(plain))
+	if 2+dnsLen > len(plain) {
+		return nil, errBad
+	}
+	// 填充必须全为 0
+	if rest := plain[2+dnsLen:]; len(rest) >= 2 && !bytes.Equal(rest[2:], make([]byte, len(rest)-2)) {
+		return nil, errBad
+	}
+	return plain[2 : 2+dnsLen], nil
+}
+
+// WithODoHProxy 同 SetODoHProxy，在创建管理器时设置 Oblivious DoH 代理，代理请求使用 WithHTTPClient 等选项确定的客户端
+func WithODoHProxy(proxyURL string) Option {
+	return func(m *ECHManager) {
+		m.odohProxy = proxyURL
+	}
+}
+
+// odohTarget 返回 server 作为 ODoH 目标的 URL；DoT、DoQ、JSON 与明文DNS服务器不能作为目标
+func odohTarget(server string) (string, error) {
+	for _, scheme := range []string{"tls://", "quic://", "json://", "udp://"} {
+		if strings.HasPrefix(server, scheme) {
+			return "", fmt.Errorf("ODoH 目标须为 DoH 服务器: %s", server)
+		}
+	}
+	return dohURL(server), nil
+}
+
+// odohClient 通过代理向目标解析器发送 ODoH 查询，并缓存各目标的公钥配置
+type odohClient struct {
+	proxyURL string
+	client   *http.Client
+
+	mu      sync.Mutex
+	configs map[string]*odohConfig
+}
+
+func newODoHClient(proxyURL string, client *http.Client) *odohClient {
+	return &odohClient{
+		proxyURL: proxyURL,
+		client:   client,
+		configs:  make(map[string]*odohConfig),
+	}
+}
+
+// targetConfig 返回目标的公钥配置，过期或 refresh 为 true 时重新从目标获取
+func (o *odohClient) targetConfig(ctx context.Context, target *url.URL, refresh bool) (*odohConfig, error) {
+	o.mu.Lock()
+	c, ok := o.configs[target.Host]
+	o.mu.Unlock()
+	if ok && !refresh && time.Since(c.fetchedAt) < odohConfigTTL {
+		return c, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.Scheme+"://"+target.Host+odohConfigsPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("获取ODoH配置失败: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取ODoH配置失败: HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("读取ODoH配置失败: %v", err)
+	}
+	if c, err = parseODoHConfigs(data); err != nil {
+		return nil, err
+	}
+	c.fetchedAt = time.Now()
+	o.mu.Lock()
+	o.configs[target.Host] = c
+	o.mu.Unlock()
+	return c, nil
+}
+
+// exchange 经代理把 DNS 查询发给 targetURL 指定的目标解析器，返回解密后的 DNS 应答。
+// 目标无法解密（通常是公钥已轮换）时重新获取配置并重试一次，超时与取消由 ctx 控制
+func (o *odohClient) exchange(ctx context.Context, targetURL string, dnsQuery []byte) ([]byte, error) {
+	target, err := url.Parse(targetURL)
+	if err != nil || target.Host == "" {
+		return nil, fmt.Errorf("无效的ODoH目标: %s", targetURL)
+	}
+	proxy, err := url.Parse(o.proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("无效的ODoH代理: %v", err)
+	}
+	q := proxy.Query()
+	q.Set("targethost", target.Host)
+	q.Set("targetpath", target.Path)
+	proxy.RawQuery = q.Encode()
+
+	for attempt := 0; ; attempt++ {
+		c, err := o.targetConfig(ctx, target, attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+		msg, query, err := encryptODoHQuery(c, dnsQuery)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxy.String(), bytes.NewReader(msg))
+		if err != nil {
+			return nil, fmt.Errorf("创建请求失败: %v", err)
+		}
+		req.Header.Set("Content-Type", odohContentType)
+		req.Header.Set("Accept", odohContentType)
+		resp, err := o.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("ODoH请求失败: %v", err)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("读取ODoH响应失败: %v", err)
+		}
+		// 目标用 HTTP 400/401 表示无法解密
+		if (resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized) && attempt == 0 {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("ODoH代理返回错误: %d", resp.StatusCode)
+		}
+		return query.decryptResponse(body)
+	}
+}
@@ -0,0 +1,81 @@
+package ech
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ResolverStrategy 多个加密DNS服务器之间的查询策略
+type ResolverStrategy int
+
+const (
+	// StrategyFailover 按当前顺序逐个查询，前一个失败或没有ECH记录时才查询下一个（默认）
+	StrategyFailover ResolverStrategy = iota
+	// StrategyRace 同时向全部服务器查询，采用最先返回ECH记录的应答并取消其余查询，
+	// 以更多的查询换取不稳定网络下更短的最坏延迟
+	StrategyRace
+)
+
+// ParseResolverStrategy 解析策略名称："failover"（或空）与 "race"
+func ParseResolverStrategy(name string) (ResolverStrategy, error) {
+	switch strings.ToLower(name) {
+	case "", "failover":
+		return StrategyFailover, nil
+	case "race":
+		return StrategyRace, nil
+	}
+	return 0, fmt.Errorf("不支持的DNS查询策略: %s (可选 failover、race)", name)
+}
+
+// WithResolverStrategy 设置获取ECH配置时多个加密DNS服务器之间的查询策略
+func WithResolverStrategy(s ResolverStrategy) Option {
+	return func(m *ECHManager) {
+		m.strategy = s
+	}
+}
+
+// raceResult 一个服务器的查询结果
+type raceResult struct {
+	server string
+	set    RecordSet
+	ttl    uint32
+	err    error
+}
+
+// queryRace 同时查询全部服务器，返回最先带ech参数的应答并取消其余查询。
+// 返回值的含义与 queryEncrypted 相同
+func (m *ECHManager) queryRace(ctx context.Context, domain string, qtype uint16) (RecordSet, uint32, string, error) {
+	servers := m.resolvers.Ordered()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult, len(servers))
+	for _, server := range servers {
+		go func() {
+			set, ttl, err := m.queryResolver(ctx, domain, server, qtype)
+			results <- raceResult{server: server, set: set, ttl: ttl, err: err}
+		}()
+	}
+
+	var errs []error
+	answered := false
+	for range servers {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		if r.set != nil {
+			return r.set, r.ttl, r.server, nil
+		}
+		answered = true
+	}
+	if answered {
+		return nil, 0, "", nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, "", err
+	}
+	return nil, 0, "", errors.Join(errs...)
+}
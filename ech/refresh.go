@@ -0,0 +1,163 @@
+package ech
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// autoRefreshDefault TTL 未知时的刷新间隔
+	autoRefreshDefault = time.Hour
+	// autoRefreshMin 两次自动刷新之间的最短间隔，避免 TTL 很小的记录导致频繁查询
+	autoRefreshMin = 30 * time.Second
+	// autoRefreshRetry 刷新失败后重试的间隔，期间继续使用旧配置
+	autoRefreshRetry = time.Minute
+	// minRefreshInterval Refresh 的默认最短间隔，见 WithMinRefreshInterval
+	minRefreshInterval = 5 * time.Second
+)
+
+// refreshCall 一次进行中的 Refresh，期间的其他调用等待并共享它的结果
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// WithMinRefreshInterval 设置两次 Refresh 之间的最短间隔（默认 5 秒）。大量连接同时失败时
+// 各自调用 Refresh，间隔内的调用直接返回上一次刷新的结果而不再查询DNS；d 为负数时不限制
+func WithMinRefreshInterval(d time.Duration) Option {
+	return func(m *ECHManager) {
+		m.minRefresh = d
+	}
+}
+
+// coalesceRefresh 执行或加入一次刷新。发起刷新的调用因自身 ctx 结束而失败时，
+// 仍在等待的调用重新发起刷新，而不是得到别人的取消错误
+func (m *ECHManager) coalesceRefresh(ctx context.Context) error {
+	for {
+		m.refreshMu.Lock()
+		if call := m.refreshing; call != nil {
+			m.refreshMu.Unlock()
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return fmt.Errorf("ECH配置获取已中止: %w", ctx.Err())
+			}
+			if errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded) {
+				continue
+			}
+			return call.err
+		}
+		interval := m.minRefresh
+		if interval == 0 {
+			interval = minRefreshInterval
+		}
+		if !m.lastRefresh.IsZero() && time.Since(m.lastRefresh) < interval {
+			err := m.lastRefreshErr
+			m.refreshMu.Unlock()
+			return err
+		}
+		call := &refreshCall{done: make(chan struct{})}
+		m.refreshing = call
+		m.refreshMu.Unlock()
+
+		m.echListMu.Lock()
+		m.refreshes++
+		m.echListMu.Unlock()
+		// 刷新通常由握手失败触发，需要服务器上的最新记录而不是缓存的应答；
+		// 频繁的调用已由上面的合并与最短间隔限制
+		for _, domain := range m.Domains() {
+			m.answers.forget(domain, m.recordType())
+		}
+		call.err = m.PrepareContext(ctx)
+
+		m.refreshMu.Lock()
+		m.refreshing = nil
+		if ctx.Err() == nil {
+			m.lastRefresh, m.lastRefreshErr = time.Now(), call.err
+		}
+		m.refreshMu.Unlock()
+		close(call.done)
+		return call.err
+	}
+}
+
+// StartAutoRefresh 在后台按HTTPS记录的 TTL 自动刷新全部域名的ECH配置：在到期前（TTL 的 90%）重新查询，
+// 刷新失败时保留旧配置并每分钟重试，直到 ctx 结束
+func (m *ECHManager) StartAutoRefresh(ctx context.Context) {
+	go m.AutoRefreshLoop(ctx.Done(), func() {})
+}
+
+// AutoRefreshLoop 与 StartAutoRefresh 相同但在当前goroutine运行，直到 stop 关闭；
+// 等待期间每分钟调用一次 beat，便于由外部守护检测卡死
+func (m *ECHManager) AutoRefreshLoop(stop <-chan struct{}, beat func()) error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	delay := m.refreshDelay()
+	for {
+		timer := time.NewTimer(delay)
+	wait:
+		for {
+			select {
+			case <-timer.C:
+				break wait
+			case <-ticker.C:
+				beat()
+			case <-stop:
+				timer.Stop()
+				return nil
+			}
+		}
+		if err := m.refreshDue(); err != nil {
+			log.Printf("[客户端] 自动刷新ECH配置失败，%v后重试: %v", autoRefreshRetry, err)
+			delay = autoRefreshRetry
+		} else {
+			delay = m.refreshDelay()
+		}
+		beat()
+	}
+}
+
+// refreshDelay 返回距下一次自动刷新的时间，即各域名中最早到期的一个
+func (m *ECHManager) refreshDelay() time.Duration {
+	m.echListMu.RLock()
+	defer m.echListMu.RUnlock()
+	next := time.Duration(math.MaxInt64)
+	for _, st := range m.domains {
+		next = min(next, st.refreshDelay())
+	}
+	return max(next, autoRefreshMin)
+}
+
+// refreshDue 刷新一分钟内到期（或尚未加载）的域名，返回各域名错误的合并
+func (m *ECHManager) refreshDue() error {
+	var errs []error
+	for _, domain := range m.Domains() {
+		m.echListMu.RLock()
+		due := m.domains[domainKey(domain)].refreshDelay() <= autoRefreshRetry
+		m.echListMu.RUnlock()
+		if !due {
+			continue
+		}
+		m.answers.forget(domain, m.recordType())
+		if err := m.PrepareDomain(context.Background(), domain); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (st *domainState) refreshDelay() time.Duration {
+	s := st.snapshot()
+	if !s.Loaded() {
+		return autoRefreshRetry
+	}
+	lifetime := autoRefreshDefault
+	if s.TTL > 0 {
+		lifetime = s.TTL * 9 / 10
+	}
+	return time.Until(s.FetchedAt.Add(lifetime))
+}
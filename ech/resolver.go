@@ -0,0 +1,107 @@
+package ech
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// resolverSource 经 WithResolver 设置的解析器获取的配置在 Status 中的来源
+const resolverSource = "resolver"
+
+// Resolver ECHManager 查询DNS的接口，*ECHManager 本身即是一个实现（经配置的加密DNS服务器查询）。
+// 以 WithResolver 注入其他实现后，ECH配置与服务器地址都经它查询，例如在测试中用 echtest.FakeResolver
+// 代替真实的网络请求。各方法可能被并发调用
+type Resolver interface {
+	// QueryHTTPS 返回 domain 的 ServiceMode HTTPS记录（已跟随 AliasMode 别名），按 SvcPriority 排列；
+	// 没有记录时返回空结果而不是错误
+	QueryHTTPS(ctx context.Context, domain string) ([]HTTPSRecord, error)
+	// QueryA 与 QueryAAAA 返回 domain 的 IPv4 与 IPv6 地址，没有记录时返回空结果
+	QueryA(ctx context.Context, domain string) ([]net.IP, error)
+	QueryAAAA(ctx context.Context, domain string) ([]net.IP, error)
+}
+
+// WithResolver 经 r 而不是配置的DNS服务器查询HTTPS记录与服务器地址。r 不提供 TTL，
+// 获取的ECH配置按默认间隔自动刷新；DNSSEC 验证、ODoH 与明文后备等传输层选项不再生效，
+// 记录类型也只能是 HTTPS
+func WithResolver(r Resolver) Option {
+	return func(m *ECHManager) {
+		m.resolver = r
+	}
+}
+
+// QueryA 经配置的DNS服务器（按当前顺序故障转移）查询 domain 的 A 记录，不使用 QueryAddr 的缓存
+func (m *ECHManager) QueryA(ctx context.Context, domain string) ([]net.IP, error) {
+	if m.resolver != nil {
+		return m.resolver.QueryA(ctx, domain)
+	}
+	ips, _, err := m.queryAddrFamily(ctx, domain, typeA)
+	return ips, err
+}
+
+// QueryAAAA 同 QueryA，查询 AAAA 记录
+func (m *ECHManager) QueryAAAA(ctx context.Context, domain string) ([]net.IP, error) {
+	if m.resolver != nil {
+		return m.resolver.QueryAAAA(ctx, domain)
+	}
+	ips, _, err := m.queryAddrFamily(ctx, domain, typeAAAA)
+	return ips, err
+}
+
+// queryAddrFamily 按当前顺序向各服务器查询一种地址记录，返回首个成功的应答
+func (m *ECHManager) queryAddrFamily(ctx context.Context, domain string, qtype uint16) ([]net.IP, uint32, error) {
+	if ascii, err := ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	var cached string
+	if ips, ttl, err := m.lookupAddr(domain, qtype, m.cachedExchange(&cached)); !errors.Is(err, errCacheMiss) {
+		return ips, ttl, err
+	}
+	var errs []error
+	for _, server := range m.resolvers.Ordered() {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		start := time.Now()
+		ips, ttl, err := m.queryAddrType(ctx, domain, server, qtype)
+		if err != nil && ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		m.resolvers.Record(server, time.Since(start), err)
+		m.recordQuery(server, time.Since(start), err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		return ips, ttl, nil
+	}
+	if len(errs) == 0 {
+		return nil, 0, ErrDoHFailed
+	}
+	return nil, 0, fmt.Errorf("%w: %w", ErrDoHFailed, errors.Join(errs...))
+}
+
+// queryWithResolver 经注入的解析器查询 domain 的HTTPS记录，结果的形式与 querySVCBRecord 相同
+func (m *ECHManager) queryWithResolver(ctx context.Context, domain string, qtype uint16) (RecordSet, uint32, string, error) {
+	if qtype != TypeHTTPS {
+		return nil, 0, "", errors.New("自定义解析器只支持HTTPS记录")
+	}
+	records, err := m.resolver.QueryHTTPS(ctx, domain)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	set := make(RecordSet, 0, len(records))
+	for i := range records {
+		if records[i].Priority != 0 {
+			set = append(set, &records[i])
+		}
+	}
+	sort.SliceStable(set, func(i, j int) bool { return set[i].Priority < set[j].Priority })
+	if set.Primary() == nil {
+		return nil, 0, "", nil
+	}
+	return set, 0, resolverSource, nil
+}
@@ -0,0 +1,198 @@
+package ech
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// resolverAlpha 延迟与成功率的指数加权系数，越大越偏重最近的测量
+	resolverAlpha = 0.3
+	// minReliability 成功率低于该值的服务器排在未测量的服务器之后
+	minReliability = 0.5
+)
+
+// ResolverStatus 单个DoH服务器的测量结果
+type ResolverStatus struct {
+	Server        string    `json:"server"`
+	Preferred     bool      `json:"preferred"`
+	LatencyMillis float64   `json:"latency_ms"`
+	Reliability   float64   `json:"reliability"`
+	Successes     uint64    `json:"successes"`
+	Failures      uint64    `json:"failures"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastChecked   time.Time `json:"last_checked,omitempty"`
+}
+
+type resolverStats struct {
+	latency     float64 // 毫秒
+	reliability float64
+	successes   uint64
+	failures    uint64
+	lastErr     string
+	lastChecked time.Time
+}
+
+func (s *resolverStats) measured() bool {
+	return s.successes+s.failures > 0
+}
+
+// score 越小越好：延迟按成功率放大，频繁失败的服务器即使延迟低也会被降级
+func (s *resolverStats) score() float64 {
+	if s.successes == 0 {
+		return math.Inf(1)
+	}
+	return s.latency / math.Max(s.reliability, 0.01)
+}
+
+// ResolverSet 记录一组DoH服务器的延迟与可靠性，并按测量结果排序
+type ResolverSet struct {
+	mu      sync.Mutex
+	servers []string
+	stats   map[string]*resolverStats
+	auto    bool
+	// last 最近一次查询成功的服务器，未启用自动选择时优先使用
+	last string
+}
+
+// ParseResolvers 解析逗号分隔的DoH服务器列表
+func ParseResolvers(spec string) ([]string, error) {
+	var servers []string
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		servers = append(servers, s)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("未指定DoH服务器")
+	}
+	return servers, nil
+}
+
+func newResolverSet(servers []string) *ResolverSet {
+	set := &ResolverSet{
+		servers: servers,
+		stats:   make(map[string]*resolverStats, len(servers)),
+	}
+	for _, s := range servers {
+		set.stats[s] = &resolverStats{reliability: 1}
+	}
+	return set
+}
+
+// Ordered 返回查询顺序。未启用自动选择时保持配置顺序，但最近一次成功的服务器排在最前
+func (r *ResolverSet) Ordered() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.orderedLocked()
+}
+
+func (r *ResolverSet) orderedLocked() []string {
+	out := append([]string(nil), r.servers...)
+	if !r.auto {
+		for i, s := range out {
+			if s == r.last {
+				copy(out[1:i+1], out[:i])
+				out[0] = s
+				break
+			}
+		}
+		return out
+	}
+	rank := func(s *resolverStats) int {
+		switch {
+		case s.measured() && s.reliability >= minReliability:
+			return 0
+		case !s.measured():
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := r.stats[out[i]], r.stats[out[j]]
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra < rb
+		}
+		return a.score() < b.score()
+	})
+	return out
+}
+
+// Preferred 返回当前首选的服务器
+func (r *ResolverSet) Preferred() string {
+	order := r.Ordered()
+	if len(order) == 0 {
+		return ""
+	}
+	return order[0]
+}
+
+// Record 记录一次查询结果
+func (r *ResolverSet) Record(server string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.stats[server]
+	if !ok {
+		return
+	}
+	before := r.orderedLocked()[0]
+
+	s.lastChecked = time.Now()
+	ms := float64(latency) / float64(time.Millisecond)
+	if err != nil {
+		s.failures++
+		s.lastErr = err.Error()
+		s.reliability *= 1 - resolverAlpha
+	} else {
+		if s.successes == 0 {
+			s.latency = ms
+		} else {
+			s.latency = (1-resolverAlpha)*s.latency + resolverAlpha*ms
+		}
+		s.successes++
+		s.lastErr = ""
+		r.last = server
+		s.reliability = (1-resolverAlpha)*s.reliability + resolverAlpha
+	}
+
+	if after := r.orderedLocked()[0]; r.auto && after != before {
+		log.Printf("[客户端] 首选DoH服务器切换: %s -> %s", before, after)
+	}
+}
+
+// Status 返回所有服务器的测量结果，按当前查询顺序排列
+func (r *ResolverSet) Status() []ResolverStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order := r.orderedLocked()
+	out := make([]ResolverStatus, 0, len(order))
+	for i, server := range order {
+		s := r.stats[server]
+		out = append(out, ResolverStatus{
+			Server:        server,
+			Preferred:     i == 0,
+			LatencyMillis: s.latency,
+			Reliability:   s.reliability,
+			Successes:     s.successes,
+			Failures:      s.failures,
+			LastError:     s.lastErr,
+			LastChecked:   s.lastChecked,
+		})
+	}
+	return out
+}
+
+func (r *ResolverSet) setAuto(auto bool) {
+	r.mu.Lock()
+	r.auto = auto
+	r.mu.Unlock()
+}
@@ -0,0 +1,52 @@
+package ech
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// defaultMaxBackoff 重试等待的默认上限
+const defaultMaxBackoff = 30 * time.Second
+
+// RetryPolicy 获取ECH配置 (Prepare/Refresh/PrepareDomain) 失败时的重试策略。
+// 每次尝试按顺序查询全部DNS服务器，单次查询的超时见 WithQueryTimeout
+type RetryPolicy struct {
+	// Attempts 最多尝试的次数，0 表示 MaxRetries
+	Attempts int
+	// MinBackoff 第一次重试前的等待，之后每次翻倍直到 MaxBackoff，实际等待在 [d/2, d) 内随机，
+	// 避免大量客户端同时重试。0 分别表示 RetryInterval 与 30 秒
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Deadline 一次获取（含全部重试与等待）的总时限，0 表示不限
+	Deadline time.Duration
+}
+
+// WithRetryPolicy 设置获取ECH配置的重试策略，见 RetryPolicy
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(m *ECHManager) {
+		m.retry = p
+	}
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.Attempts <= 0 {
+		return MaxRetries
+	}
+	return p.Attempts
+}
+
+// backoff 返回第 attempt 次（从 1 开始）失败后的等待时间
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d, limit := p.MinBackoff, p.MaxBackoff
+	if d <= 0 {
+		d = RetryInterval
+	}
+	if limit <= 0 {
+		limit = defaultMaxBackoff
+	}
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	d = min(d, limit)
+	return d/2 + rand.N(d/2+1)
+}
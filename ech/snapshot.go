@@ -0,0 +1,100 @@
+package ech
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// ConfigSnapshot 某一时刻一个域名的ECH配置。快照发布后不再修改，更新配置时整体替换，
+// 因此并发的 Refresh 不会使正在进行的握手读到更新到一半的配置
+type ConfigSnapshot struct {
+	// Version 管理器内单调递增的配置版本，每次更新任一域名的配置加 1，0 表示尚未加载
+	Version uint64
+	Domain  string
+	ECHList []byte
+	// Records 获取该配置时的HTTPS记录，按 SvcPriority 排列
+	Records   RecordSet
+	Source    string
+	FetchedAt time.Time
+	// TTL HTTPS记录的有效期，0 表示未知
+	TTL time.Duration
+}
+
+// Loaded 快照中有可用的配置
+func (s *ConfigSnapshot) Loaded() bool {
+	return len(s.ECHList) > 0
+}
+
+// emptySnapshot 尚未加载配置的域名的快照
+var emptySnapshot = &ConfigSnapshot{}
+
+// snapshot 返回域名当前的配置，尚未加载时返回空快照
+func (st *domainState) snapshot() *ConfigSnapshot {
+	if s := st.config.Load(); s != nil {
+		return s
+	}
+	return emptySnapshot
+}
+
+// Snapshot 返回当前使用的域名（见 ActiveDomain）的配置快照，尚未加载时返回 nil
+func (m *ECHManager) Snapshot() *ConfigSnapshot {
+	return m.SnapshotFor(m.ActiveDomain())
+}
+
+// SnapshotFor 返回 domain 的配置快照，domain 不在管理中或尚未加载时返回 nil
+func (m *ECHManager) SnapshotFor(domain string) *ConfigSnapshot {
+	s, err := m.loadSnapshot(domain)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+// loadSnapshot 返回 domain 已加载的配置快照
+func (m *ECHManager) loadSnapshot(domain string) (*ConfigSnapshot, error) {
+	m.echListMu.RLock()
+	st := m.domains[domainKey(domain)]
+	m.echListMu.RUnlock()
+	if st == nil {
+		return nil, fmt.Errorf("%s 不是管理的ECH域名", domain)
+	}
+	s := st.snapshot()
+	if !s.Loaded() {
+		return nil, ErrECHNotLoaded
+	}
+	return s, nil
+}
+
+// ConfigVersion 返回当前使用的配置的版本，尚未加载时返回 0
+func (m *ECHManager) ConfigVersion() uint64 {
+	if s := m.Snapshot(); s != nil {
+		return s.Version
+	}
+	return 0
+}
+
+// BuildTLSConfigVersion 同 BuildTLSConfig，另外返回所用配置的版本（使用 GREASE 配置时为 0），
+// 用于在握手失败时记录失败的是哪个版本的配置
+func (m *ECHManager) BuildTLSConfigVersion(serverName string) (*tls.Config, uint64, error) {
+	return m.buildTLSConfig(m.ActiveDomain(), serverName)
+}
+
+// publish 以新快照替换 domain 的配置并返回该快照
+func (m *ECHManager) publish(domain string, list []byte, records RecordSet, source string, ttl time.Duration, fetchedAt time.Time) *ConfigSnapshot {
+	m.echListMu.Lock()
+	defer m.echListMu.Unlock()
+	m.configVersion++
+	s := &ConfigSnapshot{
+		Version:   m.configVersion,
+		Domain:    domain,
+		ECHList:   list,
+		Records:   records,
+		Source:    source,
+		FetchedAt: fetchedAt,
+		TTL:       ttl,
+	}
+	m.domains[domainKey(domain)].config.Store(s)
+	m.lastUpdate = time.Now()
+	return s
+}
@@ -0,0 +1,115 @@
+package ech
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// standbyRejectThreshold 当前域名的配置连续被拒绝该次数后切换到下一个备用域名
+const standbyRejectThreshold = 3
+
+// WithStandbyDomains 设置备用ECH域名（如同一服务的其他 Cloudflare 区域）。Prepare 与自动刷新同时获取
+// 全部域名的配置；默认域名的配置不可用或连接时连续被拒绝（见 ReportECH）时，GetECHList 与
+// BuildTLSConfig 依次改用下一个已有配置的备用域名，避免针对单一前置域名的封锁使隧道中断
+func WithStandbyDomains(domains ...string) Option {
+	return func(m *ECHManager) {
+		for _, domain := range domains {
+			key := domainKey(domain)
+			if key == "" || m.domains[key] != nil {
+				continue
+			}
+			m.domains[key] = &domainState{}
+			m.standby = append(m.standby, key)
+		}
+	}
+}
+
+// ActiveDomain 返回 GetECHList 与 BuildTLSConfig 当前使用的ECH域名
+func (m *ECHManager) ActiveDomain() string {
+	m.echListMu.RLock()
+	defer m.echListMu.RUnlock()
+	return m.activeLocked()
+}
+
+func (m *ECHManager) activeLocked() string {
+	if m.active == "" {
+		return m.echDomain
+	}
+	return m.active
+}
+
+// ReportECH 报告一次使用当前配置的握手结果：accepted 为 false 表示服务器拒绝或忽略了 ECH。
+// 连续被拒绝 3 次后切换到下一个已有配置的备用域名；没有备用域名时不做处理
+func (m *ECHManager) ReportECH(accepted bool) {
+	if len(m.standby) == 0 {
+		return
+	}
+	m.echListMu.Lock()
+	defer m.echListMu.Unlock()
+	if accepted {
+		m.rejectStreak = 0
+		return
+	}
+	if m.rejectStreak++; m.rejectStreak < standbyRejectThreshold {
+		return
+	}
+	m.rejectStreak = 0
+	from := m.activeLocked()
+	if next := m.nextLoadedLocked(from); next != "" {
+		log.Printf("[ECH] 域名 %s 的配置连续 %d 次被拒绝，切换到备用域名 %s", from, standbyRejectThreshold, next)
+		m.active = next
+	}
+}
+
+// nextLoadedLocked 返回默认域名与备用域名的循环顺序中 from 之后第一个已有配置的域名，没有时返回空字符串
+func (m *ECHManager) nextLoadedLocked(from string) string {
+	order := append([]string{m.echDomain}, m.standby...)
+	start := 0
+	for i, domain := range order {
+		if domainKey(domain) == domainKey(from) {
+			start = i
+		}
+	}
+	for i := 1; i < len(order); i++ {
+		domain := order[(start+i)%len(order)]
+		if st := m.domains[domainKey(domain)]; st != nil && st.snapshot().Loaded() {
+			return domain
+		}
+	}
+	return ""
+}
+
+// prepareWithStandby 同时获取默认域名与全部备用域名的配置。当前域名没有配置时切换到下一个已有配置的域名；
+// 只有全部域名都失败时才返回错误
+func (m *ECHManager) prepareWithStandby(ctx context.Context) error {
+	domains := append([]string{m.echDomain}, m.standby...)
+	errs := make([]error, len(domains))
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.PrepareDomain(ctx, domain); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", domain, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	m.echListMu.Lock()
+	defer m.echListMu.Unlock()
+	active := m.activeLocked()
+	if st := m.domains[domainKey(active)]; st != nil && st.snapshot().Loaded() {
+		return nil
+	}
+	if next := m.nextLoadedLocked(active); next != "" {
+		log.Printf("[ECH] 域名 %s 没有可用的配置，切换到备用域名 %s", active, next)
+		m.active = next
+		m.rejectStreak = 0
+		return nil
+	}
+	return errors.Join(errs...)
+}
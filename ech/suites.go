@@ -0,0 +1,151 @@
+package ech
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// HPKESuite ECH 使用的 HPKE 算法组合，字段为 0 表示不限
+type HPKESuite struct {
+	KEM  uint16
+	KDF  uint16
+	AEAD uint16
+}
+
+func (s HPKESuite) String() string {
+	var parts []string
+	if s.KEM != 0 {
+		parts = append(parts, kemName(s.KEM))
+	}
+	if s.KDF != 0 {
+		parts = append(parts, kdfName(s.KDF))
+	}
+	if s.AEAD != 0 {
+		parts = append(parts, aeadName(s.AEAD))
+	}
+	if len(parts) == 0 {
+		return "*"
+	}
+	return strings.Join(parts, "+")
+}
+
+// match 判断实际使用的算法组合是否满足 s
+func (s HPKESuite) match(kem uint16, cs CipherSuite) bool {
+	return (s.KEM == 0 || s.KEM == kem) && (s.KDF == 0 || s.KDF == cs.KDF) && (s.AEAD == 0 || s.AEAD == cs.AEAD)
+}
+
+// hpkeAlgorithms HPKE 算法名称（小写）到类型与编号的映射，同时接受常用的简称
+var hpkeAlgorithms = map[string]struct {
+	kind string
+	id   uint16
+}{
+	"x25519":            {"kem", 0x0020},
+	"p-256":             {"kem", 0x0010},
+	"p256":              {"kem", 0x0010},
+	"hkdf-sha256":       {"kdf", 0x0001},
+	"sha256":            {"kdf", 0x0001},
+	"hkdf-sha384":       {"kdf", 0x0002},
+	"sha384":            {"kdf", 0x0002},
+	"hkdf-sha512":       {"kdf", 0x0003},
+	"sha512":            {"kdf", 0x0003},
+	"aes-128-gcm":       {"aead", 0x0001},
+	"aes128":            {"aead", 0x0001},
+	"aes-256-gcm":       {"aead", 0x0002},
+	"aes256":            {"aead", 0x0002},
+	"chacha20-poly1305": {"aead", 0x0003},
+	"chacha20":          {"aead", 0x0003},
+}
+
+// ParseHPKESuites 解析逗号分隔、按偏好从高到低排列的算法组合，每项由 "+" 连接的 KEM、KDF、AEAD 名称组成，
+// 未给出的部分不限，如 "x25519+chacha20,aes-256-gcm"。名称不区分大小写
+func ParseHPKESuites(s string) ([]HPKESuite, error) {
+	var out []HPKESuite
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var suite HPKESuite
+		for _, name := range strings.Split(item, "+") {
+			alg, ok := hpkeAlgorithms[strings.ToLower(strings.TrimSpace(name))]
+			if !ok {
+				return nil, fmt.Errorf("未知的 HPKE 算法: %s", name)
+			}
+			var field *uint16
+			switch alg.kind {
+			case "kem":
+				field = &suite.KEM
+			case "kdf":
+				field = &suite.KDF
+			default:
+				field = &suite.AEAD
+			}
+			if *field != 0 {
+				return nil, fmt.Errorf("HPKE 算法组合 %s 重复指定了 %s", item, strings.ToUpper(alg.kind))
+			}
+			*field = alg.id
+		}
+		out = append(out, suite)
+	}
+	return out, nil
+}
+
+// EffectiveSuite 返回握手时实际使用的密码套件：与 crypto/tls 相同，取配置中第一个受支持的套件
+func (c ConfigSummary) EffectiveSuite() (CipherSuite, bool) {
+	for _, cs := range c.CipherSuites {
+		if cs.KDF == hpkeKDFHKDFSHA256 && hpkeKeySize(cs.AEAD) != 0 {
+			return cs, true
+		}
+	}
+	return CipherSuite{}, false
+}
+
+// SelectSuites 按偏好 prefs 筛选并重排 ECHConfigList：只保留实际使用的算法组合（见 EffectiveSuite）
+// 与某一项偏好相符的配置，并按相符的偏好先后排列，同一偏好下保持原顺序。
+// 配置本身是 HPKE 加密上下文的一部分，不能改写其中的套件列表，只能在配置之间选择
+func SelectSuites(list []byte, prefs []HPKESuite) ([]byte, error) {
+	configs, err := DescribeConfigList(list)
+	if err != nil {
+		return nil, err
+	}
+	type ranked struct {
+		rank int
+		raw  []byte
+	}
+	var kept []ranked
+	data := list[2:]
+	for _, c := range configs {
+		length := 4 + int(binary.BigEndian.Uint16(data[2:]))
+		raw := data[:length]
+		data = data[length:]
+		if c.usable() != nil {
+			continue
+		}
+		cs, _ := c.EffectiveSuite()
+		for i, p := range prefs {
+			if p.match(c.KEM, cs) {
+				kept = append(kept, ranked{i, raw})
+				break
+			}
+		}
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("%w: 没有使用 %v 的配置", ErrNoECHRecord, prefs)
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].rank < kept[j].rank })
+	var out []byte
+	for _, k := range kept {
+		out = append(out, k.raw...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...), nil
+}
+
+// WithHPKESuites 限定并排序可接受的 HPKE 算法组合，BuildTLSConfig 只使用实际算法与 prefs 之一相符的配置，
+// 见 SelectSuites。没有相符的配置时与没有配置相同（可配合 WithGREASE）
+func WithHPKESuites(prefs ...HPKESuite) Option {
+	return func(m *ECHManager) {
+		m.suites = prefs
+	}
+}
@@ -0,0 +1,95 @@
+package ech
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSOptions 合并到 BuildTLSConfig 返回的 tls.Config 中的附加设置
+type TLSOptions struct {
+	// RootCAPEM PEM 格式的附加 CA 证书，与系统根证书一起用于验证服务端（含 ECH 被拒绝时的外层证书）
+	RootCAPEM []byte
+	// Certificates 向服务端出示的客户端证书，用于要求 mTLS 的 Worker 或反向代理
+	Certificates []tls.Certificate
+	// InsecureSkipVerify 不验证服务端证书，只应在测试环境使用
+	InsecureSkipVerify bool
+	// NextProtos 握手提供的 ALPN 协议
+	NextProtos []string
+}
+
+// WithTLSOptions 设置 BuildTLSConfig 的附加 TLS 选项
+func WithTLSOptions(opts TLSOptions) Option {
+	return func(m *ECHManager) {
+		m.tlsOpts = opts
+	}
+}
+
+// LoadTLSOptions 从文件读取附加 CA 证书与客户端证书/私钥（均为 PEM），路径为空表示不使用该项；
+// certFile 与 keyFile 须同时给出
+func LoadTLSOptions(caFile, certFile, keyFile string) (TLSOptions, error) {
+	var opts TLSOptions
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return TLSOptions{}, fmt.Errorf("读取CA证书失败: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return TLSOptions{}, fmt.Errorf("%s 中没有有效的PEM证书", caFile)
+		}
+		opts.RootCAPEM = pem
+	}
+	if (certFile == "") != (keyFile == "") {
+		return TLSOptions{}, errors.New("客户端证书与私钥须同时指定")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return TLSOptions{}, fmt.Errorf("加载客户端证书失败: %w", err)
+		}
+		opts.Certificates = []tls.Certificate{cert}
+	}
+	return opts, nil
+}
+
+// BuildFallbackTLSConfig 返回不使用 ECH 的TLS配置，用于允许回退时的普通 TLS 连接。附加 CA、客户端证书、
+// ALPN 与会话缓存与 BuildTLSConfig 相同，只是不携带ECH配置列表，并接受 TLS 1.2
+func (m *ECHManager) BuildFallbackTLSConfig(serverName string) (*tls.Config, error) {
+	cfg, err := m.baseTLSConfig(serverName)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MinVersion = tls.VersionTLS12
+	return cfg, nil
+}
+
+// baseTLSConfig 返回合并了附加设置、尚未设置ECH配置列表的TLS配置
+func (m *ECHManager) baseTLSConfig(serverName string) (*tls.Config, error) {
+	roots, err := m.tlsOpts.rootCAs()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		ServerName:         serverName,
+		RootCAs:            roots,
+		Certificates:       m.tlsOpts.Certificates,
+		InsecureSkipVerify: m.tlsOpts.InsecureSkipVerify,
+		NextProtos:         m.tlsOpts.NextProtos,
+		ClientSessionCache: m.sessionCache,
+	}, nil
+}
+
+// rootCAs 返回系统根证书加上 RootCAPEM 中的证书
+func (o *TLSOptions) rootCAs() (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("加载系统根证书失败: %w", err)
+	}
+	if len(o.RootCAPEM) > 0 && !roots.AppendCertsFromPEM(o.RootCAPEM) {
+		return nil, errors.New("附加CA证书中没有有效的PEM证书")
+	}
+	return roots, nil
+}
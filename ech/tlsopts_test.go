@@ -0,0 +1,36 @@
+package ech
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+)
+
+func TestBuildFallbackTLSConfigKeepsOptions(t *testing.T) {
+	cert := tls.Certificate{Certificate: [][]byte{{1, 2, 3}}}
+	cache := tls.NewLRUClientSessionCache(4)
+	m := NewECHManager("ech.example", "https://dns.example/dns-query",
+		WithTLSOptions(TLSOptions{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"http/1.1"},
+		}),
+		WithSessionCache(cache),
+	)
+	cfg, err := m.BuildFallbackTLSConfig("server.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerName != "server.example" || cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("ServerName %q, MinVersion %x", cfg.ServerName, cfg.MinVersion)
+	}
+	if len(cfg.EncryptedClientHelloConfigList) != 0 {
+		t.Error("回退配置不应携带ECH配置列表")
+	}
+	if len(cfg.Certificates) != 1 || !cfg.InsecureSkipVerify || !slices.Equal(cfg.NextProtos, []string{"http/1.1"}) {
+		t.Errorf("附加 TLS 选项丢失: %+v", cfg)
+	}
+	if cfg.ClientSessionCache != cache || cfg.RootCAs == nil {
+		t.Error("会话缓存或根证书丢失")
+	}
+}
@@ -0,0 +1,358 @@
+package ech
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsTimeout 单次DNS查询的默认超时，见 WithQueryTimeout
+const dnsTimeout = 10 * time.Second
+
+// dnsTransport 向一个DNS服务器发送查询报文并返回应答报文。
+// dnsServer 中的每个服务器按前缀选择实现：tls:// 为 DNS-over-TLS，quic:// 为 DNS-over-QUIC，
+// json:// 为 JSON 格式的 DoH，udp:// 为明文DNS（只用于后备），其余为 DoH。
+// 查询的超时与取消均由 ctx 控制
+type dnsTransport interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// transport 返回服务器对应的传输，同一服务器复用同一实例以便复用连接
+func (m *ECHManager) transport(server string) (dnsTransport, error) {
+	m.transportsMu.Lock()
+	defer m.transportsMu.Unlock()
+	if t, ok := m.transports[server]; ok {
+		return t, nil
+	}
+	var t dnsTransport
+	if addr, ok := strings.CutPrefix(server, "tls://"); ok {
+		d, err := newDoTTransport(addr)
+		if err != nil {
+			return nil, err
+		}
+		d.dial = m.dialContext
+		t = d
+	} else if addr, ok := strings.CutPrefix(server, "quic://"); ok {
+		d, err := newDoQTransport(addr)
+		if err != nil {
+			return nil, err
+		}
+		t = d
+	} else if addr, ok := strings.CutPrefix(server, "json://"); ok {
+		t = &jsonTransport{url: dohURL(addr), client: m.dohClient()}
+	} else if strings.HasPrefix(server, "udp://") {
+		p, err := newPlainTransport(server)
+		if err != nil {
+			return nil, err
+		}
+		t = p
+	} else {
+		u, err := url.Parse(dohURL(server))
+		if err != nil {
+			return nil, fmt.Errorf("无效的DoH URL: %v", err)
+		}
+		d := &dohTransport{url: u, post: m.dohPost, client: m.dohClient()}
+		if u.Scheme == "https" {
+			d.h3 = m.h3Client
+		}
+		t = d
+	}
+	if m.transports == nil {
+		m.transports = make(map[string]dnsTransport)
+	}
+	m.transports[server] = t
+	return t, nil
+}
+
+func dohURL(server string) string {
+	if !strings.HasPrefix(server, "https://") && !strings.HasPrefix(server, "http://") {
+		return "https://" + server
+	}
+	return server
+}
+
+// dohTransport DNS-over-HTTPS (RFC 8484)
+type dohTransport struct {
+	url *url.URL
+	// post 以 POST 发送查询，否则为 GET ?dns=
+	post   bool
+	client *http.Client
+	// h3 不为空时优先经 HTTP/3 查询，失败后改用 client，见 WithDoHHTTP3
+	h3 *http.Client
+
+	h3Mu sync.Mutex
+	// h3Until 之前不使用 HTTP/3
+	h3Until time.Time
+}
+
+func (d *dohTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if d.h3 != nil && d.h3Usable() {
+		h3ctx, cancel := context.WithTimeout(ctx, h3AttemptTimeout)
+		body, err := d.roundTrip(h3ctx, d.h3, query)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return body, err
+		}
+		log.Printf("[客户端] DoH over HTTP/3 失败，%v内改用 HTTP/2: %v", h3Backoff, err)
+		d.h3Mu.Lock()
+		d.h3Until = time.Now().Add(h3Backoff)
+		d.h3Mu.Unlock()
+	}
+	return d.roundTrip(ctx, d.client, query)
+}
+
+func (d *dohTransport) h3Usable() bool {
+	d.h3Mu.Lock()
+	defer d.h3Mu.Unlock()
+	return time.Now().After(d.h3Until)
+}
+
+func (d *dohTransport) roundTrip(ctx context.Context, client *http.Client, query []byte) ([]byte, error) {
+	u := *d.url
+	var req *http.Request
+	var err error
+	if d.post {
+		req, err = http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(query))
+	} else {
+		q := u.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("Content-Type", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH服务器返回错误: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取DoH响应失败: %v", err)
+	}
+	return body, nil
+}
+
+// dotTransport DNS-over-TLS (RFC 7858)。连接在查询之间保持，
+// 服务器关闭空闲连接后下一次查询自动重连
+type dotTransport struct {
+	addr       string
+	serverName string
+	// dial 建立 TCP 连接，为空时直接连接 addr
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu   sync.Mutex
+	conn *tls.Conn
+}
+
+// newDoTTransport 解析 host[:port]，端口默认为 853
+func newDoTTransport(addr string) (*dotTransport, error) {
+	addr = strings.TrimSuffix(addr, "/")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.Trim(addr, "[]"), "853"
+	}
+	if host == "" {
+		return nil, fmt.Errorf("无效的DoT服务器: %s", addr)
+	}
+	return &dotTransport{addr: net.JoinHostPort(host, port), serverName: host}, nil
+}
+
+func (d *dotTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reused := d.conn != nil
+	resp, err := d.roundTrip(ctx, query)
+	if err != nil && reused && ctx.Err() == nil {
+		// 复用的连接可能已被服务器关闭，重新连接后再试一次
+		resp, err = d.roundTrip(ctx, query)
+	}
+	return resp, err
+}
+
+func (d *dotTransport) roundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	if d.conn == nil {
+		conn, err := d.connect(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("DoT连接失败: %v", err)
+		}
+		d.conn = conn
+	}
+	resp, err := d.send(ctx, query)
+	if err != nil {
+		d.conn.Close()
+		d.conn = nil
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (d *dotTransport) connect(ctx context.Context) (*tls.Conn, error) {
+	dial := d.dial
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	raw, err := dial(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{MinVersion: tls.VersionTLS12, ServerName: d.serverName})
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *dotTransport) send(ctx context.Context, query []byte) ([]byte, error) {
+	defer bindContext(ctx, d.conn)()
+	resp, err := streamExchange(d.conn, query)
+	if err != nil {
+		return nil, fmt.Errorf("DoT%v", err)
+	}
+	return resp, nil
+}
+
+// bindContext 使 conn 上的读写遵循 ctx 的期限，ctx 被取消时立即中断；
+// 返回的函数解除绑定并清除期限，以便连接继续复用
+func bindContext(ctx context.Context, conn net.Conn) func() {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	return func() {
+		stop()
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// streamExchange 在流式连接上发送带 2 字节长度前缀的查询并读取应答 (TCP/DoT)
+func streamExchange(conn net.Conn, query []byte) ([]byte, error) {
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, fmt.Errorf("请求失败: %v", err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, fmt.Errorf("读取响应失败: %v", err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("读取响应失败: %v", err)
+	}
+	if len(resp) < 2 || len(query) < 2 || !bytes.Equal(resp[:2], query[:2]) {
+		return nil, errors.New("响应ID不匹配")
+	}
+	return resp, nil
+}
+
+// plainTransport 传统的明文DNS：先用 UDP 查询，应答被截断 (TC) 时改用 TCP 重新查询。
+// 携带多个 ECH 配置的 HTTPS 记录常超过 512 字节，查询的 EDNS0 载荷大小见 WithEDNSBufferSize。
+// 查询内容对网络可见，只作为加密DNS全部不可用时的后备
+type plainTransport struct {
+	addr string
+}
+
+func newPlainTransport(addr string) (*plainTransport, error) {
+	addr = strings.TrimPrefix(addr, "udp://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	if host, _, _ := net.SplitHostPort(addr); host == "" {
+		return nil, fmt.Errorf("无效的DNS服务器: %s", addr)
+	}
+	return &plainTransport{addr: addr}, nil
+}
+
+func (p *plainTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	resp, err := p.exchangeUDP(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if resp[2]&0x02 == 0 {
+		return resp, nil
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("DNS应答被截断，TCP连接失败: %v", err)
+	}
+	defer conn.Close()
+	defer bindContext(ctx, conn)()
+	if resp, err = streamExchange(conn, query); err != nil {
+		return nil, fmt.Errorf("DNS over TCP %v", err)
+	}
+	return resp, nil
+}
+
+// randomizeCase 随机改变查询报文问题部分域名中每个字母的大小写 (DNS 0x20)
+func randomizeCase(query []byte) {
+	bits := make([]byte, maxNameLength)
+	rand.Read(bits)
+	for i := 12; i < len(query) && query[i] != 0; {
+		l := int(query[i])
+		for j := i + 1; j <= i+l && j < len(query); j++ {
+			if c := query[j] | 0x20; c >= 'a' && c <= 'z' && bits[j%len(bits)]&1 != 0 {
+				query[j] ^= 0x20
+			}
+		}
+		i += l + 1
+	}
+}
+
+// checkCase 确认应答问题部分的域名与查询的大小写完全一致
+func checkCase(query, response []byte) error {
+	_, qend, err := readName(query, 12)
+	if err != nil || qend > len(response) || !bytes.Equal(query[12:qend], response[12:qend]) {
+		return errors.New("应答的问题部分大小写与查询不一致 (DNS 0x20)")
+	}
+	return nil
+}
+
+func (p *plainTransport) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("DNS查询失败: %v", err)
+	}
+	defer conn.Close()
+	defer bindContext(ctx, conn)()
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("DNS查询失败: %v", err)
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("读取DNS应答失败: %v", err)
+		}
+		// 忽略 ID 不匹配或不是应答的报文，继续等待到超时
+		if n >= 12 && buf[0] == query[0] && buf[1] == query[1] && buf[2]&0x80 != 0 {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package ech
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// VerifyResult Verify 的检查结果
+type VerifyResult struct {
+	// ServerName 内层 ClientHello 的 SNI，OuterServerName 为外层（配置的 public_name）
+	ServerName      string
+	OuterServerName string
+	// Addr 实际连接的地址
+	Addr     string
+	Accepted bool
+	// Version 协商的 TLS 版本，Latency 为连接与握手的总耗时
+	Version string
+	Latency time.Duration
+	// RetryConfigs 服务器拒绝 ECH 时在外层握手中提供的新配置，可交给 ApplyRetryConfigs
+	RetryConfigs []byte
+}
+
+// Verify 用当前的ECH配置与 addr 完成一次 TLS 握手（不发送应用数据），检查服务器是否接受 ECH，
+// 便于在转发流量前诊断"服务器拒绝ECH"。serverName 为内层 SNI，为空时使用默认域名；
+// addr 为空时连接配置的 public_name 的 443 端口，主机名经 QueryAddr 解析。
+// ECH 未被接受时返回的错误包装 ErrECHRejected，结果中仍填写已知的字段
+func (m *ECHManager) Verify(ctx context.Context, serverName, addr string) (VerifyResult, error) {
+	if serverName == "" {
+		serverName = m.echDomain
+	}
+	res := VerifyResult{ServerName: serverName}
+	outer, err := m.OuterServerName()
+	if err != nil {
+		return res, err
+	}
+	res.OuterServerName = outer
+	if addr == "" {
+		addr = net.JoinHostPort(outer, "443")
+	}
+	cfg, err := m.BuildTLSConfig(serverName)
+	if err != nil {
+		return res, err
+	}
+	// 不恢复会话，确保每次检查都完整地协商 ECH
+	cfg.ClientSessionCache = nil
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+	start := time.Now()
+	raw, err := m.dialVerify(ctx, addr)
+	if err != nil {
+		return res, fmt.Errorf("连接 %s 失败: %w", addr, err)
+	}
+	defer raw.Close()
+	res.Addr = raw.RemoteAddr().String()
+	conn := tls.Client(raw, cfg)
+	err = conn.HandshakeContext(ctx)
+	res.Latency = time.Since(start)
+	if err != nil {
+		var rejection *tls.ECHRejectionError
+		if errors.As(err, &rejection) {
+			res.RetryConfigs = rejection.RetryConfigList
+			return res, fmt.Errorf("%w: %v", ErrECHRejected, err)
+		}
+		return res, fmt.Errorf("TLS 握手失败: %w", err)
+	}
+	state := conn.ConnectionState()
+	res.Version = tls.VersionName(state.Version)
+	res.Accepted = state.ECHAccepted
+	if !res.Accepted {
+		return res, fmt.Errorf("%w: 握手完成但 ECH 未被接受", ErrECHRejected)
+	}
+	return res, nil
+}
+
+// dialVerify 连接 addr，主机名经 QueryAddr 解析后依次尝试各地址
+func (m *ECHManager) dialVerify(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := m.QueryAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
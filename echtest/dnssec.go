@@ -0,0 +1,219 @@
+package echtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	typeDS       = 43
+	typeRRSIG    = 46
+	typeDNSKEY   = 48
+	algED25519   = 15
+	digestSHA256 = 2
+	// wrongSigner FaultWrongSigner 使用的签名者，不是任何测试域名的上级
+	wrongSigner = "wrong-signer.invalid"
+)
+
+// DNSSECFault 在签名区域中注入的错误，用于测试验证失败的情况
+type DNSSECFault int
+
+const (
+	FaultNone DNSSECFault = iota
+	// FaultBadSignature 区域内记录集（DNSKEY 除外）的签名被篡改
+	FaultBadSignature
+	// FaultExpired 区域内记录集（DNSKEY 除外）的签名已过期
+	FaultExpired
+	// FaultWrongSigner 区域内记录集（DNSKEY 除外）的签名者不是记录所在的区域或其上级
+	FaultWrongSigner
+	// FaultDSMismatch 上级区域发布的该区域 DS 摘要与密钥不符
+	FaultDSMismatch
+)
+
+// signedZone 以 Ed25519 KSK 签名的区域
+type signedZone struct {
+	name   string
+	key    ed25519.PrivateKey
+	dnskey []byte
+	tag    uint16
+	fault  DNSSECFault
+}
+
+// SignZone 用新生成的 Ed25519 密钥签名 zone：zone 及其下（不属于更深的签名区域）的应答记录集附带 RRSIG，
+// 并应答 zone 的 DNSKEY 查询；上级区域也已签名时由上级发布 zone 的 DS 记录。
+// 返回 ech.ParseTrustAnchor 格式的 DS，可作为信任锚
+func (s *DoHServer) SignZone(zone string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	z := &signedZone{name: canonicalName(zone), key: priv}
+	z.dnskey = append([]byte{0x01, 0x01, 3, algED25519}, pub...)
+	z.tag = keyTag(z.dnskey)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones[z.name] = z
+	return fmt.Sprintf("%s. %d %d %d %s", z.name, z.tag, algED25519, digestSHA256, hex.EncodeToString(z.dsDigest())), nil
+}
+
+// SetZoneFault 为已签名的区域注入错误，FaultNone 恢复正常
+func (s *DoHServer) SetZoneFault(zone string, fault DNSSECFault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if z, ok := s.zones[canonicalName(zone)]; ok {
+		z.fault = fault
+	}
+}
+
+// zoneOf 返回 name 所在的最深的签名区域，不在任何签名区域内时返回 nil。调用方需持有 s.mu
+func (s *DoHServer) zoneOf(name string) *signedZone {
+	for {
+		if z, ok := s.zones[name]; ok {
+			return z
+		}
+		if name == "" {
+			return nil
+		}
+		_, parent, _ := strings.Cut(name, ".")
+		name = parent
+	}
+}
+
+// keyAnswers 返回签名区域的 DNSKEY 或 DS 记录。调用方需持有 s.mu
+func (s *DoHServer) keyAnswers(name string, qtype uint16) []answer {
+	z, ok := s.zones[name]
+	if !ok {
+		return nil
+	}
+	if qtype == typeDNSKEY {
+		return []answer{{rrType: typeDNSKEY, ttl: 300, rdata: z.dnskey}}
+	}
+	_, parent, _ := strings.Cut(name, ".")
+	if name == "" || s.zoneOf(parent) == nil {
+		return nil
+	}
+	digest := z.dsDigest()
+	if z.fault == FaultDSMismatch {
+		digest[0] ^= 0xFF
+	}
+	rdata := binary.BigEndian.AppendUint16(nil, z.tag)
+	rdata = append(rdata, algED25519, digestSHA256)
+	return []answer{{rrType: typeDS, ttl: 300, rdata: append(rdata, digest...)}}
+}
+
+// signAnswers 为 answers 中位于签名区域内的每个记录集追加 RRSIG，qname 为问题部分的域名。
+// DS 记录集由上级区域签名。调用方需持有 s.mu
+func (s *DoHServer) signAnswers(qname string, answers []answer) []answer {
+	type rrsetKey struct {
+		owner  string
+		rrType uint16
+	}
+	var order []rrsetKey
+	sets := map[rrsetKey][]answer{}
+	for _, a := range answers {
+		k := rrsetKey{a.owner, a.rrType}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], a)
+	}
+
+	for _, k := range order {
+		owner := k.owner
+		if owner == "" {
+			owner = qname
+		}
+		zoneName := owner
+		if k.rrType == typeDS {
+			_, zoneName, _ = strings.Cut(owner, ".")
+		}
+		z := s.zoneOf(zoneName)
+		if z == nil {
+			continue
+		}
+		rrset := sets[k]
+		rdatas := make([][]byte, len(rrset))
+		for i, a := range rrset {
+			rdatas[i] = a.rdata
+		}
+		sig := z.sign(owner, k.rrType, rrset[0].ttl, rdatas)
+		answers = append(answers, answer{owner: k.owner, rrType: typeRRSIG, ttl: rrset[0].ttl, rdata: sig})
+	}
+	return answers
+}
+
+// sign 返回 owner 的 rrType 记录集的 RRSIG RDATA (RFC 4034 3.1.8.1)
+func (z *signedZone) sign(owner string, rrType uint16, ttl uint32, rdatas [][]byte) []byte {
+	fault := z.fault
+	if rrType == typeDNSKEY {
+		fault = FaultNone
+	}
+	now := time.Now()
+	inception, expiration := now.Add(-time.Hour), now.Add(time.Hour)
+	if fault == FaultExpired {
+		inception, expiration = now.Add(-2*time.Hour), now.Add(-time.Hour)
+	}
+	signer := z.name
+	if fault == FaultWrongSigner {
+		signer = wrongSigner
+	}
+
+	labels := 0
+	if owner != "" {
+		labels = strings.Count(owner, ".") + 1
+	}
+	rdata := binary.BigEndian.AppendUint16(nil, rrType)
+	rdata = append(rdata, algED25519, byte(labels))
+	rdata = binary.BigEndian.AppendUint32(rdata, ttl)
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(expiration.Unix()))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(inception.Unix()))
+	rdata = binary.BigEndian.AppendUint16(rdata, z.tag)
+	rdata = appendName(rdata, signer)
+
+	// 待签名数据：RRSIG RDATA（不含签名）后接按 RDATA 排序的规范形式记录
+	sorted := append([][]byte(nil), rdatas...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	data := append([]byte(nil), rdata...)
+	for _, rd := range sorted {
+		data = appendName(data, owner)
+		data = binary.BigEndian.AppendUint16(data, rrType)
+		data = binary.BigEndian.AppendUint16(data, classIN)
+		data = binary.BigEndian.AppendUint32(data, ttl)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rd)))
+		data = append(data, rd...)
+	}
+	sig := ed25519.Sign(z.key, data)
+	if fault == FaultBadSignature {
+		sig[0] ^= 0xFF
+	}
+	return append(rdata, sig...)
+}
+
+// dsDigest 返回区域 DNSKEY 的 SHA-256 摘要
+func (z *signedZone) dsDigest() []byte {
+	sum := sha256.Sum256(append(appendName(nil, z.name), z.dnskey...))
+	return sum[:]
+}
+
+// keyTag 计算密钥标签 (RFC 4034 附录 B)
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac)
+}
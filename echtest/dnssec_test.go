@@ -0,0 +1,98 @@
+package echtest_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"ech-workers/ech"
+	"ech-workers/echtest"
+)
+
+// signedServer 返回发布了 svc.zone.example 的ECH配置的 DoH 服务器：example 与其下的 zone.example
+// 均已签名，alias.zone.example 为 svc.zone.example 的别名。返回 example 的信任锚
+func signedServer(t *testing.T) (*echtest.DoHServer, *echtest.ECHKey, ech.TrustAnchor) {
+	t.Helper()
+	s := newDoHServer(t)
+	key := generateKey(t, 1)
+	s.SetECH("svc.zone.example", key.ConfigList())
+	s.SetCNAME("alias.zone.example", "svc.zone.example", true)
+
+	ds, err := s.SignZone("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SignZone("zone.example"); err != nil {
+		t.Fatal(err)
+	}
+	anchor, err := ech.ParseTrustAnchor(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, key, anchor
+}
+
+func prepareSigned(s *echtest.DoHServer, domain string, anchor ech.TrustAnchor) (*ech.ECHManager, error) {
+	m := ech.NewECHManager(domain, s.DNSServer(), ech.WithDNSSEC(anchor), ech.WithRetryPolicy(ech.RetryPolicy{Attempts: 1}))
+	return m, m.Prepare()
+}
+
+func TestDNSSECValidChain(t *testing.T) {
+	s, key, anchor := signedServer(t)
+	for _, domain := range []string{"svc.zone.example", "alias.zone.example"} {
+		m, err := prepareSigned(s, domain, anchor)
+		if err != nil {
+			t.Fatalf("%s: %v", domain, err)
+		}
+		if list, _ := m.GetECHList(); !bytes.Equal(list, key.ConfigList()) {
+			t.Fatalf("%s: 获取的ECH配置与发布的不一致", domain)
+		}
+	}
+}
+
+func TestDNSSECFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		zone  string
+		fault echtest.DNSSECFault
+		want  string
+	}{
+		{"签名被篡改", "zone.example", echtest.FaultBadSignature, "签名验证失败"},
+		{"签名已过期", "zone.example", echtest.FaultExpired, "签名已过期"},
+		{"签名者不是上级", "zone.example", echtest.FaultWrongSigner, "不是其所在区域"},
+		{"DS 不匹配", "zone.example", echtest.FaultDSMismatch, "没有与 DS 匹配的 DNSKEY"},
+		{"上级区域的 DS 签名被篡改", "example", echtest.FaultBadSignature, "签名验证失败"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, anchor := signedServer(t)
+			s.SetZoneFault(tt.zone, tt.fault)
+			_, err := prepareSigned(s, "svc.zone.example", anchor)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Prepare 返回 %v，应包含 %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSSECUntrustedAnchor(t *testing.T) {
+	s, _, _ := signedServer(t)
+	// 信任锚来自另一台服务器上同名区域的密钥
+	other, _, anchor := signedServer(t)
+	other.Close()
+	if _, err := prepareSigned(s, "svc.zone.example", anchor); err == nil {
+		t.Fatal("接受了无法验证到信任锚的应答")
+	}
+}
+
+func TestDNSSECUnsignedZone(t *testing.T) {
+	s := newDoHServer(t)
+	s.SetECH("ech.example", generateKey(t, 1).ConfigList())
+	anchor, err := ech.ParseTrustAnchor(". 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prepareSigned(s, "ech.example", anchor); err == nil || !strings.Contains(err.Error(), "没有签名") {
+		t.Fatalf("Prepare 返回 %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+// Package echtest 提供用于测试 ECH 相关逻辑的辅助工具，无需访问真实网络。
+package echtest
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const (
+	typeA         = 1
+	typeCNAME     = 5
+	typeAAAA      = 28
+	typeSVCB      = 64
+	typeHTTPS     = 65
+	classIN       = 1
+	paramALPN     = 1
+	paramPort     = 3
+	paramIPv4Hint = 4
+	paramECH      = 5
+	paramIPv6Hint = 6
+)
+
+// Record 描述一条 HTTPS 记录（ServiceMode），零值参数不写入记录
+type Record struct {
+	// SVCB 为 true 时作为 SVCB (类型 64) 记录发布，否则为 HTTPS 记录
+	SVCB     bool
+	Priority uint16
+	Target   string
+	ALPN     []string
+	Port     uint16
+	IPv4Hint []net.IP
+	IPv6Hint []net.IP
+	ECH      []byte
+	TTL      uint32
+}
+
+// DoHServer 是基于 httptest 的 DoH 模拟服务器，按域名返回配置好的 HTTPS 记录
+type DoHServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	records  map[string][]Record
+	addrs    map[string][]net.IP
+	cnames   map[string]cname
+	zones    map[string]*signedZone
+	queries  int
+	failNext int
+}
+
+// NewDoHServer 启动一个 DoH 模拟服务器，使用完毕后需调用 Close
+func NewDoHServer() *DoHServer {
+	s := &DoHServer{records: make(map[string][]Record), addrs: make(map[string][]net.IP), cnames: make(map[string]cname), zones: make(map[string]*signedZone)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveDoH))
+	return s
+}
+
+// DNSServer 返回可直接传给 ech.NewECHManager 的 DoH 地址
+func (s *DoHServer) DNSServer() string {
+	return s.URL + "/dns-query"
+}
+
+// SetECH 为域名设置一条携带 ECHConfigList 的 HTTPS 记录
+func (s *DoHServer) SetECH(domain string, echList []byte) {
+	s.SetRecords(domain, Record{Priority: 1, Target: ".", ECH: echList, TTL: 300})
+}
+
+// SetRecords 替换域名的全部 HTTPS 记录
+func (s *DoHServer) SetRecords(domain string, records ...Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[canonicalName(domain)] = records
+}
+
+// SetAddrs 设置域名的 A/AAAA 记录，TTL 为 300 秒
+func (s *DoHServer) SetAddrs(domain string, ips ...net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addrs[canonicalName(domain)] = ips
+}
+
+// Remove 删除域名的记录，之后的查询将返回无应答
+func (s *DoHServer) Remove(domain string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, canonicalName(domain))
+	delete(s.cnames, canonicalName(domain))
+}
+
+// cname SetCNAME 设置的别名
+type cname struct {
+	target     string
+	withTarget bool
+}
+
+// SetCNAME 把 domain 设为 target 的别名 (CNAME)。withTarget 为 true 时应答同时包含 target 的记录，
+// 与多数递归解析器相同；否则只返回 CNAME 记录，客户端需要再查询 target
+func (s *DoHServer) SetCNAME(domain, target string, withTarget bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cnames[canonicalName(domain)] = cname{target: canonicalName(target), withTarget: withTarget}
+}
+
+// FailNext 使接下来的 n 次请求返回 HTTP 500
+func (s *DoHServer) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failNext = n
+}
+
+// Queries 返回已收到的 DoH 请求数
+func (s *DoHServer) Queries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+func (s *DoHServer) serveDoH(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		query, err = io.ReadAll(io.LimitReader(r.Body, 65535))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.queries++
+	if s.failNext > 0 {
+		s.failNext--
+		s.mu.Unlock()
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+	s.mu.Unlock()
+
+	name, qtype, qend, err := parseQuestion(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	var answers []answer
+	qname, owner := name, ""
+	if c, ok := s.cnames[name]; ok {
+		answers = append(answers, answer{rrType: typeCNAME, ttl: 300, rdata: appendName(nil, c.target)})
+		if !c.withTarget {
+			// 只返回 CNAME 记录
+			name = ""
+		} else {
+			name, owner = c.target, c.target
+		}
+	}
+	if qtype == typeDNSKEY || qtype == typeDS {
+		answers = append(answers, s.keyAnswers(name, qtype)...)
+	} else if qtype == typeA || qtype == typeAAAA {
+		for _, ip := range s.addrs[name] {
+			if (ip.To4() != nil) == (qtype == typeA) {
+				answers = append(answers, addrAnswer(owner, qtype, ip))
+			}
+		}
+	} else {
+		for _, rec := range s.records[name] {
+			if rec.rrType() == qtype {
+				answers = append(answers, rec.answer(owner))
+			}
+		}
+	}
+	answers = s.signAnswers(qname, answers)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(buildResponse(query[:qend], answers))
+}
+
+// answer 应答部分的一条记录，owner 为空时使用指向问题部分域名的压缩指针
+type answer struct {
+	owner  string
+	rrType uint16
+	ttl    uint32
+	rdata  []byte
+}
+
+// buildResponse 根据查询报文（头部与问题部分）构造包含 answers 的应答
+func buildResponse(question []byte, answers []answer) []byte {
+	resp := make([]byte, 0, 512)
+	resp = append(resp, question[0], question[1], 0x81, 0x80)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = append(resp, 0, 0, 0, 0)
+	resp = append(resp, question[12:]...)
+	for _, a := range answers {
+		if a.owner == "" {
+			resp = append(resp, 0xC0, 0x0C)
+		} else {
+			resp = appendName(resp, a.owner)
+		}
+		resp = binary.BigEndian.AppendUint16(resp, a.rrType)
+		resp = binary.BigEndian.AppendUint16(resp, classIN)
+		resp = binary.BigEndian.AppendUint32(resp, a.ttl)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(a.rdata)))
+		resp = append(resp, a.rdata...)
+	}
+	return resp
+}
+
+// BuildHTTPSResponse 根据查询报文（头部与问题部分）构造包含 HTTPS 记录的应答
+func BuildHTTPSResponse(question []byte, records []Record) []byte {
+	answers := make([]answer, len(records))
+	for i, rec := range records {
+		answers[i] = rec.answer("")
+	}
+	return buildResponse(question, answers)
+}
+
+// addrAnswer 返回 owner 的 A 或 AAAA 记录
+func addrAnswer(owner string, qtype uint16, ip net.IP) answer {
+	data := ip.To16()
+	if qtype == typeA {
+		data = ip.To4()
+	}
+	return answer{owner: owner, rrType: qtype, ttl: 300, rdata: data}
+}
+
+// answer 返回以 owner 为所有者的记录
+func (rec Record) answer(owner string) answer {
+	rdata := binary.BigEndian.AppendUint16(nil, rec.Priority)
+	rdata = appendName(rdata, rec.Target)
+	rdata = rec.appendParams(rdata)
+	return answer{owner: owner, rrType: rec.rrType(), ttl: rec.TTL, rdata: rdata}
+}
+
+func (rec Record) rrType() uint16 {
+	if rec.SVCB {
+		return typeSVCB
+	}
+	return typeHTTPS
+}
+
+// appendParams 按 SvcParamKey 升序写入记录的参数
+func (rec Record) appendParams(rdata []byte) []byte {
+	param := func(key uint16, value []byte) {
+		rdata = binary.BigEndian.AppendUint16(rdata, key)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(value)))
+		rdata = append(rdata, value...)
+	}
+	if len(rec.ALPN) > 0 {
+		var value []byte
+		for _, p := range rec.ALPN {
+			value = append(append(value, byte(len(p))), p...)
+		}
+		param(paramALPN, value)
+	}
+	if rec.Port != 0 {
+		param(paramPort, binary.BigEndian.AppendUint16(nil, rec.Port))
+	}
+	if len(rec.IPv4Hint) > 0 {
+		var value []byte
+		for _, ip := range rec.IPv4Hint {
+			value = append(value, ip.To4()...)
+		}
+		param(paramIPv4Hint, value)
+	}
+	if len(rec.ECH) > 0 {
+		param(paramECH, rec.ECH)
+	}
+	if len(rec.IPv6Hint) > 0 {
+		var value []byte
+		for _, ip := range rec.IPv6Hint {
+			value = append(value, ip.To16()...)
+		}
+		param(paramIPv6Hint, value)
+	}
+	return rdata
+}
+
+func parseQuestion(query []byte) (name string, qtype uint16, end int, err error) {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return "", 0, 0, errors.New("invalid dns query")
+	}
+	var labels []string
+	offset := 12
+	for {
+		if offset >= len(query) {
+			return "", 0, 0, errors.New("truncated question")
+		}
+		l := int(query[offset])
+		offset++
+		if l == 0 {
+			break
+		}
+		if l > 63 || offset+l > len(query) {
+			return "", 0, 0, errors.New("invalid label")
+		}
+		labels = append(labels, string(query[offset:offset+l]))
+		offset += l
+	}
+	if offset+4 > len(query) {
+		return "", 0, 0, errors.New("truncated question")
+	}
+	qtype = binary.BigEndian.Uint16(query[offset : offset+2])
+	return canonicalName(strings.Join(labels, ".")), qtype, offset + 4, nil
+}
+
+func appendName(b []byte, name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
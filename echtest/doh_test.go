@@ -0,0 +1,173 @@
+package echtest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"ech-workers/ech"
+	"ech-workers/echtest"
+)
+
+func newDoHServer(t *testing.T) *echtest.DoHServer {
+	t.Helper()
+	s := echtest.NewDoHServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func generateKey(t *testing.T, configID uint8) *echtest.ECHKey {
+	t.Helper()
+	key, err := echtest.GenerateECHKey("public.example", configID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// httpsQuery 构造 domain 的 HTTPS 查询报文（头部与问题部分）
+func httpsQuery(domain string) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(domain, ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, ech.TypeHTTPS)
+	return binary.BigEndian.AppendUint16(q, 1)
+}
+
+// exchange 以 POST 向 s 发送 domain 的 HTTPS 查询，返回状态码与应答中的记录数
+func exchange(t *testing.T, s *echtest.DoHServer, domain string) (int, int) {
+	t.Helper()
+	resp, err := http.Post(s.DNSServer(), "application/dns-message", bytes.NewReader(httpsQuery(domain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(body) < 12 {
+		return resp.StatusCode, 0
+	}
+	return resp.StatusCode, int(binary.BigEndian.Uint16(body[6:8]))
+}
+
+func TestDoHServerPrepareAndRefresh(t *testing.T) {
+	s := newDoHServer(t)
+	first, second := generateKey(t, 1), generateKey(t, 2)
+	s.SetECH("ech.example", first.ConfigList())
+
+	m := ech.NewECHManager("ech.example", s.DNSServer())
+	if err := m.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := m.GetECHList(); !bytes.Equal(list, first.ConfigList()) {
+		t.Fatal("获取的ECH配置与发布的不一致")
+	}
+	if s.Queries() == 0 {
+		t.Fatal("没有记录收到的查询")
+	}
+
+	s.SetECH("ech.example", second.ConfigList())
+	if err := m.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := m.GetECHList(); !bytes.Equal(list, second.ConfigList()) {
+		t.Fatal("刷新后没有使用新发布的ECH配置")
+	}
+}
+
+func TestDoHServerRemove(t *testing.T) {
+	s := newDoHServer(t)
+	s.SetECH("ech.example", generateKey(t, 1).ConfigList())
+	if code, n := exchange(t, s, "ech.example"); code != http.StatusOK || n != 1 {
+		t.Fatalf("删除前: 状态码 %d，记录数 %d", code, n)
+	}
+	s.Remove("ech.example")
+	if code, n := exchange(t, s, "ech.example"); code != http.StatusOK || n != 0 {
+		t.Fatalf("删除后: 状态码 %d，记录数 %d", code, n)
+	}
+}
+
+func TestDoHServerFailNext(t *testing.T) {
+	s := newDoHServer(t)
+	s.SetECH("ech.example", generateKey(t, 1).ConfigList())
+	s.FailNext(1)
+	if code, _ := exchange(t, s, "ech.example"); code != http.StatusInternalServerError {
+		t.Fatalf("注入失败时状态码为 %d", code)
+	}
+	if code, n := exchange(t, s, "ech.example"); code != http.StatusOK || n != 1 {
+		t.Fatalf("错误次数用完后: 状态码 %d，记录数 %d", code, n)
+	}
+	if n := s.Queries(); n != 2 {
+		t.Fatalf("收到 %d 次查询，应为 2", n)
+	}
+}
+
+func TestDoHServerCNAME(t *testing.T) {
+	for _, withTarget := range []bool{true, false} {
+		s := newDoHServer(t)
+		key := generateKey(t, 1)
+		s.SetECH("target.example", key.ConfigList())
+		s.SetCNAME("alias.example", "target.example", withTarget)
+
+		m := ech.NewECHManager("alias.example", s.DNSServer())
+		if err := m.Prepare(); err != nil {
+			t.Fatalf("withTarget=%v: %v", withTarget, err)
+		}
+		if list, _ := m.GetECHList(); !bytes.Equal(list, key.ConfigList()) {
+			t.Fatalf("withTarget=%v: 没有经别名获取到ECH配置", withTarget)
+		}
+	}
+}
+
+func TestDoHServerAddrs(t *testing.T) {
+	s := newDoHServer(t)
+	s.SetAddrs("server.example", net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1"))
+
+	m := ech.NewECHManager("ech.example", s.DNSServer())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := m.QueryAddr(ctx, "server.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v4, v6 bool
+	for _, ip := range ips {
+		v4 = v4 || ip.Equal(net.IPv4(192, 0, 2, 1))
+		v6 = v6 || ip.Equal(net.ParseIP("2001:db8::1"))
+	}
+	if !v4 || !v6 {
+		t.Fatalf("解析结果为 %v", ips)
+	}
+}
+
+func TestBuildHTTPSResponse(t *testing.T) {
+	key := generateKey(t, 1)
+	resp := echtest.BuildHTTPSResponse(httpsQuery("ech.example"), []echtest.Record{{
+		Priority: 1, Target: ".", ALPN: []string{"h2"}, Port: 8443,
+		IPv4Hint: []net.IP{net.IPv4(192, 0, 2, 1)}, ECH: key.ConfigList(), TTL: 120,
+	}})
+	rec, ttl, err := ech.ParseHTTPSAnswer(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 120 || rec.Priority != 1 || rec.Port != 8443 || len(rec.ALPN) != 1 || rec.ALPN[0] != "h2" {
+		t.Fatalf("解析结果为 %+v (TTL %d)", rec, ttl)
+	}
+	if len(rec.IPv4Hint) != 1 || !rec.IPv4Hint[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("ipv4hint 为 %v", rec.IPv4Hint)
+	}
+	if !bytes.Equal(rec.ECH, key.ConfigList()) {
+		t.Fatal("ech 参数与发布的配置不一致")
+	}
+}
@@ -0,0 +1,623 @@
+package echtest_test
+
+// 端到端集成测试：启用 ECH 的本地 TLS 服务器、模拟 DoH 服务器、真实的 ECH 管理器、
+// WebSocket 客户端与代理组成完整链路，用于在修改 ECH 与 WebSocket 衔接部分后发现回归。
+// 每个测试都会生成密钥并启动服务器，-short 时跳过。
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ech-workers/ech"
+	"ech-workers/echtest"
+	"ech-workers/proxy"
+	"ech-workers/websocket"
+
+	gws "github.com/gorilla/websocket"
+)
+
+const (
+	serverDomain = "tunnel.e2e.test"
+	echDomain    = "ech.e2e.test"
+)
+
+// newHarness 启动测试服务端，测试结束时关闭
+func newHarness(t *testing.T) *echtest.Harness {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("跳过端到端测试")
+	}
+	h, err := echtest.NewHarness(serverDomain, echDomain)
+	if err != nil {
+		t.Fatalf("启动测试服务器失败: %v", err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+// newClient 创建连接到 h 的 WebSocket 客户端，ECH 配置经模拟 DoH 由真实的 ECH 管理器获取
+func newClient(t *testing.T, h *echtest.Harness, token string) *websocket.WebSocketClient {
+	t.Helper()
+	m := prepare(t, echDomain, h.DoH.DNSServer())
+	return websocket.NewWebSocketClient(h.ServerAddr("/ws"), token, h.Trust(m), h.ServerIP())
+}
+
+// prepare 创建 ECH 管理器并获取 domain 的配置
+func prepare(t *testing.T, domain, dnsServer string, opts ...ech.Option) *ech.ECHManager {
+	t.Helper()
+	m := ech.NewECHManager(domain, dnsServer, opts...)
+	if err := m.Prepare(); err != nil {
+		t.Fatalf("获取ECH配置失败: %v", err)
+	}
+	return m
+}
+
+// publishedECH 返回 h 在 ECH 域名下发布的 ECHConfigList
+func publishedECH(t *testing.T, h *echtest.Harness) []byte {
+	t.Helper()
+	list, err := prepare(t, echDomain, h.DoH.DNSServer()).GetECHList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+// startProxy 在随机端口启动代理，返回监听地址
+func startProxy(t *testing.T, c proxy.WebSocketClient) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	server := proxy.NewProxyServer(ln.Addr().String(), c, "")
+	go server.Serve(ln)
+	return ln.Addr().String()
+}
+
+// dial 连接 addr，测试结束时关闭
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+// expectEcho 通过已建立的隧道发送数据并检查回显
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	payload := bytes.Repeat([]byte("ech-e2e "), 4096)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	go conn.Write(payload)
+	reply := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("读取回显失败: %v", err)
+	}
+	if !bytes.Equal(reply, payload) {
+		t.Fatal("回显内容不一致")
+	}
+}
+
+// expectECHAccepted 检查服务端看到的连接都使用了 ECH，且内层 SNI 为隧道域名
+func expectECHAccepted(t *testing.T, h *echtest.Harness) {
+	t.Helper()
+	if h.Upgrades() == 0 {
+		t.Fatal("服务端没有收到 WebSocket 连接")
+	}
+	if h.ECHAccepted() != h.Upgrades() {
+		t.Fatalf("ECH 被接受 %d/%d 次", h.ECHAccepted(), h.Upgrades())
+	}
+	if sni := h.LastServerName(); sni != serverDomain {
+		t.Fatalf("服务端看到的 SNI 为 %q", sni)
+	}
+}
+
+// mustDial 拨号并立即关闭连接
+func mustDial(t *testing.T, c *websocket.WebSocketClient, format string) {
+	t.Helper()
+	conn, err := c.DialWithECH(2)
+	if err != nil {
+		t.Fatalf(format, err)
+	}
+	conn.Close()
+}
+
+func TestE2ESOCKS5Relay(t *testing.T) {
+	h := newHarness(t)
+	h.SetToken("e2e-token")
+	addr := startProxy(t, newClient(t, h, "e2e-token"))
+
+	conn := dial(t, addr)
+	target := "echo.e2e.test"
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil || resp[1] != 0 {
+		t.Fatalf("SOCKS5 协商失败: %v", err)
+	}
+	req := append([]byte{5, 1, 0, 3, byte(len(target))}, target...)
+	req = append(req, 0x01, 0xbb)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("读取 SOCKS5 响应失败: %v", err)
+	}
+	if reply[1] != 0 {
+		t.Fatalf("SOCKS5 CONNECT 失败: 0x%02x", reply[1])
+	}
+	expectEcho(t, conn)
+	expectECHAccepted(t, h)
+}
+
+func TestE2EHTTPConnectRelay(t *testing.T) {
+	h := newHarness(t)
+	addr := startProxy(t, newClient(t, h, ""))
+
+	conn := dial(t, addr)
+	fmt.Fprintf(conn, "CONNECT echo.e2e.test:443 HTTP/1.1\r\nHost: echo.e2e.test:443\r\n\r\n")
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("读取 CONNECT 响应失败: %v", err)
+	}
+	if !strings.Contains(status, " 200 ") {
+		t.Fatalf("CONNECT 失败: %s", strings.TrimSpace(status))
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	if br.Buffered() > 0 {
+		t.Fatal("CONNECT 响应后出现多余数据")
+	}
+	expectEcho(t, conn)
+	expectECHAccepted(t, h)
+}
+
+func TestE2ETokenRejected(t *testing.T) {
+	h := newHarness(t)
+	h.SetToken("right-token")
+	c := newClient(t, h, "wrong-token")
+	conn, err := c.DialWithECH(2)
+	if err == nil {
+		conn.Close()
+		t.Fatal("使用错误令牌的连接没有被拒绝")
+	}
+	if !errors.Is(err, websocket.ErrAuthFailed) {
+		t.Fatalf("期望认证失败，实际为: %v", err)
+	}
+}
+
+// TestE2EKeyRotation 服务端轮换 ECH 密钥后，客户端缓存的旧配置被拒绝，应换用新配置
+// （握手中的 retry_configs 或重新查询 DNS）后重连成功
+func TestE2EKeyRotation(t *testing.T) {
+	h := newHarness(t)
+	c := newClient(t, h, "")
+	mustDial(t, c, "首次连接失败: %v")
+	if err := h.RotateKey(true); err != nil {
+		t.Fatal(err)
+	}
+	mustDial(t, c, "密钥轮换后连接失败: %v")
+	expectECHAccepted(t, h)
+}
+
+// TestE2ERetryConfigs 服务端轮换密钥但 DNS 仍是旧配置时，客户端应使用握手中的 retry_configs 重连，
+// 无需重新查询 DNS
+func TestE2ERetryConfigs(t *testing.T) {
+	h := newHarness(t)
+	c := newClient(t, h, "")
+	if err := h.RotateKey(false); err != nil {
+		t.Fatal(err)
+	}
+	queries := h.DoH.Queries()
+	mustDial(t, c, "密钥轮换后连接失败: %v")
+	if h.DoH.Queries() != queries {
+		t.Fatal("使用 retry_configs 时仍重新查询了 DNS")
+	}
+	expectECHAccepted(t, h)
+}
+
+// TestE2EStrictWithoutECH 未发布 ECH 配置且不允许回退时，客户端不应以明文 SNI 连接
+func TestE2EStrictWithoutECH(t *testing.T) {
+	h := newHarness(t)
+	h.DoH.Remove(echDomain)
+	m := ech.NewECHManager(echDomain, h.DoH.DNSServer())
+	c := websocket.NewWebSocketClient(h.ServerAddr("/ws"), "", h.Trust(m), h.ServerIP())
+	conn, err := c.DialWithECH(1)
+	if err == nil {
+		conn.Close()
+		t.Fatal("没有 ECH 配置时仍建立了连接")
+	}
+	if h.Upgrades() != 0 {
+		t.Fatal("服务端收到了未使用 ECH 的连接")
+	}
+}
+
+// TestE2EDialContextTimeout 没有 ECH 配置时拨号会反复刷新配置并重试；DialWithECHContext 的 ctx 超时后
+// 应立即返回，且错误可以识别为超时
+func TestE2EDialContextTimeout(t *testing.T) {
+	h := newHarness(t)
+	h.DoH.Remove(echDomain)
+	m := ech.NewECHManager(echDomain, h.DoH.DNSServer())
+	c := websocket.NewWebSocketClient(h.ServerAddr("/ws"), "", h.Trust(m), h.ServerIP())
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	conn, err := c.DialWithECHContext(ctx, 5)
+	if err == nil {
+		conn.Close()
+		t.Fatal("没有 ECH 配置时仍建立了连接")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("ctx 超时后拨号仍持续了 %v", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, websocket.ErrDialCanceled) {
+		t.Fatalf("返回的错误不是超时: %v", err)
+	}
+}
+
+// TestE2EGREASEDiscovery DNS 没有 ECH 配置时，GREASE 探测应从服务端的 retry_configs 获得可用配置
+func TestE2EGREASEDiscovery(t *testing.T) {
+	h := newHarness(t)
+	h.DoH.Remove(echDomain)
+	m := ech.NewECHManager(echDomain, h.DoH.DNSServer())
+	m.SetDiscovery(&ech.Discovery{ServerName: serverDomain, Addr: h.ServerIP(), RootCAs: h.RootCAs()})
+	if err := m.Prepare(); err != nil {
+		t.Fatalf("探测ECH配置失败: %v", err)
+	}
+	if src := m.Status().Source; !strings.HasPrefix(src, "grease:") {
+		t.Fatalf("ECH 配置来源为 %q", src)
+	}
+	c := websocket.NewWebSocketClient(h.ServerAddr("/ws"), "", h.Trust(m), h.ServerIP())
+	mustDial(t, c, "使用探测到的配置连接失败: %v")
+	expectECHAccepted(t, h)
+}
+
+// TestE2EHTTPSAddrHints 未指定服务端IP时，客户端应使用服务器域名HTTPS记录中的 ipv4hint 连接，
+// 而不依赖系统DNS（测试域名无法由系统解析）
+func TestE2EHTTPSAddrHints(t *testing.T) {
+	h := newHarness(t)
+	h.DoH.SetRecords(serverDomain, echtest.Record{
+		Priority: 1, Target: ".", ALPN: []string{"http/1.1"},
+		IPv4Hint: []net.IP{net.IPv4(127, 0, 0, 1)}, ECH: publishedECH(t, h), TTL: 300,
+	})
+
+	m := prepare(t, serverDomain, h.DoH.DNSServer())
+	if rec := m.Record(); rec == nil || len(rec.ALPN) != 1 || rec.ALPN[0] != "http/1.1" {
+		t.Fatalf("HTTPS记录解析错误: %+v", rec)
+	}
+	c := websocket.NewWebSocketClient(h.ServerAddr("/ws"), "", h.Trust(m), "")
+	mustDial(t, c, "使用地址提示连接失败: %v")
+	expectECHAccepted(t, h)
+}
+
+// TestE2EDoHAddrResolve 未指定服务端IP且HTTPS记录没有地址提示时，客户端应经 DoH 查询服务器的 A 记录，
+// 而不是交给系统DNS（测试域名无法由系统解析）
+func TestE2EDoHAddrResolve(t *testing.T) {
+	h := newHarness(t)
+	h.DoH.SetECH(serverDomain, publishedECH(t, h))
+	h.DoH.SetAddrs(serverDomain, net.IPv4(127, 0, 0, 1))
+
+	m := prepare(t, serverDomain, h.DoH.DNSServer())
+	c := websocket.NewWebSocketClient(h.ServerAddr("/ws"), "", h.Trust(m), "")
+	mustDial(t, c, "经 DoH 解析服务器地址后连接失败: %v")
+	expectECHAccepted(t, h)
+}
+
+func TestE2EFakeResolver(t *testing.T) {
+	h := newHarness(t)
+	r := echtest.NewFakeResolver()
+	r.SetECH(serverDomain, publishedECH(t, h))
+	r.SetAddrs(serverDomain, net.IPv4(127, 0, 0, 1))
+
+	before := h.DoH.Queries()
+	m := prepare(t, serverDomain, h.DoH.DNSServer(), ech.WithResolver(r))
+	c := websocket.NewWebSocketClient(h.ServerAddr("/ws"), "", h.Trust(m), "")
+	mustDial(t, c, "经 FakeResolver 解析服务器地址后连接失败: %v")
+	if n := h.DoH.Queries() - before; n != 0 {
+		t.Fatalf("注入解析器后仍向 DoH 服务器发送了 %d 次查询", n)
+	}
+	expectECHAccepted(t, h)
+}
+
+// TestE2EConnInfo 客户端应能从握手结果确认连接使用了 ECH，且内层名称为隧道域名
+func TestE2EConnInfo(t *testing.T) {
+	h := newHarness(t)
+	c := newClient(t, h, "")
+	conn, info, err := c.DialWithECHInfo(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !info.ECHAccepted {
+		t.Fatalf("握手结果显示未使用 ECH: %s", info)
+	}
+	if info.Version != tls.VersionTLS13 {
+		t.Fatalf("协商的版本为 %s", tls.VersionName(info.Version))
+	}
+	if info.ServerName != serverDomain {
+		t.Fatalf("握手使用的服务器名称为 %q", info.ServerName)
+	}
+	expectECHAccepted(t, h)
+}
+
+// TestE2EHTTPSTarget 启用 SetServiceEndpoint 时，客户端应连接HTTPS记录 TargetName 的地址与 port 参数给出的端口，
+// 而不是 -f 中的主机与端口（这里故意使用错误的端口，且服务器域名本身没有地址记录）
+func TestE2EHTTPSTarget(t *testing.T) {
+	h := newHarness(t)
+	_, port, _ := net.SplitHostPort(h.ServerIP())
+	realPort, _ := strconv.Atoi(port)
+	const origin = "origin.e2e.test"
+	h.DoH.SetRecords(serverDomain, echtest.Record{
+		Priority: 1, Target: origin, Port: uint16(realPort), ECH: publishedECH(t, h), TTL: 300,
+	})
+	h.DoH.SetAddrs(serverDomain)
+	h.DoH.SetAddrs(origin, net.IPv4(127, 0, 0, 1))
+
+	m := prepare(t, serverDomain, h.DoH.DNSServer())
+	c := websocket.NewWebSocketClient(net.JoinHostPort(serverDomain, "1")+"/ws", "", h.Trust(m), "")
+	c.SetServiceEndpoint(true)
+	conn, info, err := c.DialWithECHInfo(2)
+	if err != nil {
+		t.Fatalf("按HTTPS记录的目标连接失败: %v", err)
+	}
+	conn.Close()
+	if want := net.JoinHostPort("127.0.0.1", port); info.Addr != want {
+		t.Fatalf("连接的地址为 %s，应为 %s", info.Addr, want)
+	}
+	if info.ServerName != serverDomain {
+		t.Fatalf("握手使用的服务器名称为 %q", info.ServerName)
+	}
+	expectECHAccepted(t, h)
+}
+
+// TestE2EHappyEyeballs 服务器同时有 IPv6 与 IPv4 地址而 IPv6 不通（连接挂起）时，客户端应在 250ms 后
+// 并行连接 IPv4 并使用先建立的连接，而不是等待 IPv6 超时
+func TestE2EHappyEyeballs(t *testing.T) {
+	h := newHarness(t)
+	h.DoH.SetECH(serverDomain, publishedECH(t, h))
+	h.DoH.SetAddrs(serverDomain, net.IPv4(127, 0, 0, 1), net.ParseIP("2001:db8::1"))
+
+	m := prepare(t, serverDomain, h.DoH.DNSServer())
+	c := websocket.NewWebSocketClient(h.ServerAddr("/ws"), "", h.Trust(m), "")
+	c.SetNetDial(func(network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, "[") {
+			time.Sleep(2 * time.Second)
+			return nil, errors.New("IPv6 不可达")
+		}
+		return net.Dial(network, addr)
+	})
+	start := time.Now()
+	conn, info, err := c.DialWithECHInfo(1)
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("连接耗时 %v，IPv4 没有与 IPv6 竞速", elapsed)
+	}
+	if !strings.HasPrefix(info.Addr, "127.0.0.1:") {
+		t.Fatalf("连接的地址为 %s", info.Addr)
+	}
+
+	c.SetAddressFamily(websocket.FamilyIPv6)
+	ep, err := c.TargetAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ep, "[2001:db8::1]") {
+		t.Fatalf("v6only 时首选节点为 %s", ep)
+	}
+	expectECHAccepted(t, h)
+}
+
+// TestE2EReconnect 服务端回显一条消息后断开，ReconnectingConn 应自动重连并经 OnReconnect 重新握手
+func TestE2EReconnect(t *testing.T) {
+	h := newHarness(t)
+	h.Handler = func(conn *gws.Conn) {
+		if mt, msg, err := conn.ReadMessage(); err == nil {
+			conn.WriteMessage(mt, msg)
+		}
+	}
+	c := newClient(t, h, "")
+	rc, err := c.DialReconnecting(context.Background(), websocket.ReconnectOptions{
+		MinBackoff: 50 * time.Millisecond,
+		OnReconnect: func(conn *gws.Conn) error {
+			return conn.WriteMessage(gws.TextMessage, []byte("again"))
+		},
+	})
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer rc.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		if err := rc.WriteMessage(gws.TextMessage, []byte("first")); err != nil {
+			done <- fmt.Errorf("写入失败: %w", err)
+			return
+		}
+		for _, want := range []string{"first", "again"} {
+			_, msg, err := rc.ReadMessage()
+			if err != nil {
+				done <- fmt.Errorf("读取 %q 失败: %w", want, err)
+				return
+			}
+			if string(msg) != want {
+				done <- fmt.Errorf("读取到 %q，应为 %q", msg, want)
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("等待重连超时")
+	}
+	if n := rc.Reconnects(); n != 1 {
+		t.Fatalf("重连次数为 %d，应为 1", n)
+	}
+}
+
+// TestE2EKeepalive 对端响应 ping 时连接保持；对端不再读取（不回复 pong）时保活应在超时后关闭连接
+func TestE2EKeepalive(t *testing.T) {
+	h := newHarness(t)
+	stop := make(chan struct{})
+	defer close(stop)
+	var conns atomic.Int32
+	h.Handler = func(conn *gws.Conn) {
+		if conns.Add(1) == 1 {
+			// gorilla 在读取时自动回复 pong
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}
+		<-stop
+	}
+	c := newClient(t, h, "")
+	c.SetKeepalive(50*time.Millisecond, 100*time.Millisecond)
+
+	alive, err := c.DialWithECH(2)
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer alive.Close()
+	alive.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+	if _, _, err := alive.ReadMessage(); !isTimeout(err) {
+		t.Fatalf("对端正常响应 pong 时连接出错: %v", err)
+	}
+
+	dead, err := c.DialWithECH(2)
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer dead.Close()
+	start := time.Now()
+	dead.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = dead.ReadMessage()
+	if isTimeout(err) {
+		t.Fatal("对端不响应 pong 时保活没有关闭连接")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("对端失联 %v 后才关闭连接", elapsed)
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// TestE2EPool 连接池应预先建立空闲连接，取出的连接可以直接使用，取出与超过保留时间的连接在后台补充
+func TestE2EPool(t *testing.T) {
+	h := newHarness(t)
+	var accepted atomic.Int32
+	h.Handler = func(conn *gws.Conn) {
+		accepted.Add(1)
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, msg)
+		}
+	}
+	c := newClient(t, h, "")
+	p := c.NewPool(websocket.PoolOptions{Size: 2, HealthInterval: 50 * time.Millisecond, MaxIdle: 300 * time.Millisecond})
+	defer p.Close()
+	waitIdle := func(n int, what string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if p.Stats().Idle == n {
+				return
+			}
+		}
+		t.Fatalf("%s空闲连接数为 %d，应为 %d", what, p.Stats().Idle, n)
+	}
+	waitIdle(2, "")
+
+	conn, err := p.DialWithECH(2)
+	if err != nil {
+		t.Fatalf("取出连接失败: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(gws.BinaryMessage, []byte("pooled")); err != nil {
+		t.Fatalf("写入失败: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "pooled" {
+		t.Fatalf("取出的连接不可用: %q, %v", msg, err)
+	}
+	if st := p.Stats(); st.Hits != 1 {
+		t.Fatalf("命中次数为 %d，应为 1", st.Hits)
+	}
+	waitIdle(2, "取出后没有补充: ")
+
+	// 超过保留时间的空闲连接应被替换
+	before := accepted.Load()
+	time.Sleep(500 * time.Millisecond)
+	waitIdle(2, "")
+	if accepted.Load() < before+2 {
+		t.Fatalf("超过保留时间的空闲连接没有被替换 (服务端共接受 %d 个连接)", accepted.Load())
+	}
+}
+
+// TestE2ECustomHeaders 自定义请求头与 Host 应出现在升级请求中，TLS 服务器名称不受 Host 影响
+func TestE2ECustomHeaders(t *testing.T) {
+	h := newHarness(t)
+	c := newClient(t, h, "")
+	if err := c.SetHeader(http.Header{"Sec-Websocket-Protocol": {"x"}}); err == nil {
+		t.Fatal("允许自定义握手使用的请求头")
+	}
+	header, err := websocket.ParseHeader([]string{"User-Agent: ech-e2e/1.0", "Host: front.example", "Cookie: a=1", "Cookie: b=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetHeader(header); err != nil {
+		t.Fatal(err)
+	}
+	mustDial(t, c, "连接失败: %v")
+	host, got := h.LastUpgrade()
+	if host != "front.example" {
+		t.Fatalf("升级请求的 Host 为 %q", host)
+	}
+	if ua := got.Get("User-Agent"); ua != "ech-e2e/1.0" {
+		t.Fatalf("升级请求的 User-Agent 为 %q", ua)
+	}
+	if cookies := got.Values("Cookie"); len(cookies) != 2 {
+		t.Fatalf("升级请求的 Cookie 为 %q", cookies)
+	}
+	if sni := h.LastServerName(); sni != serverDomain {
+		t.Fatalf("TLS 服务器名称为 %q，应为 %q", sni, serverDomain)
+	}
+}
@@ -0,0 +1,97 @@
+package echtest
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	echVersion        = 0xfe0d
+	kemX25519         = 0x0020
+	kdfHKDFSHA256     = 0x0001
+	aeadAES128GCM     = 0x0001
+	aeadChaCha20      = 0x0003
+	maxNameLength     = 0
+	defaultPublicName = "public.example.com"
+)
+
+// ECHKey 是一组生成的ECH密钥，Config 为单个序列化的 ECHConfig
+type ECHKey struct {
+	Config     []byte
+	PrivateKey []byte
+	PublicName string
+	ConfigID   uint8
+}
+
+// GenerateECHKey 生成基于 X25519 的 ECH 密钥和对应的 ECHConfig
+func GenerateECHKey(publicName string, configID uint8) (*ECHKey, error) {
+	if publicName == "" {
+		publicName = defaultPublicName
+	}
+	if len(publicName) > 255 {
+		return nil, errors.New("public_name 过长")
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey().Bytes()
+
+	contents := make([]byte, 0, 64+len(publicName))
+	contents = append(contents, configID)
+	contents = binary.BigEndian.AppendUint16(contents, kemX25519)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	contents = binary.BigEndian.AppendUint16(contents, 8)
+	contents = binary.BigEndian.AppendUint16(contents, kdfHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, aeadAES128GCM)
+	contents = binary.BigEndian.AppendUint16(contents, kdfHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, aeadChaCha20)
+	contents = append(contents, maxNameLength)
+	contents = append(contents, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0)
+
+	config := make([]byte, 0, 4+len(contents))
+	config = binary.BigEndian.AppendUint16(config, echVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+
+	return &ECHKey{
+		Config:     config,
+		PrivateKey: priv.Bytes(),
+		PublicName: publicName,
+		ConfigID:   configID,
+	}, nil
+}
+
+// ConfigList 返回只包含该密钥配置的 ECHConfigList
+func (k *ECHKey) ConfigList() []byte {
+	return ConfigList(k)
+}
+
+// TLSKey 返回可用于服务端 tls.Config.EncryptedClientHelloKeys 的密钥
+func (k *ECHKey) TLSKey(sendAsRetry bool) tls.EncryptedClientHelloKey {
+	return tls.EncryptedClientHelloKey{
+		Config:      k.Config,
+		PrivateKey:  k.PrivateKey,
+		SendAsRetry: sendAsRetry,
+	}
+}
+
+// ConfigList 将多个密钥的 ECHConfig 拼接为 ECHConfigList
+func ConfigList(keys ...*ECHKey) []byte {
+	var total int
+	for _, k := range keys {
+		total += len(k.Config)
+	}
+	list := make([]byte, 0, 2+total)
+	list = binary.BigEndian.AppendUint16(list, uint16(total))
+	for _, k := range keys {
+		list = append(list, k.Config...)
+	}
+	return list
+}
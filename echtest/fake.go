@@ -0,0 +1,397 @@
+package echtest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"ech-workers/ech"
+	"ech-workers/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// FakeECHProvider 是内存中的ECH配置来源，实现 websocket.ECHProvider
+type FakeECHProvider struct {
+	mu         sync.Mutex
+	list       []byte
+	buildErr   error
+	refreshErr error
+	refreshes  int
+	// OnRefresh 如果不为空，在每次 Refresh 时调用，可用于替换配置
+	OnRefresh func(p *FakeECHProvider)
+}
+
+// NewFakeECHProvider 创建使用固定 ECHConfigList 的配置来源
+func NewFakeECHProvider(echList []byte) *FakeECHProvider {
+	return &FakeECHProvider{list: echList}
+}
+
+// SetECHList 替换当前的 ECHConfigList
+func (p *FakeECHProvider) SetECHList(echList []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.list = echList
+}
+
+// SetErrors 设置 BuildTLSConfig 与 Refresh 返回的错误
+func (p *FakeECHProvider) SetErrors(buildErr, refreshErr error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buildErr = buildErr
+	p.refreshErr = refreshErr
+}
+
+// Refreshes 返回 Refresh 被调用的次数
+func (p *FakeECHProvider) Refreshes() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.refreshes
+}
+
+func (p *FakeECHProvider) GetECHList() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.list) == 0 {
+		return nil, ech.ErrECHNotLoaded
+	}
+	return p.list, nil
+}
+
+func (p *FakeECHProvider) BuildTLSConfig(serverName string) (*tls.Config, error) {
+	p.mu.Lock()
+	buildErr := p.buildErr
+	p.mu.Unlock()
+	if buildErr != nil {
+		return nil, buildErr
+	}
+	list, err := p.GetECHList()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:                     tls.VersionTLS13,
+		ServerName:                     serverName,
+		EncryptedClientHelloConfigList: list,
+	}, nil
+}
+
+func (p *FakeECHProvider) Refresh() error {
+	p.mu.Lock()
+	p.refreshes++
+	hook := p.OnRefresh
+	refreshErr := p.refreshErr
+	p.mu.Unlock()
+	if hook != nil {
+		hook(p)
+	}
+	return refreshErr
+}
+
+// FakeResolver 是内存中的DNS解析器，实现 ech.Resolver。以 ech.WithResolver 注入 ECHManager 后，
+// ECH配置与服务器地址都从这里返回而不产生网络请求
+type FakeResolver struct {
+	mu      sync.Mutex
+	https   map[string][]ech.HTTPSRecord
+	a       map[string][]net.IP
+	aaaa    map[string][]net.IP
+	err     error
+	queries int
+}
+
+// NewFakeResolver 创建没有任何记录的解析器
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{
+		https: make(map[string][]ech.HTTPSRecord),
+		a:     make(map[string][]net.IP),
+		aaaa:  make(map[string][]net.IP),
+	}
+}
+
+// SetECH 为域名设置一条携带 ECHConfigList 的 HTTPS 记录
+func (r *FakeResolver) SetECH(domain string, echList []byte) {
+	r.SetHTTPS(domain, ech.HTTPSRecord{Priority: 1, Target: ".", ECH: echList})
+}
+
+// SetHTTPS 替换域名的全部 HTTPS 记录
+func (r *FakeResolver) SetHTTPS(domain string, records ...ech.HTTPSRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.https[canonicalName(domain)] = records
+}
+
+// SetAddrs 设置域名的地址，按 IPv4 与 IPv6 分别作为 A 与 AAAA 记录返回
+func (r *FakeResolver) SetAddrs(domain string, ips ...net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.To4())
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	r.a[canonicalName(domain)] = v4
+	r.aaaa[canonicalName(domain)] = v6
+}
+
+// SetError 使之后的查询都返回 err，传入 nil 恢复正常
+func (r *FakeResolver) SetError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// Queries 返回收到的查询次数
+func (r *FakeResolver) Queries() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries
+}
+
+func (r *FakeResolver) QueryHTTPS(ctx context.Context, domain string) ([]ech.HTTPSRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return append([]ech.HTTPSRecord(nil), r.https[canonicalName(domain)]...), nil
+}
+
+func (r *FakeResolver) QueryA(ctx context.Context, domain string) ([]net.IP, error) {
+	return r.queryAddr(r.a, domain)
+}
+
+func (r *FakeResolver) QueryAAAA(ctx context.Context, domain string) ([]net.IP, error) {
+	return r.queryAddr(r.aaaa, domain)
+}
+
+func (r *FakeResolver) queryAddr(records map[string][]net.IP, domain string) ([]net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return append([]net.IP(nil), records[canonicalName(domain)]...), nil
+}
+
+// PipeTransport 是基于 net.Pipe 的假传输层，实现 proxy.WebSocketClient。
+// 每次拨号都会在内存中完成 WebSocket 升级，并把服务端连接交给 Handler。
+type PipeTransport struct {
+	Handler func(conn *websocket.Conn)
+
+	mu      sync.Mutex
+	dials   int
+	dialErr error
+}
+
+// NewPipeTransport 创建假传输层，handler 为空时使用 EchoWorker
+func NewPipeTransport(handler func(conn *websocket.Conn)) *PipeTransport {
+	if handler == nil {
+		handler = EchoWorker
+	}
+	return &PipeTransport{Handler: handler}
+}
+
+// SetDialError 使之后的拨号直接返回 err，传入 nil 恢复正常
+func (t *PipeTransport) SetDialError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dialErr = err
+}
+
+// Dials 返回拨号次数
+func (t *PipeTransport) Dials() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dials
+}
+
+func (t *PipeTransport) DialWithECH(maxRetries int) (*websocket.Conn, error) {
+	t.mu.Lock()
+	t.dials++
+	dialErr := t.dialErr
+	t.mu.Unlock()
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	clientConn, serverConn := net.Pipe()
+	go t.serve(serverConn)
+
+	dialer := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return clientConn, nil
+		},
+	}
+	wsConn, _, err := dialer.Dial("ws://pipe/", nil)
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	return wsConn, nil
+}
+
+func (t *PipeTransport) serve(conn net.Conn) {
+	upgrader := websocket.Upgrader{}
+	ln := &singleListener{conn: conn, done: make(chan struct{})}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer ln.Close()
+			wsConn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer wsConn.Close()
+			t.Handler(wsConn)
+		}),
+	}
+	srv.Serve(ln)
+}
+
+// EchoWorker 模拟 Worker 端协议：响应 CONNECT 后回显收到的全部数据
+func EchoWorker(conn *websocket.Conn) {
+	features := map[string]bool{}
+	connected := false
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if mt == websocket.TextMessage {
+			text := string(msg)
+			switch {
+			case strings.HasPrefix(text, protocol.HelloPrefix):
+				var hello protocol.Hello
+				json.Unmarshal(msg[len(protocol.HelloPrefix):], &hello)
+				accepted := []string{}
+				for _, f := range hello.Features {
+					if f == protocol.FeatureAddressFrame || f == protocol.FeatureHalfClose || f == protocol.FeatureHeartbeat || f == protocol.FeatureCloseCode || f == protocol.FeatureReauth {
+						features[f] = true
+						accepted = append(accepted, f)
+					}
+				}
+				reply := protocol.Hello{Version: protocol.MaxVersion, Features: accepted}
+				// 回显不改变消息内容，因此可以接受任意压缩算法
+				if len(hello.Compression) > 0 {
+					reply.Compression = hello.Compression[:1]
+					reply.Level = hello.Level
+				}
+				payload, _ := json.Marshal(reply)
+				if err := conn.WriteMessage(websocket.TextMessage, append([]byte(protocol.HelloPrefix), payload...)); err != nil {
+					return
+				}
+			case strings.HasPrefix(text, "CONNECT:"):
+				parts := strings.SplitN(text[len("CONNECT:"):], "|", 3)
+				if parts[0] == "" {
+					conn.WriteMessage(websocket.TextMessage, []byte("ERROR:无效的目标地址"))
+					return
+				}
+				var earlyData []byte
+				if len(parts) > 1 {
+					earlyData = []byte(parts[1])
+				}
+				connected = true
+				if !echoConnected(conn, earlyData) {
+					return
+				}
+			case text == protocol.MessageClose || strings.HasPrefix(text, protocol.MessageClose+":"):
+				if features[protocol.FeatureCloseCode] {
+					conn.WriteMessage(websocket.TextMessage, protocol.EncodeClose(protocol.CloseNormal, ""))
+				} else {
+					conn.WriteMessage(websocket.TextMessage, []byte(protocol.MessageClose))
+				}
+				return
+			case strings.HasPrefix(text, protocol.AuthPrefix) && features[protocol.FeatureReauth]:
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(protocol.AuthOK)); err != nil {
+					return
+				}
+			case strings.HasPrefix(text, protocol.PingPrefix) && features[protocol.FeatureHeartbeat]:
+				pong := fmt.Sprintf("%s%s|%d", protocol.PongPrefix, text[len(protocol.PingPrefix):], time.Now().UnixMilli())
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(pong)); err != nil {
+					return
+				}
+			case text == protocol.MessageFIN && features[protocol.FeatureHalfClose]:
+				// 回显数据均已写出，直接结束另一方向
+				conn.WriteMessage(websocket.TextMessage, []byte(protocol.MessageFIN))
+				return
+			}
+			continue
+		}
+		if !connected && features[protocol.FeatureAddressFrame] {
+			req, err := protocol.DecodeConnectRequest(msg)
+			if err != nil {
+				conn.WriteMessage(websocket.TextMessage, []byte("ERROR:"+err.Error()))
+				return
+			}
+			connected = true
+			if !echoConnected(conn, req.EarlyData) {
+				return
+			}
+			continue
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+			return
+		}
+	}
+}
+
+func echoConnected(conn *websocket.Conn, earlyData []byte) bool {
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("CONNECTED")); err != nil {
+		return false
+	}
+	if len(earlyData) > 0 {
+		if err := conn.WriteMessage(websocket.BinaryMessage, earlyData); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// singleListener 只返回一次预先建立的连接
+type singleListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+	done chan struct{}
+}
+
+func (l *singleListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *singleListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
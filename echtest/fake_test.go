@@ -0,0 +1,174 @@
+package echtest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"ech-workers/ech"
+	"ech-workers/echtest"
+	"ech-workers/proxy"
+	"ech-workers/websocket"
+
+	gws "github.com/gorilla/websocket"
+)
+
+var (
+	_ websocket.ECHProvider = (*echtest.FakeECHProvider)(nil)
+	_ proxy.WebSocketClient = (*echtest.PipeTransport)(nil)
+)
+
+func TestFakeECHProvider(t *testing.T) {
+	p := echtest.NewFakeECHProvider(nil)
+	if _, err := p.BuildTLSConfig("server.example"); !errors.Is(err, ech.ErrECHNotLoaded) {
+		t.Fatalf("没有配置时 BuildTLSConfig 返回 %v", err)
+	}
+
+	key, err := echtest.GenerateECHKey("public.example", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := key.ConfigList()
+	p.OnRefresh = func(p *echtest.FakeECHProvider) { p.SetECHList(list) }
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Refreshes(); n != 1 {
+		t.Fatalf("刷新次数为 %d，应为 1", n)
+	}
+	cfg, err := p.BuildTLSConfig("server.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerName != "server.example" || cfg.MinVersion != tls.VersionTLS13 || !bytes.Equal(cfg.EncryptedClientHelloConfigList, list) {
+		t.Fatalf("TLS 配置为 %+v", cfg)
+	}
+
+	buildErr, refreshErr := errors.New("build"), errors.New("refresh")
+	p.SetErrors(buildErr, refreshErr)
+	if _, err := p.BuildTLSConfig("server.example"); err != buildErr {
+		t.Fatalf("BuildTLSConfig 返回 %v", err)
+	}
+	if err := p.Refresh(); err != refreshErr {
+		t.Fatalf("Refresh 返回 %v", err)
+	}
+}
+
+// readMessage 读取下一条消息，超时视为失败
+func readMessage(t *testing.T, conn *gws.Conn) (int, string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	mt, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mt, string(msg)
+}
+
+func TestPipeTransportEchoWorker(t *testing.T) {
+	tr := echtest.NewPipeTransport(nil)
+	conn, err := tr.DialWithECH(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(gws.TextMessage, []byte("CONNECT:echo.example:443|early")); err != nil {
+		t.Fatal(err)
+	}
+	if mt, msg := readMessage(t, conn); mt != gws.TextMessage || msg != "CONNECTED" {
+		t.Fatalf("CONNECT 的响应为 %q", msg)
+	}
+	if mt, msg := readMessage(t, conn); mt != gws.BinaryMessage || msg != "early" {
+		t.Fatalf("首帧数据的回显为 %q", msg)
+	}
+	if err := conn.WriteMessage(gws.BinaryMessage, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg := readMessage(t, conn); msg != "payload" {
+		t.Fatalf("回显为 %q", msg)
+	}
+	if n := tr.Dials(); n != 1 {
+		t.Fatalf("拨号次数为 %d，应为 1", n)
+	}
+
+	dialErr := errors.New("拨号失败")
+	tr.SetDialError(dialErr)
+	if _, err := tr.DialWithECH(1); err != dialErr {
+		t.Fatalf("设置拨号错误后 DialWithECH 返回 %v", err)
+	}
+	tr.SetDialError(nil)
+	conn2, err := tr.DialWithECH(1)
+	if err != nil {
+		t.Fatalf("清除拨号错误后仍然失败: %v", err)
+	}
+	conn2.Close()
+}
+
+func TestPipeTransportHandler(t *testing.T) {
+	tr := echtest.NewPipeTransport(func(conn *gws.Conn) {
+		if _, msg, err := conn.ReadMessage(); err == nil {
+			conn.WriteMessage(gws.TextMessage, append([]byte("re: "), msg...))
+		}
+	})
+	conn, err := tr.DialWithECH(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(gws.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg := readMessage(t, conn); msg != "re: hello" {
+		t.Fatalf("读取到 %q", msg)
+	}
+}
+
+var _ ech.Resolver = (*echtest.FakeResolver)(nil)
+
+func TestFakeResolver(t *testing.T) {
+	list := generateKey(t, 1).ConfigList()
+	r := echtest.NewFakeResolver()
+	r.SetHTTPS("ech.example", ech.HTTPSRecord{Priority: 1, Target: ".", ALPN: []string{"h2"}, ECH: list})
+	r.SetAddrs("server.example", net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1"))
+
+	// DoH 地址不可解析，所有查询都必须由 r 回答；查询失败时不重试，避免等待退避
+	noRetry := ech.WithRetryPolicy(ech.RetryPolicy{Attempts: 1})
+	m := ech.NewECHManager("ech.example", "https://dns.invalid/dns-query", ech.WithResolver(r), noRetry)
+	if err := m.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m.GetECHList(); !bytes.Equal(got, list) {
+		t.Fatal("获取的ECH配置与设置的不一致")
+	}
+	if rec := m.Record(); rec == nil || len(rec.ALPN) != 1 || rec.ALPN[0] != "h2" {
+		t.Fatalf("HTTPS记录为 %+v", rec)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := m.QueryAddr(ctx, "server.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("解析结果为 %v", ips)
+	}
+	queries := r.Queries()
+	if queries < 3 {
+		t.Fatalf("收到 %d 次查询", queries)
+	}
+
+	r.SetError(errors.New("解析失败"))
+	m = ech.NewECHManager("ech.example", "https://dns.invalid/dns-query", ech.WithResolver(r), noRetry)
+	if err := m.Prepare(); err == nil {
+		t.Fatal("解析器出错时 Prepare 仍然成功")
+	}
+	if r.Queries() == queries {
+		t.Fatal("出错的查询没有计数")
+	}
+}
@@ -0,0 +1,364 @@
+package echtest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ECHTLSConfigBuilder 与 websocket.ECHProvider 相同，避免 echtest 依赖 websocket 包
+type ECHTLSConfigBuilder interface {
+	BuildTLSConfig(serverName string) (*tls.Config, error)
+	Refresh() error
+}
+
+// Harness 在进程内模拟完整的服务端：启用 ECH 的 TLS 服务器接受 WebSocket 升级并交给 Handler，
+// 对应的 ECHConfigList 通过模拟 DoH 服务器发布。客户端使用真实的 ECH 管理器、
+// WebSocket 客户端与代理即可走通完整的拨号与转发路径，无需外部设施。
+type Harness struct {
+	// Domain 隧道服务器域名（内层 SNI），ECHDomain 为发布 ECH 配置的域名
+	Domain    string
+	ECHDomain string
+	DoH       *DoHServer
+	// Handler 处理升级后的连接，默认为 EchoWorker
+	Handler func(conn *websocket.Conn)
+
+	listener net.Listener
+	roots    *x509.CertPool
+	cert     tls.Certificate
+
+	mu        sync.Mutex
+	keys      []*ECHKey
+	token     string
+	upgrades  int
+	accepted  int
+	lastInner string
+	lastReq   *http.Request
+}
+
+// NewHarness 生成 ECH 密钥与自签名证书，启动 TLS 服务器和 DoH 服务器，使用完毕后需调用 Close
+func NewHarness(domain, echDomain string) (*Harness, error) {
+	key, err := GenerateECHKey("", 1)
+	if err != nil {
+		return nil, err
+	}
+	cert, roots, err := selfSignedCert(domain, key.PublicName)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	h := &Harness{
+		Domain:    domain,
+		ECHDomain: echDomain,
+		DoH:       NewDoHServer(),
+		Handler:   EchoWorker,
+		listener:  ln,
+		roots:     roots,
+		cert:      cert,
+		keys:      []*ECHKey{key},
+	}
+	h.DoH.SetECH(echDomain, key.ConfigList())
+
+	srv := &http.Server{Handler: http.HandlerFunc(h.serveWS)}
+	go srv.Serve(&tlsListener{Listener: ln, h: h})
+	return h, nil
+}
+
+// Close 关闭 TLS 服务器与 DoH 服务器
+func (h *Harness) Close() {
+	h.listener.Close()
+	h.DoH.Close()
+}
+
+// ServerAddr 返回可作为 -f 使用的服务器地址，path 为 WebSocket 路径
+func (h *Harness) ServerAddr(path string) string {
+	_, port, _ := net.SplitHostPort(h.listener.Addr().String())
+	return net.JoinHostPort(h.Domain, port) + path
+}
+
+// ServerIP 返回实际监听地址，作为 -ip 使用
+func (h *Harness) ServerIP() string {
+	return h.listener.Addr().String()
+}
+
+// SetToken 设置服务端要求的令牌（WebSocket 子协议），为空时不验证
+func (h *Harness) SetToken(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.token = token
+}
+
+// RotateKey 生成新的 ECH 密钥并立即停用旧密钥。publish 为 true 时同时更新 DoH 记录；
+// 为 false 时只有服务端换了密钥，客户端需依靠 retry_configs 或之后的刷新恢复
+func (h *Harness) RotateKey(publish bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key, err := GenerateECHKey(h.keys[0].PublicName, h.keys[0].ConfigID+1)
+	if err != nil {
+		return err
+	}
+	h.keys = []*ECHKey{key}
+	if publish {
+		h.DoH.SetECH(h.ECHDomain, key.ConfigList())
+	}
+	return nil
+}
+
+// PublishCurrentKey 把服务端当前使用的 ECH 配置发布到 DoH
+func (h *Harness) PublishCurrentKey() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.DoH.SetECH(h.ECHDomain, ConfigList(h.keys...))
+}
+
+// Upgrades 返回成功升级的 WebSocket 连接数，ECHAccepted 为其中 ECH 被接受的连接数
+func (h *Harness) Upgrades() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.upgrades
+}
+
+func (h *Harness) ECHAccepted() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.accepted
+}
+
+// LastServerName 返回最近一次握手中服务端看到的（内层）SNI
+func (h *Harness) LastServerName() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastInner
+}
+
+// LastUpgrade 返回最近一次 WebSocket 升级请求的 Host 与请求头，没有请求时 header 为 nil
+func (h *Harness) LastUpgrade() (host string, header http.Header) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastReq == nil {
+		return "", nil
+	}
+	return h.lastReq.Host, h.lastReq.Header.Clone()
+}
+
+// RootCAs 返回信任本服务器自签名证书的证书池
+func (h *Harness) RootCAs() *x509.CertPool {
+	return h.roots
+}
+
+// Trust 包装 ECH 配置来源，使其构建的 TLS 配置信任本服务器的自签名证书
+func (h *Harness) Trust(p ECHTLSConfigBuilder) ECHTLSConfigBuilder {
+	return &trustingProvider{ECHTLSConfigBuilder: p, roots: h.roots}
+}
+
+type trustingProvider struct {
+	ECHTLSConfigBuilder
+	roots *x509.CertPool
+}
+
+// ApplyRetryConfigs 转发给被包装的配置来源，使其仍能接收 retry_configs
+func (p *trustingProvider) ApplyRetryConfigs(list []byte) error {
+	applier, ok := p.ECHTLSConfigBuilder.(interface{ ApplyRetryConfigs(list []byte) error })
+	if !ok {
+		return errors.New("配置来源不支持 retry_configs")
+	}
+	return applier.ApplyRetryConfigs(list)
+}
+
+// AddrHints 转发给被包装的配置来源，使拨号仍能使用HTTPS记录的地址提示
+func (p *trustingProvider) AddrHints(host string) []net.IP {
+	if hinter, ok := p.ECHTLSConfigBuilder.(interface{ AddrHints(host string) []net.IP }); ok {
+		return hinter.AddrHints(host)
+	}
+	return nil
+}
+
+// QueryAddr 转发给被包装的配置来源，使拨号仍经 DoH 解析服务器地址
+func (p *trustingProvider) QueryAddr(ctx context.Context, host string) ([]net.IP, error) {
+	if resolver, ok := p.ECHTLSConfigBuilder.(interface {
+		QueryAddr(ctx context.Context, host string) ([]net.IP, error)
+	}); ok {
+		return resolver.QueryAddr(ctx, host)
+	}
+	return nil, errors.New("配置来源不支持地址解析")
+}
+
+// ServiceEndpoint 转发给被包装的配置来源，使拨号仍能使用HTTPS记录的 TargetName 与 port 参数
+func (p *trustingProvider) ServiceEndpoint(host string) (string, uint16) {
+	if e, ok := p.ECHTLSConfigBuilder.(interface {
+		ServiceEndpoint(host string) (string, uint16)
+	}); ok {
+		return e.ServiceEndpoint(host)
+	}
+	return "", 0
+}
+
+// RefreshContext 转发给被包装的配置来源，使拨号的 ctx 仍能中止配置刷新
+func (p *trustingProvider) RefreshContext(ctx context.Context) error {
+	if r, ok := p.ECHTLSConfigBuilder.(interface {
+		RefreshContext(ctx context.Context) error
+	}); ok {
+		return r.RefreshContext(ctx)
+	}
+	return p.Refresh()
+}
+
+// ReportECH 转发给被包装的配置来源，使备用域名的切换在测试中同样生效
+func (p *trustingProvider) ReportECH(accepted bool) {
+	if r, ok := p.ECHTLSConfigBuilder.(interface{ ReportECH(accepted bool) }); ok {
+		r.ReportECH(accepted)
+	}
+}
+
+// BuildTLSConfigVersion 转发给被包装的配置来源，使拨号日志仍能记录配置版本
+func (p *trustingProvider) BuildTLSConfigVersion(serverName string) (*tls.Config, uint64, error) {
+	v, ok := p.ECHTLSConfigBuilder.(interface {
+		BuildTLSConfigVersion(serverName string) (*tls.Config, uint64, error)
+	})
+	if !ok {
+		cfg, err := p.BuildTLSConfig(serverName)
+		return cfg, 0, err
+	}
+	cfg, version, err := v.BuildTLSConfigVersion(serverName)
+	if err != nil {
+		return nil, 0, err
+	}
+	cfg.RootCAs = p.roots
+	return cfg, version, nil
+}
+
+// BuildFallbackTLSConfig 转发给被包装的配置来源，回退连接同样信任本服务器的证书
+func (p *trustingProvider) BuildFallbackTLSConfig(serverName string) (*tls.Config, error) {
+	b, ok := p.ECHTLSConfigBuilder.(interface {
+		BuildFallbackTLSConfig(serverName string) (*tls.Config, error)
+	})
+	if !ok {
+		return &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName, RootCAs: p.roots}, nil
+	}
+	cfg, err := b.BuildFallbackTLSConfig(serverName)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RootCAs = p.roots
+	return cfg, nil
+}
+
+func (p *trustingProvider) BuildTLSConfig(serverName string) (*tls.Config, error) {
+	cfg, err := p.ECHTLSConfigBuilder.BuildTLSConfig(serverName)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RootCAs = p.roots
+	return cfg, nil
+}
+
+// tlsListener 按接受连接时的密钥为每个连接创建 TLS 配置，使 RotateKey 立即生效
+type tlsListener struct {
+	net.Listener
+	h *Harness
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.h.tlsConfig()), nil
+}
+
+func (h *Harness) tlsConfig() *tls.Config {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]tls.EncryptedClientHelloKey, 0, len(h.keys))
+	for _, k := range h.keys {
+		keys = append(keys, k.TLSKey(true))
+	}
+	return &tls.Config{
+		MinVersion:               tls.VersionTLS13,
+		Certificates:             []tls.Certificate{h.cert},
+		EncryptedClientHelloKeys: keys,
+	}
+}
+
+func (h *Harness) serveWS(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	token := h.token
+	h.mu.Unlock()
+	if token != "" && !containsToken(websocket.Subprotocols(r), token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	upgrader := websocket.Upgrader{Subprotocols: websocket.Subprotocols(r)}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	h.mu.Lock()
+	h.upgrades++
+	h.lastReq = r
+	if r.TLS != nil {
+		h.lastInner = r.TLS.ServerName
+		if r.TLS.ECHAccepted {
+			h.accepted++
+		}
+	}
+	handler := h.Handler
+	h.mu.Unlock()
+	handler(conn)
+}
+
+func containsToken(protocols []string, token string) bool {
+	for _, p := range protocols {
+		if p == token {
+			return true
+		}
+	}
+	return false
+}
+
+// selfSignedCert 生成同时覆盖 names 的自签名证书，并返回信任它的证书池
+func selfSignedCert(names ...string) (tls.Certificate, *x509.CertPool, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, roots, nil
+}
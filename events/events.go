@@ -0,0 +1,120 @@
+// Package events 发布运行期间的重要事件（隧道断开/恢复、ECH刷新、节点切换、认证失败等），
+// 便于嵌入本客户端的程序以编程方式响应。
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Type string
+
+const (
+	TunnelUp         Type = "tunnel_up"
+	TunnelDown       Type = "tunnel_down"
+	TunnelStalled    Type = "tunnel_stalled"
+	ECHRefreshed     Type = "ech_refreshed"
+	ECHRefreshFailed Type = "ech_refresh_failed"
+	EndpointSwitched Type = "endpoint_switched"
+	EndpointDrained  Type = "endpoint_drained"
+	AuthFailed       Type = "auth_failed"
+)
+
+type Event struct {
+	Type    Type
+	Time    time.Time
+	Message string
+	Err     error
+}
+
+// subscriberBuffer 每个订阅者的事件缓冲，缓冲满时丢弃新事件以免阻塞发布方
+const subscriberBuffer = 64
+
+type Bus struct {
+	mu      sync.RWMutex
+	nextID  int
+	subs    map[int]chan Event
+	dropped atomic.Uint64
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[int]chan Event)}
+}
+
+// Publish 发布事件，不会阻塞
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Chan 订阅事件通道，调用返回的 cancel 取消订阅并关闭通道
+func (b *Bus) Chan() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = ch
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// Subscribe 以回调方式订阅事件，回调在独立的goroutine中按顺序执行
+func (b *Bus) Subscribe(fn func(Event)) func() {
+	ch, cancel := b.Chan()
+	go func() {
+		for e := range ch {
+			fn(e)
+		}
+	}()
+	return cancel
+}
+
+// Dropped 返回因订阅者处理过慢而丢弃的事件数
+func (b *Bus) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+var defaultBus = NewBus()
+
+// Default 返回全局事件总线
+func Default() *Bus {
+	return defaultBus
+}
+
+func Publish(e Event) {
+	defaultBus.Publish(e)
+}
+
+func Chan() (<-chan Event, func()) {
+	return defaultBus.Chan()
+}
+
+func Subscribe(fn func(Event)) func() {
+	return defaultBus.Subscribe(fn)
+}
+
+// Emit 发布指定类型的事件
+func Emit(t Type, message string, err error) {
+	defaultBus.Publish(Event{Type: t, Message: message, Err: err})
+}
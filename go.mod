@@ -2,4 +2,18 @@ module ech-workers
 
 go 1.24.10
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.18.0
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/crypto v0.41.0
+)
+
+require golang.org/x/sys v0.35.0
+
+require github.com/quic-go/qpack v0.6.0 // indirect
+
+require (
+	golang.org/x/net v0.43.0
+	golang.org/x/text v0.28.0 // indirect
+)
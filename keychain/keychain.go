@@ -0,0 +1,37 @@
+// Package keychain 从操作系统凭据存储读取和保存令牌：
+// Windows 凭据管理器、macOS 钥匙串、Linux 上通过 secret-tool 访问 libsecret。
+package keychain
+
+import (
+	"errors"
+	"strings"
+)
+
+// Service 保存凭据时使用的服务名
+const Service = "ech-workers"
+
+// ErrNotFound 凭据存储中没有该账户
+var ErrNotFound = errors.New("凭据存储中未找到该账户")
+
+// ErrUnsupported 当前系统不支持凭据存储
+var ErrUnsupported = errors.New("当前系统不支持凭据存储")
+
+// Get 读取账户对应的令牌
+func Get(account string) (string, error) {
+	if account == "" {
+		return "", errors.New("账户名不能为空")
+	}
+	secret, err := get(Service, account)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(secret, "\r\n"), nil
+}
+
+// Set 保存账户对应的令牌，已存在时覆盖
+func Set(account, secret string) error {
+	if account == "" {
+		return errors.New("账户名不能为空")
+	}
+	return set(Service, account, secret)
+}
@@ -0,0 +1,40 @@
+package keychain
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// macOS 通过系统自带的 security 命令访问登录钥匙串
+
+func get(service, account string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("读取钥匙串失败: %w", err)
+	}
+	return string(out), nil
+}
+
+// set 写入钥匙串。令牌不能出现在命令行参数中（任何本地用户都能用 ps 看到），因此 -w 放在最后且不带值，
+// security 随后提示输入并再次确认密码，两次都从标准输入写入。子进程在新的会话中运行，没有控制终端，
+// 提示才会从标准输入而不是 /dev/tty 读取
+func set(service, account, secret string) error {
+	if strings.ContainsAny(secret, "\r\n") {
+		return errors.New("写入钥匙串失败: 令牌不能包含换行")
+	}
+	cmd := exec.Command("security", "add-generic-password", "-U", "-s", service, "-a", account, "-w")
+	cmd.Stdin = strings.NewReader(secret + "\n" + secret + "\n")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("写入钥匙串失败: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package keychain
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Linux 通过 libsecret 的 secret-tool 命令访问 Secret Service（GNOME Keyring、KWallet 等）
+
+func get(service, account string) (string, error) {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return "", fmt.Errorf("%w: 未找到 secret-tool (libsecret-tools)", ErrUnsupported)
+	}
+	out, err := exec.Command("secret-tool", "lookup", "service", service, "account", account).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(out) == 0 {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("读取凭据失败: %w", err)
+	}
+	return string(out), nil
+}
+
+func set(service, account, secret string) error {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return fmt.Errorf("%w: 未找到 secret-tool (libsecret-tools)", ErrUnsupported)
+	}
+	cmd := exec.Command("secret-tool", "store", "--label", service+" "+account, "service", service, "account", account)
+	cmd.Stdin = strings.NewReader(secret)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("写入凭据失败: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !linux && !windows
+
+package keychain
+
+func get(service, account string) (string, error) {
+	return "", ErrUnsupported
+}
+
+func set(service, account, secret string) error {
+	return ErrUnsupported
+}
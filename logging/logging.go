@@ -0,0 +1,136 @@
+// Package logging 为标准库 log 提供去重与限速：同类消息（忽略其中的数字）
+// 在一个时间窗口内超过一定条数后不再输出，窗口结束时汇总被抑制的条数，
+// 避免隧道断开时重试循环刷屏而淹没真正的事件。
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// DefaultWindow 默认的统计窗口
+	DefaultWindow = 10 * time.Second
+	// DefaultBurst 每个窗口内同类消息最多输出的条数
+	DefaultBurst = 3
+
+	timeLayout = "2006/01/02 15:04:05 "
+)
+
+type entry struct {
+	start      time.Time
+	count      int
+	suppressed int
+	last       string
+}
+
+// Writer 去重限速的日志输出，自行添加时间戳，需配合 log.SetFlags(0) 使用
+type Writer struct {
+	mu      sync.Mutex
+	out     io.Writer
+	window  time.Duration
+	burst   int
+	entries map[string]*entry
+}
+
+// NewWriter 创建写入 out 的去重输出，window 内同类消息最多输出 burst 条
+func NewWriter(out io.Writer, window time.Duration, burst int) *Writer {
+	if burst < 1 {
+		burst = DefaultBurst
+	}
+	return &Writer{
+		out:     out,
+		window:  window,
+		burst:   burst,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Install 替换标准库 log 的输出并在后台定期汇总被抑制的消息，window 为 0 时不做任何处理
+func Install(out io.Writer, window time.Duration) *Writer {
+	if window <= 0 {
+		return nil
+	}
+	w := NewWriter(out, window, DefaultBurst)
+	log.SetFlags(0)
+	log.SetOutput(w)
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.Flush()
+		}
+	}()
+	return w
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	key := normalize(msg)
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e, ok := w.entries[key]
+	if ok && now.Sub(e.start) >= w.window {
+		w.summarizeLocked(e, now)
+		ok = false
+	}
+	if !ok {
+		e = &entry{start: now}
+		w.entries[key] = e
+	}
+	e.count++
+	e.last = msg
+	if e.count > w.burst {
+		e.suppressed++
+		return len(p), nil
+	}
+	_, err := fmt.Fprintf(w.out, "%s%s\n", now.Format(timeLayout), msg)
+	return len(p), err
+}
+
+// Flush 输出所有已结束窗口的汇总，并清理过期的记录
+func (w *Writer) Flush() {
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, e := range w.entries {
+		if now.Sub(e.start) < w.window {
+			continue
+		}
+		w.summarizeLocked(e, now)
+		delete(w.entries, key)
+	}
+}
+
+func (w *Writer) summarizeLocked(e *entry, now time.Time) {
+	if e.suppressed == 0 {
+		return
+	}
+	fmt.Fprintf(w.out, "%s[日志] 以下同类消息在 %v 内被抑制 %d 次: %s\n",
+		now.Format(timeLayout), now.Sub(e.start).Round(time.Second), e.suppressed, e.last)
+}
+
+// normalize 把连续的数字替换为 #，使 "(1/5)" 与 "(2/5)" 这类消息归为一类
+func normalize(msg string) string {
+	var b strings.Builder
+	inDigits := false
+	for _, r := range msg {
+		if unicode.IsDigit(r) {
+			if !inDigits {
+				b.WriteByte('#')
+			}
+			inDigits = true
+			continue
+		}
+		inDigits = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
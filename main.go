@@ -1,53 +1,890 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"image/png"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"ech-workers/admin"
+	"ech-workers/app"
+	"ech-workers/audit"
+	"ech-workers/auth"
+	"ech-workers/breaker"
 	"ech-workers/config"
+	"ech-workers/dialer"
+	"ech-workers/doctor"
 	"ech-workers/ech"
+	"ech-workers/events"
+	"ech-workers/keychain"
+	"ech-workers/logging"
+	"ech-workers/protocol"
 	"ech-workers/proxy"
-	"ech-workers/websocket"
+	"ech-workers/qr"
+	"ech-workers/route"
+	"ech-workers/stats"
+	"ech-workers/status"
+	"ech-workers/supervisor"
+	"ech-workers/transport"
+	"ech-workers/update"
 )
 
 func main() {
 	cfg := &config.Config{}
 
-	flag.StringVar(&cfg.ListenAddr, "l", "127.0.0.1:30000", "代理监听地址 (支持SOCKS5和HTTP)")
+	flag.StringVar(&cfg.ListenAddr, "l", "127.0.0.1:30000", "代理监听地址 (支持SOCKS5、SOCKS4/4a和HTTP)")
 	flag.StringVar(&cfg.ServerAddr, "f", "", "服务端地址 (格式: x.x.workers.dev:443)")
-	flag.StringVar(&cfg.ServerIP, "ip", "", "指定服务端IP（绕过DNS解析）")
+	flag.StringVar(&cfg.ServerIP, "ip", "", "指定服务端IP（绕过DNS解析），多个以逗号分隔时按顺序使用，故障节点自动跳过；未指定时服务器地址同样经加密DNS解析")
 	flag.StringVar(&cfg.Token, "token", "", "身份验证令牌")
-	flag.StringVar(&cfg.DNSServer, "dns", "dns.alidns.com/dns-query", "ECH查询DoH服务器")
-	flag.StringVar(&cfg.ECHDomain, "ech", "cloudflare-ech.com", "ECH查询域名")
+	flag.StringVar(&cfg.TOTPSecret, "totp", "", "TOTP 共享密钥，握手时使用基于时间的一次性令牌代替固定令牌")
+	flag.StringVar(&cfg.TokenFile, "token-file", "", "从文件读取身份验证令牌，文件变化时自动轮换（不中断已建立的连接）")
+	flag.StringVar(&cfg.DNSServer, "dns", "dns.alidns.com/dns-query", "ECH查询DoH服务器 (tls://host:853 为 DNS-over-TLS，quic://host:853 为 DNS-over-QUIC，json://host/resolve 为 JSON 格式的 DoH)，逗号分隔多个时按顺序故障转移")
+	flag.StringVar(&cfg.ODoHProxy, "odoh", "", "Oblivious DoH 代理地址，HTTPS记录查询经代理转发给 -dns 指定的ODoH目标 (如 odoh-relay.example/proxy)")
+	flag.StringVar(&cfg.DNSFallback, "dns-fallback", "", "所有DoH服务器都不可达时改用的明文DNS服务器 (UDP，应答截断时改用TCP)，如 223.5.5.5:53")
+	flag.BoolVar(&cfg.DNS0x20, "dns-0x20", false, "明文DNS后备查询时随机改变域名大小写 (DNS 0x20) 并校验应答原样返回，增加伪造应答的难度")
+	flag.IntVar(&cfg.EDNSBufferSize, "edns-size", 0, "DNS查询的 EDNS0 UDP载荷大小 (0 表示 1232)")
+	flag.BoolVar(&cfg.DNSSECOK, "dns-do", false, "在DNS查询中设置 DNSSEC OK (DO) 位，部分解析器只对这类查询返回ECH参数")
+	flag.BoolVar(&cfg.DNSSEC, "dnssec", false, "验证ECH记录的 DNSSEC 签名链，无法验证的应答视为查询失败 (解析器需返回 RRSIG)")
+	flag.StringVar(&cfg.DNSSECAnchors, "dnssec-anchor", "", "DNSSEC 信任锚，格式 \"区域 密钥标签 算法 摘要类型 摘要\"，分号分隔多个 (默认为根区 KSK)")
+	flag.StringVar(&cfg.DoHBootstrap, "doh-bootstrap", "", "DNS服务器主机名的固定IP，不经系统DNS解析，如 dns.alidns.com=223.5.5.5,223.6.6.6 (分号分隔多个主机)")
+	flag.StringVar(&cfg.DoHProxy, "doh-proxy", "", "DoH 查询经该代理发送，如 socks5://127.0.0.1:1080 或 http://127.0.0.1:8080")
+	flag.BoolVar(&cfg.DoHHTTP3, "doh-h3", false, "DoH 优先使用 HTTP/3 (UDP 443)，适用于 TCP 443 被限速的网络，失败时自动改用 HTTP/2")
+	flag.BoolVar(&cfg.DoHPost, "doh-post", false, "以 POST (application/dns-message) 发送 DoH 查询，适用于限制长 GET URL 的服务器")
+	flag.DurationVar(&cfg.DNSTimeout, "dns-timeout", 0, "单次DNS查询的超时 (0 表示 10s)")
+	flag.IntVar(&cfg.DNSRetries, "dns-retries", 0, "获取ECH配置的最多尝试次数，两次尝试之间按指数退避等待 (0 表示 5)")
+	flag.DurationVar(&cfg.DNSDeadline, "dns-deadline", 0, "获取ECH配置的总时限，含全部重试 (0 表示不限)")
+	flag.IntVar(&cfg.DNSDebug, "dns-debug", 0, "保留最近 N 次DNS查询的原始报文并以 dig 格式写入日志，可经管理接口 /dns/debug 查看 (0 表示关闭)")
+	flag.DurationVar(&cfg.DNSBenchmark, "dns-bench", 0, "定期测量各DoH服务器的延迟与可靠性并自动选择最佳者 (0 表示不测量)")
+	flag.StringVar(&cfg.DNSStrategy, "dns-strategy", "failover", "多个DNS服务器的查询策略: failover (按顺序故障转移) 或 race (同时查询，采用最先返回ECH记录的应答)")
+	flag.StringVar(&cfg.ECHDomain, "ech", "cloudflare-ech.com", "ECH查询域名，可直接使用国际化域名 (如 例子.测试)")
+	flag.StringVar(&cfg.ECHCache, "ech-cache", "", "ECH配置缓存文件，每次获取成功后写入，重启时先使用缓存并在后台刷新")
+	flag.StringVar(&cfg.ECHConfig, "ech-config", "", "静态ECH配置 (Base64 形式的 ECHConfigList，或 @文件路径)，设置后不查询DNS；为空时读取环境变量 "+config.ECHConfigEnv)
+	flag.BoolVar(&cfg.ECHDiscover, "ech-discover", false, "DNS 中没有 ECH 配置时，以 GREASE ECH 握手探测服务端并使用其返回的 retry_configs")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", "", "验证服务端证书时在系统根证书之外信任的CA证书文件 (PEM)")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "向服务端出示的客户端证书文件 (PEM，mTLS，需同时指定 -tls-key)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "客户端证书的私钥文件 (PEM)")
+	flag.BoolVar(&cfg.TLSInsecure, "tls-insecure", false, "不验证服务端证书 (仅用于测试，连接可被中间人劫持)")
+	flag.StringVar(&cfg.TLSALPN, "tls-alpn", "", "TLS 握手提供的 ALPN 协议，逗号分隔")
+	flag.StringVar(&cfg.ECHOuterSNI, "ech-outer-sni", "", "只使用 public_name 为该名称的ECH配置，即指定明文 SNI (没有匹配的配置时连接失败)")
+	flag.StringVar(&cfg.ECHStandby, "ech-standby", "", "备用ECH域名，逗号分隔；与 -ech 同时获取配置，其配置不可用或连续被拒绝时依次切换")
+	flag.StringVar(&cfg.ECHSuites, "ech-suites", "", "可接受的 HPKE 算法组合，按偏好排列，如 x25519+chacha20,aes-256-gcm (只使用算法相符的ECH配置)")
+	flag.BoolVar(&cfg.ECHGrease, "ech-grease", false, "没有可用的ECH配置时发送 GREASE ECH (随机配置) 而不是报错，服务端若返回 retry_configs 则换用真实配置")
+	flag.StringVar(&cfg.ECHRecordType, "ech-rr", "https", "获取ECH配置的DNS记录类型: https (类型 65) 或 svcb (类型 64，用于非 HTTPS 服务)")
+	flag.BoolVar(&cfg.ECHAutoRefresh, "ech-refresh", false, "按HTTPS记录的TTL在后台自动刷新ECH配置，避免配置过期后才在连接失败时刷新")
+	flag.BoolVar(&cfg.ECHFallback, "ech-fallback", false, "ECH配置缺失或被拒绝时回退到普通TLS (会暴露真实服务器名称，默认只接受ECH握手)")
+	flag.StringVar(&cfg.AddressFamily, "addr-family", "auto", "连接服务器使用的地址族: auto (同时有 IPv4 与 IPv6 地址时按 Happy Eyeballs 竞速)、v4only 或 v6only")
+	flag.Var((*headerFlags)(&cfg.Headers), "header", "WebSocket 升级请求附加的请求头，格式 \"名称: 值\"，可重复指定 (如 User-Agent、Cookie；Host 覆盖 Host 头，TLS 服务器名称不变)")
+	flag.BoolVar(&cfg.HTTPSTarget, "https-target", false, "按服务器HTTPS记录的 TargetName 与 port 参数连接，代替 -f 中的主机与端口 (未指定 -ip 时)")
 	flag.StringVar(&cfg.ProxyIP, "pyip", "", "代理服务器IP（用于Worker连接回退，proxyip）")
+	flag.IntVar(&cfg.Listeners, "listeners", 1, "本地监听套接字数量，大于 1 时打开多个共享端口的套接字分摊接受连接 (Linux/FreeBSD)")
+	flag.IntVar(&cfg.StreamBuffer, "stream-buf", proxy.DefaultMaxBuffered, "每条连接每个方向最多缓冲的字节数")
+	flag.DurationVar(&cfg.StallTimeout, "stall", 0, "连接写入阻塞超过该时长则断开 (0 表示一直等待)")
+	flag.DurationVar(&cfg.Heartbeat, "heartbeat", protocol.DefaultHeartbeatInterval, "协议心跳间隔，连续 3 次未响应视为隧道停滞 (需要 -proto 1，0 表示不使用)")
+	flag.DurationVar(&cfg.Keepalive, "keepalive", 0, "每条隧道连接以该间隔发送 WebSocket ping，超时未收到 pong 即断开，及时发现被静默断开的空闲隧道 (0 表示不启用)")
+	flag.DurationVar(&cfg.KeepaliveTimeout, "keepalive-timeout", 0, "发送保活 ping 后等待 pong 的时间 (0 表示与 -keepalive 相同)")
+	flag.IntVar(&cfg.PoolSize, "pool", 0, "预先建立并保持的空闲隧道连接数，新连接直接取用以省去握手延迟 (0 表示不使用连接池)")
+	flag.StringVar(&cfg.PoolPolicy, "pool-policy", "round-robin", "连接池取出连接的策略: round-robin (轮流使用各节点) 或 least-loaded (所在节点使用中的连接最少)")
+	flag.DurationVar(&cfg.CoverTraffic, "cover", 0, "隧道空闲时以该平均间隔发送随机长度的 ping 作为掩护流量 (0 表示不发送)")
+	flag.StringVar(&cfg.Direct, "direct", "", "直连规则，逗号分隔的域名后缀/IP/CIDR/geoip:国家代码/geosite:分类（不经过隧道）")
+	flag.StringVar(&cfg.GeoIP, "geoip", "", "geoip: 直连规则使用的 MaxMind DB (.mmdb) 国家数据库")
+	flag.StringVar(&cfg.GeoSite, "geosite", "", "geosite: 直连规则使用的域名分类目录 (domain-list-community 的 data 格式)")
+	flag.StringVar(&cfg.Apps, "apps", "", "只让这些应用经过隧道，其余直连，逗号分隔的进程名/完整路径/uid:N (支持 Linux 与 Windows)")
+	flag.IntVar(&cfg.Protocol, "proto", protocol.Legacy, "隧道协议版本 (0 为旧版不协商, 1 启用版本与功能协商，需配套新版Worker)")
+	flag.BoolVar(&cfg.AEAD, "aead", false, "启用内层 ChaCha20-Poly1305 加密 (密钥由令牌派生，需要 -proto 1)")
+	flag.StringVar(&cfg.Compression, "compress", protocol.CompressionNone, "压缩算法偏好，逗号分隔 (none/deflate/zstd，需要 -proto 1)")
+	flag.IntVar(&cfg.CompressionLevel, "compress-level", 0, "压缩级别 (0 表示算法默认值)")
+	flag.StringVar(&cfg.VLESSUUID, "vless", "", "VLESS 兼容模式的UUID（连接现有 VLESS-over-WS 类 Worker 部署）")
+	flag.DurationVar(&cfg.LogDedup, "log-dedup", logging.DefaultWindow, "日志去重窗口，窗口内同类消息超过 3 条后只汇总条数 (0 表示不处理)")
+	flag.StringVar(&cfg.Transport, "transport", transport.DefaultName, "隧道传输方式 (内置 ws；h2 为 naiveproxy 式 HTTP/2 CONNECT，-token 为 用户名:密码)")
+	flag.IntVar(&cfg.BreakerBudget, "breaker", breaker.DefaultBudget, "节点连续连接失败多少次后熔断，冷却期内跳过该节点 (0 表示不熔断)")
+	flag.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", breaker.DefaultCooldown, "节点熔断后的冷却时间，到期后放行一次试探连接")
+	flag.StringVar(&cfg.Dialer, "dialer", dialer.DefaultName, "隧道底层拨号方式，格式为 名称 或 名称:选项 (内置 tcp，如 tcp:5s 设置连接超时)")
+	flag.StringVar(&cfg.AdminAddr, "admin", "", "管理接口监听地址 (如 127.0.0.1:30001，留空不启用)")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "管理接口修改状态的请求 (POST/DELETE) 须以 Authorization: Bearer 携带的令牌，留空时这些请求一律拒绝")
+	flag.StringVar(&cfg.PassphraseFile, "passphrase-file", "", "解密配置中 enc: 字段的口令文件 (默认读取环境变量 "+config.PassphraseEnv+")")
+	flag.StringVar(&cfg.KeychainAccount, "keychain", "", "从系统凭据存储读取令牌的账户名 (Windows 凭据管理器/macOS 钥匙串/libsecret)")
+	keychainStore := flag.Bool("keychain-store", false, "从标准输入读取令牌并保存到 -keychain 指定的账户后退出")
+	link := flag.String("link", "", "从分享链接 (ech://...) 读取连接配置，命令行显式指定的参数优先")
+	share := flag.Bool("share", false, "输出当前连接配置的分享链接与二维码后退出")
+	shareQR := flag.String("share-qr", "", "配合 -share 把二维码另存为 PNG 文件")
+	updateURL := flag.String("update-url", "", "发布清单地址，用于 -update 与管理接口 /update")
+	updateKey := flag.String("update-key", update.PublicKey, "发布签名公钥 (Base64 Ed25519)")
+	doUpdate := flag.Bool("update", false, "检查并安装签名的新版本后退出")
+	showVersion := flag.Bool("version", false, "输出版本号后退出")
+	runDoctor := flag.Bool("doctor", false, "逐项检查 DoH、ECH 配置、TCP、TLS、WebSocket 与令牌，输出诊断报告后退出")
+	exportECH := flag.Bool("export-ech", false, "获取并输出当前的 ECHConfigList (Base64 及解码摘要) 后退出")
+	encrypt := flag.Bool("encrypt", false, "从标准输入读取敏感值，用口令加密后输出，用于 -token 等参数或令牌文件")
 
 	flag.Parse()
 
+	logging.Install(os.Stderr, cfg.LogDedup)
+
+	if *link != "" {
+		if err := applyShareLink(flag.CommandLine, *link, cfg); err != nil {
+			log.Fatalf("配置错误: %v", err)
+		}
+	}
+
+	if *showVersion {
+		fmt.Println(update.Version)
+		return
+	}
+
+	// status 子命令：读取运行中实例的状态，如 ech-workers -admin 127.0.0.1:30001 status --json
+	if flag.Arg(0) == "status" {
+		if err := printStatus(cfg.AdminAddr, flag.Args()[1:]); err != nil {
+			log.Fatalf("[状态] %v", err)
+		}
+		return
+	}
+
+	// check 子命令：用当前ECH配置与前端握手，检查服务器是否接受 ECH，如 ech-workers -f ... check
+	if flag.Arg(0) == "check" {
+		if err := printECHCheck(cfg, flag.Args()[1:]); err != nil {
+			log.Fatalf("[检查] %v", err)
+		}
+		return
+	}
+
+	if *doUpdate {
+		if err := selfUpdate(*updateURL, *updateKey); err != nil {
+			log.Fatalf("[更新] %v", err)
+		}
+		return
+	}
+
+	if *keychainStore {
+		if err := storeKeychainToken(cfg.KeychainAccount); err != nil {
+			log.Fatalf("保存令牌失败: %v", err)
+		}
+		log.Printf("[配置] 令牌已保存到凭据存储: %s/%s", keychain.Service, cfg.KeychainAccount)
+		return
+	}
+
+	if *encrypt {
+		if err := encryptSecret(cfg.PassphraseFile); err != nil {
+			log.Fatalf("加密失败: %v", err)
+		}
+		return
+	}
+
+	if *exportECH {
+		if err := printECHExport(cfg); err != nil {
+			log.Fatalf("导出ECH配置失败: %v", err)
+		}
+		return
+	}
+
 	if err := cfg.Validate(); err != nil {
 		log.Fatalf("配置错误: %v", err)
 	}
 
+	if *runDoctor {
+		if _, ok := doctor.Run(cfg, os.Stdout); !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *share {
+		if err := printShareLink(cfg, *shareQR); err != nil {
+			log.Fatalf("生成分享链接失败: %v", err)
+		}
+		return
+	}
+
 	// 初始化ECH管理器
-	echManager := ech.NewECHManager(cfg.ECHDomain, cfg.DNSServer)
+	echManager := ech.NewECHManager(cfg.ECHDomain, cfg.DNSServer, cfg.ECHOptions()...)
+	if cfg.ECHDiscover {
+		echManager.SetDiscovery(echDiscovery(cfg))
+	}
 
-	log.Printf("[启动] 正在获取ECH配置...")
-	if err := echManager.Prepare(); err != nil {
-		log.Fatalf("[启动] 获取ECH配置失败: %v", err)
+	static, _ := cfg.StaticECHConfig()
+	cached := false
+	if static == nil {
+		var err error
+		if cached, err = echManager.LoadCache(); err != nil {
+			log.Printf("[启动] 忽略ECH配置缓存: %v", err)
+		}
+	}
+	if static != nil {
+		log.Printf("[启动] 使用静态ECH配置，跳过DNS查询")
+	} else if cached {
+		log.Printf("[启动] 已从缓存恢复ECH配置 (获取于 %s)，在后台刷新", echManager.Status().FetchedAt.Format(time.RFC3339))
+		go func() {
+			if err := echManager.Prepare(); err != nil {
+				log.Printf("[启动] 后台刷新ECH配置失败，继续使用缓存: %v", err)
+			}
+		}()
+	} else {
+		log.Printf("[启动] 正在获取ECH配置...")
+		if err := echManager.Prepare(); err != nil {
+			if !cfg.ECHGrease {
+				log.Fatalf("[启动] 获取ECH配置失败: %v", err)
+			}
+			log.Printf("[启动] 获取ECH配置失败，连接时使用 GREASE ECH: %v", err)
+		}
 	}
 
-	// 初始化WebSocket客户端
-	wsClient := websocket.NewWebSocketClient(cfg.ServerAddr, cfg.Token, echManager, cfg.ServerIP)
+	// 后台子系统由守护进程负责，崩溃或卡死后自动重启
+	sup := supervisor.New()
+	stats.SetSubsystemSource(func() []stats.Subsystem {
+		var out []stats.Subsystem
+		for _, st := range sup.Status() {
+			out = append(out, stats.Subsystem{
+				Name:     st.Name,
+				Running:  st.Running,
+				Restarts: st.Restarts,
+				Panics:   st.Panics,
+				Wedges:   st.Wedges,
+			})
+		}
+		return out
+	})
+
+	if cfg.DNSBenchmark > 0 {
+		interval := cfg.DNSBenchmark
+		sup.Go("dns-bench", func(stop <-chan struct{}, beat func()) error {
+			return echManager.BenchmarkLoop(interval, stop, beat)
+		}, supervisor.Options{WedgeTimeout: interval + 2*time.Minute})
+	}
+
+	if cfg.ECHAutoRefresh {
+		sup.Go("ech-refresh", echManager.AutoRefreshLoop, supervisor.Options{WedgeTimeout: 5 * time.Minute})
+	}
+
+	stats.SetECHSource(func() stats.ECHStatus {
+		st := echManager.Status()
+		mt := echManager.MetricsSnapshot()
+		return stats.ECHStatus{
+			Loaded:          st.Loaded,
+			Version:         st.Version,
+			FetchedAt:       st.FetchedAt,
+			Refreshes:       st.Refreshes,
+			RefreshFailures: mt.RefreshFailures,
+			LastRefresh:     mt.LastRefresh,
+			DNSQueries:      mt.Queries,
+			DNSFailures:     mt.QueryFailures,
+			Rejections:      mt.Rejections,
+		}
+	})
+
+	// 初始化隧道传输
+	underlying, err := dialer.New(cfg.Dialer)
+	if err != nil {
+		log.Fatalf("配置错误: %v", err)
+	}
+	transportOpts := transport.Options{
+		ServerAddr:       cfg.ServerAddr,
+		ServerIP:         cfg.ServerIP,
+		Token:            cfg.Token,
+		ECH:              echManager,
+		ECHFallback:      cfg.ECHFallback,
+		ServiceEndpoint:  cfg.HTTPSTarget,
+		AddressFamily:    cfg.Family(),
+		Keepalive:        cfg.Keepalive,
+		KeepaliveTimeout: cfg.KeepaliveTimeout,
+		Header:           cfg.Header(),
+		PoolSize:         cfg.PoolSize,
+		PoolPolicy:       cfg.Pool(),
+		Dialer:           underlying,
+		Breaker:          breaker.New(cfg.BreakerBudget, cfg.BreakerCooldown),
+	}
+	if cfg.TOTPSecret != "" {
+		secret := cfg.TOTPSecret
+		transportOpts.TokenSource = func() string { return auth.TOTPToken(secret, time.Now()) }
+	}
+	tunnel, err := transport.New(cfg.Transport, transportOpts)
+	if err != nil {
+		log.Fatalf("配置错误: %v", err)
+	}
+	if !tunnel.Capabilities().ECH {
+		log.Printf("[代理] 传输方式 %s 不使用 ECH，服务器名称将以明文发送", tunnel.Name())
+	}
+	if cfg.TLSInsecure {
+		log.Printf("[代理] 已关闭服务端证书验证 (-tls-insecure)，只应在测试环境使用")
+	}
 
 	// 初始化代理服务器
-	proxyServer := proxy.NewProxyServer(cfg.ListenAddr, wsClient, cfg.ProxyIP)
+	proxyServer := proxy.NewProxyServer(cfg.ListenAddr, transport.Client{Transport: tunnel}, cfg.ProxyIP)
+	proxyServer.SetStreamLimits(cfg.StreamBuffer, cfg.StallTimeout)
+	proxyServer.SetListeners(cfg.Listeners)
+	proxyServer.SetProtocol(cfg.Protocol)
+	proxyServer.SetHeartbeat(cfg.Heartbeat)
+	proxyServer.SetCoverTraffic(cfg.CoverTraffic)
+	if cfg.AEAD {
+		// TOTP 模式下令牌每次不同，内层加密密钥改由共享密钥派生
+		if cfg.TOTPSecret != "" {
+			proxyServer.SetAEAD(cfg.TOTPSecret)
+		} else {
+			proxyServer.SetAEAD(cfg.Token)
+		}
+	}
+	if algs, _ := protocol.ParseCompression(cfg.Compression); len(algs) > 0 {
+		proxyServer.SetCompression(algs, cfg.CompressionLevel)
+	}
+	if cfg.VLESSUUID != "" {
+		uuid, _ := protocol.ParseUUID(cfg.VLESSUUID)
+		proxyServer.SetVLESS(uuid)
+		log.Printf("[代理] 使用 VLESS 兼容模式")
+		if cfg.ProxyIP != "" {
+			log.Printf("[代理] VLESS 兼容模式下 -pyip 无效，请在 Worker 端配置")
+		}
+	}
+
+	if sd, ok := tunnel.(transport.StreamDialer); ok && tunnel.Capabilities().Stream {
+		proxyServer.SetStreamDialer(sd.DialStream)
+		if cfg.Protocol != protocol.Legacy || cfg.VLESSUUID != "" || cfg.AEAD {
+			log.Printf("[代理] 传输方式 %s 不使用 Worker 隧道协议，-proto/-vless/-aead 无效", tunnel.Name())
+		}
+	}
+
+	if cfg.Direct != "" {
+		router, err := route.ParseOptions(cfg.Direct, cfg.RouteOptions())
+		if err != nil {
+			log.Fatalf("配置错误: %v", err)
+		}
+		proxyServer.SetRouter(router)
+	}
+
+	if cfg.Apps != "" {
+		apps, _ := app.ParseRules(cfg.Apps)
+		proxyServer.SetAppRules(apps)
+	}
+
+	// 令牌轮换：新连接使用新令牌，已建立的会话在隧道内重新认证
+	rotateToken := func(token string) {
+		token, err := config.DecryptSecret(token, cfg.Passphrase)
+		if err != nil {
+			log.Printf("[代理] 新令牌无效: %v", err)
+			return
+		}
+		if setter, ok := tunnel.(transport.TokenSetter); ok {
+			setter.SetToken(token)
+		} else {
+			log.Printf("[代理] 传输方式 %s 不支持更换令牌，新连接仍使用旧令牌", tunnel.Name())
+		}
+		n := proxyServer.RotateToken(token)
+		log.Printf("[代理] 令牌已更新，%d 个会话已重新认证", n)
+	}
+	if cfg.TokenFile != "" {
+		// 与文件的原始内容比较：加密的令牌解密后与文件内容不同，不能用 cfg.Token 作为初始值
+		config.WatchTokenFile(cfg.TokenFile, cfg.TokenFileContent, 0, rotateToken)
+	}
+
+	statusCollector := &status.Collector{
+		Version:   update.Version,
+		Server:    cfg.ServerAddr,
+		Transport: tunnel.Name(),
+		Breaker:   transportOpts.Breaker,
+	}
+	if ep, ok := tunnel.(interface{ ActiveEndpoint() string }); ok {
+		statusCollector.ActiveEndpoint = ep.ActiveEndpoint
+	}
+	statusCollector.TrackErrors(events.Default())
+
+	if cfg.AdminAddr != "" {
+		if cfg.AdminToken == "" {
+			log.Printf("[管理] 未设置 -admin-token，修改状态的管理接口已禁用")
+		}
+		adminServer := admin.NewServer(cfg.AdminAddr, cfg.AdminToken)
+		adminServer.Handle("/stats", stats.Handler())
+		adminServer.Handle("/subsystems", subsystemsHandler(sup))
+		adminServer.Handle("/dns", resolversHandler(echManager))
+		adminServer.Handle("/dns/debug", dnsDebugHandler(echManager))
+		adminServer.Handle("/ech", echExportHandler(echManager))
+		adminServer.Handle("/ech/audit", audit.Handler())
+		adminServer.Handle("/endpoints", transportOpts.Breaker.Handler())
+		adminServer.Handle("/status", statusCollector.Handler())
+		adminServer.Handle("/route/reload", routeReloadHandler(proxyServer, cfg))
+		if d, ok := tunnel.(transport.Drainer); ok {
+			adminServer.Handle("/maintenance", maintenanceHandler(d))
+		}
+		if p, ok := tunnel.(transport.Pooler); ok && cfg.PoolSize > 0 {
+			adminServer.Handle("/pool", poolHandler(p))
+		}
+		if cfg.TOTPSecret == "" {
+			adminServer.Handle("/token", tokenHandler(rotateToken))
+		}
+		if *updateURL != "" {
+			updater, err := update.NewUpdater(*updateURL, *updateKey)
+			if err != nil {
+				log.Fatalf("配置错误: %v", err)
+			}
+			adminServer.Handle("/update", updateHandler(updater))
+		}
+		if err := adminServer.Start(); err != nil {
+			log.Fatalf("[管理] %v", err)
+		}
+	}
 
 	log.Printf("[代理] 后端服务器: %s", cfg.ServerAddr)
 	if cfg.ServerIP != "" {
 		log.Printf("[代理] 使用固定IP: %s", cfg.ServerIP)
 	}
 
-	// 运行代理服务器
-	if err := proxyServer.Run(); err != nil {
+	// 运行代理服务器；首次监听失败直接退出，之后监听器异常退出时由守护重新监听
+	listener, err := proxyServer.Listen()
+	if err != nil {
 		log.Fatalf("[代理] 运行失败: %v", err)
 	}
+	sup.Go("listener", func(stop <-chan struct{}, beat func()) error {
+		l := listener
+		listener = nil
+		if l == nil {
+			var err error
+			if l, err = proxyServer.Listen(); err != nil {
+				return err
+			}
+		}
+		return proxyServer.ServeUntil(l, stop)
+	}, supervisor.Options{})
+	sup.Wait()
+}
+
+// tokenHandler 接收 POST 提交的新令牌（请求体为 {"token": "..."}），用于外部认证程序推送轮换后的令牌
+func tokenHandler(rotate func(token string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Token string `json:"token"`
+		}
+		err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req)
+		token := strings.TrimSpace(req.Token)
+		if err != nil || token == "" {
+			http.Error(w, "empty token", http.StatusBadRequest)
+			return
+		}
+		rotate(token)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// routeReloadHandler POST 时重新解析直连规则并替换，GeoIP/geosite 文件未变化时沿用已映射的数据库与索引，
+// 文件被替换时改用新文件
+func routeReloadHandler(s *proxy.ProxyServer, cfg *config.Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		router, err := route.ParseOptions(cfg.Direct, cfg.RouteOptions())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.SetRouter(router).Close()
+		log.Printf("[代理] 已重新加载直连规则")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// applyShareLink 以分享链接填充配置，fs 中显式指定的参数优先：先记下这些参数，解析链接后再覆盖回去。
+// 可重复的参数（-header）再次 Set 会追加而不是覆盖，链接也不设置它们，跳过
+func applyShareLink(fs *flag.FlagSet, link string, cfg *config.Config) error {
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		if _, repeatable := f.Value.(*headerFlags); !repeatable {
+			explicit[f.Name] = f.Value.String()
+		}
+	})
+	if _, err := config.ParseShareLink(link, cfg); err != nil {
+		return err
+	}
+	for name, value := range explicit {
+		fs.Set(name, value)
+	}
+	return nil
+}
+
+// headerFlags 可重复指定的 -header 参数
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	*h = append(*h, v)
+	return nil
+}
+
+// poolHandler 输出连接池的空闲连接数与命中次数
+func poolHandler(p transport.Pooler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(p.PoolStats())
+	})
+}
+
+// maintenanceHandler 管理节点维护模式：
+// GET 输出各节点状态；POST ?endpoint=地址&timeout=30s 使节点进入维护并排空连接，加 &wait=1 时等待排空完成再返回；
+// DELETE ?endpoint=地址 结束维护
+func maintenanceHandler(d transport.Drainer) http.Handler {
+	writeStatus := func(w http.ResponseWriter, code int) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(d.DrainStatus())
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		endpoint := q.Get("endpoint")
+		switch r.Method {
+		case http.MethodGet:
+			writeStatus(w, http.StatusOK)
+		case http.MethodPost:
+			timeout := 30 * time.Second
+			if v := q.Get("timeout"); v != "" {
+				t, err := time.ParseDuration(v)
+				if err != nil || t < 0 {
+					http.Error(w, "invalid timeout", http.StatusBadRequest)
+					return
+				}
+				timeout = t
+			}
+			done, err := d.Drain(endpoint, timeout)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if q.Get("wait") == "" {
+				writeStatus(w, http.StatusAccepted)
+				return
+			}
+			select {
+			case <-done:
+				writeStatus(w, http.StatusOK)
+			case <-r.Context().Done():
+			}
+		case http.MethodDelete:
+			if err := d.Resume(endpoint); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeStatus(w, http.StatusOK)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// selfUpdate 实现 -update
+func selfUpdate(manifestURL, publicKey string) error {
+	u, err := update.NewUpdater(manifestURL, publicKey)
+	if err != nil {
+		return err
+	}
+	rel, err := installUpdate(u)
+	if err != nil {
+		return err
+	}
+	if !rel.Newer {
+		log.Printf("[更新] 当前已是最新版本 (%s)", rel.Current)
+	}
+	return nil
+}
+
+// installUpdate 检查更新，有新版本时替换当前可执行文件，重启后生效
+func installUpdate(u *update.Updater) (*update.Release, error) {
+	rel, err := u.Check()
+	if err != nil {
+		return nil, err
+	}
+	if !rel.Newer {
+		return rel, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return nil, err
+	}
+	if err := u.Apply(rel, exe); err != nil {
+		return nil, err
+	}
+	log.Printf("[更新] 已从 %s 更新到 %s，重启后生效", rel.Current, rel.Version)
+	return rel, nil
+}
+
+// updateHandler GET 检查是否有新版本，POST 检查并安装
+func updateHandler(u *update.Updater) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rel *update.Release
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			rel, err = u.Check()
+		case http.MethodPost:
+			mu.Lock()
+			rel, err = installUpdate(u)
+			mu.Unlock()
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(rel)
+	})
+}
+
+// subsystemsHandler 以JSON格式输出后台子系统的运行状态与重启次数
+func subsystemsHandler(sup *supervisor.Supervisor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(sup.Status())
+	})
+}
+
+// resolversHandler 以JSON格式输出各DoH服务器的测量结果
+func resolversHandler(m *ech.ECHManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(m.Resolvers())
+	})
+}
+
+// dnsDebugHandler 以 dig 格式输出最近的DNS查询 (-dns-debug)，?format=json 时输出含原始报文的JSON
+func dnsDebugHandler(m *ech.ECHManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		txs := m.DNSTransactions()
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(txs)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(txs) == 0 {
+			fmt.Fprintln(w, "没有记录的DNS查询 (需要 -dns-debug)")
+			return
+		}
+		for _, tx := range txs {
+			fmt.Fprintln(w, tx)
+		}
+	})
+}
+
+// echExportHandler 以JSON格式输出当前加载的ECH配置
+func echExportHandler(m *ech.ECHManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		export, err := m.Export()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(export)
+	})
+}
+
+// echDiscovery 以隧道服务端作为 GREASE 探测目标，指定了 -ip 时连接其中第一个地址
+func echDiscovery(cfg *config.Config) *ech.Discovery {
+	addr := cfg.ServerAddr
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr = addr[:i]
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "443"
+	}
+	d := &ech.Discovery{ServerName: host, Addr: net.JoinHostPort(host, port)}
+	if ip := strings.TrimSpace(strings.Split(cfg.ServerIP, ",")[0]); ip != "" {
+		if _, _, err := net.SplitHostPort(ip); err == nil {
+			d.Addr = ip
+		} else {
+			d.Addr = net.JoinHostPort(strings.Trim(ip, "[]"), port)
+		}
+	}
+	return d
+}
+
+// printECHExport 实现 -export-ech
+func printECHExport(cfg *config.Config) error {
+	if _, err := ech.ParseResolvers(cfg.DNSServer); err != nil {
+		return err
+	}
+	m := ech.NewECHManager(cfg.ECHDomain, cfg.DNSServer, cfg.ECHOptions()...)
+	if cfg.ECHDiscover {
+		m.SetDiscovery(echDiscovery(cfg))
+	}
+	if static, _ := cfg.StaticECHConfig(); static == nil {
+		if err := m.Prepare(); err != nil {
+			return err
+		}
+	}
+	export, err := m.Export()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("域名: %s\n", export.Domain)
+	fmt.Printf("来源: %s (版本 %d)\n", export.Source, export.Version)
+	fmt.Printf("获取时间: %s\n", export.FetchedAt.Format(time.RFC3339))
+	outer, err := m.OuterServerName()
+	if err != nil {
+		outer = err.Error()
+	}
+	fmt.Printf("外层 SNI: %s\n", outer)
+	for i, c := range export.Configs {
+		fmt.Printf("配置 %d: %s\n", i+1, c)
+	}
+	fmt.Println(export.ConfigList)
+	return nil
+}
+
+// printECHCheck 实现 check 子命令。默认以隧道服务器的主机名作为内层 SNI，连接ECH配置的 public_name
+func printECHCheck(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	addr := fs.String("addr", "", "握手的目标地址 (host:port)，默认为ECH配置 public_name 的 443 端口")
+	sni := fs.String("sni", "", "内层 SNI，默认为 -f 中的主机名")
+	fs.Parse(args)
+	if *sni == "" {
+		*sni = echDiscovery(cfg).ServerName
+	}
+
+	if _, err := ech.ParseResolvers(cfg.DNSServer); err != nil {
+		return err
+	}
+	m := ech.NewECHManager(cfg.ECHDomain, cfg.DNSServer, cfg.ECHOptions()...)
+	if static, _ := cfg.StaticECHConfig(); static == nil {
+		if err := m.Prepare(); err != nil {
+			return err
+		}
+	}
+	res, err := m.Verify(context.Background(), *sni, *addr)
+	fmt.Printf("内层 SNI: %s\n", res.ServerName)
+	fmt.Printf("外层 SNI: %s\n", res.OuterServerName)
+	if res.Addr != "" {
+		fmt.Printf("连接地址: %s\n", res.Addr)
+	}
+	if err != nil {
+		if len(res.RetryConfigs) > 0 {
+			fmt.Printf("服务器提供的新配置: %s\n", base64.StdEncoding.EncodeToString(res.RetryConfigs))
+		}
+		return err
+	}
+	fmt.Printf("ECH 已接受 (%s，耗时 %v)\n", res.Version, res.Latency.Round(time.Millisecond))
+	return nil
+}
+
+// printStatus 实现 status 子命令，--json 输出完整的原始状态
+func printStatus(adminAddr string, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "以JSON格式输出完整状态")
+	fs.StringVar(&adminAddr, "admin", adminAddr, "运行中实例的管理接口地址")
+	fs.Parse(args)
+	if adminAddr == "" {
+		return errors.New("需要通过 -admin 指定运行中实例的管理接口地址")
+	}
+	r, raw, err := status.Fetch(adminAddr)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		_, err := os.Stdout.Write(raw)
+		return err
+	}
+	status.Print(os.Stdout, r)
+	return nil
+}
+
+// printShareLink 实现 -share：输出分享链接与终端二维码，pngPath 非空时另存为图片
+func printShareLink(cfg *config.Config, pngPath string) error {
+	host, _, _ := strings.Cut(cfg.ServerAddr, ":")
+	s, err := cfg.ShareLink(host)
+	if err != nil {
+		return err
+	}
+	code, err := qr.Encode([]byte(s), qr.LevelM)
+	if err != nil {
+		return err
+	}
+	fmt.Println(s)
+	fmt.Print(code.Terminal())
+	if pngPath == "" {
+		return nil
+	}
+	f, err := os.Create(pngPath)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, code.Image(8)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readStdinLine 读取标准输入的第一行
+func readStdinLine() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	value := strings.TrimRight(line, "\r\n")
+	if value == "" {
+		return "", errors.New("输入为空")
+	}
+	return value, nil
+}
+
+// storeKeychainToken 实现 -keychain-store
+func storeKeychainToken(account string) error {
+	token, err := readStdinLine()
+	if err != nil {
+		return err
+	}
+	return keychain.Set(account, token)
+}
+
+// encryptSecret 实现 -encrypt：读取标准输入的第一行并输出加密后的值
+func encryptSecret(passphraseFile string) error {
+	passphrase, err := config.LoadPassphrase(passphraseFile)
+	if err != nil {
+		return err
+	}
+	value, err := readStdinLine()
+	if err != nil {
+		return err
+	}
+	enc, err := config.EncryptSecret(value, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Println(enc)
+	return nil
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"testing"
+
+	"ech-workers/config"
+)
+
+func TestApplyShareLinkKeepsRepeatedHeaders(t *testing.T) {
+	link, err := (&config.Config{ServerAddr: "link.example:443", Token: "link-token"}).ShareLink("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&cfg.Token, "token", "", "")
+	fs.Var((*headerFlags)(&cfg.Headers), "header", "")
+	if err := fs.Parse([]string{"-token", "cli-token", "-header", "A: b", "-header", "C: d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyShareLink(fs, link, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerAddr != "link.example:443" {
+		t.Errorf("ServerAddr %q 未取自链接", cfg.ServerAddr)
+	}
+	if cfg.Token != "cli-token" {
+		t.Errorf("显式指定的 -token 被链接覆盖为 %q", cfg.Token)
+	}
+	if want := []string{"A: b", "C: d"}; !slices.Equal(cfg.Headers, want) {
+		t.Errorf("Headers %q，应为 %q", cfg.Headers, want)
+	}
+}
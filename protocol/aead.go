@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// FeatureAEAD 在隧道载荷外再套一层 ChaCha20-Poly1305 加密，
+// 使 Worker/边缘节点运营方无法读取隧道内的明文协议
+const FeatureAEAD = "aead"
+
+// SaltSize 每个会话随机生成的密钥派生盐长度
+const SaltSize = 16
+
+const (
+	aeadInfoClientToServer = "ech-workers aead c2s"
+	aeadInfoServerToClient = "ech-workers aead s2c"
+)
+
+var ErrAEADOpen = errors.New("内层解密失败")
+
+// AEADStream 一个会话两个方向的加解密状态。每个方向使用独立的密钥，
+// nonce 为按消息递增的计数器，依赖 WebSocket 的有序可靠传输。
+// Seal 与 Open 可分别在不同的goroutine中调用，但各自不能并发调用。
+type AEADStream struct {
+	seal    cipher.AEAD
+	open    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+}
+
+// NewClientAEAD 由令牌和会话盐派生客户端侧的加解密状态
+func NewClientAEAD(token string, salt []byte) (*AEADStream, error) {
+	if token == "" {
+		return nil, errors.New("内层加密需要设置令牌")
+	}
+	if len(salt) != SaltSize {
+		return nil, errors.New("会话盐长度错误")
+	}
+	seal, err := deriveAEAD(token, salt, aeadInfoClientToServer)
+	if err != nil {
+		return nil, err
+	}
+	open, err := deriveAEAD(token, salt, aeadInfoServerToClient)
+	if err != nil {
+		return nil, err
+	}
+	return &AEADStream{seal: seal, open: open}, nil
+}
+
+func deriveAEAD(token string, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, []byte(token), salt, info, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func seqNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// Seal 加密一条消息，结果追加到 dst
+func (a *AEADStream) Seal(dst, plaintext []byte) []byte {
+	nonce := seqNonce(a.sendSeq)
+	a.sendSeq++
+	return a.seal.Seal(dst, nonce, plaintext, nil)
+}
+
+// Open 解密一条消息，结果追加到 dst
+func (a *AEADStream) Open(dst, ciphertext []byte) ([]byte, error) {
+	nonce := seqNonce(a.recvSeq)
+	a.recvSeq++
+	plain, err := a.open.Open(dst, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrAEADOpen
+	}
+	return plain, nil
+}
+
+// Overhead 每条消息增加的字节数
+func (a *AEADStream) Overhead() int {
+	return a.seal.Overhead()
+}
@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// 与 _worker.js 中 createAEAD 注释里的向量相同：令牌 "ech-workers-test-token"，盐为 00 01 … 0f
+var (
+	vectorToken = "ech-workers-test-token"
+	vectorSalt  = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSeqNonce(t *testing.T) {
+	for seq, want := range map[uint64]string{
+		0:                  "000000000000000000000000",
+		1:                  "000000000000000000000001",
+		0x0102030405060708: "000000000102030405060708",
+	} {
+		if got := hex.EncodeToString(seqNonce(seq)); got != want {
+			t.Errorf("seqNonce(%#x) = %s，应为 %s", seq, got, want)
+		}
+	}
+}
+
+func TestAEADVectors(t *testing.T) {
+	a, err := NewClientAEAD(vectorToken, vectorSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 客户端到 Worker：同一明文按序号得到不同密文
+	for _, want := range []string{
+		"03a5fc0582678cde13d005f8863ec1f63131947e7a",
+		"b1736a108b3840884c80a78737b9efae4903dd2f4a",
+	} {
+		if got := a.Seal(nil, []byte("hello")); !bytes.Equal(got, mustHex(t, want)) {
+			t.Fatalf("Seal = %x，应为 %s", got, want)
+		}
+	}
+
+	// Worker 到客户端
+	s2c, err := deriveAEAD(vectorToken, vectorSalt, aeadInfoServerToClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq, want := range []string{
+		"337d819f29a095f69e1baeb6c07bac640e053be063",
+		"55649cc7c240c43ecd06e3ab03a2ff08d54a8d3f09",
+	} {
+		if got := s2c.Seal(nil, seqNonce(uint64(seq)), []byte("world"), nil); !bytes.Equal(got, mustHex(t, want)) {
+			t.Fatalf("序号 %d 的 s2c 密文 = %x，应为 %s", seq, got, want)
+		}
+		plain, err := a.Open(nil, mustHex(t, want))
+		if err != nil || string(plain) != "world" {
+			t.Fatalf("Open = %q, %v", plain, err)
+		}
+	}
+
+	// 乱序（重放）的消息无法解密
+	if _, err := a.Open(nil, mustHex(t, "337d819f29a095f69e1baeb6c07bac640e053be063")); err != ErrAEADOpen {
+		t.Fatalf("重放的消息返回 %v", err)
+	}
+}
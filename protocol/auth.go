@@ -0,0 +1,34 @@
+package protocol
+
+import "strings"
+
+// FeatureReauth 允许在已建立的会话上用新令牌重新认证，令牌轮换时无需重连
+const FeatureReauth = "reauth"
+
+// 重新认证消息: 客户端发送 "AUTH:<新令牌>"，Worker 回复 AuthOK 或 "AUTH:FAIL[:说明]"，
+// 失败后 Worker 以 CloseAuthFailed 关闭会话
+const (
+	AuthPrefix = "AUTH:"
+	AuthOK     = "AUTH:OK"
+	AuthFail   = "AUTH:FAIL"
+)
+
+// EncodeAuth 构造重新认证消息
+func EncodeAuth(token string) []byte {
+	return []byte(AuthPrefix + token)
+}
+
+// ParseAuthReply 解析 Worker 的重新认证响应，msg 不是认证响应时 ok 为 false
+func ParseAuthReply(msg []byte) (accepted bool, reason string, ok bool) {
+	text := string(msg)
+	if text == AuthOK {
+		return true, "", true
+	}
+	if text == AuthFail {
+		return false, "", true
+	}
+	if rest, found := strings.CutPrefix(text, AuthFail+":"); found {
+		return false, rest, true
+	}
+	return false, "", false
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// FeatureCloseCode 关闭消息携带原因码，使对端能区分正常关闭与异常
+const FeatureCloseCode = "closecode"
+
+// MessageClose 流关闭消息。协商了 FeatureCloseCode 时格式为 "CLOSE:<原因码>[:说明]"，
+// 旧版协议只发送 "CLOSE"，等同于 CloseNormal
+const MessageClose = "CLOSE"
+
+// CloseCode 关闭原因码，均从发送方的角度描述
+type CloseCode int
+
+const (
+	CloseNormal        CloseCode = 0 // 数据已全部发送，正常关闭
+	CloseGoingAway     CloseCode = 1 // 发送方正在退出或维护
+	CloseConnectFailed CloseCode = 2 // Worker 连接目标失败
+	CloseReset         CloseCode = 3 // 发送方一侧的连接被重置或出错
+	CloseProtocolError CloseCode = 4 // 收到无法解析或解密的消息
+	CloseStalled       CloseCode = 5 // 写入阻塞或心跳超时
+	CloseInternalError CloseCode = 6 // 其他内部错误
+	CloseAuthFailed    CloseCode = 7 // 重新认证失败
+)
+
+// sessionCloseBase 会话关闭时 WebSocket 关闭帧状态码 = sessionCloseBase + 原因码
+const sessionCloseBase = 4000
+
+var closeCodeNames = map[CloseCode]string{
+	CloseNormal:        "正常关闭",
+	CloseGoingAway:     "对端退出",
+	CloseConnectFailed: "连接目标失败",
+	CloseReset:         "连接被重置",
+	CloseProtocolError: "协议错误",
+	CloseStalled:       "连接停滞",
+	CloseInternalError: "内部错误",
+	CloseAuthFailed:    "认证失败",
+}
+
+func (c CloseCode) String() string {
+	if name, ok := closeCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("未知原因(%d)", int(c))
+}
+
+// CloseInfo 对端给出的关闭原因，非正常关闭时可作为 error 使用
+type CloseInfo struct {
+	Code   CloseCode
+	Reason string
+}
+
+// Orderly 返回是否为有序关闭（正常关闭或对端主动退出）
+func (c CloseInfo) Orderly() bool {
+	return c.Code == CloseNormal || c.Code == CloseGoingAway
+}
+
+func (c CloseInfo) Error() string {
+	if c.Reason == "" {
+		return "对端关闭: " + c.Code.String()
+	}
+	return fmt.Sprintf("对端关闭: %s (%s)", c.Code, c.Reason)
+}
+
+// EncodeClose 构造携带原因码的流关闭消息
+func EncodeClose(code CloseCode, reason string) []byte {
+	msg := MessageClose + ":" + strconv.Itoa(int(code))
+	if reason != "" {
+		msg += ":" + reason
+	}
+	return []byte(msg)
+}
+
+// ParseClose 解析流关闭消息，msg 不是关闭消息时 ok 为 false
+func ParseClose(msg []byte) (info CloseInfo, ok bool) {
+	text := string(msg)
+	if text == MessageClose {
+		return CloseInfo{Code: CloseNormal}, true
+	}
+	rest, found := strings.CutPrefix(text, MessageClose+":")
+	if !found {
+		return CloseInfo{}, false
+	}
+	codeStr, reason, _ := strings.Cut(rest, ":")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || code < 0 {
+		return CloseInfo{}, false
+	}
+	return CloseInfo{Code: CloseCode(code), Reason: reason}, true
+}
+
+// SessionCloseMessage 构造会话关闭使用的 WebSocket 关闭帧内容
+func SessionCloseMessage(code CloseCode, reason string) []byte {
+	if code == CloseNormal {
+		return websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+	}
+	return websocket.FormatCloseMessage(sessionCloseBase+int(code), reason)
+}
+
+// ParseSessionClose 从读取错误中识别对端发送的会话关闭帧，
+// 网络中断等未收到关闭帧的情况 ok 为 false
+func ParseSessionClose(err error) (info CloseInfo, ok bool) {
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return CloseInfo{}, false
+	}
+	switch {
+	case ce.Code == websocket.CloseNormalClosure:
+		return CloseInfo{Code: CloseNormal, Reason: ce.Text}, true
+	case ce.Code == websocket.CloseGoingAway:
+		return CloseInfo{Code: CloseGoingAway, Reason: ce.Text}, true
+	case ce.Code >= sessionCloseBase && ce.Code < sessionCloseBase+1000:
+		return CloseInfo{Code: CloseCode(ce.Code - sessionCloseBase), Reason: ce.Text}, true
+	}
+	return CloseInfo{}, false
+}
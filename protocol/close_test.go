@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseClose(t *testing.T) {
+	tests := []struct {
+		msg  string
+		ok   bool
+		info CloseInfo
+	}{
+		{"CLOSE", true, CloseInfo{Code: CloseNormal}},
+		{"CLOSE:0", true, CloseInfo{Code: CloseNormal}},
+		{"CLOSE:3:connection refused", true, CloseInfo{Code: CloseReset, Reason: "connection refused"}},
+		{"CLOSE:5:a:b", true, CloseInfo{Code: CloseStalled, Reason: "a:b"}},
+		{"CLOSE:", false, CloseInfo{}},
+		{"CLOSE:-1", false, CloseInfo{}},
+		{"CLOSE:x", false, CloseInfo{}},
+		{"CLOSED", false, CloseInfo{}},
+		{"FIN", false, CloseInfo{}},
+	}
+	for _, tt := range tests {
+		info, ok := ParseClose([]byte(tt.msg))
+		if ok != tt.ok || info != tt.info {
+			t.Errorf("ParseClose(%q) = %+v, %v", tt.msg, info, ok)
+		}
+	}
+
+	if got := string(EncodeClose(CloseReset, "connection refused")); got != "CLOSE:3:connection refused" {
+		t.Fatalf("EncodeClose = %q", got)
+	}
+	if got := string(EncodeClose(CloseNormal, "")); got != "CLOSE:0" {
+		t.Fatalf("EncodeClose = %q", got)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	// 0x0fa3 = 4000 + CloseReset
+	if got := SessionCloseMessage(CloseReset, "r"); !bytes.Equal(got, mustHex(t, "0fa372")) {
+		t.Fatalf("SessionCloseMessage = %x", got)
+	}
+	if got := SessionCloseMessage(CloseNormal, ""); !bytes.Equal(got, mustHex(t, "03e8")) {
+		t.Fatalf("SessionCloseMessage = %x", got)
+	}
+
+	tests := []struct {
+		code int
+		ok   bool
+		info CloseInfo
+	}{
+		{websocket.CloseNormalClosure, true, CloseInfo{Code: CloseNormal, Reason: "r"}},
+		{websocket.CloseGoingAway, true, CloseInfo{Code: CloseGoingAway, Reason: "r"}},
+		{4000 + int(CloseReset), true, CloseInfo{Code: CloseReset, Reason: "r"}},
+		{websocket.CloseAbnormalClosure, false, CloseInfo{}},
+		{5000, false, CloseInfo{}},
+	}
+	for _, tt := range tests {
+		info, ok := ParseSessionClose(&websocket.CloseError{Code: tt.code, Text: "r"})
+		if ok != tt.ok || info != tt.info {
+			t.Errorf("ParseSessionClose(%d) = %+v, %v", tt.code, info, ok)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩算法名称，握手时客户端按偏好顺序列出，Worker 选择其中一个
+const (
+	CompressionNone    = "none"
+	CompressionDeflate = "deflate"
+	CompressionZstd    = "zstd"
+)
+
+// 启用压缩后每条二进制数据消息的首字节
+const (
+	frameRaw        = 0
+	frameCompressed = 1
+)
+
+// ErrDecompress 压缩数据无效或解压后超过上限
+var ErrDecompress = errors.New("解压失败")
+
+// ParseCompression 解析逗号分隔的压缩算法偏好列表，结果中不包含 none
+func ParseCompression(spec string) ([]string, error) {
+	var algs []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "", CompressionNone:
+			continue
+		case CompressionDeflate, CompressionZstd:
+		default:
+			return nil, fmt.Errorf("不支持的压缩算法: %s", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			algs = append(algs, name)
+		}
+	}
+	return algs, nil
+}
+
+// checkLevel 校验压缩级别，0 表示使用算法默认值
+func checkLevel(alg string, level int) error {
+	switch alg {
+	case CompressionDeflate:
+		if level < 0 || level > flate.BestCompression {
+			return fmt.Errorf("deflate 压缩级别需为 0-%d", flate.BestCompression)
+		}
+	case CompressionZstd:
+		if level < 0 || level > 22 {
+			return errors.New("zstd 压缩级别需为 0-22")
+		}
+	}
+	return nil
+}
+
+// CheckCompression 校验偏好列表中的每个算法都能使用该级别
+func CheckCompression(algs []string, level int) error {
+	for _, alg := range algs {
+		if err := checkLevel(alg, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxZstdMemory 单条 zstd 消息解码时允许使用的最大内存
+const maxZstdMemory = 4 << 20
+
+// 压缩器开销较大，按级别在所有流之间共享
+var (
+	deflateWriters [flate.BestCompression + 1]sync.Pool
+	deflateReaders sync.Pool
+
+	zstdMu       sync.Mutex
+	zstdEncoders = map[int]*zstd.Encoder{}
+	zstdDecoder  *zstd.Decoder
+)
+
+// Compressor 对隧道中的二进制数据消息逐条压缩。
+// 每条消息独立压缩，首字节标记是否压缩，压缩无收益时原样发送。
+type Compressor struct {
+	alg   string
+	level int
+
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+}
+
+// NewCompressor 创建指定算法与级别的压缩器，level 为 0 时使用默认级别
+func NewCompressor(alg string, level int) (*Compressor, error) {
+	if err := checkLevel(alg, level); err != nil {
+		return nil, err
+	}
+	c := &Compressor{alg: alg, level: level}
+	switch alg {
+	case CompressionDeflate:
+	case CompressionZstd:
+		zstdMu.Lock()
+		defer zstdMu.Unlock()
+		if zstdEncoders[level] == nil {
+			encLevel := zstd.SpeedDefault
+			if level > 0 {
+				encLevel = zstd.EncoderLevelFromZstd(level)
+			}
+			enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encLevel))
+			if err != nil {
+				return nil, err
+			}
+			zstdEncoders[level] = enc
+		}
+		if zstdDecoder == nil {
+			dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxZstdMemory))
+			if err != nil {
+				return nil, err
+			}
+			zstdDecoder = dec
+		}
+		c.zenc, c.zdec = zstdEncoders[level], zstdDecoder
+	default:
+		return nil, fmt.Errorf("不支持的压缩算法: %s", alg)
+	}
+	return c, nil
+}
+
+// String 返回算法与级别，用于日志
+func (c *Compressor) String() string {
+	if c.level == 0 {
+		return c.alg
+	}
+	return fmt.Sprintf("%s:%d", c.alg, c.level)
+}
+
+// Encode 将压缩后的消息追加到 dst
+func (c *Compressor) Encode(dst, p []byte) []byte {
+	start := len(dst)
+	dst = append(dst, frameCompressed)
+	switch c.alg {
+	case CompressionDeflate:
+		buf := bytes.NewBuffer(dst)
+		pool := &deflateWriters[c.level]
+		w, _ := pool.Get().(*flate.Writer)
+		if w == nil {
+			level := c.level
+			if level == 0 {
+				level = flate.DefaultCompression
+			}
+			w, _ = flate.NewWriter(buf, level)
+		} else {
+			w.Reset(buf)
+		}
+		w.Write(p)
+		w.Close()
+		pool.Put(w)
+		dst = buf.Bytes()
+	case CompressionZstd:
+		dst = c.zenc.EncodeAll(p, dst)
+	}
+	if len(dst)-start-1 >= len(p) {
+		dst = append(dst[:start], frameRaw)
+		dst = append(dst, p...)
+	}
+	return dst
+}
+
+// Decode 将解压后的数据追加到 dst，解压结果超过 limit 字节时返回 ErrDecompress
+func (c *Compressor) Decode(dst, msg []byte, limit int) ([]byte, error) {
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("%w: 空消息", ErrDecompress)
+	}
+	body := msg[1:]
+	switch msg[0] {
+	case frameRaw:
+		return append(dst, body...), nil
+	case frameCompressed:
+	default:
+		return nil, fmt.Errorf("%w: 未知的消息标记 %d", ErrDecompress, msg[0])
+	}
+
+	var r io.Reader
+	switch c.alg {
+	case CompressionDeflate:
+		fr, _ := deflateReaders.Get().(io.ReadCloser)
+		if fr == nil {
+			fr = flate.NewReader(bytes.NewReader(body))
+		} else {
+			fr.(flate.Resetter).Reset(bytes.NewReader(body), nil)
+		}
+		defer deflateReaders.Put(fr)
+		r = fr
+	case CompressionZstd:
+		out, err := c.zdec.DecodeAll(body, dst)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecompress, err)
+		}
+		if len(out)-len(dst) > limit {
+			return nil, fmt.Errorf("%w: 解压后超过 %d 字节", ErrDecompress, limit)
+		}
+		return out, nil
+	}
+
+	buf := bytes.NewBuffer(dst)
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecompress, err)
+	}
+	if n > int64(limit) {
+		return nil, fmt.Errorf("%w: 解压后超过 %d 字节", ErrDecompress, limit)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// deflateVector 是 "ech-workers " 重复 64 次（768 字节）的压缩帧，
+// 与 _worker.js 中 decompressMessage 注释里的向量相同
+const deflateVector = "014a4dced02dcf2fca4e2d2a5618658fb2471a1b3000"
+
+func TestDecodeLimit(t *testing.T) {
+	c, err := NewCompressor(CompressionDeflate, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Repeat("ech-workers ", 64)
+
+	got, err := c.Decode(nil, mustHex(t, deflateVector), len(want))
+	if err != nil || string(got) != want {
+		t.Fatalf("Decode = %d 字节, %v", len(got), err)
+	}
+	if _, err := c.Decode(nil, mustHex(t, deflateVector), len(want)-1); !errors.Is(err, ErrDecompress) {
+		t.Fatalf("超过上限时返回 %v", err)
+	}
+
+	for _, msg := range []string{"", "02", "01ffff"} {
+		if _, err := c.Decode(nil, mustHex(t, msg), 1024); !errors.Is(err, ErrDecompress) {
+			t.Errorf("Decode(%s) 返回 %v", msg, err)
+		}
+	}
+
+	// 未压缩的帧原样返回
+	if got, err := c.Decode([]byte("a"), []byte("\x00bc"), 0); err != nil || string(got) != "abc" {
+		t.Fatalf("未压缩帧: %q, %v", got, err)
+	}
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	msg := []byte(strings.Repeat("ech-workers ", 64))
+	for _, alg := range []string{CompressionDeflate, CompressionZstd} {
+		c, err := NewCompressor(alg, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := c.Encode(nil, msg)
+		if frame[0] != frameCompressed || len(frame) >= len(msg) {
+			t.Fatalf("%s: 压缩帧 %d 字节", alg, len(frame))
+		}
+		got, err := c.Decode(nil, frame, len(msg))
+		if err != nil || string(got) != string(msg) {
+			t.Fatalf("%s: Decode = %d 字节, %v", alg, len(got), err)
+		}
+		if _, err := c.Decode(nil, frame, len(msg)-1); !errors.Is(err, ErrDecompress) {
+			t.Fatalf("%s: 超过上限时返回 %v", alg, err)
+		}
+
+		// 无法压缩的短消息以原始帧发送
+		if frame := c.Encode(nil, []byte("hi")); string(frame) != "\x00hi" {
+			t.Fatalf("%s: 短消息编码为 %x", alg, frame)
+		}
+	}
+}
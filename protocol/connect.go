@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// FeatureAddressFrame 使用二进制地址帧建立流，代替旧版文本 "CONNECT:" 消息
+const FeatureAddressFrame = "addrframe"
+
+// 地址帧格式（二进制消息，所有整数为大端序）:
+//
+//	+-----+---------+------+----------+------+--------------+----------+------------+
+//	| VER | NETWORK | ATYP | ADDR     | PORT | FALLBACK_LEN | FALLBACK | EARLY_DATA |
+//	| 1   | 1       | 1    | 可变     | 2    | 1            | 可变     | 剩余部分   |
+//	+-----+---------+------+----------+------+--------------+----------+------------+
+//
+// ATYP 为 1 时 ADDR 为4字节IPv4，为 4 时为16字节IPv6，为 3 时为1字节长度加域名。
+// FALLBACK 为可选的回退地址（proxyip），EARLY_DATA 为随连接请求发送的首帧数据。
+const (
+	FrameVersion = 1
+
+	NetworkTCP = 1
+	NetworkUDP = 2
+
+	AddrIPv4   = 1
+	AddrDomain = 3
+	AddrIPv6   = 4
+)
+
+// ConnectRequest 流建立请求
+type ConnectRequest struct {
+	Network   byte
+	Host      string
+	Port      uint16
+	Fallback  string
+	EarlyData []byte
+}
+
+// NewConnectRequest 由 host:port 形式的目标构造TCP连接请求
+func NewConnectRequest(target, fallback string, earlyData []byte) (*ConnectRequest, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("无效的目标地址 %q: %v", target, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的目标端口 %q", portStr)
+	}
+	return &ConnectRequest{
+		Network:   NetworkTCP,
+		Host:      host,
+		Port:      uint16(port),
+		Fallback:  fallback,
+		EarlyData: earlyData,
+	}, nil
+}
+
+// Encode 序列化为地址帧
+func (r *ConnectRequest) Encode() ([]byte, error) {
+	if r.Network != NetworkTCP && r.Network != NetworkUDP {
+		return nil, fmt.Errorf("不支持的网络类型: %d", r.Network)
+	}
+	if len(r.Fallback) > 255 {
+		return nil, errors.New("回退地址过长")
+	}
+
+	frame := make([]byte, 0, 3+1+len(r.Host)+2+1+len(r.Fallback)+len(r.EarlyData))
+	frame = append(frame, FrameVersion, r.Network)
+	if ip := net.ParseIP(r.Host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			frame = append(frame, AddrIPv4)
+			frame = append(frame, ip4...)
+		} else {
+			frame = append(frame, AddrIPv6)
+			frame = append(frame, ip.To16()...)
+		}
+	} else {
+		if r.Host == "" || len(r.Host) > 255 {
+			return nil, fmt.Errorf("无效的目标域名: %q", r.Host)
+		}
+		frame = append(frame, AddrDomain, byte(len(r.Host)))
+		frame = append(frame, r.Host...)
+	}
+	frame = binary.BigEndian.AppendUint16(frame, r.Port)
+	frame = append(frame, byte(len(r.Fallback)))
+	frame = append(frame, r.Fallback...)
+	frame = append(frame, r.EarlyData...)
+	return frame, nil
+}
+
+// DecodeConnectRequest 解析地址帧
+func DecodeConnectRequest(frame []byte) (*ConnectRequest, error) {
+	if len(frame) < 3 {
+		return nil, errors.New("地址帧过短")
+	}
+	if frame[0] != FrameVersion {
+		return nil, fmt.Errorf("不支持的地址帧版本: %d", frame[0])
+	}
+	r := &ConnectRequest{Network: frame[1]}
+	if r.Network != NetworkTCP && r.Network != NetworkUDP {
+		return nil, fmt.Errorf("不支持的网络类型: %d", r.Network)
+	}
+
+	offset := 3
+	switch frame[2] {
+	case AddrIPv4:
+		if len(frame) < offset+4 {
+			return nil, errors.New("地址帧被截断")
+		}
+		r.Host = net.IP(frame[offset : offset+4]).String()
+		offset += 4
+	case AddrIPv6:
+		if len(frame) < offset+16 {
+			return nil, errors.New("地址帧被截断")
+		}
+		r.Host = net.IP(frame[offset : offset+16]).String()
+		offset += 16
+	case AddrDomain:
+		if len(frame) < offset+1 {
+			return nil, errors.New("地址帧被截断")
+		}
+		l := int(frame[offset])
+		offset++
+		if l == 0 || len(frame) < offset+l {
+			return nil, errors.New("地址帧被截断")
+		}
+		r.Host = string(frame[offset : offset+l])
+		offset += l
+	default:
+		return nil, fmt.Errorf("不支持的地址类型: %d", frame[2])
+	}
+
+	if len(frame) < offset+3 {
+		return nil, errors.New("地址帧被截断")
+	}
+	r.Port = binary.BigEndian.Uint16(frame[offset : offset+2])
+	offset += 2
+	fl := int(frame[offset])
+	offset++
+	if len(frame) < offset+fl {
+		return nil, errors.New("地址帧被截断")
+	}
+	r.Fallback = string(frame[offset : offset+fl])
+	offset += fl
+	r.EarlyData = frame[offset:]
+	return r, nil
+}
+
+// Target 返回 host:port 形式的目标地址
+func (r *ConnectRequest) Target() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 与 _worker.js 中 parseAddressFrame 注释里的向量相同
+func TestConnectRequestVectors(t *testing.T) {
+	tests := []struct {
+		target, fallback string
+		early            []byte
+		frame            string
+	}{
+		{"example.com:443", "proxy.example:8443", []byte("GET"),
+			"0101030b6578616d706c652e636f6d01bb1270726f78792e6578616d706c653a38343433474554"},
+		{"192.0.2.1:80", "", nil,
+			"010101c0000201005000"},
+		{"[2001:db8::1]:443", "", []byte{1, 2},
+			"01010420010db800000000000000000000000101bb000102"},
+	}
+	for _, tt := range tests {
+		req, err := NewConnectRequest(tt.target, tt.fallback, tt.early)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := req.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := mustHex(t, tt.frame); !bytes.Equal(frame, want) {
+			t.Fatalf("%s 的地址帧 = %x，应为 %s", tt.target, frame, tt.frame)
+		}
+
+		got, err := DecodeConnectRequest(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Target() != req.Target() || got.Fallback != tt.fallback || !bytes.Equal(got.EarlyData, tt.early) {
+			t.Fatalf("解析 %s 得到 %+v", tt.frame, got)
+		}
+	}
+}
+
+func TestDecodeConnectRequestErrors(t *testing.T) {
+	for _, frame := range []string{
+		"0101",                     // 过短
+		"020101c0000201005000",     // 版本错误
+		"010301c0000201005000",     // 网络类型错误
+		"010102c0000201005000",     // 地址类型错误
+		"010101c00002",             // IPv4 地址被截断
+		"01010300",                 // 空域名
+		"0101030b6578616d706c65",   // 域名被截断
+		"010101c000020100",         // 缺少端口与回退长度
+		"010101c00002010050057072", // 回退地址被截断
+	} {
+		if _, err := DecodeConnectRequest(mustHex(t, frame)); err == nil {
+			t.Errorf("接受了无效的地址帧 %s", frame)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FeatureHeartbeat 协议级心跳：客户端定期发送 PING，Worker 回复 PONG 并附带自身时间
+const FeatureHeartbeat = "heartbeat"
+
+// 心跳消息格式: "PING:<发送时间 unix 纳秒>"，"PONG:<原样回显>|<Worker 时间 unix 毫秒>"
+const (
+	PingPrefix = "PING:"
+	PongPrefix = "PONG:"
+)
+
+// DefaultHeartbeatInterval 默认心跳间隔，连续 3 个间隔未收到 PONG 视为隧道停滞
+const DefaultHeartbeatInterval = 5 * time.Second
+
+// HeartbeatSample 一次心跳测得的往返时延与时钟偏差
+type HeartbeatSample struct {
+	RTT time.Duration
+	// Skew 为 Worker 时钟减去本地时钟，正值表示本地时钟偏慢
+	Skew time.Duration
+}
+
+// EncodePing 构造携带发送时间的心跳消息
+func EncodePing(now time.Time) []byte {
+	return strconv.AppendInt([]byte(PingPrefix), now.UnixNano(), 10)
+}
+
+// ParsePong 解析 Worker 的心跳响应，now 为收到响应的时间
+func ParsePong(msg []byte, now time.Time) (HeartbeatSample, error) {
+	text, ok := strings.CutPrefix(string(msg), PongPrefix)
+	if !ok {
+		return HeartbeatSample{}, errors.New("不是心跳响应")
+	}
+	sentStr, serverStr, ok := strings.Cut(text, "|")
+	if !ok {
+		return HeartbeatSample{}, errors.New("心跳响应格式错误")
+	}
+	sent, err := strconv.ParseInt(sentStr, 10, 64)
+	if err != nil {
+		return HeartbeatSample{}, errors.New("心跳响应格式错误")
+	}
+	serverMillis, err := strconv.ParseInt(serverStr, 10, 64)
+	if err != nil {
+		return HeartbeatSample{}, errors.New("心跳响应格式错误")
+	}
+
+	sentAt := time.Unix(0, sent)
+	rtt := now.Sub(sentAt)
+	if rtt < 0 {
+		return HeartbeatSample{}, errors.New("心跳响应时间无效")
+	}
+	// 假设往返对称，Worker 处理请求的时刻约为发送后半个RTT
+	skew := time.UnixMilli(serverMillis).Sub(sentAt.Add(rtt / 2))
+	return HeartbeatSample{RTT: rtt, Skew: skew}, nil
+}
@@ -0,0 +1,206 @@
+// Package protocol 定义客户端与 Worker 之间的隧道协议版本与握手协商。
+//
+// WebSocket 建立后客户端发送 "HELLO:" + JSON，声明支持的版本范围与功能；
+// Worker 回复 "HELLO:" + JSON，给出选定的版本、双方都支持的功能与压缩算法，
+// 不兼容时回复 "ERROR:原因"。未启用协商时保持旧版（v0）行为。
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Legacy 表示不进行协商的旧版协议
+	Legacy = 0
+
+	MinVersion = 1
+	MaxVersion = 1
+
+	HelloPrefix = "HELLO:"
+	ErrorPrefix = "ERROR:"
+
+	DefaultHandshakeTimeout = 5 * time.Second
+)
+
+// 协议功能名称
+const (
+	FeatureMux = "mux"
+	FeatureUDP = "udp"
+	// FeatureHalfClose 单方向结束时发送 MessageFIN，而不是关闭整个流
+	FeatureHalfClose = "halfclose"
+)
+
+// MessageFIN 半关闭消息，表示发送方不会再发送数据
+const MessageFIN = "FIN"
+
+// Hello 是握手双方交换的消息
+type Hello struct {
+	Version    int      `json:"v"`
+	MinVersion int      `json:"min_v,omitempty"`
+	Features   []string `json:"features"`
+	// Salt 客户端为内层加密生成的随机会话盐
+	Salt []byte `json:"salt,omitempty"`
+	// Compression 客户端按偏好顺序列出的压缩算法，Worker 回复时只包含选定的一个
+	Compression []string `json:"compression,omitempty"`
+	// Level 压缩级别，0 表示算法默认值
+	Level int `json:"level,omitempty"`
+}
+
+// Offer 本端在握手中请求的功能与压缩参数
+type Offer struct {
+	Features    []string
+	Compression []string
+	Level       int
+}
+
+// Session 协商结果
+type Session struct {
+	Version  int
+	Features map[string]bool
+	Salt     []byte
+	// Compression 选定的压缩算法，未启用压缩时为 CompressionNone
+	Compression string
+	Level       int
+}
+
+// Has 返回协商结果中是否包含某个功能
+func (s *Session) Has(feature string) bool {
+	return s != nil && s.Features[feature]
+}
+
+// LegacySession 返回旧版协议的会话（不包含任何功能）
+func LegacySession() *Session {
+	return &Session{Version: Legacy, Features: map[string]bool{}, Compression: CompressionNone}
+}
+
+// ErrIncompatible 对端协议版本不兼容
+var ErrIncompatible = errors.New("协议版本不兼容")
+
+// Negotiate 在新建立的WebSocket连接上执行握手，offer 为本端希望启用的功能与压缩算法
+func Negotiate(conn *websocket.Conn, offer Offer, timeout time.Duration) (*Session, error) {
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	features := offer.Features
+	hello := Hello{
+		Version:     MaxVersion,
+		MinVersion:  MinVersion,
+		Features:    features,
+		Compression: offer.Compression,
+		Level:       offer.Level,
+	}
+	if hello.Features == nil {
+		hello.Features = []string{}
+	}
+	for _, f := range features {
+		if f == FeatureAEAD {
+			hello.Salt = make([]byte, SaltSize)
+			if _, err := rand.Read(hello.Salt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	payload, err := json.Marshal(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := conn.WriteMessage(websocket.TextMessage, append([]byte(HelloPrefix), payload...)); err != nil {
+		return nil, fmt.Errorf("发送握手失败: %w", err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	mt, msg, err := conn.ReadMessage()
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w: Worker 未响应握手，可能是不支持协商的旧版本", ErrIncompatible)
+		}
+		return nil, fmt.Errorf("读取握手响应失败: %w", err)
+	}
+	if mt != websocket.TextMessage {
+		return nil, fmt.Errorf("%w: 握手响应类型错误", ErrIncompatible)
+	}
+
+	text := string(msg)
+	if strings.HasPrefix(text, ErrorPrefix) {
+		return nil, fmt.Errorf("%w: %s", ErrIncompatible, strings.TrimPrefix(text, ErrorPrefix))
+	}
+	if !strings.HasPrefix(text, HelloPrefix) {
+		return nil, fmt.Errorf("%w: 意外的握手响应 %q", ErrIncompatible, text)
+	}
+
+	var reply Hello
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(text, HelloPrefix)), &reply); err != nil {
+		return nil, fmt.Errorf("%w: 握手响应格式错误: %v", ErrIncompatible, err)
+	}
+	if reply.Version < MinVersion || reply.Version > MaxVersion {
+		return nil, fmt.Errorf("%w: 对端选择 v%d，本端支持 v%d-v%d", ErrIncompatible, reply.Version, MinVersion, MaxVersion)
+	}
+
+	session := &Session{Version: reply.Version, Features: map[string]bool{}, Salt: hello.Salt, Compression: CompressionNone}
+	offered := make(map[string]bool, len(features))
+	for _, f := range features {
+		offered[f] = true
+	}
+	for _, f := range reply.Features {
+		if !offered[f] {
+			return nil, fmt.Errorf("%w: 对端启用了未请求的功能 %q", ErrIncompatible, f)
+		}
+		session.Features[f] = true
+	}
+
+	switch len(reply.Compression) {
+	case 0:
+	case 1:
+		alg := reply.Compression[0]
+		if alg == CompressionNone {
+			break
+		}
+		accepted := false
+		for _, a := range offer.Compression {
+			accepted = accepted || a == alg
+		}
+		if !accepted {
+			return nil, fmt.Errorf("%w: 对端选择了未请求的压缩算法 %q", ErrIncompatible, alg)
+		}
+		if err := checkLevel(alg, reply.Level); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrIncompatible, err)
+		}
+		session.Compression, session.Level = alg, reply.Level
+	default:
+		return nil, fmt.Errorf("%w: 对端选择了多个压缩算法", ErrIncompatible)
+	}
+	return session, nil
+}
+
+// String 返回便于日志输出的会话描述
+func (s *Session) String() string {
+	if s == nil || s.Version == Legacy {
+		return "v0"
+	}
+	names := make([]string, 0, len(s.Features))
+	for f := range s.Features {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	desc := fmt.Sprintf("v%d [%s]", s.Version, strings.Join(names, ","))
+	if s.Compression != "" && s.Compression != CompressionNone {
+		desc += " " + s.Compression
+		if s.Level != 0 {
+			desc += fmt.Sprintf(":%d", s.Level)
+		}
+	}
+	return desc
+}
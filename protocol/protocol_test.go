@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// negotiateWith 对返回固定响应的服务端执行握手，并返回服务端收到的 Hello
+func negotiateWith(t *testing.T, offer Offer, reply string) (*Session, Hello, error) {
+	t.Helper()
+	got := make(chan Hello, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var hello Hello
+		json.Unmarshal([]byte(strings.TrimPrefix(string(msg), HelloPrefix)), &hello)
+		got <- hello
+		conn.WriteMessage(websocket.TextMessage, []byte(reply))
+		conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s, err := Negotiate(conn, offer, time.Second)
+	select {
+	case hello := <-got:
+		return s, hello, err
+	case <-time.After(time.Second):
+		t.Fatal("服务端未收到握手")
+		return nil, Hello{}, nil
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offer := Offer{
+		Features:    []string{FeatureMux, FeatureAEAD, FeatureCloseCode},
+		Compression: []string{CompressionZstd, CompressionDeflate},
+		Level:       3,
+	}
+	s, hello, err := negotiateWith(t, offer, `HELLO:{"v":1,"features":["mux","aead"],"compression":["deflate"],"level":3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.Version != MaxVersion || hello.MinVersion != MinVersion || len(hello.Salt) != SaltSize ||
+		strings.Join(hello.Features, ",") != "mux,aead,closecode" || strings.Join(hello.Compression, ",") != "zstd,deflate" || hello.Level != 3 {
+		t.Fatalf("发送的握手 = %+v", hello)
+	}
+	if !s.Has(FeatureMux) || !s.Has(FeatureAEAD) || s.Has(FeatureCloseCode) ||
+		string(s.Salt) != string(hello.Salt) || s.Compression != CompressionDeflate || s.Level != 3 {
+		t.Fatalf("协商结果 = %+v", s)
+	}
+	if got := s.String(); got != "v1 [aead,mux] deflate:3" {
+		t.Fatalf("String() = %q", got)
+	}
+
+	// 未请求 aead 时不发送盐
+	s, hello, err = negotiateWith(t, Offer{}, `HELLO:{"v":1,"features":[]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.Salt != nil || hello.Features == nil || s.Compression != CompressionNone {
+		t.Fatalf("发送的握手 = %+v，协商结果 = %+v", hello, s)
+	}
+}
+
+func TestNegotiateIncompatible(t *testing.T) {
+	offer := Offer{Features: []string{FeatureMux}, Compression: []string{CompressionDeflate}}
+	for _, reply := range []string{
+		"ERROR:unsupported version",
+		`HELLO:{"v":2,"features":[]}`,
+		`HELLO:{"v":0,"features":[]}`,
+		`HELLO:{"v":1,"features":["udp"]}`,
+		`HELLO:{"v":1,"features":[],"compression":["zstd"]}`,
+		`HELLO:{"v":1,"features":[],"compression":["deflate","zstd"]}`,
+		`HELLO:{"v":1,"features":[],"compression":["deflate"],"level":99}`,
+		`HELLO:not json`,
+		"OK",
+	} {
+		if _, _, err := negotiateWith(t, offer, reply); !errors.Is(err, ErrIncompatible) {
+			t.Errorf("响应 %q 返回 %v", reply, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// VLESS-over-WS 兼容格式，供连接已部署的常见 Worker 代理脚本（如 edgetunnel 一类）使用。
+//
+// 请求（首个二进制消息）:
+//
+//	VER(0) | UUID(16) | ADDONS_LEN(1) | ADDONS | CMD(1) | PORT(2) | ATYP(1) | ADDR | PAYLOAD
+//
+// 响应: 服务端数据的最前面是 VER(1) | ADDONS_LEN(1) | ADDONS，之后为原始数据。
+const (
+	vlessVersion   = 0
+	vlessCmdTCP    = 1
+	vlessAddrIPv4  = 1
+	vlessAddrName  = 2
+	vlessAddrIPv6  = 3
+	vlessUUIDBytes = 16
+)
+
+// ParseUUID 解析标准格式的UUID
+func ParseUUID(s string) ([16]byte, error) {
+	var id [16]byte
+	raw := strings.ReplaceAll(strings.TrimSpace(s), "-", "")
+	if len(raw) != 32 {
+		return id, fmt.Errorf("无效的UUID: %q", s)
+	}
+	b, err := hex.DecodeString(raw)
+	if err != nil {
+		return id, fmt.Errorf("无效的UUID: %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// EncodeVLESSRequest 构造携带首帧数据的 VLESS 请求头
+func EncodeVLESSRequest(uuid [16]byte, target string, payload []byte) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("无效的目标地址 %q: %v", target, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的目标端口 %q", portStr)
+	}
+
+	header := make([]byte, 0, 1+vlessUUIDBytes+1+1+2+1+1+len(host)+len(payload))
+	header = append(header, vlessVersion)
+	header = append(header, uuid[:]...)
+	header = append(header, 0, vlessCmdTCP)
+	header = binary.BigEndian.AppendUint16(header, uint16(port))
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			header = append(header, vlessAddrIPv4)
+			header = append(header, ip4...)
+		} else {
+			header = append(header, vlessAddrIPv6)
+			header = append(header, ip.To16()...)
+		}
+	} else {
+		if host == "" || len(host) > 255 {
+			return nil, fmt.Errorf("无效的目标域名: %q", host)
+		}
+		header = append(header, vlessAddrName, byte(len(host)))
+		header = append(header, host...)
+	}
+	return append(header, payload...), nil
+}
+
+// VLESSResponseStripper 逐块剥离服务端数据前部的 VLESS 响应头
+type VLESSResponseStripper struct {
+	header []byte
+	need   int
+	done   bool
+}
+
+// Strip 返回去除响应头后的数据，响应头可能跨多个数据块
+func (s *VLESSResponseStripper) Strip(b []byte) ([]byte, error) {
+	for !s.done && len(b) > 0 {
+		if len(s.header) < 2 {
+			s.header = append(s.header, b[0])
+			b = b[1:]
+			if len(s.header) == 2 {
+				if s.header[0] != vlessVersion {
+					return nil, errors.New("VLESS 响应版本错误")
+				}
+				s.need = int(s.header[1])
+				s.done = s.need == 0
+			}
+			continue
+		}
+		n := s.need
+		if n > len(b) {
+			n = len(b)
+		}
+		s.need -= n
+		b = b[n:]
+		s.done = s.need == 0
+	}
+	return b, nil
+}
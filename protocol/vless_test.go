@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeVLESSRequestVectors(t *testing.T) {
+	uuid, err := ParseUUID("0b3a5c2e-7d41-4f8a-9c6e-1f2a3b4c5d6e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target  string
+		payload []byte
+		header  string
+	}{
+		{"example.com:443", []byte("hi"),
+			"000b3a5c2e7d414f8a9c6e1f2a3b4c5d6e000101bb020b6578616d706c652e636f6d6869"},
+		{"192.0.2.1:80", nil,
+			"000b3a5c2e7d414f8a9c6e1f2a3b4c5d6e0001005001c0000201"},
+	}
+	for _, tt := range tests {
+		got, err := EncodeVLESSRequest(uuid, tt.target, tt.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := mustHex(t, tt.header); !bytes.Equal(got, want) {
+			t.Fatalf("%s 的请求 = %x，应为 %s", tt.target, got, tt.header)
+		}
+	}
+
+	if _, err := ParseUUID("0b3a5c2e-7d41"); err == nil {
+		t.Fatal("接受了过短的UUID")
+	}
+}
+
+func TestVLESSResponseStripper(t *testing.T) {
+	// 响应头 00 02 aa bb 被拆分到多个数据块中
+	var s VLESSResponseStripper
+	var out []byte
+	for _, chunk := range [][]byte{{0x00}, {0x02, 0xaa}, {0xbb, 'o'}, []byte("k")} {
+		b, err := s.Strip(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, b...)
+	}
+	if string(out) != "ok" {
+		t.Fatalf("剥离后得到 %q", out)
+	}
+
+	s = VLESSResponseStripper{}
+	if b, err := s.Strip([]byte{0x00, 0x00, 'x'}); err != nil || string(b) != "x" {
+		t.Fatalf("无附加信息的响应头: %q, %v", b, err)
+	}
+
+	s = VLESSResponseStripper{}
+	if _, err := s.Strip([]byte{0x01, 0x00}); err == nil {
+		t.Fatal("接受了错误的响应版本")
+	}
+}
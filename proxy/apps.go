@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+
+	"ech-workers/app"
+)
+
+// SetAppRules 启用按应用分流：只有匹配规则的应用经过隧道，其余直连
+func (s *ProxyServer) SetAppRules(m *app.Matcher) {
+	s.apps = m
+}
+
+// appLookupWarned 避免每条连接都重复输出查找失败的警告
+var appLookupWarned atomic.Bool
+
+// appTunneled 返回本地连接所属的应用是否应经过隧道。
+// 找不到所属进程时保守地走隧道，避免应走隧道的流量被直连泄露
+func (s *ProxyServer) appTunneled(conn net.Conn) bool {
+	if s.apps.Empty() {
+		return true
+	}
+	p, err := app.Lookup(conn.RemoteAddr(), conn.LocalAddr(), s.apps)
+	if err != nil {
+		if !appLookupWarned.Swap(true) {
+			log.Printf("[代理] 无法确定 %s 所属的应用 (%v)，该类连接将经过隧道", conn.RemoteAddr(), err)
+		}
+		return true
+	}
+	return s.apps.Match(p)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxPingPayload WebSocket 控制帧负载的上限
+const maxPingPayload = 125
+
+// SetCoverTraffic 在隧道空闲时以随机间隔（interval 的 0.5~1.5 倍）发送随机长度的 ping，
+// 避免长时间完全静默的 TLS 连接形成明显特征；0 表示不发送
+func (s *ProxyServer) SetCoverTraffic(interval time.Duration) {
+	s.coverInterval = interval
+}
+
+// activity 记录隧道最近一次收发数据的时间
+type activity struct {
+	last atomic.Int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// coverTraffic 空闲期间发送填充 ping，直到 stop 关闭
+func (s *ProxyServer) coverTraffic(wsConn *websocket.Conn, mu *sync.Mutex, act *activity, stop <-chan bool) {
+	for {
+		delay := s.coverInterval/2 + rand.N(s.coverInterval)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+		if act.idle() < delay {
+			continue
+		}
+		mu.Lock()
+		err := wsConn.WriteMessage(websocket.PingMessage, paddedPingPayload())
+		mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// paddedPingPayload 在携带发送时间的 ping 负载后附加随机长度的随机填充
+func paddedPingPayload() []byte {
+	payload := pingPayload()
+	pad := make([]byte, rand.IntN(maxPingPayload-len(payload)+1))
+	for i := range pad {
+		pad[i] = byte(rand.Uint32())
+	}
+	return append(payload, pad...)
+}
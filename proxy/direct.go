@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"ech-workers/bufpool"
+	"ech-workers/stats"
+)
+
+// StreamDialFunc 按目标建立字节流，ctx 取消时中止拨号（不影响已建立的流）
+type StreamDialFunc func(ctx context.Context, target string) (net.Conn, error)
+
+// SetStreamDialer 设置按目标建立字节流的出站方式（如 HTTP/2 CONNECT），
+// 设置后经过隧道的连接改用该方式，不再使用 WebSocket 隧道协议
+func (s *ProxyServer) SetStreamDialer(dial StreamDialFunc) {
+	s.streamDial = dial
+}
+
+// handleDirect 不经过隧道直接连接目标
+func (s *ProxyServer) handleDirect(conn net.Conn, target, clientAddr string, mode int, firstFrame []byte) error {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	dial := func(ctx context.Context, target string) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", target)
+	}
+	return s.handleDialed(conn, target, clientAddr, mode, firstFrame, dial, "直连")
+}
+
+// handleDialed 用 dial 建立到目标的字节流并双向转发，name 为日志中的出站名称
+func (s *ProxyServer) handleDialed(conn net.Conn, target, clientAddr string, mode int, firstFrame []byte, dial StreamDialFunc, name string) error {
+	watcher := watchLocalClose(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	release := watcher.abortOnClose(cancel)
+	remote, err := dial(ctx, target)
+	release()
+	cancel()
+	conn = watcher.stop()
+	if err != nil {
+		if watcher.isClosed() {
+			return errLocalClosed
+		}
+		s.sendErrorResponse(conn, mode)
+		return fmt.Errorf("%s连接目标失败: %w", name, err)
+	}
+	defer remote.Close()
+
+	conn.SetDeadline(time.Time{})
+
+	if err := s.sendSuccessResponse(conn, mode); err != nil {
+		return fmt.Errorf("发送成功响应失败: %w", err)
+	}
+	if len(firstFrame) > 0 {
+		if _, err := remote.Write(firstFrame); err != nil {
+			return fmt.Errorf("发送首帧失败: %w", err)
+		}
+	}
+
+	log.Printf("[%s] %s 已连接: %s", name, clientAddr, target)
+	relayTCP(conn, remote)
+	log.Printf("[%s] %s 已断开: %s", name, clientAddr, target)
+	return nil
+}
+
+// relayTCP 在两个TCP连接之间双向转发，每个方向结束后半关闭对端写方向
+func relayTCP(local, remote net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn, count func(int)) {
+		defer wg.Done()
+		n, _ := copyTCP(dst, src)
+		count(int(n))
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go pipe(remote, local, stats.AddBytesUp)
+	go pipe(local, remote, stats.AddBytesDown)
+	wg.Wait()
+}
+
+// copyTCP 两端都是 *net.TCPConn 时使用 ReadFrom，Linux 下由内核 splice 完成，
+// 数据无需复制到用户态；否则使用共享缓冲区复制
+func copyTCP(dst, src net.Conn) (int64, error) {
+	if dstTCP, ok := dst.(*net.TCPConn); ok {
+		if _, ok := src.(*net.TCPConn); ok {
+			return dstTCP.ReadFrom(src)
+		}
+	}
+	buf := bufpool.Get(relayBufferSize)
+	defer bufpool.Put(buf)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, buf)
+}
+
+// writerOnly/readerOnly 隐藏 ReadFrom/WriteTo，确保 io.CopyBuffer 使用传入的缓冲区
+type writerOnly struct{ io.Writer }
+
+type readerOnly struct{ io.Reader }
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ech-workers/events"
+	"ech-workers/protocol"
+	"ech-workers/stats"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// heartbeatMisses 连续多少个间隔未收到 PONG 视为隧道停滞
+	heartbeatMisses = 3
+	// maxClockSkew 本地时钟与 Worker 相差超过该值时输出警告
+	maxClockSkew = 30 * time.Second
+)
+
+// errTunnelStalled 隧道连续多次未响应心跳
+var errTunnelStalled = errors.New("心跳超时，隧道停滞")
+
+// skewWarned 避免每条连接都重复输出时钟偏差警告
+var skewWarned atomic.Bool
+
+// heartbeat 记录一条隧道的协议心跳状态
+type heartbeat struct {
+	interval time.Duration
+	lastPong atomic.Int64
+	stalled  atomic.Bool
+}
+
+func newHeartbeat(interval time.Duration) *heartbeat {
+	h := &heartbeat{interval: interval}
+	h.lastPong.Store(time.Now().UnixNano())
+	return h
+}
+
+// handlePong 处理 Worker 的心跳响应，更新RTT与时钟偏差统计
+func (h *heartbeat) handlePong(msg []byte) {
+	sample, err := protocol.ParsePong(msg, time.Now())
+	if err != nil {
+		log.Printf("[代理] 忽略无效的心跳响应: %v", err)
+		return
+	}
+	h.lastPong.Store(time.Now().UnixNano())
+	stats.SetRTT(sample.RTT)
+	stats.SetClockSkew(sample.Skew)
+
+	if sample.Skew > maxClockSkew || sample.Skew < -maxClockSkew {
+		if !skewWarned.Swap(true) {
+			log.Printf("[代理] 本地时钟与 Worker 相差 %v，请校准系统时间", sample.Skew.Round(time.Second))
+		}
+	} else {
+		skewWarned.Store(false)
+	}
+}
+
+// run 定期发送心跳，超时未收到响应时关闭隧道，使 relay 尽快结束而不必等待 TCP 超时
+func (h *heartbeat) run(wsConn *websocket.Conn, mu *sync.Mutex, target string, stop <-chan bool) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	timeout := h.interval * heartbeatMisses
+	for {
+		select {
+		case <-ticker.C:
+			if since := time.Since(time.Unix(0, h.lastPong.Load())); since > timeout {
+				log.Printf("[代理] %s 隧道 %v 未响应心跳，断开该流", target, since.Round(time.Millisecond))
+				stats.HeartbeatTimeout()
+				events.Emit(events.TunnelStalled, target, nil)
+				h.stalled.Store(true)
+				wsConn.Close()
+				return
+			}
+			mu.Lock()
+			wsConn.WriteMessage(websocket.TextMessage, protocol.EncodePing(time.Now()))
+			mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// SetListeners 设置监听套接字数量。大于 1 时在 Linux (SO_REUSEPORT) 与 FreeBSD (SO_REUSEPORT_LB)
+// 上打开多个共享同一端口的套接字，由内核在它们之间分配新连接，每个套接字由独立的 goroutine 接受连接；
+// 其他系统使用单个套接字
+func (s *ProxyServer) SetListeners(n int) {
+	s.listeners = n
+}
+
+// listenReusePort 打开 n 个共享同一端口的监听套接字。
+// 监听端口为 0 时其余套接字绑定到第一个套接字实际分配的端口
+func listenReusePort(addr string, n int) (*multiListener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	var ls []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			addr = l.Addr().String()
+		}
+		ls = append(ls, l)
+	}
+	return &multiListener{listeners: ls}, nil
+}
+
+// multiListener 共享同一地址的多个监听套接字。Serve 为每个套接字单独运行接受循环，
+// 作为普通 net.Listener 使用时由各套接字的 goroutine 汇总到 Accept
+type multiListener struct {
+	listeners []net.Listener
+
+	once     sync.Once
+	accepted chan acceptResult
+	closed   chan struct{}
+	closeMu  sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (m *multiListener) start() {
+	m.once.Do(func() {
+		m.accepted = make(chan acceptResult)
+		m.closed = make(chan struct{})
+		for _, l := range m.listeners {
+			go func(l net.Listener) {
+				for {
+					conn, err := l.Accept()
+					select {
+					case m.accepted <- acceptResult{conn, err}:
+					case <-m.closed:
+						if conn != nil {
+							conn.Close()
+						}
+						return
+					}
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+				}
+			}(l)
+		}
+	})
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	m.start()
+	select {
+	case r := <-m.accepted:
+		return r.conn, r.err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.start()
+	m.closeMu.Do(func() { close(m.closed) })
+	var firstErr error
+	for _, l := range m.listeners {
+		if err := l.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// serveMulti 为每个套接字运行独立的接受循环，全部结束后返回
+func (s *ProxyServer) serveMulti(m *multiListener) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.listeners))
+	for i, l := range m.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.acceptLoop(l)
+			// 任一接受循环异常退出时关闭全部套接字，由调用方（守护）重新监听
+			m.Close()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// listenMulti 在支持时打开 n 个共享端口的套接字，否则返回 nil 由调用方使用单个套接字
+func (s *ProxyServer) listenMulti() (net.Listener, error) {
+	if !reusePortSupported {
+		log.Printf("[代理] 当前系统不支持在多个套接字之间分配连接，使用单个监听套接字代替 %d 个", s.listeners)
+		return nil, nil
+	}
+	m, err := listenReusePort(s.listenAddr, s.listeners)
+	if err != nil {
+		return nil, fmt.Errorf("监听失败: %v", err)
+	}
+	return m, nil
+}
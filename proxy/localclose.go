@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"ech-workers/bufpool"
+)
+
+// errLocalClosed 隧道建立完成前本地客户端已关闭连接
+var errLocalClosed = errors.New("本地连接已关闭")
+
+// closeWatcher 在隧道建立期间监视本地连接，客户端提前关闭时关闭 closed，
+// 使正在进行的拨号与连接请求立即中止，而不是留下无人使用的远端连接。
+// 监视期间读到的数据不会丢失，stop 返回的连接会先读出这些数据。
+type closeWatcher struct {
+	conn    net.Conn
+	closed  chan struct{}
+	done    chan struct{}
+	pending []byte
+}
+
+func watchLocalClose(conn net.Conn) *closeWatcher {
+	w := &closeWatcher{
+		conn:   conn,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		buf := bufpool.Get(relayBufferSize)
+		n, err := conn.Read(buf)
+		if n > 0 {
+			w.pending = buf[:n]
+			return
+		}
+		bufpool.Put(buf)
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			close(w.closed)
+		}
+	}()
+	return w
+}
+
+// stop 结束监视，返回之后应使用的本地连接
+func (w *closeWatcher) stop() net.Conn {
+	w.conn.SetReadDeadline(time.Now())
+	<-w.done
+	w.conn.SetReadDeadline(time.Time{})
+	if len(w.pending) == 0 {
+		return w.conn
+	}
+	return &prefixConn{Conn: w.conn, prefix: w.pending}
+}
+
+// isClosed 返回监视期间本地连接是否已关闭
+func (w *closeWatcher) isClosed() bool {
+	select {
+	case <-w.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// abortOnClose 本地连接关闭时调用 abort，返回的函数用于结束等待
+func (w *closeWatcher) abortOnClose(abort func()) func() {
+	cancel := make(chan struct{})
+	var once sync.Once
+	go func() {
+		select {
+		case <-w.closed:
+			abort()
+		case <-cancel:
+		}
+	}()
+	return func() { once.Do(func() { close(cancel) }) }
+}
+
+// prefixConn 先读出 prefix，再从原连接读取
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite 保留原连接的半关闭能力
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("连接不支持半关闭")
+}
@@ -2,16 +2,25 @@ package proxy
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"ech-workers/app"
+	"ech-workers/bufpool"
+	"ech-workers/protocol"
+	"ech-workers/route"
+	"ech-workers/stats"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -19,6 +28,9 @@ const (
 	ModeSOCKS5      = 1
 	ModeHTTPConnect = 2
 	ModeHTTPProxy   = 3
+	ModeSOCKS4      = 4
+
+	relayBufferSize = 32 * 1024
 )
 
 // WebSocketClient 接口定义
@@ -26,11 +38,38 @@ type WebSocketClient interface {
 	DialWithECH(maxRetries int) (*websocket.Conn, error)
 }
 
+// cancelableDialer 支持在本地连接关闭时中止拨号的客户端
+type cancelableDialer interface {
+	DialWithECHCancel(maxRetries int, cancel <-chan struct{}) (*websocket.Conn, error)
+}
+
 type ProxyServer struct {
 	listenAddr string
 	wsClient   WebSocketClient
 	proxyIP    string
-	bufPool    sync.Pool
+	router     atomic.Pointer[route.Router]
+	apps       *app.Matcher
+	protocol   int
+	vlessUUID  *[16]byte
+	aeadToken  string
+	tokenMu    sync.RWMutex
+
+	compression      []string
+	compressionLevel int
+
+	heartbeatInterval time.Duration
+	coverInterval     time.Duration
+
+	maxBuffered  int
+	stallTimeout time.Duration
+
+	sessionsMu sync.Mutex
+	sessions   map[*liveSession]struct{}
+
+	// listeners 监听套接字数量，见 listeners.go
+	listeners int
+	// streamDial 不为空时经过隧道的连接改用按目标建立的字节流，见 direct.go
+	streamDial StreamDialFunc
 }
 
 func NewProxyServer(listenAddr string, wsClient WebSocketClient, proxyIP string) *ProxyServer {
@@ -38,29 +77,127 @@ func NewProxyServer(listenAddr string, wsClient WebSocketClient, proxyIP string)
 		listenAddr: listenAddr,
 		wsClient:   wsClient,
 		proxyIP:    proxyIP,
-		bufPool: sync.Pool{
-			New: func() interface{} {
-				return make([]byte, 32*1024)
-			},
-		},
+
+		maxBuffered:       DefaultMaxBuffered,
+		heartbeatInterval: protocol.DefaultHeartbeatInterval,
 	}
 }
 
+// SetStreamLimits 设置每条流每个方向的最大缓冲量，以及写入阻塞多久后断开（0 表示一直等待）
+func (s *ProxyServer) SetStreamLimits(maxBuffered int, stallTimeout time.Duration) {
+	if maxBuffered <= 0 {
+		maxBuffered = DefaultMaxBuffered
+	}
+	s.maxBuffered = maxBuffered
+	s.stallTimeout = stallTimeout
+}
+
+// SetProtocol 设置隧道协议版本，protocol.Legacy 表示不进行握手协商
+func (s *ProxyServer) SetProtocol(version int) {
+	s.protocol = version
+}
+
+// SetVLESS 使用 VLESS-over-WS 格式连接已部署的兼容 Worker，不再使用本项目的 Worker 协议
+func (s *ProxyServer) SetVLESS(uuid [16]byte) {
+	s.vlessUUID = &uuid
+}
+
+// SetAEAD 启用内层 ChaCha20-Poly1305 加密，密钥由令牌派生，需要协议 v1 及支持该功能的Worker
+func (s *ProxyServer) SetAEAD(token string) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	s.aeadToken = token
+}
+
+// SetCompression 设置握手时按偏好顺序提供的压缩算法与级别，需要协议 v1
+func (s *ProxyServer) SetCompression(algs []string, level int) {
+	s.compression = algs
+	s.compressionLevel = level
+}
+
+// SetHeartbeat 设置协议心跳间隔，0 表示不使用协议心跳（仅发送 WebSocket ping）
+func (s *ProxyServer) SetHeartbeat(interval time.Duration) {
+	s.heartbeatInterval = interval
+}
+
+// offer 返回握手时向Worker请求启用的功能与压缩算法
+func (s *ProxyServer) offer(aeadToken string) protocol.Offer {
+	features := []string{protocol.FeatureAddressFrame, protocol.FeatureHalfClose, protocol.FeatureCloseCode, protocol.FeatureReauth}
+	if aeadToken != "" {
+		features = append(features, protocol.FeatureAEAD)
+	}
+	if s.heartbeatInterval > 0 {
+		features = append(features, protocol.FeatureHeartbeat)
+	}
+	return protocol.Offer{Features: features, Compression: s.compression, Level: s.compressionLevel}
+}
+
+// SetRouter 设置直连规则，命中规则的目标不经过隧道。可在运行中替换，返回被替换的规则
+func (s *ProxyServer) SetRouter(router *route.Router) *route.Router {
+	return s.router.Swap(router)
+}
+
 func (s *ProxyServer) Run() error {
+	listener, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Listen 在配置的地址上监听
+func (s *ProxyServer) Listen() (net.Listener, error) {
+	if s.listeners > 1 {
+		if l, err := s.listenMulti(); l != nil || err != nil {
+			return l, err
+		}
+	}
 	listener, err := net.Listen("tcp", s.listenAddr)
 	if err != nil {
-		return fmt.Errorf("监听失败: %v", err)
+		return nil, fmt.Errorf("监听失败: %v", err)
 	}
+	return listener, nil
+}
+
+// ServeUntil 与 Serve 相同，stop 关闭时关闭监听器并返回
+func (s *ProxyServer) ServeUntil(listener net.Listener, stop <-chan struct{}) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			listener.Close()
+		case <-done:
+		}
+	}()
+	return s.Serve(listener)
+}
+
+// Serve 在已有的监听器上接受连接
+func (s *ProxyServer) Serve(listener net.Listener) error {
 	defer listener.Close()
+	s.listenAddr = listener.Addr().String()
 
-	log.Printf("[代理] 服务器启动: %s (支持SOCKS5和HTTP)", s.listenAddr)
+	log.Printf("[代理] 服务器启动: %s (支持SOCKS5、SOCKS4/4a和HTTP)", s.listenAddr)
 	if s.proxyIP != "" {
 		log.Printf("[代理] 回退代理IP: %s", s.proxyIP)
 	}
 
+	if m, ok := listener.(*multiListener); ok {
+		log.Printf("[代理] 使用 %d 个 SO_REUSEPORT 监听套接字", len(m.listeners))
+		return s.serveMulti(m)
+	}
+	return s.acceptLoop(listener)
+}
+
+// acceptLoop 在监听器上循环接受连接，直到监听器被关闭
+func (s *ProxyServer) acceptLoop(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			log.Printf("[代理] 接受连接失败: %v", err)
 			continue
 		}
@@ -73,11 +210,20 @@ func (s *ProxyServer) handleConnection(conn net.Conn) {
 	if conn == nil {
 		return
 	}
+	stats.ConnOpened()
+	defer stats.ConnClosed()
 	defer func() {
 		if conn != nil {
 			conn.Close()
 		}
 	}()
+	// 单个连接的处理出错不应使整个进程退出
+	defer func() {
+		if r := recover(); r != nil {
+			stats.HandlerPanic()
+			log.Printf("[代理] %s 处理连接时崩溃: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
 
 	clientAddr := conn.RemoteAddr().String()
 	conn.SetDeadline(time.Now().Add(30 * time.Second))
@@ -93,6 +239,8 @@ func (s *ProxyServer) handleConnection(conn net.Conn) {
 	switch firstByte {
 	case 0x05:
 		s.handleSOCKS5(conn, clientAddr, firstByte)
+	case 0x04:
+		s.handleSOCKS4(conn, clientAddr)
 	case 'C', 'G', 'P', 'H', 'D', 'O', 'T':
 		s.handleHTTP(conn, clientAddr, firstByte)
 	default:
@@ -321,8 +469,27 @@ func (s *ProxyServer) handleTunnel(conn net.Conn, target, clientAddr string, mod
 		return errors.New("连接对象为空")
 	}
 
-	wsConn, err := s.wsClient.DialWithECH(2)
+	if s.router.Load().Route(target) == route.ActionDirect || !s.appTunneled(conn) {
+		return s.handleDirect(conn, target, clientAddr, mode, firstFrame)
+	}
+	if s.streamDial != nil {
+		return s.handleDialed(conn, target, clientAddr, mode, firstFrame, s.streamDial, "隧道")
+	}
+
+	aeadToken := s.currentAEADToken()
+	watcher := watchLocalClose(conn)
+	var wsConn *websocket.Conn
+	var err error
+	if d, ok := s.wsClient.(cancelableDialer); ok {
+		wsConn, err = d.DialWithECHCancel(2, watcher.closed)
+	} else {
+		wsConn, err = s.wsClient.DialWithECH(2)
+	}
 	if err != nil {
+		watcher.stop()
+		if watcher.isClosed() {
+			return errLocalClosed
+		}
 		s.sendErrorResponse(conn, mode)
 		return fmt.Errorf("建立WebSocket连接失败: %w", err)
 	}
@@ -332,136 +499,231 @@ func (s *ProxyServer) handleTunnel(conn net.Conn, target, clientAddr string, mod
 		}
 	}()
 
+	session := protocol.LegacySession()
+	if s.protocol != protocol.Legacy && s.vlessUUID == nil {
+		release := watcher.abortOnClose(func() { wsConn.Close() })
+		session, err = protocol.Negotiate(wsConn, s.offer(aeadToken), 0)
+		release()
+		if err != nil {
+			watcher.stop()
+			if watcher.isClosed() {
+				return errLocalClosed
+			}
+			s.sendErrorResponse(conn, mode)
+			return fmt.Errorf("协议协商失败: %w", err)
+		}
+	}
+	conn = watcher.stop()
+
+	var aead *protocol.AEADStream
+	if aeadToken != "" {
+		if !session.Has(protocol.FeatureAEAD) || !session.Has(protocol.FeatureAddressFrame) {
+			s.sendErrorResponse(conn, mode)
+			return errors.New("Worker 未启用内层加密，拒绝以明文转发")
+		}
+		if aead, err = protocol.NewClientAEAD(aeadToken, session.Salt); err != nil {
+			s.sendErrorResponse(conn, mode)
+			return fmt.Errorf("初始化内层加密失败: %w", err)
+		}
+	}
+
+	var compressor *protocol.Compressor
+	if session.Compression != protocol.CompressionNone {
+		if compressor, err = protocol.NewCompressor(session.Compression, session.Level); err != nil {
+			s.sendErrorResponse(conn, mode)
+			return fmt.Errorf("初始化压缩失败: %w", err)
+		}
+	}
+
 	var mu sync.Mutex
 
+	// 保留拨号时设置的处理函数（连接保活依靠它记录 pong）
+	prevPong := wsConn.PongHandler()
+	wsConn.SetPongHandler(func(appData string) error {
+		handlePong(appData)
+		return prevPong(appData)
+	})
+
 	stopPing := make(chan bool)
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				mu.Lock()
-				wsConn.WriteMessage(websocket.PingMessage, nil)
-				mu.Unlock()
-			case <-stopPing:
-				return
-			}
-		}
-	}()
 	defer close(stopPing)
+	// 协商了协议心跳时在流建立后再启动，避免 PONG 与连接确认混在一起
+	var hb *heartbeat
+	if session.Has(protocol.FeatureHeartbeat) {
+		hb = newHeartbeat(s.heartbeatInterval)
+	} else {
+		go func() {
+			ticker := time.NewTicker(10 * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					mu.Lock()
+					wsConn.WriteMessage(websocket.PingMessage, pingPayload())
+					mu.Unlock()
+				case <-stopPing:
+					return
+				}
+			}
+		}()
+	}
 
 	conn.SetDeadline(time.Time{})
 
-	if firstFrame == nil && mode == ModeSOCKS5 {
+	if firstFrame == nil && (mode == ModeSOCKS5 || mode == ModeSOCKS4) {
 		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second)) // 增加超时时间
-		buffer := s.bufPool.Get().([]byte)
+		buffer := bufpool.Get(relayBufferSize)
 		n, _ := conn.Read(buffer)
 		_ = conn.SetReadDeadline(time.Time{})
-		if n > 0 && n <= 32*1024 {
+		if n > 0 {
 			firstFrame = make([]byte, n)
 			copy(firstFrame, buffer[:n])
-		} else if n > 32*1024 {
-			firstFrame = make([]byte, 32*1024)
-			copy(firstFrame, buffer[:32*1024])
-		} else {
-			firstFrame = nil
 		}
-		s.bufPool.Put(buffer)
+		bufpool.Put(buffer)
+	}
+
+	opts := relayOptions{
+		aead:      aead,
+		compress:  compressor,
+		heartbeat: hb,
+		halfClose: session.Has(protocol.FeatureHalfClose),
+		closeCode: session.Has(protocol.FeatureCloseCode),
+	}
+	if s.vlessUUID != nil {
+		err = s.openVLESSStream(wsConn, &mu, target, firstFrame)
+		opts.vless = true
+	} else {
+		watcher = watchLocalClose(conn)
+		release := watcher.abortOnClose(func() { wsConn.Close() })
+		err = s.openStream(wsConn, &mu, session, aead, target, firstFrame)
+		release()
+		conn = watcher.stop()
+		if err != nil && watcher.isClosed() {
+			return errLocalClosed
+		}
+	}
+	if err != nil {
+		s.sendErrorResponse(conn, mode)
+		return err
+	}
+
+	if err := s.sendSuccessResponse(conn, mode); err != nil {
+		return fmt.Errorf("发送成功响应失败: %w", err)
+	}
+
+	log.Printf("[代理] %s 已连接: %s (协议 %s)", clientAddr, target, session)
+
+	if hb != nil {
+		go hb.run(wsConn, &mu, target, stopPing)
+	}
+	if s.coverInterval > 0 {
+		opts.activity = newActivity()
+		go s.coverTraffic(wsConn, &mu, opts.activity, stopPing)
+	}
+	if session.Has(protocol.FeatureReauth) {
+		defer s.track(wsConn, &mu)()
 	}
 
+	err = s.relay(conn, wsConn, &mu, opts)
+	if hb != nil && hb.stalled.Load() {
+		err = errTunnelStalled
+	}
+	if opts.closeCode {
+		closeSession(wsConn, err)
+	}
+	if err != nil {
+		log.Printf("[代理] %s 异常断开: %s (%v)", clientAddr, target, err)
+	} else {
+		log.Printf("[代理] %s 已断开: %s", clientAddr, target)
+	}
+	return nil
+}
+
+// closeSession 发送会话关闭帧，告知Worker本端结束的原因
+func closeSession(wsConn *websocket.Conn, err error) {
+	code := protocol.CloseNormal
+	var peer protocol.CloseInfo
+	switch {
+	case err == nil, errors.As(err, &peer):
+	case errors.Is(err, errStreamStalled), errors.Is(err, errTunnelStalled):
+		code = protocol.CloseStalled
+	case errors.Is(err, errBadMessage):
+		code = protocol.CloseProtocolError
+	default:
+		code = protocol.CloseInternalError
+	}
+	wsConn.WriteControl(websocket.CloseMessage, protocol.SessionCloseMessage(code, ""), time.Now().Add(time.Second))
+}
+
+// openStream 发送连接请求并等待Worker确认
+func (s *ProxyServer) openStream(wsConn *websocket.Conn, mu *sync.Mutex, session *protocol.Session, aead *protocol.AEADStream, target string, firstFrame []byte) error {
+	msgType := websocket.TextMessage
 	var connectMsg []byte
-	if s.proxyIP != "" {
-		connectMsg = append([]byte(fmt.Sprintf("CONNECT:%s|", target)), firstFrame...)
-		connectMsg = append(connectMsg, []byte(fmt.Sprintf("|%s", s.proxyIP))...)
+	if session.Has(protocol.FeatureAddressFrame) {
+		req, err := protocol.NewConnectRequest(target, s.proxyIP, firstFrame)
+		if err == nil {
+			connectMsg, err = req.Encode()
+		}
+		if err != nil {
+			return fmt.Errorf("构造地址帧失败: %w", err)
+		}
+		if aead != nil {
+			connectMsg = aead.Seal(nil, connectMsg)
+		}
+		msgType = websocket.BinaryMessage
 	} else {
-		connectMsg = append([]byte(fmt.Sprintf("CONNECT:%s|", target)), firstFrame...)
+		connectMsg = BuildConnectMessage(target, firstFrame, s.proxyIP)
 	}
 
 	mu.Lock()
-	err = wsConn.WriteMessage(websocket.TextMessage, connectMsg)
+	err := wsConn.WriteMessage(msgType, connectMsg)
 	mu.Unlock()
 	if err != nil {
-		s.sendErrorResponse(conn, mode)
 		return fmt.Errorf("发送连接请求失败: %w", err)
 	}
 
 	_, msg, err := wsConn.ReadMessage()
 	if err != nil {
-		s.sendErrorResponse(conn, mode)
 		return fmt.Errorf("读取连接响应失败: %w", err)
 	}
 
 	response := string(msg)
 	if strings.HasPrefix(response, "ERROR:") {
-		s.sendErrorResponse(conn, mode)
 		return errors.New(response)
 	}
 	if response != "CONNECTED" {
-		s.sendErrorResponse(conn, mode)
 		return fmt.Errorf("意外响应: %s", response)
 	}
+	return nil
+}
 
-	if err := s.sendSuccessResponse(conn, mode); err != nil {
-		return fmt.Errorf("发送成功响应失败: %w", err)
+// openVLESSStream 以 VLESS-over-WS 格式发送请求头和首帧，服务端不会单独确认
+func (s *ProxyServer) openVLESSStream(wsConn *websocket.Conn, mu *sync.Mutex, target string, firstFrame []byte) error {
+	header, err := protocol.EncodeVLESSRequest(*s.vlessUUID, target, firstFrame)
+	if err != nil {
+		return fmt.Errorf("构造VLESS请求失败: %w", err)
 	}
-
-	log.Printf("[代理] %s 已连接: %s", clientAddr, target)
-
-	done := make(chan struct{})
-	var once sync.Once
-	closeDone := func() {
-		once.Do(func() { close(done) })
+	mu.Lock()
+	err = wsConn.WriteMessage(websocket.BinaryMessage, header)
+	mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("发送连接请求失败: %w", err)
 	}
+	return nil
+}
 
-	go func() {
-		buf := s.bufPool.Get().([]byte)
-		defer s.bufPool.Put(buf)
-
-		for {
-			n, err := conn.Read(buf)
-			if err != nil {
-				mu.Lock()
-				wsConn.WriteMessage(websocket.TextMessage, []byte("CLOSE"))
-				mu.Unlock()
-				closeDone()
-				return
-			}
-
-			mu.Lock()
-			err = wsConn.WriteMessage(websocket.BinaryMessage, buf[:n])
-			mu.Unlock()
-			if err != nil {
-				closeDone()
-				return
-			}
-		}
-	}()
-
-	go func() {
-		for {
-			mt, msg, err := wsConn.ReadMessage()
-			if err != nil {
-				closeDone()
-				return
-			}
-
-			if mt == websocket.TextMessage {
-				if string(msg) == "CLOSE" {
-					closeDone()
-					return
-				}
-			}
+// pingPayload 在ping中携带发送时间，用于根据pong计算隧道RTT
+func pingPayload() []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+}
 
-			if _, err := conn.Write(msg); err != nil {
-				closeDone()
-				return
-			}
+func handlePong(appData string) error {
+	// 填充 ping 的负载以发送时间开头，之后是随机填充
+	if len(appData) >= 8 {
+		sent := int64(binary.BigEndian.Uint64([]byte(appData[:8])))
+		if rtt := time.Since(time.Unix(0, sent)); rtt > 0 {
+			stats.SetRTT(rtt)
 		}
-	}()
-
-	<-done
-	log.Printf("[代理] %s 已断开: %s", clientAddr, target)
+	}
 	return nil
 }
 
@@ -469,6 +731,8 @@ func (s *ProxyServer) sendErrorResponse(conn net.Conn, mode int) {
 	switch mode {
 	case ModeSOCKS5:
 		conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	case ModeSOCKS4:
+		conn.Write(socks4Reply(socks4Rejected))
 	case ModeHTTPConnect, ModeHTTPProxy:
 		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
 	}
@@ -479,6 +743,9 @@ func (s *ProxyServer) sendSuccessResponse(conn net.Conn, mode int) error {
 	case ModeSOCKS5:
 		_, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 		return err
+	case ModeSOCKS4:
+		_, err := conn.Write(socks4Reply(socks4Granted))
+		return err
 	case ModeHTTPConnect:
 		_, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 		return err
@@ -492,7 +759,7 @@ func isNormalCloseError(err error) bool {
 	if err == nil {
 		return false
 	}
-	if err == io.EOF {
+	if err == io.EOF || errors.Is(err, errLocalClosed) {
 		return true
 	}
 	errStr := err.Error()
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// DefaultMaxBuffered 每条流每个方向默认最多缓冲的数据量
+const DefaultMaxBuffered = 256 * 1024
+
+var (
+	errStreamStalled = errors.New("流写入阻塞超时")
+	errStreamClosed  = errors.New("流已关闭")
+)
+
+// chunkQueue 是单向的有界数据块队列。每个块不超过 relayBufferSize，
+// 队列容量按 maxBuffered/relayBufferSize 计算，因此缓冲数据量有明确上限。
+type chunkQueue struct {
+	ch chan []byte
+}
+
+func newChunkQueue(maxBuffered int) *chunkQueue {
+	slots := maxBuffered / relayBufferSize
+	if slots < 1 {
+		slots = 1
+	}
+	return &chunkQueue{ch: make(chan []byte, slots)}
+}
+
+// push 放入一个数据块，队列已满时阻塞；stall 大于0时阻塞超过该时长返回 errStreamStalled
+func (q *chunkQueue) push(chunk []byte, done <-chan struct{}, stall time.Duration) error {
+	select {
+	case q.ch <- chunk:
+		return nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if stall > 0 {
+		timer := time.NewTimer(stall)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case q.ch <- chunk:
+		return nil
+	case <-done:
+		return errStreamClosed
+	case <-timeout:
+		return errStreamStalled
+	}
+}
+
+// pop 取出一个数据块，队列关闭且为空时返回 io.EOF，流结束时返回 errStreamClosed
+func (q *chunkQueue) pop(done <-chan struct{}) ([]byte, error) {
+	select {
+	case chunk, ok := <-q.ch:
+		if !ok {
+			return nil, io.EOF
+		}
+		return chunk, nil
+	case <-done:
+		return nil, errStreamClosed
+	}
+}
+
+// close 由生产方调用，表示不会再放入数据
+func (q *chunkQueue) close() {
+	close(q.ch)
+}
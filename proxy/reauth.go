@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+
+	"ech-workers/events"
+	"ech-workers/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// liveSession 已建立且支持重新认证的隧道会话
+type liveSession struct {
+	wsConn *websocket.Conn
+	mu     *sync.Mutex
+}
+
+// track 登记会话，返回的函数用于注销
+func (s *ProxyServer) track(wsConn *websocket.Conn, mu *sync.Mutex) func() {
+	ls := &liveSession{wsConn: wsConn, mu: mu}
+	s.sessionsMu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[*liveSession]struct{})
+	}
+	s.sessions[ls] = struct{}{}
+	s.sessionsMu.Unlock()
+	return func() {
+		s.sessionsMu.Lock()
+		delete(s.sessions, ls)
+		s.sessionsMu.Unlock()
+	}
+}
+
+func (s *ProxyServer) currentAEADToken() string {
+	s.tokenMu.RLock()
+	defer s.tokenMu.RUnlock()
+	return s.aeadToken
+}
+
+// RotateToken 在所有支持重新认证的会话上发送新令牌，返回已通知的会话数。
+// 新建连接使用的令牌需另外通过 WebSocket 客户端的 SetToken 更换；
+// 已建立会话的内层加密密钥在握手时派生，不随令牌变化。
+func (s *ProxyServer) RotateToken(token string) int {
+	s.tokenMu.Lock()
+	if s.aeadToken != "" {
+		s.aeadToken = token
+	}
+	s.tokenMu.Unlock()
+
+	s.sessionsMu.Lock()
+	live := make([]*liveSession, 0, len(s.sessions))
+	for ls := range s.sessions {
+		live = append(live, ls)
+	}
+	s.sessionsMu.Unlock()
+
+	msg := protocol.EncodeAuth(token)
+	notified := 0
+	for _, ls := range live {
+		ls.mu.Lock()
+		err := ls.wsConn.WriteMessage(websocket.TextMessage, msg)
+		ls.mu.Unlock()
+		if err == nil {
+			notified++
+		}
+	}
+	return notified
+}
+
+// handleAuthReply 处理 Worker 对重新认证的响应，失败时 Worker 随后会关闭会话
+func handleAuthReply(accepted bool, reason string) {
+	if accepted {
+		return
+	}
+	log.Printf("[代理] Worker 拒绝新令牌: %s", reason)
+	events.Emit(events.AuthFailed, reason, nil)
+}
@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"ech-workers/bufpool"
+	"ech-workers/protocol"
+	"ech-workers/stats"
+
+	"github.com/gorilla/websocket"
+)
+
+// BuildConnectMessage 构造发送给Worker的连接请求
+func BuildConnectMessage(target string, firstFrame []byte, proxyIP string) []byte {
+	connectMsg := append([]byte(fmt.Sprintf("CONNECT:%s|", target)), firstFrame...)
+	if proxyIP != "" {
+		connectMsg = append(connectMsg, []byte(fmt.Sprintf("|%s", proxyIP))...)
+	}
+	return connectMsg
+}
+
+// relayOptions 描述流在隧道中的封装格式
+type relayOptions struct {
+	// vless 为 true 时剥离服务端数据前的 VLESS 响应头，并以 WebSocket 关闭帧代替 CLOSE 消息
+	vless bool
+	// aead 不为空时对二进制消息进行内层加解密
+	aead *protocol.AEADStream
+	// compress 不为空时对二进制数据消息逐条压缩，先压缩再加密
+	compress *protocol.Compressor
+	// heartbeat 不为空时处理 Worker 返回的 PONG 消息
+	heartbeat *heartbeat
+	// halfClose 为 true 时用 FIN 传递单方向结束
+	halfClose bool
+	// closeCode 为 true 时关闭消息携带原因码
+	closeCode bool
+	// activity 不为空时在收发数据后更新，用于判断隧道是否空闲
+	activity *activity
+}
+
+// errBadMessage 收到的消息无法解密、解压或解析
+var errBadMessage = errors.New("消息解码失败")
+
+// maxSealedMessage 内层加密或压缩模式下单条消息（以及解压结果）的上限
+const maxSealedMessage = 1024 * 1024
+
+// relay 在本地连接与WebSocket之间双向转发数据。
+// 每个方向的读写通过有界队列解耦，队列满时阻塞读取端形成背压；
+// 设置了 stallTimeout 时，阻塞超过该时长的流会被直接断开。
+// 协商了半关闭时，一个方向结束只发送/执行 FIN，两个方向都结束后流才关闭；
+// 否则任一方向结束即返回。
+// 有序关闭时返回 nil，对端异常关闭、网络中断等情况返回原因。
+func (s *ProxyServer) relay(conn net.Conn, wsConn *websocket.Conn, mu *sync.Mutex, opts relayOptions) error {
+	// endErr 记录第一个结束原因，nil 指针表示尚未记录
+	var endErr atomic.Pointer[error]
+	setEnd := func(err error) {
+		endErr.CompareAndSwap(nil, &err)
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	finish := func(err error) {
+		setEnd(err)
+		once.Do(func() { close(done) })
+	}
+	closeDone := func() { finish(nil) }
+	var halves atomic.Int32
+	halfDone := func() {
+		if halves.Add(1) == 2 {
+			closeDone()
+		}
+	}
+
+	up := newChunkQueue(s.maxBuffered)
+	down := newChunkQueue(s.maxBuffered)
+
+	var upAborted, finReceived atomic.Bool
+
+	// 本地 -> 队列
+	go func() {
+		defer up.close()
+		for {
+			buf := bufpool.Get(relayBufferSize)
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if err := up.push(buf[:n], done, s.stallTimeout); err != nil {
+					bufpool.Put(buf)
+					s.logStall("上行", err)
+					finish(err)
+					return
+				}
+			} else {
+				bufpool.Put(buf)
+			}
+			if err != nil {
+				if err != io.EOF {
+					upAborted.Store(true)
+				}
+				return
+			}
+		}
+	}()
+
+	// 队列 -> WebSocket
+	go func() {
+		for {
+			chunk, err := up.pop(done)
+			if err != nil {
+				mu.Lock()
+				switch {
+				case opts.vless:
+					wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				case opts.halfClose && err == io.EOF && !upAborted.Load():
+					wsConn.WriteMessage(websocket.TextMessage, []byte(protocol.MessageFIN))
+				case opts.closeCode && err == io.EOF && upAborted.Load():
+					wsConn.WriteMessage(websocket.TextMessage, protocol.EncodeClose(protocol.CloseReset, "本地连接异常"))
+				case opts.closeCode && err == io.EOF:
+					wsConn.WriteMessage(websocket.TextMessage, protocol.EncodeClose(protocol.CloseNormal, ""))
+				case opts.closeCode:
+					// 流因其他原因结束，由会话关闭帧告知对端原因
+				default:
+					wsConn.WriteMessage(websocket.TextMessage, []byte(protocol.MessageClose))
+				}
+				mu.Unlock()
+				if opts.halfClose && err == io.EOF && !upAborted.Load() {
+					halfDone()
+				} else {
+					closeDone()
+				}
+				return
+			}
+			payload := chunk
+			var compressed, sealed []byte
+			if opts.compress != nil {
+				compressed = opts.compress.Encode(bufpool.Get(len(chunk) + 1)[:0], chunk)
+				payload = compressed
+			}
+			if opts.aead != nil {
+				sealed = opts.aead.Seal(bufpool.Get(len(payload) + opts.aead.Overhead())[:0], payload)
+				payload = sealed
+			}
+			mu.Lock()
+			err = wsConn.WriteMessage(websocket.BinaryMessage, payload)
+			mu.Unlock()
+			if compressed != nil {
+				bufpool.Put(compressed)
+			}
+			if sealed != nil {
+				bufpool.Put(sealed)
+			}
+			if err == nil {
+				stats.AddBytesUp(len(chunk))
+				if opts.activity != nil {
+					opts.activity.touch()
+				}
+			}
+			bufpool.Put(chunk)
+			if err != nil {
+				finish(fmt.Errorf("写入隧道失败: %w", err))
+				return
+			}
+		}
+	}()
+
+	// WebSocket -> 队列
+	go func() {
+		defer down.close()
+		var stripper *protocol.VLESSResponseStripper
+		if opts.vless {
+			stripper = &protocol.VLESSResponseStripper{}
+		}
+	messages:
+		for {
+			mt, r, err := wsConn.NextReader()
+			if err != nil {
+				if info, ok := protocol.ParseSessionClose(err); ok && info.Orderly() {
+					setEnd(nil)
+				} else if ok {
+					setEnd(info)
+				} else {
+					setEnd(fmt.Errorf("隧道连接中断: %w", err))
+				}
+				return
+			}
+			if (opts.aead != nil || opts.compress != nil) && mt == websocket.BinaryMessage {
+				if err := s.pushMessage(down, r, opts, done); err != nil {
+					s.logStall("下行", err)
+					finish(err)
+					return
+				}
+				continue
+			}
+			first := true
+			for {
+				buf := bufpool.Get(relayBufferSize)
+				n, rerr := io.ReadFull(r, buf)
+				if first && mt == websocket.TextMessage && rerr != nil {
+					if info, ok := protocol.ParseClose(buf[:n]); ok {
+						if !info.Orderly() {
+							setEnd(info)
+						}
+						bufpool.Put(buf)
+						return
+					}
+					switch text := buf[:n]; {
+					case string(text) == protocol.MessageFIN && opts.halfClose:
+						bufpool.Put(buf)
+						finReceived.Store(true)
+						return
+					case bytes.HasPrefix(text, []byte(protocol.AuthPrefix)):
+						if accepted, reason, ok := protocol.ParseAuthReply(text); ok {
+							handleAuthReply(accepted, reason)
+							bufpool.Put(buf)
+							continue messages
+						}
+					case opts.heartbeat != nil && bytes.HasPrefix(text, []byte(protocol.PongPrefix)):
+						opts.heartbeat.handlePong(text)
+						bufpool.Put(buf)
+						continue messages
+					}
+				}
+				first = false
+				data := buf[:n]
+				if stripper != nil && n > 0 {
+					if data, err = stripper.Strip(data); err != nil {
+						bufpool.Put(buf)
+						finish(fmt.Errorf("%w: %v", errBadMessage, err))
+						return
+					}
+				}
+				if len(data) > 0 {
+					if err := down.push(data, done, s.stallTimeout); err != nil {
+						bufpool.Put(buf)
+						s.logStall("下行", err)
+						finish(err)
+						return
+					}
+				} else {
+					bufpool.Put(buf)
+				}
+				if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+					break
+				}
+				if rerr != nil {
+					setEnd(fmt.Errorf("隧道连接中断: %w", rerr))
+					return
+				}
+			}
+		}
+	}()
+
+	// 队列 -> 本地
+	go func() {
+		for {
+			chunk, err := down.pop(done)
+			if err != nil {
+				if err == io.EOF && finReceived.Load() {
+					if cw, ok := conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+						halfDone()
+						return
+					}
+				}
+				closeDone()
+				return
+			}
+			n, err := conn.Write(chunk)
+			stats.AddBytesDown(n)
+			if opts.activity != nil {
+				opts.activity.touch()
+			}
+			bufpool.Put(chunk)
+			if err != nil {
+				closeDone()
+				return
+			}
+		}
+	}()
+
+	<-done
+	if err := endErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// pushMessage 读取一条完整的消息，依次解密、解压后按缓冲区大小切块放入队列
+func (s *ProxyServer) pushMessage(q *chunkQueue, r io.Reader, opts relayOptions, done <-chan struct{}) error {
+	msg, err := io.ReadAll(io.LimitReader(r, maxSealedMessage+1))
+	if err != nil {
+		return err
+	}
+	if len(msg) > maxSealedMessage {
+		return fmt.Errorf("%w: 消息过大", errBadMessage)
+	}
+	plain := msg
+	if opts.aead != nil {
+		if plain, err = opts.aead.Open(msg[:0], msg); err != nil {
+			return fmt.Errorf("%w: %v", errBadMessage, err)
+		}
+	}
+	if opts.compress != nil {
+		if plain, err = opts.compress.Decode(nil, plain, maxSealedMessage); err != nil {
+			return fmt.Errorf("%w: %v", errBadMessage, err)
+		}
+	}
+	for len(plain) > 0 {
+		n := len(plain)
+		if n > relayBufferSize {
+			n = relayBufferSize
+		}
+		if err := q.push(plain[:n:n], done, s.stallTimeout); err != nil {
+			return err
+		}
+		plain = plain[n:]
+	}
+	return nil
+}
+
+func (s *ProxyServer) logStall(direction string, err error) {
+	if errors.Is(err, errStreamStalled) {
+		log.Printf("[代理] %s方向写入阻塞超过 %v，断开该流", direction, s.stallTimeout)
+	}
+}
@@ -0,0 +1,135 @@
+package proxy_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"ech-workers/echtest"
+	"ech-workers/proxy"
+
+	"github.com/gorilla/websocket"
+)
+
+// benchSizes 转发基准使用的消息大小 (字节)
+var benchSizes = []int{512, 4096, 32768, 262144}
+
+// quietLog 代理在每条隧道建立/断开时都会打印日志，基准运行期间关闭
+func quietLog(b *testing.B) {
+	w := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(w) })
+}
+
+// BenchmarkRelay 测量 本地连接 -> 代理 -> WebSocket -> 回显Worker -> 本地连接 的完整转发路径
+func BenchmarkRelay(b *testing.B) {
+	quietLog(b)
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			server := proxy.NewProxyServer(ln.Addr().String(), echtest.NewPipeTransport(nil), "")
+			go server.Serve(ln)
+			defer ln.Close()
+
+			conn, err := openTunnel(ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			payload := make([]byte, size)
+			reply := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, reply); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRelayFraming 测量单条WebSocket消息的封帧、传输与解帧开销
+func BenchmarkRelayFraming(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			wsConn, err := echtest.NewPipeTransport(func(conn *websocket.Conn) {
+				for {
+					mt, msg, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					if err := conn.WriteMessage(mt, msg); err != nil {
+						return
+					}
+				}
+			}).DialWithECH(1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer wsConn.Close()
+
+			payload := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := wsConn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := wsConn.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRelayConnectMessage 测量携带首帧数据的连接请求构造
+func BenchmarkRelayConnectMessage(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			firstFrame := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				proxy.BuildConnectMessage("example.com:443", firstFrame, "proxy.example.com")
+			}
+		})
+	}
+}
+
+// openTunnel 经代理的 HTTP CONNECT 建立到回显Worker的隧道
+func openTunnel(addr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("CONNECT bench.invalid:443 HTTP/1.1\r\nHost: bench.invalid:443\r\n\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	const established = "HTTP/1.1 200 Connection Established\r\n\r\n"
+	status := make([]byte, len(established))
+	if _, err := io.ReadFull(conn, status); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if string(status) != established {
+		conn.Close()
+		return nil, errors.New("建立隧道失败: " + strings.TrimSpace(string(status)))
+	}
+	return conn, nil
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// FreeBSD 的 SO_REUSEPORT 只允许绑定同一端口，新连接总是交给其中一个套接字；
+// SO_REUSEPORT_LB 才会在各套接字之间负载均衡
+const reusePortSupported = true
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT_LB, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
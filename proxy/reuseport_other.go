@@ -0,0 +1,13 @@
+//go:build !linux && !freebsd
+
+package proxy
+
+import "syscall"
+
+// 其他系统（包括 macOS 与其他 BSD）的 SO_REUSEPORT 不在套接字之间分配连接，
+// 打开多个套接字没有意义
+const reusePortSupported = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+	// socks4MaxField USERID 与 SOCKS4a 域名的最大长度
+	socks4MaxField = 255
+)
+
+// handleSOCKS4 处理 SOCKS4 与 SOCKS4a 的 CONNECT 请求（与 SOCKS5 共用监听端口，按首字节区分）。
+// SOCKS4a 以 0.0.0.x 作为目标IP，并在 USERID 之后附带域名
+func (s *ProxyServer) handleSOCKS4(conn net.Conn, clientAddr string) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	command := header[0]
+	port := binary.BigEndian.Uint16(header[1:3])
+	ip := net.IP(header[3:7])
+
+	if _, ok := readSOCKS4String(conn); !ok {
+		return
+	}
+
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, ok := readSOCKS4String(conn)
+		if !ok || domain == "" {
+			conn.Write(socks4Reply(socks4Rejected))
+			return
+		}
+		host = domain
+	}
+
+	if command != 0x01 {
+		log.Printf("[SOCKS4] %s 不支持的命令: 0x%02x", clientAddr, command)
+		conn.Write(socks4Reply(socks4Rejected))
+		return
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	log.Printf("[SOCKS4] %s -> %s", clientAddr, target)
+
+	if err := s.handleTunnel(conn, target, clientAddr, ModeSOCKS4, nil); err != nil {
+		if !isNormalCloseError(err) {
+			log.Printf("[SOCKS4] %s 代理失败: %v", clientAddr, err)
+		}
+	}
+}
+
+// readSOCKS4String 读取以 0 结尾的字段。逐字节读取，以免吞掉客户端在请求之后提前发送的数据
+func readSOCKS4String(r io.Reader) (string, bool) {
+	var b []byte
+	c := make([]byte, 1)
+	for len(b) <= socks4MaxField {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", false
+		}
+		if c[0] == 0 {
+			return string(b), true
+		}
+		b = append(b, c[0])
+	}
+	return "", false
+}
+
+func socks4Reply(code byte) []byte {
+	return []byte{0x00, code, 0, 0, 0, 0, 0, 0}
+}
@@ -0,0 +1,376 @@
+package route
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// geoIP MaxMind DB (.mmdb) 格式的国家/地区数据库，例如 GeoLite2-Country 或 Country.mmdb。
+// 文件只读映射，查找时直接在映射上遍历搜索树，不把数据载入堆内存。
+type geoIP struct {
+	file *sharedFile
+}
+
+// mmdbMeta 由元数据解析出的搜索树参数，首次查找时构建
+type mmdbMeta struct {
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint
+	// ipv4Start IPv6 数据库中 ::/96 子树的起点，IPv4 地址从这里开始查找
+	ipv4Start uint
+}
+
+var mmdbMetaMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openGeoIP(path string) (*geoIP, error) {
+	f, err := openShared(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开GeoIP数据库失败: %v", err)
+	}
+	return &geoIP{file: f}, nil
+}
+
+func (g *geoIP) release() {
+	g.file.release()
+}
+
+// Country 返回 ip 所属国家/地区的 ISO 代码（大写），未收录时返回空
+func (g *geoIP) Country(ip net.IP) (string, error) {
+	idx, err := g.file.buildIndex(parseMMDBMeta)
+	if err != nil || idx == nil {
+		return "", err
+	}
+	meta := idx.(*mmdbMeta)
+
+	// Router 被替换后仍可能有进行中的查找，映射已释放时视为未收录
+	g.file.mu.RLock()
+	defer g.file.mu.RUnlock()
+	if g.file.closed {
+		return "", nil
+	}
+	data := g.file.data
+
+	node := uint(0)
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if meta.ipVersion == 6 {
+			node = meta.ipv4Start
+		}
+	} else if meta.ipVersion == 4 {
+		return "", nil
+	}
+	for i := 0; i < len(bits)*8 && node < meta.nodeCount; i++ {
+		bit := (bits[i/8] >> (7 - uint(i%8))) & 1
+		if node, err = meta.record(data, node, bit); err != nil {
+			return "", err
+		}
+	}
+	if node <= meta.nodeCount {
+		return "", nil
+	}
+	d := mmdbDecoder{data: data[meta.treeSize+16:]}
+	offset := node - meta.nodeCount - 16
+	for _, path := range [][]string{{"country", "iso_code"}, {"registered_country", "iso_code"}} {
+		v, err := d.lookup(offset, path)
+		if err != nil {
+			return "", err
+		}
+		if s, ok := v.(string); ok && s != "" {
+			return strings.ToUpper(s), nil
+		}
+	}
+	return "", nil
+}
+
+// record 读取节点 node 的左 (bit=0) 或右 (bit=1) 记录
+func (m *mmdbMeta) record(data []byte, node uint, bit byte) (uint, error) {
+	size := m.recordSize / 4
+	off := node * size
+	if off+size > uint(len(data)) {
+		return 0, errors.New("GeoIP数据库搜索树损坏")
+	}
+	b := data[off : off+size]
+	switch m.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b)), nil
+		}
+		return uint(binary.BigEndian.Uint32(b[4:])), nil
+	}
+}
+
+// parseMMDBMeta 从文件末尾的元数据中读取搜索树参数
+func parseMMDBMeta(data []byte) (any, error) {
+	i := bytes.LastIndex(data, mmdbMetaMarker)
+	if i < 0 {
+		return nil, errors.New("不是有效的 MaxMind DB 文件")
+	}
+	d := mmdbDecoder{data: data[i+len(mmdbMetaMarker):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("GeoIP数据库元数据无效: %v", err)
+	}
+	fields, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("GeoIP数据库元数据无效")
+	}
+	uintField := func(name string) uint {
+		n, _ := fields[name].(uint64)
+		return uint(n)
+	}
+	m := &mmdbMeta{
+		nodeCount:  uintField("node_count"),
+		recordSize: uintField("record_size"),
+		ipVersion:  uintField("ip_version"),
+	}
+	if m.recordSize != 24 && m.recordSize != 28 && m.recordSize != 32 {
+		return nil, fmt.Errorf("不支持的GeoIP记录长度: %d", m.recordSize)
+	}
+	m.treeSize = m.nodeCount * m.recordSize / 4
+	if m.treeSize+16 > uint(i) {
+		return nil, errors.New("GeoIP数据库被截断")
+	}
+	if m.ipVersion == 6 {
+		var err error
+		for n := 0; n < 96 && m.ipv4Start < m.nodeCount; n++ {
+			if m.ipv4Start, err = m.record(data, m.ipv4Start, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// mmdbDecoder 解码 MaxMind DB 数据段，偏移相对于 data 起点
+type mmdbDecoder struct {
+	data []byte
+}
+
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errMMDBData = errors.New("GeoIP数据库数据段损坏")
+
+// header 解析 offset 处的控制字节，返回类型、长度（指针为目标偏移）与负载起点
+func (d *mmdbDecoder) header(offset uint) (typ int, size uint, next uint, err error) {
+	if offset >= uint(len(d.data)) {
+		return 0, 0, 0, errMMDBData
+	}
+	ctrl := d.data[offset]
+	offset++
+	typ = int(ctrl >> 5)
+	if typ == mmdbPointer {
+		n := uint(ctrl>>3&3) + 1
+		if offset+n > uint(len(d.data)) {
+			return 0, 0, 0, errMMDBData
+		}
+		b := d.data[offset : offset+n]
+		v := uint(ctrl & 7)
+		switch n {
+		case 1:
+			size = v<<8 | uint(b[0])
+		case 2:
+			size = (v<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 3:
+			size = (v<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			size = uint(binary.BigEndian.Uint32(b))
+		}
+		return typ, size, offset + n, nil
+	}
+	if typ == mmdbExtended {
+		if offset >= uint(len(d.data)) {
+			return 0, 0, 0, errMMDBData
+		}
+		typ = 7 + int(d.data[offset])
+		offset++
+	}
+	size = uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.data)) {
+			return 0, 0, 0, errMMDBData
+		}
+		var ext uint
+		for _, c := range d.data[offset : offset+n] {
+			ext = ext<<8 | uint(c)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + ext
+		case 2:
+			size = 285 + ext
+		default:
+			size = 65821 + ext
+		}
+	}
+	return typ, size, offset, nil
+}
+
+// deref 解析指针 target 处的控制字节。规范不允许指针指向另一个指针，
+// 否则损坏的数据库可以构造指针环使解码无限递归
+func (d *mmdbDecoder) deref(target uint) (typ int, size uint, next uint, err error) {
+	if typ, size, next, err = d.header(target); err != nil {
+		return 0, 0, 0, err
+	}
+	if typ == mmdbPointer {
+		return 0, 0, 0, errMMDBData
+	}
+	return typ, size, next, nil
+}
+
+// decode 解码 offset 处的值，返回值与下一个值的偏移
+func (d *mmdbDecoder) decode(offset uint) (any, uint, error) {
+	typ, size, next, err := d.header(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == mmdbPointer {
+		if _, _, _, err := d.deref(size); err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(size)
+		return v, next, err
+	}
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, n, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBData
+			}
+			if m[key], next, err = d.decode(n); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, next, nil
+	case mmdbArray:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v any
+			if v, next, err = d.decode(next); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, next, nil
+	case mmdbBool:
+		return size != 0, next, nil
+	}
+	if next+size > uint(len(d.data)) {
+		return nil, 0, errMMDBData
+	}
+	b := d.data[next : next+size]
+	switch typ {
+	case mmdbString:
+		return string(b), next + size, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next + size, nil
+	case mmdbDouble, mmdbFloat, mmdbBytes, mmdbUint128:
+		// 路由不需要这些类型的值，只跳过
+		return nil, next + size, nil
+	}
+	return nil, 0, fmt.Errorf("GeoIP数据库包含未知类型 %d", typ)
+}
+
+// skip 返回跳过 offset 处的值后的偏移，不构造值
+func (d *mmdbDecoder) skip(offset uint) (uint, error) {
+	typ, size, next, err := d.header(offset)
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case mmdbPointer, mmdbBool:
+		return next, nil
+	case mmdbMap:
+		size *= 2
+		fallthrough
+	case mmdbArray:
+		for i := uint(0); i < size; i++ {
+			if next, err = d.skip(next); err != nil {
+				return 0, err
+			}
+		}
+		return next, nil
+	}
+	return next + size, nil
+}
+
+// lookup 沿 path 逐层查找嵌套的映射，只解码路径上的键与最终的值
+func (d *mmdbDecoder) lookup(offset uint, path []string) (any, error) {
+	for _, key := range path {
+		typ, size, next, err := d.header(offset)
+		if err != nil {
+			return nil, err
+		}
+		if typ == mmdbPointer {
+			if typ, size, next, err = d.deref(size); err != nil {
+				return nil, err
+			}
+		}
+		if typ != mmdbMap {
+			return nil, nil
+		}
+		found := false
+		for i := uint(0); i < size; i++ {
+			k, n, err := d.decode(next)
+			if err != nil {
+				return nil, err
+			}
+			if k == key {
+				offset, found = n, true
+				break
+			}
+			if next, err = d.skip(n); err != nil {
+				return nil, err
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+	v, _, err := d.decode(offset)
+	return v, err
+}
@@ -0,0 +1,121 @@
+package route
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdb 值的编码，只覆盖测试用到的类型
+func encString(s string) []byte  { return append([]byte{mmdbString<<5 | byte(len(s))}, s...) }
+func encMap(n int) []byte        { return []byte{mmdbMap<<5 | byte(n)} }
+func encUint(typ, v byte) []byte { return []byte{typ<<5 | 1, v} }
+func encPtr(off uint) []byte     { return []byte{mmdbPointer<<5 | byte(off>>8&7), byte(off)} }
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// writeTestMMDB 生成只有一个节点的 IPv4 数据库 (24 位记录)：0.0.0.0/1 指向 data 中的 left 偏移，
+// 128.0.0.0/1 指向 right 偏移
+func writeTestMMDB(t *testing.T, data []byte, left, right uint) string {
+	t.Helper()
+	const nodeCount = 1
+	rec := func(off uint) []byte {
+		v := nodeCount + 16 + off
+		return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	file := concat(rec(left), rec(right), make([]byte, 16), data, mmdbMetaMarker,
+		encMap(3),
+		encString("node_count"), encUint(mmdbUint32, nodeCount),
+		encString("record_size"), encUint(mmdbUint16, 24),
+		encString("ip_version"), encUint(mmdbUint16, 4),
+	)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// countryData 返回 {"country": {"iso_code": code}}，country 的值经指针引用位于 base 处的内层映射
+func countryData(base uint, code string) (data []byte, record uint) {
+	inner := concat(encMap(1), encString("iso_code"), encString(code))
+	outer := concat(encMap(1), encString("country"), encPtr(base))
+	return concat(inner, outer), base + uint(len(inner))
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	data, left := countryData(0, "us")
+	// 右半部分的 country 指向一个指针
+	bad := uint(len(data))
+	data = concat(data, encPtr(0), encMap(1), encString("country"), encPtr(bad))
+	right := bad + 2
+
+	g, err := openGeoIP(writeTestMMDB(t, data, left, right))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.release()
+
+	// 192.0.2.1 的首位为 1，落在右半部分
+	if _, err := g.Country(net.ParseIP("192.0.2.1")); !errors.Is(err, errMMDBData) {
+		t.Fatalf("接受了指向指针的指针: %v", err)
+	}
+	if c, err := g.Country(net.ParseIP("10.0.0.1")); err != nil || c != "US" {
+		t.Fatalf("Country(10.0.0.1) = %q, %v", c, err)
+	}
+	if c, err := g.Country(net.ParseIP("2001:db8::1")); err != nil || c != "" {
+		t.Fatalf("IPv4 数据库查找 IPv6 地址: %q, %v", c, err)
+	}
+}
+
+func TestMMDBDecoderPointers(t *testing.T) {
+	// 0: "us"  3: 指向 0  5: 指向 3  7: 指向自身
+	d := mmdbDecoder{data: concat(encString("us"), encPtr(0), encPtr(3), encPtr(7))}
+
+	v, next, err := d.decode(3)
+	if err != nil || v != "us" || next != 5 {
+		t.Fatalf("decode(3) = %v, %d, %v", v, next, err)
+	}
+	for _, off := range []uint{5, 7} {
+		if _, _, err := d.decode(off); !errors.Is(err, errMMDBData) {
+			t.Errorf("decode(%d) 返回 %v", off, err)
+		}
+	}
+	if next, err := d.skip(5); err != nil || next != 7 {
+		t.Fatalf("skip(5) = %d, %v", next, err)
+	}
+
+	// lookup 同样拒绝指向指针的指针
+	data, record := countryData(0, "us")
+	d = mmdbDecoder{data: data}
+	if v, err := d.lookup(record, []string{"country", "iso_code"}); err != nil || v != "us" {
+		t.Fatalf("lookup = %v, %v", v, err)
+	}
+	d = mmdbDecoder{data: concat(encPtr(2), encPtr(0))}
+	if _, err := d.lookup(0, []string{"country"}); !errors.Is(err, errMMDBData) {
+		t.Fatalf("lookup 返回 %v", err)
+	}
+}
+
+func TestMMDBDecoderTruncated(t *testing.T) {
+	for _, data := range [][]byte{
+		{},
+		{mmdbString<<5 | 5, 'a'},
+		{mmdbPointer << 5},
+		encPtr(100),
+		concat(encMap(1), encString("k")),
+	} {
+		d := mmdbDecoder{data: data}
+		if _, _, err := d.decode(0); err == nil {
+			t.Errorf("decode(%x) 没有返回错误", data)
+		}
+	}
+}
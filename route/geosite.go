@@ -0,0 +1,161 @@
+package route
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// geoSite 一个域名分类，对应 geosite 目录下与分类同名的文本文件
+// （v2fly/domain-list-community 的 data 格式），每行一条规则：
+//
+//	example.com          域名及其子域名
+//	domain:example.com   同上
+//	full:www.example.com 完全匹配
+//	keyword:example      包含关键字
+//	include:other        包含同目录下的另一个分类
+//
+// 行尾的 @属性 与 # 注释被忽略，regexp: 规则不支持，跳过。
+type geoSite struct {
+	name  string
+	files []*sharedFile
+}
+
+// domainSet 由分类文件构建的索引
+type domainSet struct {
+	suffixes map[string]struct{}
+	full     map[string]struct{}
+	keywords []string
+}
+
+// openGeoSite 映射分类 name 及其 include 的全部文件，文件内容在首次匹配时才解析
+func openGeoSite(dir, name string) (*geoSite, error) {
+	g := &geoSite{name: name}
+	seen := make(map[string]bool)
+	var open func(name string) error
+	open = func(name string) error {
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return fmt.Errorf("无效的geosite分类 %q", name)
+		}
+		f, err := openShared(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("打开geosite分类 %s 失败: %v", name, err)
+		}
+		g.files = append(g.files, f)
+		// include 需要在打开时解析，以便引用的文件一起被共享与释放
+		f.mu.RLock()
+		includes := geoSiteIncludes(f.data)
+		f.mu.RUnlock()
+		for _, inc := range includes {
+			if err := open(inc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := open(name); err != nil {
+		g.release()
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *geoSite) release() {
+	for _, f := range g.files {
+		f.release()
+	}
+	g.files = nil
+}
+
+// Match 返回 host（小写、无末尾点）是否属于该分类
+func (g *geoSite) Match(host string) (bool, error) {
+	for _, f := range g.files {
+		idx, err := f.buildIndex(parseGeoSite)
+		if err != nil {
+			return false, err
+		}
+		if idx != nil && idx.(*domainSet).match(host) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *domainSet) match(host string) bool {
+	if _, ok := s.full[host]; ok {
+		return true
+	}
+	for h := host; ; {
+		if _, ok := s.suffixes[h]; ok {
+			return true
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	for _, k := range s.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoSiteLines 逐行返回去掉注释与属性后的规则
+func geoSiteLines(data []byte, fn func(line string)) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if i := strings.IndexByte(line, '@'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line != "" {
+			fn(line)
+		}
+	}
+}
+
+func geoSiteIncludes(data []byte) []string {
+	var includes []string
+	geoSiteLines(data, func(line string) {
+		if inc, ok := strings.CutPrefix(line, "include:"); ok {
+			includes = append(includes, strings.TrimSpace(inc))
+		}
+	})
+	return includes
+}
+
+func parseGeoSite(data []byte) (any, error) {
+	s := &domainSet{suffixes: make(map[string]struct{}), full: make(map[string]struct{})}
+	geoSiteLines(data, func(line string) {
+		kind, value, ok := strings.Cut(line, ":")
+		if !ok {
+			kind, value = "domain", line
+		}
+		value = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(value), "."), ".")
+		if value == "" {
+			return
+		}
+		switch kind {
+		case "domain":
+			s.suffixes[value] = struct{}{}
+		case "full":
+			s.full[value] = struct{}{}
+		case "keyword":
+			s.keywords = append(s.keywords, value)
+		}
+	})
+	return s, nil
+}
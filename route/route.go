@@ -0,0 +1,196 @@
+// Package route 根据目标地址决定连接走隧道还是直连。
+package route
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+type Action int
+
+const (
+	ActionTunnel Action = iota
+	ActionDirect
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionDirect:
+		return "direct"
+	default:
+		return "tunnel"
+	}
+}
+
+// Router 保存直连规则，未命中任何规则的目标走隧道
+type Router struct {
+	domains []string
+	ips     []net.IP
+	nets    []*net.IPNet
+
+	geoIP     *geoIP
+	countries []string
+	geoSites  []*geoSite
+}
+
+// Options 规则数据库的位置
+type Options struct {
+	// GeoIP MaxMind DB 格式的国家数据库，geoip:CC 规则需要
+	GeoIP string
+	// GeoSite 域名分类目录，每个分类一个文件，geosite:分类 规则需要
+	GeoSite string
+}
+
+// Parse 解析逗号分隔的直连规则，支持域名后缀、IP 和 CIDR
+func Parse(spec string) (*Router, error) {
+	return ParseOptions(spec, Options{})
+}
+
+// ParseOptions 同 Parse，另外支持 geoip:国家代码 与 geosite:分类 规则。
+// 数据库以只读映射打开并在首次匹配时建立索引，相同的文件在多个 Router 之间共享；
+// 不再使用的 Router 需调用 Close 释放映射
+func ParseOptions(spec string, opts Options) (*Router, error) {
+	r := &Router{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if code, ok := strings.CutPrefix(item, "geoip:"); ok {
+			if err := r.addCountry(code, opts.GeoIP); err != nil {
+				r.Close()
+				return nil, err
+			}
+			continue
+		}
+		if name, ok := strings.CutPrefix(item, "geosite:"); ok {
+			if opts.GeoSite == "" {
+				r.Close()
+				return nil, fmt.Errorf("规则 %q 需要指定 geosite 目录", item)
+			}
+			site, err := openGeoSite(opts.GeoSite, name)
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			r.geoSites = append(r.geoSites, site)
+			continue
+		}
+		if strings.Contains(item, "/") {
+			_, ipNet, err := net.ParseCIDR(item)
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("无效的CIDR规则 %q: %v", item, err)
+			}
+			r.nets = append(r.nets, ipNet)
+			continue
+		}
+		if ip := net.ParseIP(strings.Trim(item, "[]")); ip != nil {
+			r.ips = append(r.ips, ip)
+			continue
+		}
+		r.domains = append(r.domains, strings.TrimPrefix(strings.TrimSuffix(item, "."), "."))
+	}
+	return r, nil
+}
+
+func (r *Router) addCountry(code, path string) error {
+	if len(code) != 2 {
+		return fmt.Errorf("无效的国家代码 %q", code)
+	}
+	if path == "" {
+		return fmt.Errorf("规则 geoip:%s 需要指定 GeoIP 数据库", code)
+	}
+	if r.geoIP == nil {
+		g, err := openGeoIP(path)
+		if err != nil {
+			return err
+		}
+		r.geoIP = g
+	}
+	r.countries = append(r.countries, strings.ToUpper(code))
+	return nil
+}
+
+// Close 释放对数据库映射的引用，最后一个引用释放后解除映射，Close 之后不应再使用该 Router
+func (r *Router) Close() {
+	if r == nil {
+		return
+	}
+	if r.geoIP != nil {
+		r.geoIP.release()
+	}
+	for _, s := range r.geoSites {
+		s.release()
+	}
+}
+
+// Empty 返回是否没有任何规则
+func (r *Router) Empty() bool {
+	return r == nil || len(r.domains)+len(r.ips)+len(r.nets)+len(r.countries)+len(r.geoSites) == 0
+}
+
+// Route 返回目标地址（host 或 host:port）应使用的路由
+func (r *Router) Route(target string) Action {
+	if r.Empty() {
+		return ActionTunnel
+	}
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, v := range r.ips {
+			if v.Equal(ip) {
+				return ActionDirect
+			}
+		}
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				return ActionDirect
+			}
+		}
+		if len(r.countries) > 0 {
+			country, err := r.geoIP.Country(ip)
+			if err != nil {
+				logLookupError(err)
+			}
+			for _, c := range r.countries {
+				if c == country {
+					return ActionDirect
+				}
+			}
+		}
+		return ActionTunnel
+	}
+
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return ActionDirect
+		}
+	}
+	for _, s := range r.geoSites {
+		ok, err := s.Match(host)
+		if err != nil {
+			logLookupError(err)
+		}
+		if ok {
+			return ActionDirect
+		}
+	}
+	return ActionTunnel
+}
+
+var lookupErrOnce sync.Once
+
+// logLookupError 数据库损坏时每次查找都会失败，只记录一次
+func logLookupError(err error) {
+	lookupErrOnce.Do(func() {
+		log.Printf("[路由] 规则数据库查找失败，相关规则不生效: %v", err)
+	})
+}
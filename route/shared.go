@@ -0,0 +1,97 @@
+package route
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// sharedFile 一个只读映射的数据库文件。同一文件（路径、大小与修改时间都相同）在多个 Router
+// 之间共享一份映射与索引，热重载规则时不会重复占用内存；文件被替换后新的 Router 映射新文件，
+// 旧映射在最后一个引用它的 Router 关闭后释放。
+type sharedFile struct {
+	key  string
+	path string
+	refs int
+
+	// mu 保护 data：查找持读锁，释放映射持写锁，避免读取已解除映射的内存
+	mu     sync.RWMutex
+	data   []byte
+	unmap  func() error
+	closed bool
+
+	// 按需构建的索引，随映射一起共享
+	once  sync.Once
+	index any
+	err   error
+}
+
+var shared = struct {
+	sync.Mutex
+	files map[string]*sharedFile
+}{files: make(map[string]*sharedFile)}
+
+// openShared 映射 path，已有相同文件的映射时增加引用计数后直接返回
+func openShared(path string) (*sharedFile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s 是目录", path)
+	}
+	key := fmt.Sprintf("%s|%d|%d", abs, fi.Size(), fi.ModTime().UnixNano())
+
+	shared.Lock()
+	defer shared.Unlock()
+	if f, ok := shared.files[key]; ok {
+		f.refs++
+		return f, nil
+	}
+	data, unmap, err := mapFile(abs)
+	if err != nil {
+		return nil, err
+	}
+	f := &sharedFile{key: key, path: path, refs: 1, data: data, unmap: unmap}
+	shared.files[key] = f
+	return f, nil
+}
+
+// release 减少引用计数，归零时解除映射
+func (f *sharedFile) release() {
+	shared.Lock()
+	f.refs--
+	last := f.refs == 0
+	if last {
+		delete(shared.files, f.key)
+	}
+	shared.Unlock()
+	if !last {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.data = nil
+	if f.unmap != nil {
+		f.unmap()
+	}
+}
+
+// buildIndex 首次调用时用 build 构建索引，之后返回同一结果；映射已释放时返回 nil
+func (f *sharedFile) buildIndex(build func(data []byte) (any, error)) (any, error) {
+	f.once.Do(func() {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+		if f.closed {
+			return
+		}
+		f.index, f.err = build(f.data)
+	})
+	return f.index, f.err
+}
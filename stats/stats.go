@@ -0,0 +1,189 @@
+// Package stats 收集运行时统计数据，供管理接口、面板与脚本使用。
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ECHStatus ECH配置状态
+type ECHStatus struct {
+	Loaded     bool      `json:"loaded"`
+	Version    uint64    `json:"version"`
+	FetchedAt  time.Time `json:"fetched_at,omitempty"`
+	AgeSeconds float64   `json:"age_seconds"`
+	Refreshes  uint64    `json:"refreshes"`
+	// 以下为ECH管理器的累计指标，便于对配置过期或DNS查询持续失败告警
+	RefreshFailures uint64    `json:"refresh_failures"`
+	LastRefresh     time.Time `json:"last_refresh,omitempty"`
+	DNSQueries      uint64    `json:"dns_queries"`
+	DNSFailures     uint64    `json:"dns_failures"`
+	Rejections      uint64    `json:"rejections"`
+}
+
+// Subsystem 后台子系统的重启统计
+type Subsystem struct {
+	Name     string `json:"name"`
+	Running  bool   `json:"running"`
+	Restarts uint64 `json:"restarts"`
+	Panics   uint64 `json:"panics"`
+	Wedges   uint64 `json:"wedges"`
+}
+
+// Stats 某一时刻的统计快照
+type Stats struct {
+	StartedAt         time.Time   `json:"started_at"`
+	UptimeSeconds     float64     `json:"uptime_seconds"`
+	TotalConnections  uint64      `json:"total_connections"`
+	ActiveConnections int64       `json:"active_connections"`
+	BytesUp           uint64      `json:"bytes_up"`
+	BytesDown         uint64      `json:"bytes_down"`
+	RTTMillis         float64     `json:"rtt_ms"`
+	ClockSkewMillis   float64     `json:"clock_skew_ms"`
+	HeartbeatTimeouts uint64      `json:"heartbeat_timeouts"`
+	Dials             uint64      `json:"dials"`
+	DialFailures      uint64      `json:"dial_failures"`
+	DialRetries       uint64      `json:"dial_retries"`
+	HandlerPanics     uint64      `json:"handler_panics"`
+	ECH               ECHStatus   `json:"ech"`
+	Subsystems        []Subsystem `json:"subsystems,omitempty"`
+}
+
+var (
+	startedAt = time.Now()
+
+	totalConns   atomic.Uint64
+	activeConns  atomic.Int64
+	bytesUp      atomic.Uint64
+	bytesDown    atomic.Uint64
+	rttNanos     atomic.Int64
+	skewNanos    atomic.Int64
+	hbTimeouts   atomic.Uint64
+	dials        atomic.Uint64
+	dialFailures atomic.Uint64
+	dialRetries  atomic.Uint64
+	panics       atomic.Uint64
+
+	echSourceMu sync.RWMutex
+	echSource   func() ECHStatus
+
+	subsystemSourceMu sync.RWMutex
+	subsystemSource   func() []Subsystem
+)
+
+// ConnOpened 记录新建立的本地连接
+func ConnOpened() {
+	totalConns.Add(1)
+	activeConns.Add(1)
+}
+
+// ConnClosed 记录本地连接关闭
+func ConnClosed() {
+	activeConns.Add(-1)
+}
+
+// AddBytesUp 记录发往隧道的字节数
+func AddBytesUp(n int) {
+	bytesUp.Add(uint64(n))
+}
+
+// AddBytesDown 记录从隧道收到的字节数
+func AddBytesDown(n int) {
+	bytesDown.Add(uint64(n))
+}
+
+// SetRTT 更新最近一次测得的隧道往返时延
+func SetRTT(d time.Duration) {
+	rttNanos.Store(int64(d))
+}
+
+// SetClockSkew 更新心跳测得的 Worker 与本地时钟的偏差
+func SetClockSkew(d time.Duration) {
+	skewNanos.Store(int64(d))
+}
+
+// HeartbeatTimeout 记录一次心跳超时（隧道停滞）
+func HeartbeatTimeout() {
+	hbTimeouts.Add(1)
+}
+
+// DialDone 记录一次隧道拨号，attempts 为实际尝试次数
+func DialDone(attempts int, err error) {
+	dials.Add(1)
+	if attempts > 1 {
+		dialRetries.Add(uint64(attempts - 1))
+	}
+	if err != nil {
+		dialFailures.Add(1)
+	}
+}
+
+// HandlerPanic 记录一次连接处理崩溃（已恢复）
+func HandlerPanic() {
+	panics.Add(1)
+}
+
+// SetECHSource 设置ECH状态的数据来源
+func SetECHSource(fn func() ECHStatus) {
+	echSourceMu.Lock()
+	defer echSourceMu.Unlock()
+	echSource = fn
+}
+
+// SetSubsystemSource 设置后台子系统状态的数据来源
+func SetSubsystemSource(fn func() []Subsystem) {
+	subsystemSourceMu.Lock()
+	defer subsystemSourceMu.Unlock()
+	subsystemSource = fn
+}
+
+// Snapshot 返回当前统计快照
+func Snapshot() Stats {
+	now := time.Now()
+	s := Stats{
+		StartedAt:         startedAt,
+		UptimeSeconds:     now.Sub(startedAt).Seconds(),
+		TotalConnections:  totalConns.Load(),
+		ActiveConnections: activeConns.Load(),
+		BytesUp:           bytesUp.Load(),
+		BytesDown:         bytesDown.Load(),
+		RTTMillis:         float64(rttNanos.Load()) / float64(time.Millisecond),
+		ClockSkewMillis:   float64(skewNanos.Load()) / float64(time.Millisecond),
+		HeartbeatTimeouts: hbTimeouts.Load(),
+		Dials:             dials.Load(),
+		DialFailures:      dialFailures.Load(),
+		DialRetries:       dialRetries.Load(),
+		HandlerPanics:     panics.Load(),
+	}
+
+	echSourceMu.RLock()
+	src := echSource
+	echSourceMu.RUnlock()
+	if src != nil {
+		s.ECH = src()
+		if s.ECH.Loaded && !s.ECH.FetchedAt.IsZero() {
+			s.ECH.AgeSeconds = now.Sub(s.ECH.FetchedAt).Seconds()
+		}
+	}
+
+	subsystemSourceMu.RLock()
+	subs := subsystemSource
+	subsystemSourceMu.RUnlock()
+	if subs != nil {
+		s.Subsystems = subs()
+	}
+	return s
+}
+
+// Handler 以JSON格式输出统计快照
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(Snapshot())
+	})
+}
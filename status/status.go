@@ -0,0 +1,156 @@
+// Package status 汇总完整的运行时状态（ECH配置年龄、当前节点、连接统计、熔断状态、最近的错误等），
+// 由管理接口 /status 以JSON输出，命令行 status 子命令读取后供脚本与监控程序使用。
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ech-workers/audit"
+	"ech-workers/breaker"
+	"ech-workers/events"
+	"ech-workers/stats"
+)
+
+// LastError 某类事件最近一次携带的错误
+type LastError struct {
+	Type    events.Type `json:"type"`
+	Time    time.Time   `json:"time"`
+	Message string      `json:"message,omitempty"`
+	Error   string      `json:"error"`
+}
+
+// Report 某一时刻的完整状态
+type Report struct {
+	Version        string                   `json:"version"`
+	Server         string                   `json:"server"`
+	Transport      string                   `json:"transport"`
+	ActiveEndpoint string                   `json:"active_endpoint,omitempty"`
+	Stats          stats.Stats              `json:"stats"`
+	Endpoints      []breaker.Status         `json:"endpoints,omitempty"`
+	ECHAudit       map[audit.Outcome]uint64 `json:"ech_audit"`
+	LastErrors     []LastError              `json:"last_errors,omitempty"`
+}
+
+// Collector 收集生成 Report 所需的各项状态
+type Collector struct {
+	Version   string
+	Server    string
+	Transport string
+	// ActiveEndpoint 返回当前使用的节点，可为空
+	ActiveEndpoint func() string
+	// Breaker 节点熔断器，可为空
+	Breaker *breaker.Breaker
+
+	mu         sync.Mutex
+	lastErrors map[events.Type]LastError
+}
+
+// TrackErrors 订阅事件总线，记录每类事件最近一次的错误，返回取消订阅的函数
+func (c *Collector) TrackErrors(bus *events.Bus) func() {
+	return bus.Subscribe(func(e events.Event) {
+		if e.Err == nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.lastErrors == nil {
+			c.lastErrors = make(map[events.Type]LastError)
+		}
+		c.lastErrors[e.Type] = LastError{Type: e.Type, Time: e.Time, Message: e.Message, Error: e.Err.Error()}
+	})
+}
+
+// Report 生成当前状态
+func (c *Collector) Report() Report {
+	r := Report{
+		Version:   c.Version,
+		Server:    c.Server,
+		Transport: c.Transport,
+		Stats:     stats.Snapshot(),
+		ECHAudit:  audit.Default().Counts(),
+	}
+	if c.ActiveEndpoint != nil {
+		r.ActiveEndpoint = c.ActiveEndpoint()
+	}
+	if c.Breaker != nil {
+		r.Endpoints = c.Breaker.Status()
+	}
+	c.mu.Lock()
+	for _, e := range c.lastErrors {
+		r.LastErrors = append(r.LastErrors, e)
+	}
+	c.mu.Unlock()
+	sort.Slice(r.LastErrors, func(i, j int) bool { return r.LastErrors[i].Time.After(r.LastErrors[j].Time) })
+	return r
+}
+
+// Handler 以JSON格式输出当前状态
+func (c *Collector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(c.Report())
+	})
+}
+
+// Fetch 从运行中实例的管理接口读取状态，同时返回原始JSON
+func Fetch(adminAddr string) (*Report, []byte, error) {
+	url := adminAddr
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(url, "/") + "/status")
+	if err != nil {
+		return nil, nil, fmt.Errorf("连接管理接口失败: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取状态失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("管理接口返回错误: %d", resp.StatusCode)
+	}
+	var r Report
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, nil, fmt.Errorf("解析状态失败: %v", err)
+	}
+	return &r, body, nil
+}
+
+// Print 以便于阅读的格式输出状态摘要
+func Print(w io.Writer, r *Report) {
+	s := r.Stats
+	fmt.Fprintf(w, "版本: %s\n", r.Version)
+	fmt.Fprintf(w, "服务器: %s (传输 %s)\n", r.Server, r.Transport)
+	if r.ActiveEndpoint != "" {
+		fmt.Fprintf(w, "当前节点: %s\n", r.ActiveEndpoint)
+	}
+	fmt.Fprintf(w, "运行时间: %s\n", (time.Duration(s.UptimeSeconds) * time.Second).String())
+	if s.ECH.Loaded {
+		fmt.Fprintf(w, "ECH配置: 已加载，%s 前获取，刷新 %d 次\n", (time.Duration(s.ECH.AgeSeconds) * time.Second).String(), s.ECH.Refreshes)
+	} else {
+		fmt.Fprintf(w, "ECH配置: 未加载\n")
+	}
+	fmt.Fprintf(w, "连接: 活动 %d，累计 %d\n", s.ActiveConnections, s.TotalConnections)
+	fmt.Fprintf(w, "隧道拨号: %d 次，失败 %d 次，重试 %d 次\n", s.Dials, s.DialFailures, s.DialRetries)
+	fmt.Fprintf(w, "流量: 上行 %d 字节，下行 %d 字节\n", s.BytesUp, s.BytesDown)
+	for _, ep := range r.Endpoints {
+		fmt.Fprintf(w, "节点 %s: %s，连续失败 %d 次\n", ep.Endpoint, ep.State, ep.Failures)
+	}
+	for _, sub := range s.Subsystems {
+		fmt.Fprintf(w, "子系统 %s: 运行=%v，重启 %d 次\n", sub.Name, sub.Running, sub.Restarts)
+	}
+	for _, e := range r.LastErrors {
+		fmt.Fprintf(w, "最近错误 [%s] %s: %s\n", e.Type, e.Time.Format(time.RFC3339), e.Error)
+	}
+}
@@ -0,0 +1,217 @@
+// Package supervisor 在后台运行长期子系统（监听器、定期刷新、健康探测等），
+// 子系统崩溃 (panic)、意外返回或停止报告心跳时按指数退避重启，并记录重启次数。
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+	// stableAfter 运行超过该时长后视为恢复正常，退避时间重新计算
+	stableAfter = time.Minute
+)
+
+// Func 子系统的主循环。stop 关闭时应尽快返回；设置了 WedgeTimeout 的子系统需定期调用 beat 报告存活
+type Func func(stop <-chan struct{}, beat func()) error
+
+// Options 子系统的重启策略
+type Options struct {
+	// WedgeTimeout 大于 0 时，超过该时长未调用 beat 视为卡死：通知旧实例停止并启动新实例
+	WedgeTimeout time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+}
+
+// Status 子系统的运行状态
+type Status struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	Restarts  uint64    `json:"restarts"`
+	Panics    uint64    `json:"panics"`
+	Wedges    uint64    `json:"wedges"`
+	LastError string    `json:"last_error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type task struct {
+	name string
+	fn   Func
+	opts Options
+
+	mu       sync.Mutex
+	running  bool
+	restarts uint64
+	panics   uint64
+	wedges   uint64
+	lastErr  string
+	started  time.Time
+	lastBeat time.Time
+}
+
+// Supervisor 管理一组子系统
+type Supervisor struct {
+	mu    sync.Mutex
+	tasks []*task
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func New() *Supervisor {
+	return &Supervisor{stop: make(chan struct{})}
+}
+
+// Go 在后台启动子系统，name 用于日志与状态输出
+func (s *Supervisor) Go(name string, fn Func, opts Options) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	t := &task{name: name, fn: fn, opts: opts}
+	s.mu.Lock()
+	s.tasks = append(s.tasks, t)
+	s.mu.Unlock()
+	go s.supervise(t)
+}
+
+// supervise 循环运行子系统，每次结束后按退避时间重启，直到 Stop
+func (s *Supervisor) supervise(t *task) {
+	backoff := t.opts.MinBackoff
+	for {
+		start := time.Now()
+		err := s.runOnce(t)
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		if time.Since(start) > stableAfter {
+			backoff = t.opts.MinBackoff
+		}
+		t.mu.Lock()
+		t.restarts++
+		if err != nil {
+			t.lastErr = err.Error()
+		}
+		t.mu.Unlock()
+		log.Printf("[守护] %s 已停止: %v，%v后重启", t.name, err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			return
+		}
+		backoff *= 2
+		if backoff > t.opts.MaxBackoff {
+			backoff = t.opts.MaxBackoff
+		}
+	}
+}
+
+// runOnce 运行一次子系统，返回其结束原因。卡死的实例不会被等待，只会收到 stop 通知
+func (s *Supervisor) runOnce(t *task) error {
+	stop := make(chan struct{})
+	result := make(chan error, 1)
+
+	t.mu.Lock()
+	t.running = true
+	t.started = time.Now()
+	t.lastBeat = t.started
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.running = false
+		t.mu.Unlock()
+	}()
+
+	beat := func() {
+		t.mu.Lock()
+		t.lastBeat = time.Now()
+		t.mu.Unlock()
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.mu.Lock()
+				t.panics++
+				t.mu.Unlock()
+				log.Printf("[守护] %s 崩溃: %v\n%s", t.name, r, debug.Stack())
+				result <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		err := t.fn(stop, beat)
+		if err == nil {
+			err = errors.New("意外退出")
+		}
+		result <- err
+	}()
+
+	var wedgeCheck <-chan time.Time
+	if t.opts.WedgeTimeout > 0 {
+		ticker := time.NewTicker(t.opts.WedgeTimeout / 4)
+		defer ticker.Stop()
+		wedgeCheck = ticker.C
+	}
+	for {
+		select {
+		case err := <-result:
+			return err
+		case <-s.stop:
+			close(stop)
+			return nil
+		case <-wedgeCheck:
+			t.mu.Lock()
+			since := time.Since(t.lastBeat)
+			t.mu.Unlock()
+			if since > t.opts.WedgeTimeout {
+				close(stop)
+				t.mu.Lock()
+				t.wedges++
+				t.mu.Unlock()
+				return fmt.Errorf("%v 未报告心跳，判定为卡死", since.Round(time.Second))
+			}
+		}
+	}
+}
+
+// Status 返回所有子系统的状态，按启动顺序排列
+func (s *Supervisor) Status() []Status {
+	s.mu.Lock()
+	tasks := append([]*task(nil), s.tasks...)
+	s.mu.Unlock()
+	out := make([]Status, 0, len(tasks))
+	for _, t := range tasks {
+		t.mu.Lock()
+		out = append(out, Status{
+			Name:      t.name,
+			Running:   t.running,
+			Restarts:  t.restarts,
+			Panics:    t.panics,
+			Wedges:    t.wedges,
+			LastError: t.lastErr,
+			StartedAt: t.started,
+		})
+		t.mu.Unlock()
+	}
+	return out
+}
+
+// Stop 通知所有子系统停止，不再重启
+func (s *Supervisor) Stop() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+// Wait 阻塞直到 Stop 被调用
+func (s *Supervisor) Wait() {
+	<-s.stop
+}
@@ -0,0 +1,322 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"ech-workers/audit"
+	"ech-workers/dialer"
+	"ech-workers/ech"
+	"ech-workers/websocket"
+
+	gorilla "github.com/gorilla/websocket"
+)
+
+// h2Transport 以 HTTP/2 CONNECT 连接兼容 naiveproxy 的前端，每个目标一条 HTTP/2 流，
+// 多条流复用同一个 TLS+ECH 连接。双方都声明 padding 时，每个方向的前若干个数据块
+// 带随机长度的填充，以打乱 TLS 内层握手的长度特征。
+//
+// ServerAddr 为前端的 host:port，Token 为 "用户名:密码"（Proxy-Authorization Basic），
+// ServerIP 不为空时连接其中第一个地址。
+type h2Transport struct {
+	host        string
+	port        string
+	auth        string
+	serverIP    string
+	ech         websocket.ECHProvider
+	echFallback bool
+	dialer      dialer.UnderlyingDialer
+
+	transport *http.Transport
+}
+
+const (
+	// h2PaddedFrames 每个方向带填充的数据块个数
+	h2PaddedFrames = 8
+	h2MaxPadding   = 255
+	h2MaxPayload   = 65535
+)
+
+func newH2(opts Options) (Transport, error) {
+	addr := opts.ServerAddr
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr = addr[:i]
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("无效的服务器地址: %s", opts.ServerAddr)
+	}
+	if opts.TokenSource != nil {
+		return nil, errors.New("不支持一次性令牌")
+	}
+	t := &h2Transport{
+		host:        host,
+		port:        port,
+		serverIP:    strings.TrimSpace(strings.Split(opts.ServerIP, ",")[0]),
+		ech:         opts.ECH,
+		echFallback: opts.ECHFallback,
+		dialer:      opts.Dialer,
+	}
+	if opts.Token != "" {
+		t.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(opts.Token))
+	}
+	t.transport = &http.Transport{
+		DialTLSContext:    t.dialTLS,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   5 * time.Minute,
+	}
+	return t, nil
+}
+
+func (*h2Transport) Name() string {
+	return "h2"
+}
+
+func (*h2Transport) Capabilities() Capabilities {
+	return Capabilities{ECH: true, Stream: true}
+}
+
+func (*h2Transport) Dial(maxRetries int, cancel <-chan struct{}) (*gorilla.Conn, error) {
+	return nil, ErrStreamOnly
+}
+
+// dialTLS 建立到前端的 TLS 连接，ECH 规则与 WebSocket 传输相同：默认只接受 ECH 被接受的握手
+func (t *h2Transport) dialTLS(ctx context.Context, network, _ string) (net.Conn, error) {
+	addr := net.JoinHostPort(t.host, t.port)
+	if t.serverIP != "" {
+		if _, _, err := net.SplitHostPort(t.serverIP); err == nil {
+			addr = t.serverIP
+		} else {
+			addr = net.JoinHostPort(t.serverIP, t.port)
+		}
+	} else if resolver, ok := t.ech.(websocket.AddrResolver); ok {
+		// 与 WebSocket 传输相同，服务器地址经加密DNS解析
+		ips, err := resolver.QueryAddr(ctx, t.host)
+		if err != nil {
+			return nil, fmt.Errorf("解析服务器地址失败: %w", err)
+		}
+		addr = net.JoinHostPort(ips[0].String(), t.port)
+	}
+
+	server := net.JoinHostPort(t.host, t.port)
+	cfg, err := t.ech.BuildTLSConfig(t.host)
+	fallback := false
+	if err != nil {
+		if !t.echFallback {
+			return nil, fmt.Errorf("构建TLS配置失败: %w", err)
+		}
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: t.host}
+		fallback = true
+	}
+	cfg.NextProtos = []string{"h2"}
+
+	var raw net.Conn
+	if t.dialer != nil {
+		raw, err = t.dialer.DialContext(ctx, network, addr)
+	} else {
+		d := net.Dialer{Timeout: 10 * time.Second}
+		raw, err = d.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, cfg)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		// 服务器提供了新的 ECH 配置时更新，下一次连接即可使用
+		var rejection *tls.ECHRejectionError
+		if errors.As(err, &rejection) && len(rejection.RetryConfigList) > 0 {
+			audit.Record(server, audit.Rejected, err.Error())
+			if applier, ok := t.ech.(websocket.RetryConfigApplier); ok {
+				applier.ApplyRetryConfigs(rejection.RetryConfigList)
+			}
+		}
+		return nil, err
+	}
+	state := conn.ConnectionState()
+	switch {
+	case state.ECHAccepted:
+		audit.Record(server, audit.Accepted, "")
+	case fallback:
+		audit.Record(server, audit.Fallback, "h2")
+	default:
+		audit.Record(server, audit.GREASE, "")
+		if !t.echFallback {
+			conn.Close()
+			return nil, fmt.Errorf("%w: 服务器未接受ECH，严格模式下拒绝连接", ech.ErrECHRejected)
+		}
+	}
+	if state.NegotiatedProtocol != "h2" {
+		conn.Close()
+		return nil, errors.New("前端不支持 HTTP/2")
+	}
+	return conn, nil
+}
+
+// DialStream 发送 CONNECT 请求建立到 target 的流
+func (t *h2Transport) DialStream(ctx context.Context, target string) (net.Conn, error) {
+	// 流的生命周期独立于 ctx，ctx 只用于中止建立过程
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodConnect, "https://"+net.JoinHostPort(t.host, t.port), pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Host = target
+	req.Header.Set("Padding", h2PaddingHeader())
+	if t.auth != "" {
+		req.Header.Set("Proxy-Authorization", t.auth)
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if !stop() || err != nil {
+		cancel()
+		pw.Close()
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("CONNECT 请求失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		pw.Close()
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			return nil, errors.New("前端拒绝了认证信息 (HTTP 407)")
+		}
+		return nil, fmt.Errorf("CONNECT 被拒绝: HTTP %d", resp.StatusCode)
+	}
+
+	c := &h2Conn{body: resp.Body, pw: pw, cancel: cancel, target: target}
+	if resp.Header.Get("Padding") != "" {
+		c.readPadded = h2PaddedFrames
+		c.writePadded = h2PaddedFrames
+	}
+	return c, nil
+}
+
+// h2PaddingHeader 生成随机长度的 padding 请求头，使 HEADERS 帧的长度不固定
+func h2PaddingHeader() string {
+	return strings.Repeat("~", 16+rand.IntN(17))
+}
+
+// h2Conn 一条 CONNECT 流，读取响应体、写入请求体
+type h2Conn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	target string
+
+	readMu     sync.Mutex
+	readPadded int
+	// pending 当前填充块中尚未读出的数据
+	pending []byte
+
+	writeMu     sync.Mutex
+	writePadded int
+
+	closeOnce sync.Once
+}
+
+func (c *h2Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.readPadded == 0 {
+		return c.body.Read(p)
+	}
+	// 块格式: 数据长度(2) 填充长度(1) 数据 填充
+	var hdr [3]byte
+	if _, err := io.ReadFull(c.body, hdr[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(hdr[:2]))
+	frame := make([]byte, size+int(hdr[2]))
+	if _, err := io.ReadFull(c.body, frame); err != nil {
+		return 0, err
+	}
+	c.readPadded--
+	n := copy(p, frame[:size])
+	c.pending = frame[n:size]
+	return n, nil
+}
+
+func (c *h2Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for c.writePadded > 0 && len(p) > 0 {
+		chunk := p
+		if len(chunk) > h2MaxPayload {
+			chunk = chunk[:h2MaxPayload]
+		}
+		pad := rand.IntN(h2MaxPadding + 1)
+		frame := make([]byte, 3+len(chunk)+pad)
+		binary.BigEndian.PutUint16(frame, uint16(len(chunk)))
+		frame[2] = byte(pad)
+		copy(frame[3:], chunk)
+		if _, err := c.pw.Write(frame); err != nil {
+			return written, err
+		}
+		c.writePadded--
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	if len(p) == 0 {
+		return written, nil
+	}
+	n, err := c.pw.Write(p)
+	return written + n, err
+}
+
+// CloseWrite 结束请求体（发送 END_STREAM），对端仍可继续发送数据
+func (c *h2Conn) CloseWrite() error {
+	return c.pw.Close()
+}
+
+func (c *h2Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.pw.Close()
+		c.body.Close()
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *h2Conn) LocalAddr() net.Addr  { return h2Addr("local") }
+func (c *h2Conn) RemoteAddr() net.Addr { return h2Addr(c.target) }
+
+// 流没有独立的超时，超时由本地连接一侧控制
+func (c *h2Conn) SetDeadline(time.Time) error      { return nil }
+func (c *h2Conn) SetReadDeadline(time.Time) error  { return nil }
+func (c *h2Conn) SetWriteDeadline(time.Time) error { return nil }
+
+type h2Addr string
+
+func (a h2Addr) Network() string { return "h2" }
+func (a h2Addr) String() string  { return string(a) }
+
+func init() {
+	Register("h2", newH2)
+}
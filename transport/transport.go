@@ -0,0 +1,162 @@
+// Package transport 定义隧道传输方式的接口与注册表。
+// 内置 WebSocket 传输 ("ws")，新的传输（h2、h3、原始 TLS 等）可以在自己的包中
+// 通过 Register 注册，并在配置中按名称选择，无需修改核心代码。
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ech-workers/breaker"
+	"ech-workers/dialer"
+	"ech-workers/websocket"
+
+	gorilla "github.com/gorilla/websocket"
+)
+
+// DefaultName 默认的传输方式
+const DefaultName = "ws"
+
+// Capabilities 传输方式具备的能力，用于检查与其他配置是否兼容
+type Capabilities struct {
+	// ECH 握手使用 ECH 保护服务器名称
+	ECH bool `json:"ech"`
+	// Reauth 支持运行中更换令牌
+	Reauth bool `json:"reauth"`
+	// Stream 按目标建立字节流（实现 StreamDialer），不使用 Worker 隧道协议，
+	// -proto、-vless、-aead 等隧道协议选项对其无效
+	Stream bool `json:"stream"`
+}
+
+// Options 创建传输时使用的连接参数
+type Options struct {
+	ServerAddr string
+	ServerIP   string
+	Token      string
+	// TokenSource 不为空时每次拨号调用以生成令牌（如 TOTP），忽略 Token
+	TokenSource func() string
+	ECH         websocket.ECHProvider
+	ECHFallback bool
+	// ServiceEndpoint 为 true 时按HTTPS记录的 TargetName 与 port 参数连接服务器，见 websocket.SetServiceEndpoint
+	ServiceEndpoint bool
+	// AddressFamily 连接服务器使用的地址族，见 websocket.SetAddressFamily
+	AddressFamily websocket.AddressFamily
+	// Keepalive 与 KeepaliveTimeout 为连接保活的 ping 间隔与等待 pong 的时间，见 websocket.SetKeepalive
+	Keepalive        time.Duration
+	KeepaliveTimeout time.Duration
+	// Header 升级请求附加的请求头，见 websocket.SetHeader
+	Header http.Header
+	// PoolSize 大于 0 时预先建立并保持该数量的空闲连接，PoolPolicy 为取出的策略，见 websocket.Pool
+	PoolSize   int
+	PoolPolicy websocket.PoolPolicy
+	Dialer     dialer.UnderlyingDialer
+	// Breaker 不为空时按节点熔断连续失败的连接
+	Breaker *breaker.Breaker
+}
+
+// Transport 隧道传输方式
+type Transport interface {
+	Name() string
+	Capabilities() Capabilities
+	// Dial 建立一条隧道连接，cancel 关闭时中止拨号
+	Dial(maxRetries int, cancel <-chan struct{}) (*gorilla.Conn, error)
+}
+
+// StreamDialer 按目标建立字节流的传输实现该接口，ctx 只作用于建立过程
+type StreamDialer interface {
+	DialStream(ctx context.Context, target string) (net.Conn, error)
+}
+
+// ErrStreamOnly 只支持按目标建立字节流的传输在 Dial 时返回该错误
+var ErrStreamOnly = errors.New("该传输方式只支持按目标建立的流，不支持 WebSocket 隧道")
+
+// TokenSetter 支持运行中更换令牌的传输实现该接口
+type TokenSetter interface {
+	SetToken(token string)
+}
+
+// Drainer 支持维护模式（停止向节点分配新连接并排空已有连接）的传输实现该接口
+type Drainer interface {
+	Drain(endpoint string, timeout time.Duration) (<-chan struct{}, error)
+	Resume(endpoint string) error
+	DrainStatus() []websocket.DrainStatus
+}
+
+// Pooler 支持连接池（见 Options.PoolSize）的传输实现该接口
+type Pooler interface {
+	PoolStats() websocket.PoolStats
+}
+
+// Factory 根据连接参数创建传输
+type Factory func(opts Options) (Transport, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register 注册传输方式，同名的注册会覆盖之前的
+func Register(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = f
+}
+
+// Names 返回已注册的传输方式名称
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup 检查传输方式是否已注册，name 为空时使用 DefaultName
+func Lookup(name string) (Factory, error) {
+	if name == "" {
+		name = DefaultName
+	}
+	registryMu.RLock()
+	f, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("未知的传输方式 %q (可用: %s)", name, strings.Join(Names(), ", "))
+	}
+	return f, nil
+}
+
+// New 创建指定名称的传输
+func New(name string, opts Options) (Transport, error) {
+	f, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	t, err := f(opts)
+	if err != nil {
+		return nil, fmt.Errorf("传输方式 %s: %w", name, err)
+	}
+	return t, nil
+}
+
+// Client 把 Transport 适配为代理服务器使用的拨号接口
+type Client struct {
+	Transport
+}
+
+func (c Client) DialWithECH(maxRetries int) (*gorilla.Conn, error) {
+	return c.Dial(maxRetries, nil)
+}
+
+func (c Client) DialWithECHCancel(maxRetries int, cancel <-chan struct{}) (*gorilla.Conn, error) {
+	return c.Dial(maxRetries, cancel)
+}
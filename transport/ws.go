@@ -0,0 +1,62 @@
+package transport
+
+import (
+	"ech-workers/websocket"
+
+	gorilla "github.com/gorilla/websocket"
+)
+
+// wsTransport 基于 TLS+ECH 的 WebSocket 传输
+type wsTransport struct {
+	*websocket.WebSocketClient
+	// pool 不为空时优先取用预先建立的连接
+	pool *websocket.Pool
+}
+
+func newWS(opts Options) (Transport, error) {
+	c := websocket.NewWebSocketClient(opts.ServerAddr, opts.Token, opts.ECH, opts.ServerIP)
+	c.SetECHFallback(opts.ECHFallback)
+	c.SetServiceEndpoint(opts.ServiceEndpoint)
+	c.SetAddressFamily(opts.AddressFamily)
+	c.SetKeepalive(opts.Keepalive, opts.KeepaliveTimeout)
+	if err := c.SetHeader(opts.Header); err != nil {
+		return nil, err
+	}
+	if opts.TokenSource != nil {
+		c.SetTokenSource(opts.TokenSource)
+	}
+	if opts.Breaker != nil {
+		c.SetBreaker(opts.Breaker)
+	}
+	if opts.Dialer != nil {
+		c.SetUnderlyingDialer(opts.Dialer)
+	}
+	return wsTransport{c, c.NewPool(websocket.PoolOptions{Size: opts.PoolSize, Policy: opts.PoolPolicy})}, nil
+}
+
+func (wsTransport) Name() string {
+	return DefaultName
+}
+
+func (wsTransport) Capabilities() Capabilities {
+	return Capabilities{ECH: true, Reauth: true}
+}
+
+func (t wsTransport) Dial(maxRetries int, cancel <-chan struct{}) (*gorilla.Conn, error) {
+	if t.pool != nil {
+		return t.pool.DialWithECHCancel(maxRetries, cancel)
+	}
+	return t.DialWithECHCancel(maxRetries, cancel)
+}
+
+// PoolStats 返回连接池的状态，未启用连接池时为零值
+func (t wsTransport) PoolStats() websocket.PoolStats {
+	if t.pool == nil {
+		return websocket.PoolStats{}
+	}
+	return t.pool.Stats()
+}
+
+func init() {
+	Register(DefaultName, newWS)
+}
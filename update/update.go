@@ -0,0 +1,216 @@
+// Package update 实现签名发布的检查、下载与替换。
+//
+// 发布清单为 JSON，与清单同路径的 ".sig" 文件是对清单原始字节的 Ed25519 签名 (Base64)。
+// 二进制的 SHA-256 记录在已签名的清单中，下载后先校验再替换当前可执行文件。
+package update
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version 当前版本，发布构建时通过 -ldflags "-X ech-workers/update.Version=v1.2.3" 注入
+var Version = "dev"
+
+// PublicKey 发布签名公钥 (Base64)，可通过 -ldflags 注入或由 -update-key 指定
+var PublicKey = ""
+
+const (
+	maxManifestSize = 1 << 20
+	maxBinarySize   = 256 << 20
+)
+
+// Manifest 发布清单
+type Manifest struct {
+	Version string           `json:"version"`
+	Assets  map[string]Asset `json:"assets"`
+}
+
+// Asset 某个平台的二进制
+type Asset struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// Release 适用于当前平台的新版本
+type Release struct {
+	Version string `json:"version"`
+	Current string `json:"current"`
+	Newer   bool   `json:"newer"`
+	Asset   Asset  `json:"asset"`
+}
+
+// Platform 返回当前平台在清单中的名称，如 linux-amd64
+func Platform() string {
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// Updater 检查与安装更新
+type Updater struct {
+	manifestURL string
+	publicKey   ed25519.PublicKey
+	client      *http.Client
+}
+
+// NewUpdater 创建更新器，publicKey 为 Base64 编码的 Ed25519 公钥
+func NewUpdater(manifestURL, publicKey string) (*Updater, error) {
+	if manifestURL == "" {
+		return nil, errors.New("未配置更新清单地址 (-update-url)")
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("更新签名公钥无效 (-update-key)")
+	}
+	return &Updater{
+		manifestURL: manifestURL,
+		publicKey:   ed25519.PublicKey(key),
+		client:      &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Check 下载并验证发布清单，返回当前平台对应的版本
+func (u *Updater) Check() (*Release, error) {
+	manifestData, err := u.fetch(u.manifestURL, maxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("下载发布清单失败: %w", err)
+	}
+	sigData, err := u.fetch(u.manifestURL+".sig", 4096)
+	if err != nil {
+		return nil, fmt.Errorf("下载清单签名失败: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigData)))
+	if err != nil || !ed25519.Verify(u.publicKey, manifestData, sig) {
+		return nil, errors.New("发布清单签名验证失败")
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(manifestData, &m); err != nil {
+		return nil, fmt.Errorf("发布清单格式无效: %w", err)
+	}
+	asset, ok := m.Assets[Platform()]
+	if !ok {
+		return nil, fmt.Errorf("发布清单中没有 %s 平台的文件", Platform())
+	}
+	return &Release{
+		Version: m.Version,
+		Current: Version,
+		Newer:   Newer(m.Version, Version),
+		Asset:   asset,
+	}, nil
+}
+
+// Apply 下载新版本，校验 SHA-256 后替换 exe；旧文件保留为 exe + ".old"
+func (u *Updater) Apply(rel *Release, exe string) error {
+	want, err := hex.DecodeString(rel.Asset.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		return errors.New("发布清单中的 SHA-256 无效")
+	}
+	data, err := u.fetch(rel.Asset.URL, maxBinarySize)
+	if err != nil {
+		return fmt.Errorf("下载新版本失败: %w", err)
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], want) {
+		return errors.New("新版本校验失败，SHA-256 不匹配")
+	}
+
+	// 临时文件放在同一目录，保证重命名是原子的
+	dir := filepath.Dir(exe)
+	tmp, err := os.CreateTemp(dir, ".ech-update-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, 0o755); err != nil {
+		return err
+	}
+
+	// Windows 不能覆盖正在运行的可执行文件，但可以重命名它
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return fmt.Errorf("备份当前版本失败: %w", err)
+	}
+	if err := os.Rename(tmpName, exe); err != nil {
+		os.Rename(old, exe)
+		return fmt.Errorf("替换可执行文件失败: %w", err)
+	}
+	return nil
+}
+
+func (u *Updater) fetch(url string, limit int64) ([]byte, error) {
+	resp, err := u.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errors.New("文件过大")
+	}
+	return data, nil
+}
+
+// Newer 比较形如 v1.2.3 的版本号，a 比 b 新时返回 true；
+// 非发布版本 (如 dev) 视为最旧
+func Newer(a, b string) bool {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	switch {
+	case !okA:
+		return false
+	case !okB:
+		return true
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			return pa[i] > pb[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	v = strings.TrimPrefix(v, "v")
+	v, _, _ = strings.Cut(v, "-")
+	parts := strings.Split(v, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
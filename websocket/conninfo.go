@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnInfo 已建立的隧道连接的 TLS 握手结果，用于确认连接确实使用了 ECH 而不是回退到普通 TLS
+type ConnInfo struct {
+	// Addr 实际连接的节点地址
+	Addr string
+	// ServerName 握手使用的服务器名称；ECH 被接受时为内层 ClientHello 中的真实名称
+	ServerName string
+	// ECHAccepted 服务器接受了 ECH
+	ECHAccepted bool
+	// Version 与 CipherSuite 为协商的 TLS 版本与密码套件
+	Version     uint16
+	CipherSuite uint16
+	// ALPN 协商的应用层协议，为空表示未协商
+	ALPN string
+}
+
+// ConnInfoOf 读取 conn 的 TLS 握手结果；conn 不是 TLS 连接时返回 false
+func ConnInfoOf(conn *websocket.Conn) (ConnInfo, bool) {
+	tlsConn, ok := conn.NetConn().(*tls.Conn)
+	if !ok {
+		return ConnInfo{}, false
+	}
+	st := tlsConn.ConnectionState()
+	return ConnInfo{
+		Addr:        tlsConn.RemoteAddr().String(),
+		ServerName:  st.ServerName,
+		ECHAccepted: st.ECHAccepted,
+		Version:     st.Version,
+		CipherSuite: st.CipherSuite,
+		ALPN:        st.NegotiatedProtocol,
+	}, true
+}
+
+// String 返回如 "TLS 1.3, TLS_AES_128_GCM_SHA256, ECH 已接受" 的摘要
+func (i ConnInfo) String() string {
+	parts := []string{tls.VersionName(i.Version), tls.CipherSuiteName(i.CipherSuite)}
+	if i.ALPN != "" {
+		parts = append(parts, "ALPN "+i.ALPN)
+	}
+	if i.ECHAccepted {
+		parts = append(parts, "ECH 已接受")
+	} else {
+		parts = append(parts, "未使用 ECH")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DialWithECHInfo 与 DialWithECH 相同，另外返回连接的 TLS 握手结果。
+// 允许回退 (SetECHFallback) 时可据此判断连接是否真正使用了 ECH
+func (c *WebSocketClient) DialWithECHInfo(maxRetries int) (*websocket.Conn, ConnInfo, error) {
+	conn, err := c.DialWithECH(maxRetries)
+	if err != nil {
+		return nil, ConnInfo{}, err
+	}
+	info, ok := ConnInfoOf(conn)
+	if !ok {
+		conn.Close()
+		return nil, ConnInfo{}, fmt.Errorf("连接 %s 不是 TLS 连接", conn.RemoteAddr())
+	}
+	return conn, info, nil
+}
@@ -0,0 +1,219 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"ech-workers/events"
+
+	"github.com/gorilla/websocket"
+)
+
+// 维护模式：节点进入维护后不再分配新连接，已有连接在期限内自然结束，
+// 期限到达时仍未结束的连接被强制关闭。用于无中断地轮换节点。
+
+// DrainStatus 单个节点的连接与维护状态
+type DrainStatus struct {
+	Endpoint    string    `json:"endpoint"`
+	Active      int       `json:"active"`
+	Maintenance bool      `json:"maintenance"`
+	Draining    bool      `json:"draining"`
+	Deadline    time.Time `json:"deadline,omitzero"`
+	DrainedAt   time.Time `json:"drained_at,omitzero"`
+	// ForcedClosed 期限到达时被强制关闭的连接数
+	ForcedClosed int `json:"forced_closed"`
+}
+
+// endpointConns 节点上的活动连接与维护状态
+type endpointConns struct {
+	conns       map[*trackedConn]struct{}
+	maintenance bool
+	deadline    time.Time
+	drainedAt   time.Time
+	forced      int
+	drained     chan struct{}
+}
+
+// trackedConn 关闭时从节点的活动连接中移除
+type trackedConn struct {
+	net.Conn
+	ep      string
+	once    sync.Once
+	release func(*trackedConn)
+}
+
+func (t *trackedConn) Close() error {
+	t.once.Do(func() { t.release(t) })
+	return t.Conn.Close()
+}
+
+func (c *WebSocketClient) endpointState(ep string) *endpointConns {
+	if c.drainState == nil {
+		c.drainState = make(map[string]*endpointConns)
+	}
+	e, ok := c.drainState[ep]
+	if !ok {
+		e = &endpointConns{conns: make(map[*trackedConn]struct{})}
+		c.drainState[ep] = e
+	}
+	return e
+}
+
+// track 把到节点 ep 的底层连接登记为活动连接
+func (c *WebSocketClient) track(ep string, conn net.Conn) net.Conn {
+	t := &trackedConn{Conn: conn, ep: ep}
+	t.release = func(t *trackedConn) {
+		c.drainMu.Lock()
+		defer c.drainMu.Unlock()
+		e := c.endpointState(ep)
+		delete(e.conns, t)
+		if len(e.conns) == 0 && e.drained != nil {
+			close(e.drained)
+			e.drained = nil
+		}
+	}
+	c.drainMu.Lock()
+	c.endpointState(ep).conns[t] = struct{}{}
+	c.drainMu.Unlock()
+	return t
+}
+
+// endpointOf 返回 conn 所连接的节点；经底层拨号器（如 SOCKS5 代理）连接时远端地址不是节点地址
+func endpointOf(conn *websocket.Conn) string {
+	nc := conn.NetConn()
+	if tlsConn, ok := nc.(*tls.Conn); ok {
+		nc = tlsConn.NetConn()
+	}
+	if t, ok := nc.(*trackedConn); ok {
+		return t.ep
+	}
+	return conn.RemoteAddr().String()
+}
+
+// activeConns 返回节点上的活动连接数
+func (c *WebSocketClient) activeConns(ep string) int {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	if e, ok := c.drainState[ep]; ok {
+		return len(e.conns)
+	}
+	return 0
+}
+
+// inMaintenance 判断节点是否处于维护模式
+func (c *WebSocketClient) inMaintenance(ep string) bool {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	e, ok := c.drainState[ep]
+	return ok && e.maintenance
+}
+
+// Drain 使节点进入维护模式并排空已有连接，timeout 到达后强制关闭剩余连接。
+// 返回的通道在排空完成时关闭
+func (c *WebSocketClient) Drain(ep string, timeout time.Duration) (<-chan struct{}, error) {
+	if !c.isEndpoint(ep) {
+		return nil, fmt.Errorf("未知的节点: %s", ep)
+	}
+	done := make(chan struct{})
+	c.drainMu.Lock()
+	e := c.endpointState(ep)
+	e.maintenance = true
+	e.deadline = time.Now().Add(timeout)
+	e.drainedAt = time.Time{}
+	e.forced = 0
+	drained := make(chan struct{})
+	if len(e.conns) == 0 {
+		close(drained)
+	} else {
+		if e.drained != nil {
+			close(e.drained)
+		}
+		e.drained = drained
+	}
+	c.drainMu.Unlock()
+	log.Printf("[WebSocket] 节点 %s 进入维护模式，排空期限 %s", ep, timeout)
+
+	go func() {
+		defer close(done)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-drained:
+		case <-timer.C:
+		}
+
+		c.drainMu.Lock()
+		var remaining []*trackedConn
+		for t := range e.conns {
+			remaining = append(remaining, t)
+		}
+		e.forced = len(remaining)
+		e.drainedAt = time.Now()
+		c.drainMu.Unlock()
+		for _, t := range remaining {
+			t.Close()
+		}
+		if len(remaining) > 0 {
+			log.Printf("[WebSocket] 节点 %s 排空期限已到，强制关闭 %d 个连接", ep, len(remaining))
+		} else {
+			log.Printf("[WebSocket] 节点 %s 已排空", ep)
+		}
+		events.Emit(events.EndpointDrained, ep, nil)
+	}()
+	return done, nil
+}
+
+// Resume 结束节点的维护模式，之后的新连接可以再次使用该节点
+func (c *WebSocketClient) Resume(ep string) error {
+	if !c.isEndpoint(ep) {
+		return fmt.Errorf("未知的节点: %s", ep)
+	}
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	e := c.endpointState(ep)
+	e.maintenance = false
+	e.deadline = time.Time{}
+	log.Printf("[WebSocket] 节点 %s 结束维护模式", ep)
+	return nil
+}
+
+// DrainStatus 返回各节点的活动连接数与维护状态
+func (c *WebSocketClient) DrainStatus() []DrainStatus {
+	host, port, _, err := c.ParseServerAddr()
+	if err != nil {
+		return nil
+	}
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	var out []DrainStatus
+	for _, ep := range c.endpoints(host, port) {
+		st := DrainStatus{Endpoint: ep}
+		if e, ok := c.drainState[ep]; ok {
+			st.Active = len(e.conns)
+			st.Maintenance = e.maintenance
+			st.Draining = e.maintenance && e.drainedAt.IsZero() && !e.deadline.IsZero()
+			st.Deadline = e.deadline
+			st.DrainedAt = e.drainedAt
+			st.ForcedClosed = e.forced
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+func (c *WebSocketClient) isEndpoint(ep string) bool {
+	host, port, _, err := c.ParseServerAddr()
+	if err != nil {
+		return false
+	}
+	for _, e := range c.endpoints(host, port) {
+		if e == ep {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// AddressFamily 连接服务器时使用的地址族
+type AddressFamily int
+
+const (
+	// FamilyAuto 使用全部地址，同时有 IPv4 与 IPv6 地址时按 Happy Eyeballs (RFC 8305) 竞速
+	FamilyAuto AddressFamily = iota
+	// FamilyIPv4 只连接 IPv4 地址
+	FamilyIPv4
+	// FamilyIPv6 只连接 IPv6 地址
+	FamilyIPv6
+)
+
+// happyEyeballsDelay 发起下一个地址族的连接前等待的时间 (RFC 8305 的 Connection Attempt Delay)
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// ParseAddressFamily 解析地址族名称：auto、v4only 或 v6only
+func ParseAddressFamily(name string) (AddressFamily, error) {
+	switch name {
+	case "", "auto":
+		return FamilyAuto, nil
+	case "v4only":
+		return FamilyIPv4, nil
+	case "v6only":
+		return FamilyIPv6, nil
+	}
+	return 0, fmt.Errorf("未知的地址族: %s (可选 auto、v4only、v6only)", name)
+}
+
+func (f AddressFamily) String() string {
+	switch f {
+	case FamilyIPv4:
+		return "v4only"
+	case FamilyIPv6:
+		return "v6only"
+	}
+	return "auto"
+}
+
+// SetAddressFamily 设置连接服务器时使用的地址族，默认 FamilyAuto。只限制以IP地址给出的节点，
+// 由系统DNS解析的主机名不受影响
+func (c *WebSocketClient) SetAddressFamily(f AddressFamily) {
+	c.family = f
+}
+
+// endpointFamily 返回节点地址的地址族，主机名返回 FamilyAuto
+func endpointFamily(ep string) AddressFamily {
+	host, _, err := net.SplitHostPort(ep)
+	if err != nil {
+		return FamilyAuto
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return FamilyAuto
+	case ip.To4() != nil:
+		return FamilyIPv4
+	default:
+		return FamilyIPv6
+	}
+}
+
+// filterFamily 去掉不属于所选地址族的节点
+func (c *WebSocketClient) filterFamily(eps []string) []string {
+	if c.family == FamilyAuto {
+		return eps
+	}
+	out := eps[:0]
+	for _, ep := range eps {
+		if f := endpointFamily(ep); f == FamilyAuto || f == c.family {
+			out = append(out, ep)
+		}
+	}
+	return out
+}
+
+// interleaveFamilies 按 RFC 8305 交替排列两个地址族的节点，IPv6 在前；各地址族内保持原有顺序
+func interleaveFamilies(eps []string) []string {
+	var v4, v6, other []string
+	for _, ep := range eps {
+		switch endpointFamily(ep) {
+		case FamilyIPv4:
+			v4 = append(v4, ep)
+		case FamilyIPv6:
+			v6 = append(v6, ep)
+		default:
+			other = append(other, ep)
+		}
+	}
+	if len(v4) == 0 || len(v6) == 0 {
+		return eps
+	}
+	out := make([]string, 0, len(eps))
+	for i := 0; i < max(len(v4), len(v6)); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return append(out, other...)
+}
+
+// alternateEndpoint 返回与 ep 竞速的另一地址族的节点：endpoints 中第一个与 ep 地址族不同、未尝试过、
+// 未在维护且熔断器放行的节点。没有时返回空字符串。返回的节点须随后向熔断器报告结果或 Abort
+func (c *WebSocketClient) alternateEndpoint(host, port, ep string, tried map[string]bool) string {
+	family := endpointFamily(ep)
+	if c.family != FamilyAuto || family == FamilyAuto {
+		return ""
+	}
+	for _, alt := range c.endpoints(host, port) {
+		if f := endpointFamily(alt); f == FamilyAuto || f == family || tried[alt] || c.inMaintenance(alt) {
+			continue
+		}
+		if c.breaker.Allow(alt) {
+			return alt
+		}
+	}
+	return ""
+}
+
+// raceDial 按 Happy Eyeballs 依次连接 eps：先连接第一个，happyEyeballsDelay 后或前一个失败时立即
+// 连接下一个，返回最先建立的连接及其节点，其余的连接被取消或关闭。全部失败时返回第一个节点的错误
+func raceDial(ctx context.Context, network string, eps []string, dial func(ctx context.Context, network, ep string) (net.Conn, error)) (net.Conn, string, error) {
+	if len(eps) == 1 {
+		conn, err := dial(ctx, network, eps[0])
+		return conn, eps[0], err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		ep   string
+		err  error
+	}
+	results := make(chan result, len(eps))
+	next, pending := 0, 0
+	start := func() {
+		ep := eps[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, ep)
+			results <- result{conn, ep, err}
+		}()
+	}
+	start()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	errs := make(map[string]error, len(eps))
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(eps) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 仍在进行的连接随 cancel 结束，已建立的关闭
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				if r.ep != eps[0] {
+					log.Printf("[WebSocket] Happy Eyeballs: 经 %s 建立连接", r.ep)
+				}
+				return r.conn, r.ep, nil
+			}
+			errs[r.ep] = r.err
+			if next < len(eps) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, eps[0], errs[eps[0]]
+}
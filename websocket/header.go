@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// reservedHeaders 由 WebSocket 握手本身设置、不能自定义的请求头。子协议用于携带令牌，见 SetToken
+var reservedHeaders = []string{
+	"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version",
+	"Sec-Websocket-Extensions", "Sec-Websocket-Protocol",
+}
+
+// ParseHeader 解析 "名称: 值" 格式的请求头，同名的多行保留为多个值
+func ParseHeader(lines []string) (http.Header, error) {
+	h := make(http.Header)
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("请求头 %q 的格式应为 \"名称: 值\"", line)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	if err := checkHeader(h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func checkHeader(h http.Header) error {
+	for name := range h {
+		for _, reserved := range reservedHeaders {
+			if http.CanonicalHeaderKey(name) == reserved {
+				return fmt.Errorf("请求头 %s 由 WebSocket 握手设置，不能自定义", name)
+			}
+		}
+	}
+	return nil
+}
+
+// SetHeader 设置之后每次 WebSocket 升级请求附加的请求头（如 User-Agent、Cookie 或 CDN 需要的头部），
+// 代替拨号器的默认值。Host 覆盖请求的 Host 头，TLS 服务器名称（ECH 内层的 SNI）仍为服务器地址中的主机名。
+// 握手本身使用的头部（Upgrade、Sec-WebSocket-* 等）不能设置，令牌经 SetToken 以子协议发送
+func (c *WebSocketClient) SetHeader(h http.Header) error {
+	if err := checkHeader(h); err != nil {
+		return err
+	}
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.header = h.Clone()
+	return nil
+}
+
+// requestHeader 返回升级请求附加的请求头，没有设置时为 nil
+func (c *WebSocketClient) requestHeader() http.Header {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.header.Clone()
+}
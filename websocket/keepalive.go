@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SetKeepalive 在之后建立的每条连接上每隔 interval 发送 WebSocket ping；发出 ping 后 timeout 内没有收到 pong
+// 时判定对端失联并关闭连接，使读取方立即出错（ReconnectingConn 随即重连），而不是等到下次写入才发现
+// 长时间空闲的隧道已被中间设备静默断开。interval 为 0 时不发送，timeout 为 0 时等于 interval。
+// pong 在读取连接时处理，连接的使用方需要持续读取
+func (c *WebSocketClient) SetKeepalive(interval, timeout time.Duration) {
+	c.keepalive = max(interval, 0)
+	if timeout <= 0 {
+		timeout = c.keepalive
+	}
+	c.keepaliveTimeout = timeout
+}
+
+// startKeepalive 在新建立的 conn 上开始保活，须在开始读取 conn 之前调用。之后设置 pong 处理函数的
+// 使用方应链式调用 conn.PongHandler() 原有的处理函数，否则保活会因收不到 pong 而关闭连接
+func (c *WebSocketClient) startKeepalive(conn *websocket.Conn) {
+	if c.keepalive <= 0 {
+		return
+	}
+	var lastPong atomic.Int64
+	lastPong.Store(time.Now().UnixNano())
+	prev := conn.PongHandler()
+	conn.SetPongHandler(func(appData string) error {
+		lastPong.Store(time.Now().UnixNano())
+		return prev(appData)
+	})
+	go keepalive(conn, c.keepalive, c.keepaliveTimeout, &lastPong)
+}
+
+// keepalive 定期发送 ping 并检查 pong，连接关闭（ping 写入失败）或判定对端失联后返回
+func keepalive(conn *websocket.Conn, interval, timeout time.Duration, lastPong *atomic.Int64) {
+	for {
+		time.Sleep(max(interval-timeout, 0))
+		sent := time.Now()
+		// ping 负载以发送时间开头，与代理计算隧道RTT的格式相同
+		payload := binary.BigEndian.AppendUint64(nil, uint64(sent.UnixNano()))
+		if err := conn.WriteControl(websocket.PingMessage, payload, sent.Add(timeout)); err != nil {
+			return
+		}
+		time.Sleep(timeout)
+		if lastPong.Load() < sent.UnixNano() {
+			log.Printf("[WebSocket] %s 在 %v 内未响应 ping，判定对端失联，关闭连接", conn.RemoteAddr(), timeout)
+			conn.Close()
+			return
+		}
+	}
+}
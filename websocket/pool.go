@@ -0,0 +1,301 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultPoolHealthInterval 检查空闲连接的默认间隔
+	defaultPoolHealthInterval = 15 * time.Second
+	// defaultPoolMaxIdle 空闲连接的默认最长保留时间，短于 Cloudflare 关闭空闲 WebSocket 的约 100 秒
+	defaultPoolMaxIdle = time.Minute
+	// defaultPoolRetries 补充连接时 connect 的默认重试次数
+	defaultPoolRetries = 2
+)
+
+// PoolPolicy 连接池取出空闲连接的策略
+type PoolPolicy int
+
+const (
+	// PoolRoundRobin 轮流取出不同节点上的连接，同一节点上先建立的先取出
+	PoolRoundRobin PoolPolicy = iota
+	// PoolLeastLoaded 取出所在节点正在使用的连接最少的连接
+	PoolLeastLoaded
+)
+
+var poolPolicyNames = map[string]PoolPolicy{"round-robin": PoolRoundRobin, "least-loaded": PoolLeastLoaded}
+
+// ParsePoolPolicy 解析连接池策略名称：round-robin（默认，空字符串亦同）或 least-loaded
+func ParsePoolPolicy(name string) (PoolPolicy, error) {
+	if name == "" {
+		return PoolRoundRobin, nil
+	}
+	if p, ok := poolPolicyNames[name]; ok {
+		return p, nil
+	}
+	return PoolRoundRobin, fmt.Errorf("未知的连接池策略 %q (可用: round-robin, least-loaded)", name)
+}
+
+func (p PoolPolicy) String() string {
+	for name, v := range poolPolicyNames {
+		if v == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// PoolOptions 连接池的设置，零值字段使用默认值
+type PoolOptions struct {
+	// Size 保持的空闲连接数
+	Size   int
+	Policy PoolPolicy
+	// HealthInterval 向空闲连接发送 ping 检查的间隔，0 表示 15 秒
+	HealthInterval time.Duration
+	// MaxIdle 空闲连接的最长保留时间，超过后关闭并替换，0 表示 1 分钟
+	MaxIdle time.Duration
+	// MaxRetries 补充每条连接时的重试次数，0 表示 2
+	MaxRetries int
+}
+
+// PoolStats 连接池的状态
+type PoolStats struct {
+	Idle    int `json:"idle"`
+	Dialing int `json:"dialing"`
+	// Hits 与 Misses 为取出时有无可用空闲连接的次数
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// pooledConn 空闲连接与其所在节点
+type pooledConn struct {
+	conn     *websocket.Conn
+	endpoint string
+	created  time.Time
+}
+
+// Pool 在后台预先建立并保持若干条隧道连接，新的代理连接直接取用，省去 DNS、TLS 与 WebSocket 升级的延迟。
+// 每条连接只交给一个使用方，取出后在后台补充新的连接。空闲连接定期发送 ping，写入失败、超过 MaxIdle
+// 或所在节点进入维护模式的连接被关闭并替换。空闲连接无人读取，收不到 pong，静默失联的连接只能由
+// MaxIdle 淘汰；连接取出后才开始保活 (SetKeepalive)。
+// Pool 的 DialWithECH 与 DialWithECHCancel 与 WebSocketClient 的同名方法相同，可直接代替客户端使用
+type Pool struct {
+	client *WebSocketClient
+	opts   PoolOptions
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wake 在连接被取出或替换后通知补充
+	wake chan struct{}
+
+	mu       sync.Mutex
+	idle     []*pooledConn
+	dialing  int
+	failures int
+	// last 最近一次取出的连接所在的节点，轮流策略据此选择其他节点
+	last         string
+	hits, misses uint64
+}
+
+// NewPool 创建连接池并开始在后台建立连接，Size 不大于 0 时返回 nil
+func (c *WebSocketClient) NewPool(opts PoolOptions) *Pool {
+	if opts.Size <= 0 {
+		return nil
+	}
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = defaultPoolHealthInterval
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = defaultPoolMaxIdle
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = defaultPoolRetries
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{client: c, opts: opts, ctx: ctx, cancel: cancel, wake: make(chan struct{}, 1)}
+	go p.run()
+	return p
+}
+
+func (p *Pool) DialWithECH(maxRetries int) (*websocket.Conn, error) {
+	return p.DialWithECHCancel(maxRetries, nil)
+}
+
+// DialWithECHCancel 取出一条空闲连接，没有时同 WebSocketClient.DialWithECHCancel 直接建立新连接
+func (p *Pool) DialWithECHCancel(maxRetries int, cancel <-chan struct{}) (*websocket.Conn, error) {
+	if conn := p.take(); conn != nil {
+		p.client.startKeepalive(conn)
+		return conn, nil
+	}
+	return p.client.DialWithECHCancel(maxRetries, cancel)
+}
+
+// Stats 返回连接池的状态
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{Idle: len(p.idle), Dialing: p.dialing, Hits: p.hits, Misses: p.misses}
+}
+
+// Close 关闭全部空闲连接并停止补充，已取出的连接不受影响
+func (p *Pool) Close() {
+	p.cancel()
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, m := range idle {
+		m.conn.Close()
+	}
+}
+
+// take 按策略取出一条可用的空闲连接，没有时返回 nil
+func (p *Pool) take() *websocket.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.notify()
+	for len(p.idle) > 0 {
+		i := p.pickLocked()
+		m := p.idle[i]
+		p.idle = slices.Delete(p.idle, i, i+1)
+		if p.stale(m) != "" {
+			m.conn.Close()
+			continue
+		}
+		p.hits++
+		p.last = m.endpoint
+		return m.conn
+	}
+	p.misses++
+	return nil
+}
+
+// pickLocked 返回按策略应取出的空闲连接的下标
+func (p *Pool) pickLocked() int {
+	if p.opts.Policy == PoolLeastLoaded {
+		idleAt := make(map[string]int)
+		for _, m := range p.idle {
+			idleAt[m.endpoint]++
+		}
+		best, bestLoad := 0, -1
+		for i, m := range p.idle {
+			// 节点上的活动连接包括池中的空闲连接，只计正在使用的
+			load := p.client.activeConns(m.endpoint) - idleAt[m.endpoint]
+			if bestLoad < 0 || load < bestLoad {
+				best, bestLoad = i, load
+			}
+		}
+		return best
+	}
+	for i, m := range p.idle {
+		if m.endpoint != p.last {
+			return i
+		}
+	}
+	return 0
+}
+
+// stale 返回空闲连接不再可用的原因：已超过最长保留时间或所在节点进入了维护模式，可用时返回空字符串
+func (p *Pool) stale(m *pooledConn) string {
+	switch {
+	case time.Since(m.created) > p.opts.MaxIdle:
+		return "已超过最长保留时间"
+	case p.client.inMaintenance(m.endpoint):
+		return "节点处于维护模式"
+	}
+	return ""
+}
+
+func (p *Pool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run 补充空闲连接并定期检查，直到 Close
+func (p *Pool) run() {
+	ticker := time.NewTicker(p.opts.HealthInterval)
+	defer ticker.Stop()
+	for {
+		p.fill()
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.wake:
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// fill 为缺少的空闲连接开始建立新连接
+func (p *Pool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ; len(p.idle)+p.dialing < p.opts.Size; p.dialing++ {
+		go p.add()
+	}
+}
+
+// add 建立一条空闲连接，失败时按退避等待后再让出名额，避免服务器不可用时反复拨号
+func (p *Pool) add() {
+	conn, err := p.client.connect(p.ctx, p.opts.MaxRetries)
+	p.mu.Lock()
+	if err != nil {
+		p.failures++
+		wait := jitteredBackoff(defaultReconnectMinBackoff, defaultReconnectMaxBackoff, p.failures)
+		p.mu.Unlock()
+		if p.ctx.Err() == nil {
+			log.Printf("[WebSocket] 连接池建立连接失败，%v后重试: %v", wait.Round(time.Millisecond), err)
+			sleepCtx(p.ctx, wait)
+		}
+		p.mu.Lock()
+		p.dialing--
+		p.mu.Unlock()
+		p.notify()
+		return
+	}
+	defer p.mu.Unlock()
+	p.dialing--
+	p.failures = 0
+	if p.ctx.Err() != nil {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, &pooledConn{conn: conn, endpoint: endpointOf(conn), created: time.Now()})
+}
+
+// check 关闭超时、所在节点维护中或 ping 写入失败的空闲连接，由 run 随后补充
+func (p *Pool) check() {
+	p.mu.Lock()
+	idle := slices.Clone(p.idle)
+	p.mu.Unlock()
+	for _, m := range idle {
+		reason := p.stale(m)
+		if reason == "" {
+			if err := m.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				reason = err.Error()
+			}
+		}
+		if reason == "" {
+			continue
+		}
+		p.mu.Lock()
+		i := slices.Index(p.idle, m)
+		if i >= 0 {
+			p.idle = slices.Delete(p.idle, i, i+1)
+		}
+		p.mu.Unlock()
+		if i >= 0 {
+			log.Printf("[WebSocket] 替换连接池中 %s 的空闲连接: %s", m.endpoint, reason)
+			m.conn.Close()
+		}
+	}
+}
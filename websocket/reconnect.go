@@ -0,0 +1,216 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultReconnectRetries 每次重连调用 DialWithECHContext 的默认重试次数
+	defaultReconnectRetries = 3
+	// defaultReconnectMinBackoff 与 defaultReconnectMaxBackoff 重连失败后等待的默认下限与上限
+	defaultReconnectMinBackoff = time.Second
+	defaultReconnectMaxBackoff = time.Minute
+)
+
+// ErrReconnectClosed ReconnectingConn 已关闭
+var ErrReconnectClosed = errors.New("重连连接已关闭")
+
+// ReconnectOptions ReconnectingConn 的重连策略，零值使用默认设置
+type ReconnectOptions struct {
+	// MaxRetries 每次重连调用 DialWithECHContext 的重试次数，0 表示 3
+	MaxRetries int
+	// MinBackoff 第一次重连失败后的等待，之后每次翻倍直到 MaxBackoff，实际等待在 [d/2, d] 内随机，
+	// 避免大量客户端在服务端恢复时同时重连。0 分别表示 1 秒与 1 分钟
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnReconnect 不为空时在每次重连成功后、连接交给读写方法之前调用（首次连接不调用），
+	// 用于重新执行应用层的握手。返回错误时关闭该连接并继续重连
+	OnReconnect func(conn *websocket.Conn) error
+}
+
+func (o ReconnectOptions) maxRetries() int {
+	if o.MaxRetries <= 0 {
+		return defaultReconnectRetries
+	}
+	return o.MaxRetries
+}
+
+// backoff 返回第 attempt 次（从 1 开始）重连失败后的等待时间
+func (o ReconnectOptions) backoff(attempt int) time.Duration {
+	d, limit := o.MinBackoff, o.MaxBackoff
+	if d <= 0 {
+		d = defaultReconnectMinBackoff
+	}
+	if limit <= 0 {
+		limit = defaultReconnectMaxBackoff
+	}
+	return jitteredBackoff(d, limit, attempt)
+}
+
+// jitteredBackoff 返回第 attempt 次（从 1 开始）失败后的等待：从 d 开始每次翻倍，不超过 limit，
+// 实际等待在 [d/2, d] 内随机
+func jitteredBackoff(d, limit time.Duration, attempt int) time.Duration {
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	d = min(d, limit)
+	return d/2 + rand.N(d/2+1)
+}
+
+// ReconnectingConn 连接断开时自动经 DialWithECHContext 重新连接的 WebSocket 连接。每次重连都完整地
+// 重新拨号与握手，令牌子协议随之重新发送（SetTokenSource 的令牌重新生成）。
+// 读写遇到断开时等待重连完成后在新连接上继续：ReadMessage 读取新连接的消息，WriteMessage 在新连接上
+// 重新写入失败的消息。断开前已发出但对端未处理的消息不会重发，需要可靠传递的应用应在 OnReconnect 中同步状态。
+// 与 websocket.Conn 相同，同一时刻最多一个读取方与一个写入方
+type ReconnectingConn struct {
+	client *WebSocketClient
+	opts   ReconnectOptions
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// ready 在重连成功或关闭时关闭，conn 为空时读写方法等待它
+	ready      chan struct{}
+	reconnects int
+}
+
+// DialReconnecting 建立一条自动重连的连接。首次连接在 ctx 内完成，失败时返回错误；
+// 之后的重连持续进行直到调用 Close
+func (c *WebSocketClient) DialReconnecting(ctx context.Context, opts ReconnectOptions) (*ReconnectingConn, error) {
+	conn, err := c.DialWithECHContext(ctx, opts.maxRetries())
+	if err != nil {
+		return nil, err
+	}
+	rctx, cancel := context.WithCancel(context.Background())
+	return &ReconnectingConn{client: c, opts: opts, ctx: rctx, cancel: cancel, conn: conn}, nil
+}
+
+// Conn 返回当前的连接，正在重连时返回 nil
+func (r *ReconnectingConn) Conn() *websocket.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn
+}
+
+// Reconnects 返回成功重连的次数
+func (r *ReconnectingConn) Reconnects() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reconnects
+}
+
+// ReadMessage 读取下一条消息，连接断开时等待重连后从新连接读取
+func (r *ReconnectingConn) ReadMessage() (messageType int, p []byte, err error) {
+	for {
+		conn, err := r.current()
+		if err != nil {
+			return 0, nil, err
+		}
+		messageType, p, err := conn.ReadMessage()
+		if err == nil {
+			return messageType, p, nil
+		}
+		r.broken(conn, err)
+	}
+}
+
+// WriteMessage 写入一条消息，连接断开时等待重连后在新连接上重新写入
+func (r *ReconnectingConn) WriteMessage(messageType int, data []byte) error {
+	for {
+		conn, err := r.current()
+		if err != nil {
+			return err
+		}
+		err = conn.WriteMessage(messageType, data)
+		if err == nil {
+			return nil
+		}
+		r.broken(conn, err)
+	}
+}
+
+// Close 关闭当前连接并停止重连，等待中的读写方法返回 ErrReconnectClosed
+func (r *ReconnectingConn) Close() error {
+	r.cancel()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// current 返回当前连接，正在重连时等待重连完成
+func (r *ReconnectingConn) current() (*websocket.Conn, error) {
+	for {
+		if r.ctx.Err() != nil {
+			return nil, ErrReconnectClosed
+		}
+		r.mu.Lock()
+		conn, ready := r.conn, r.ready
+		r.mu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-ready:
+		case <-r.ctx.Done():
+		}
+	}
+}
+
+// broken 报告 conn 读写失败。conn 仍是当前连接时关闭它并在后台开始重连，读写双方同时报告时只重连一次
+func (r *ReconnectingConn) broken(conn *websocket.Conn, cause error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != conn || r.ctx.Err() != nil {
+		return
+	}
+	conn.Close()
+	r.conn = nil
+	r.ready = make(chan struct{})
+	log.Printf("[WebSocket] 连接已断开，开始重连: %v", cause)
+	go r.reconnect(r.ready)
+}
+
+// reconnect 按退避策略重连直到成功或关闭，成功后关闭 ready
+func (r *ReconnectingConn) reconnect(ready chan struct{}) {
+	for attempt := 1; ; attempt++ {
+		conn, err := r.client.DialWithECHContext(r.ctx, r.opts.maxRetries())
+		if err == nil && r.opts.OnReconnect != nil {
+			if err = r.opts.OnReconnect(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			r.mu.Lock()
+			if r.ctx.Err() != nil {
+				r.mu.Unlock()
+				conn.Close()
+				return
+			}
+			r.conn = conn
+			r.reconnects++
+			close(ready)
+			r.mu.Unlock()
+			log.Printf("[WebSocket] 重连成功 (第%d次尝试)", attempt)
+			return
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+		wait := r.opts.backoff(attempt)
+		log.Printf("[WebSocket] 重连失败，%v后重试: %v", wait.Round(time.Millisecond), err)
+		sleepCtx(r.ctx, wait)
+	}
+}
@@ -1,26 +1,120 @@
 package websocket
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"ech-workers/audit"
+	"ech-workers/breaker"
+	"ech-workers/dialer"
 	"ech-workers/ech"
+	"ech-workers/events"
+	"ech-workers/stats"
 
 	"github.com/gorilla/websocket"
 )
 
+// ECHProvider ECH配置来源接口定义
+type ECHProvider interface {
+	BuildTLSConfig(serverName string) (*tls.Config, error)
+	Refresh() error
+}
+
+// RetryConfigApplier 可选接口，ECH配置来源实现它时，服务器拒绝 ECH 并提供 retry_configs 后
+// 客户端用新配置立即重试，而不必重新查询 DNS
+type RetryConfigApplier interface {
+	ApplyRetryConfigs(list []byte) error
+}
+
+// AddrHinter 可选接口，ECH配置来源实现它时，未指定服务端IP的拨号先尝试HTTPS记录中的
+// ipv4hint/ipv6hint 地址，全部失败后再按系统DNS解析服务器地址
+type AddrHinter interface {
+	AddrHints(host string) []net.IP
+}
+
+// AddrResolver 可选接口，ECH配置来源实现它时，未指定服务端IP的拨号经它（加密DNS）解析服务器地址，
+// 不再交给系统DNS，避免服务器域名以明文DNS查询泄露
+type AddrResolver interface {
+	QueryAddr(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// ECHReporter 可选接口，ECH配置来源实现它时，每次握手的 ECH 结果（接受或被拒绝、忽略）都报告给它，
+// 用于在当前配置被持续拒绝时切换到备用域名
+type ECHReporter interface {
+	ReportECH(accepted bool)
+}
+
+// VersionedProvider 可选接口，BuildTLSConfigVersion 同 BuildTLSConfig，另外返回所用ECH配置的版本
+// （0 表示未知），拨号失败的日志中注明失败的是哪个版本的配置
+type VersionedProvider interface {
+	BuildTLSConfigVersion(serverName string) (*tls.Config, uint64, error)
+}
+
+// ContextRefresher 可选接口，ECH配置来源实现它时，拨号过程中的配置刷新随 DialWithECHContext 的 ctx 中止
+type ContextRefresher interface {
+	RefreshContext(ctx context.Context) error
+}
+
+// ServiceEndpointer 可选接口，ECH配置来源实现它且启用 SetServiceEndpoint 时，HTTPS记录的 TargetName 与
+// port 参数代替用户给出的服务器地址作为实际连接的主机与端口。TLS 服务器名称与 Host 仍为原服务器地址
+type ServiceEndpointer interface {
+	ServiceEndpoint(host string) (target string, port uint16)
+}
+
+// FallbackTLSBuilder 可选接口，ECH配置来源实现它时，回退到普通 TLS (SetECHFallback) 的连接使用它返回的
+// TLS配置，保留附加 CA、客户端证书、ALPN 与会话缓存等设置
+type FallbackTLSBuilder interface {
+	BuildFallbackTLSConfig(serverName string) (*tls.Config, error)
+}
+
+// ErrAuthFailed 服务端拒绝了身份验证令牌
+var ErrAuthFailed = errors.New("身份验证失败")
+
+// writeBufferPool 在所有连接间共享WebSocket写缓冲区
+var writeBufferPool sync.Pool
+
 type WebSocketClient struct {
 	serverAddr string
+	tokenMu    sync.RWMutex
 	token      string
-	echManager *ech.ECHManager
+	tokenSrc   func() string
+	// header 升级请求附加的请求头，见 SetHeader，与令牌同由 tokenMu 保护
+	header     http.Header
+	echManager ECHProvider
 	serverIP   string
+	netDial    func(network, addr string) (net.Conn, error)
+	// underlying 建立底层连接的拨号器，为空时直接使用 TCP
+	underlying dialer.UnderlyingDialer
+	// echFallback 为 true 时允许 ECH 不可用时回退到普通 TLS，否则只接受 ECH 被接受的连接
+	echFallback bool
+	// serviceEndpoint 为 true 时按HTTPS记录的 TargetName 与 port 参数连接，见 SetServiceEndpoint
+	serviceEndpoint bool
+	// family 连接使用的地址族，见 SetAddressFamily
+	family AddressFamily
+	// keepalive 与 keepaliveTimeout 为 ping 间隔与等待 pong 的时间，见 SetKeepalive
+	keepalive        time.Duration
+	keepaliveTimeout time.Duration
+	// breaker 为空时不熔断，lastEndpoint 为最近一次使用的节点
+	breaker      *breaker.Breaker
+	endpointMu   sync.Mutex
+	lastEndpoint string
+	// resolved 最近一次经 AddrResolver 解析到的服务器地址，由 endpointMu 保护
+	resolved []net.IP
+	// drainState 各节点的活动连接与维护状态，见 drain.go
+	drainMu    sync.Mutex
+	drainState map[string]*endpointConns
 }
 
-func NewWebSocketClient(serverAddr, token string, echManager *ech.ECHManager, serverIP string) *WebSocketClient {
+func NewWebSocketClient(serverAddr, token string, echManager ECHProvider, serverIP string) *WebSocketClient {
 	return &WebSocketClient{
 		serverAddr: serverAddr,
 		token:      token,
@@ -29,6 +123,74 @@ func NewWebSocketClient(serverAddr, token string, echManager *ech.ECHManager, se
 	}
 }
 
+// SetToken 更换身份验证令牌，之后新建的连接使用新令牌
+func (c *WebSocketClient) SetToken(token string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.token = token
+}
+
+// SetTokenSource 设置每次拨号时生成令牌的函数（如一次性令牌），设置后忽略固定令牌
+func (c *WebSocketClient) SetTokenSource(src func() string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.tokenSrc = src
+}
+
+func (c *WebSocketClient) currentToken() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	if c.tokenSrc != nil {
+		return c.tokenSrc()
+	}
+	return c.token
+}
+
+// SetECHFallback 设置 ECH 不可用（配置缺失或被拒绝）时是否回退到普通 TLS。
+// 默认不回退：除 ECH 被接受外的任何握手结果都视为连接失败
+func (c *WebSocketClient) SetECHFallback(allow bool) {
+	c.echFallback = allow
+}
+
+// SetServiceEndpoint 设置是否按HTTPS记录的 TargetName 与 port 参数连接服务器（需配置来源实现
+// ServiceEndpointer）。记录未指定时仍连接用户给出的地址；指定了服务端IP (-ip) 时不生效
+func (c *WebSocketClient) SetServiceEndpoint(enable bool) {
+	c.serviceEndpoint = enable
+}
+
+// serviceAddr 返回实际连接的主机与端口：启用 SetServiceEndpoint 时以HTTPS记录的 TargetName 与 port 参数
+// 代替 host 与 port
+func (c *WebSocketClient) serviceAddr(host, port string) (string, string) {
+	e, ok := c.echManager.(ServiceEndpointer)
+	if !c.serviceEndpoint || !ok {
+		return host, port
+	}
+	target, p := e.ServiceEndpoint(host)
+	if target != "" {
+		host = target
+	}
+	if p != 0 {
+		port = strconv.Itoa(int(p))
+	}
+	return host, port
+}
+
+// SetUnderlyingDialer 替换建立底层连接的拨号器（如用户态 WireGuard、混淆 TCP 等）
+func (c *WebSocketClient) SetUnderlyingDialer(d dialer.UnderlyingDialer) {
+	c.underlying = d
+}
+
+// SetBreaker 设置节点熔断器：连续失败超过预算的节点在冷却期内被跳过，
+// 所有节点都被熔断时拨号立即失败
+func (c *WebSocketClient) SetBreaker(b *breaker.Breaker) {
+	c.breaker = b
+}
+
+// SetNetDial 替换底层TCP拨号函数，主要用于测试
+func (c *WebSocketClient) SetNetDial(dial func(network, addr string) (net.Conn, error)) {
+	c.netDial = dial
+}
+
 func (c *WebSocketClient) ParseServerAddr() (host, port, path string, err error) {
 	if c.serverAddr == "" {
 		return "", "", "", errors.New("服务器地址为空")
@@ -56,73 +218,501 @@ func (c *WebSocketClient) ParseServerAddr() (host, port, path string, err error)
 	return host, port, path, nil
 }
 
+// endpoints 返回可连接的节点地址。-ip 可以是逗号分隔的多个地址，按顺序优先使用，
+// 未带端口的沿用 port；未指定时为HTTPS记录的地址提示，其后是经 AddrResolver 解析到的地址，
+// 配置来源不支持解析时为服务器地址本身（由系统DNS解析）。启用 SetServiceEndpoint 时后两者
+// 使用HTTPS记录的 TargetName，端口使用记录的 port 参数。结果按 SetAddressFamily 筛选
+func (c *WebSocketClient) endpoints(host, port string) []string {
+	return c.filterFamily(c.allEndpoints(host, port))
+}
+
+// allEndpoints 返回未按地址族筛选的节点，未指定服务端IP时两个地址族交替排列
+func (c *WebSocketClient) allEndpoints(host, port string) []string {
+	if c.serverIP == "" {
+		target, port := c.serviceAddr(host, port)
+		var out []string
+		seen := map[string]bool{}
+		add := func(ip net.IP) {
+			if ep := net.JoinHostPort(ip.String(), port); !seen[ep] {
+				seen[ep] = true
+				out = append(out, ep)
+			}
+		}
+		if hinter, ok := c.echManager.(AddrHinter); ok {
+			for _, ip := range hinter.AddrHints(host) {
+				add(ip)
+			}
+		}
+		if _, ok := c.echManager.(AddrResolver); ok {
+			c.endpointMu.Lock()
+			resolved := c.resolved
+			c.endpointMu.Unlock()
+			for _, ip := range resolved {
+				add(ip)
+			}
+			return interleaveFamilies(out)
+		}
+		return append(out, net.JoinHostPort(target, port))
+	}
+	var out []string
+	for _, ip := range strings.Split(c.serverIP, ",") {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+		if h, userPort, err := net.SplitHostPort(ip); err == nil {
+			out = append(out, net.JoinHostPort(h, userPort))
+		} else {
+			out = append(out, net.JoinHostPort(ip, port))
+		}
+	}
+	return out
+}
+
+// resolveServer 未指定服务端IP且配置来源实现 AddrResolver 时解析服务器地址，供 endpoints 使用。
+// 解析失败时保留上一次的结果
+func (c *WebSocketClient) resolveServer(ctx context.Context, host string) error {
+	resolver, ok := c.echManager.(AddrResolver)
+	if c.serverIP != "" || !ok {
+		return nil
+	}
+	target, _ := c.serviceAddr(host, "")
+	ips, err := resolver.QueryAddr(ctx, target)
+	if err != nil {
+		return err
+	}
+	c.endpointMu.Lock()
+	c.resolved = ips
+	c.endpointMu.Unlock()
+	return nil
+}
+
+// ErrCircuitOpen 所有节点都处于熔断冷却中
+var ErrCircuitOpen = errors.New("所有节点均已熔断")
+
+// ErrMaintenance 所有可用节点都处于维护模式
+var ErrMaintenance = errors.New("所有节点均处于维护中")
+
+// pickEndpoint 返回第一个未尝试过、未在维护且未被熔断的节点，节点与上次不同时发布切换事件
+func (c *WebSocketClient) pickEndpoint(host, port string, tried map[string]bool) (string, error) {
+	maintenance := false
+	for _, ep := range c.endpoints(host, port) {
+		if c.inMaintenance(ep) {
+			maintenance = true
+			continue
+		}
+		if tried[ep] || !c.breaker.Allow(ep) {
+			continue
+		}
+		c.endpointMu.Lock()
+		switched := c.lastEndpoint != "" && c.lastEndpoint != ep
+		c.lastEndpoint = ep
+		c.endpointMu.Unlock()
+		if switched {
+			log.Printf("[WebSocket] 切换到节点 %s", ep)
+			events.Emit(events.EndpointSwitched, ep, nil)
+		}
+		return ep, nil
+	}
+	if maintenance {
+		return "", ErrMaintenance
+	}
+	return "", ErrCircuitOpen
+}
+
+// ActiveEndpoint 返回最近一次拨号使用的节点
+func (c *WebSocketClient) ActiveEndpoint() string {
+	c.endpointMu.Lock()
+	defer c.endpointMu.Unlock()
+	return c.lastEndpoint
+}
+
+// reportEndpoint 把一次拨号结果计入节点的熔断状态。只有连接层面的失败（没有收到 HTTP 响应且与 ECH 无关）
+// 才算节点故障，认证失败或 ECH 被拒绝说明节点本身可达
+func (c *WebSocketClient) reportEndpoint(ep string, resp *http.Response, err error) {
+	switch {
+	case err == ErrDialCanceled:
+		c.breaker.Abort(ep)
+	case err != nil && resp == nil && !isECHError(err):
+		if c.breaker.Failure(ep, err) {
+			log.Printf("[WebSocket] 节点 %s 连续失败，暂停使用: %v", ep, err)
+		}
+	default:
+		c.breaker.Success(ep)
+	}
+}
+
+// TargetAddr 返回建立隧道时优先连接的TCP地址
+func (c *WebSocketClient) TargetAddr() (string, error) {
+	host, port, _, err := c.ParseServerAddr()
+	if err != nil {
+		return "", err
+	}
+	resolveErr := c.resolveServer(context.Background(), host)
+	eps := c.endpoints(host, port)
+	if len(eps) == 0 {
+		if resolveErr != nil {
+			return "", fmt.Errorf("解析服务器地址失败: %w", resolveErr)
+		}
+		return "", errors.New("未指定有效的服务端IP")
+	}
+	return eps[0], nil
+}
+
 func (c *WebSocketClient) DialWithECH(maxRetries int) (*websocket.Conn, error) {
+	return c.dial(context.Background(), maxRetries)
+}
+
+// ErrDialCanceled 拨号被调用方取消（如本地连接已关闭）
+var ErrDialCanceled = errors.New("拨号已取消")
+
+// DialWithECHCancel 与 DialWithECH 相同，cancel 关闭时立即中止正在进行的拨号、握手与重试等待，
+// 已建立的底层连接会被关闭
+func (c *WebSocketClient) DialWithECHCancel(maxRetries int, cancel <-chan struct{}) (*websocket.Conn, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	if cancel != nil {
+		go func() {
+			select {
+			case <-cancel:
+				stop()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return c.dial(ctx, maxRetries)
+}
+
+// DialWithECHContext 与 DialWithECH 相同，ctx 取消或超时时立即中止整个重试过程：正在进行的拨号、握手、
+// ECH配置刷新（配置来源实现 ContextRefresher 时）与重试之间的等待，已建立的底层连接会被关闭。
+// 此时返回的错误同时满足 errors.Is(err, ErrDialCanceled) 与 errors.Is(err, ctx.Err())
+func (c *WebSocketClient) DialWithECHContext(ctx context.Context, maxRetries int) (*websocket.Conn, error) {
+	conn, err := c.dial(ctx, maxRetries)
+	if err == ErrDialCanceled && ctx.Err() != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDialCanceled, context.Cause(ctx))
+	}
+	return conn, err
+}
+
+// dial 建立隧道连接并开始保活，ctx 结束时返回 ErrDialCanceled
+func (c *WebSocketClient) dial(ctx context.Context, maxRetries int) (*websocket.Conn, error) {
+	conn, err := c.connect(ctx, maxRetries)
+	if err == nil {
+		c.startKeepalive(conn)
+	}
+	return conn, err
+}
+
+// connect 建立隧道连接但不开始保活，供连接池预先建立暂不读取的连接
+func (c *WebSocketClient) connect(ctx context.Context, maxRetries int) (conn *websocket.Conn, err error) {
+	attempts := 0
+	defer func() {
+		switch {
+		case err == ErrDialCanceled:
+			// 调用方放弃了连接，不代表隧道故障
+		case err != nil:
+			stats.DialDone(attempts, err)
+			events.Emit(events.TunnelDown, c.serverAddr, err)
+		default:
+			stats.DialDone(attempts, err)
+			events.Emit(events.TunnelUp, c.serverAddr, nil)
+		}
+	}()
+
 	host, port, path, err := c.ParseServerAddr()
 	if err != nil {
 		return nil, fmt.Errorf("解析服务器地址失败: %w", err)
 	}
 
 	wsURL := fmt.Sprintf("wss://%s:%s%s", host, port, path)
+	if err := c.resolveServer(ctx, host); err != nil {
+		if ctx.Err() != nil {
+			return nil, ErrDialCanceled
+		}
+		if len(c.endpoints(host, port)) == 0 {
+			return nil, fmt.Errorf("解析服务器地址失败: %w", err)
+		}
+		log.Printf("[WebSocket] 解析服务器地址失败，只使用HTTPS记录的地址提示: %v", err)
+	}
 
 	var lastErr error
+	tried := make(map[string]bool)
 
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		tlsCfg, tlsErr := c.echManager.BuildTLSConfig(host)
+		if ctx.Err() != nil {
+			return nil, ErrDialCanceled
+		}
+		attempts = attempt
+		tlsCfg, version, tlsErr := c.buildTLSConfig(host)
 		if tlsErr != nil {
 			lastErr = tlsErr
-			if attempt < maxRetries && (strings.Contains(tlsErr.Error(), "ECH配置") ||
-				strings.Contains(tlsErr.Error(), "未找到ECH")) {
+			echErr := errors.Is(tlsErr, ech.ErrECHNotLoaded) || errors.Is(tlsErr, ech.ErrNoECHRecord)
+			if attempt < maxRetries && echErr {
 				log.Printf("[ECH] TLS配置失败，尝试刷新ECH配置 (%d/%d): %v", attempt, maxRetries, tlsErr)
-				c.echManager.Refresh()
-				time.Sleep(500 * time.Millisecond)
+				c.refresh(ctx)
+				sleepCtx(ctx, 500*time.Millisecond)
 				continue
 			}
+			if echErr && c.echFallback {
+				break
+			}
 			return nil, fmt.Errorf("构建TLS配置失败: %w", tlsErr)
 		}
 
-		dialer := websocket.Dialer{
-			TLSClientConfig: tlsCfg,
-			Subprotocols: func() []string {
-				if c.token == "" {
-					return nil
-				}
-				return []string{c.token}
-			}(),
-			HandshakeTimeout: 10 * time.Second,
+		ep, epErr := c.pickEndpoint(host, port, tried)
+		if epErr != nil {
+			if lastErr != nil {
+				return nil, fmt.Errorf("WebSocket连接失败: %w", lastErr)
+			}
+			return nil, epErr
 		}
-
-		if c.serverIP != "" {
-			dialer.NetDial = func(network, address string) (net.Conn, error) {
-				_, port, err := net.SplitHostPort(address)
-				if err != nil {
-					return nil, err
-				}
-				ipHost := c.serverIP
-				userHost, userPort, splitErr := net.SplitHostPort(c.serverIP)
-				if splitErr == nil {
-					ipHost = userHost
-					port = userPort
+		eps := []string{ep}
+		if alt := c.alternateEndpoint(host, port, ep, tried); alt != "" {
+			eps = append(eps, alt)
+		}
+		wsConn, resp, used, dialErr := c.dialOnce(ctx, wsURL, eps, tlsCfg)
+		if ctx.Err() != nil {
+			for _, e := range eps {
+				c.breaker.Abort(e)
+			}
+			return nil, ErrDialCanceled
+		}
+		for _, e := range eps {
+			switch {
+			case used == "":
+				// 竞速的节点都没有建立连接
+				c.reportEndpoint(e, nil, dialErr)
+				if e != ep {
+					tried[e] = true
 				}
-				return net.DialTimeout(network, net.JoinHostPort(ipHost, port), 10*time.Second)
+			case e == used:
+				c.reportEndpoint(e, resp, dialErr)
+			default:
+				c.breaker.Abort(e)
 			}
 		}
-
-		wsConn, _, dialErr := dialer.Dial(wsURL, nil)
+		if used != "" && used != ep {
+			c.endpointMu.Lock()
+			c.lastEndpoint = used
+			c.endpointMu.Unlock()
+			ep = used
+		}
 		if dialErr != nil {
 			lastErr = dialErr
-			if attempt < maxRetries && (strings.Contains(dialErr.Error(), "ECH") ||
-				strings.Contains(dialErr.Error(), "encrypted")) {
+			if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+				events.Emit(events.AuthFailed, c.serverAddr, dialErr)
+				return nil, fmt.Errorf("%w (HTTP %d): %w", ErrAuthFailed, resp.StatusCode, dialErr)
+			}
+			echErr := isECHError(dialErr)
+			// 节点连不上时在同一次拨号中换下一个节点
+			if resp == nil && !echErr && attempt < maxRetries && len(tried)+1 < len(c.endpoints(host, port)) {
+				tried[ep] = true
+				log.Printf("[WebSocket] 节点 %s 连接失败，尝试下一个节点: %v", ep, dialErr)
+				continue
+			}
+			if version != 0 {
+				log.Printf("[WebSocket] 使用版本 %d 的ECH配置连接 %s 失败: %v", version, ep, dialErr)
+			}
+			if isECHRejection(dialErr) {
+				audit.Record(c.serverAddr, audit.Rejected, dialErr.Error())
+				c.reportECH(false)
+			}
+			if attempt < maxRetries && c.applyRetryConfigs(dialErr) {
+				log.Printf("[ECH] 服务器拒绝ECH并提供了新配置，使用 retry_configs 重试 (%d/%d)", attempt, maxRetries)
+				continue
+			}
+			if attempt < maxRetries && echErr {
 				log.Printf("[ECH] 连接失败，尝试刷新ECH配置 (%d/%d): %v", attempt, maxRetries, dialErr)
-				c.echManager.Refresh()
-				time.Sleep(time.Second)
+				c.refresh(ctx)
+				sleepCtx(ctx, time.Second)
 				continue
 			}
+			if echErr && c.echFallback {
+				break
+			}
 			return nil, fmt.Errorf("WebSocket连接失败: %w", dialErr)
 		}
 
+		if err := c.checkECH(wsConn); err != nil {
+			wsConn.Close()
+			return nil, err
+		}
 		log.Printf("[WebSocket] 连接成功建立 (尝试%d次)", attempt)
 		return wsConn, nil
 	}
 
+	if c.echFallback && lastErr != nil {
+		return c.dialFallback(ctx, wsURL, host, port, lastErr)
+	}
 	return nil, fmt.Errorf("连接失败，已达最大重试次数(%d): %v", maxRetries, lastErr)
 }
+
+// refresh 刷新ECH配置，配置来源实现 ContextRefresher 时随 ctx 中止
+func (c *WebSocketClient) refresh(ctx context.Context) error {
+	if r, ok := c.echManager.(ContextRefresher); ok {
+		return r.RefreshContext(ctx)
+	}
+	return c.echManager.Refresh()
+}
+
+// buildTLSConfig 构建一次握手的TLS配置，配置来源实现 VersionedProvider 时同时返回所用配置的版本
+func (c *WebSocketClient) buildTLSConfig(host string) (*tls.Config, uint64, error) {
+	if v, ok := c.echManager.(VersionedProvider); ok {
+		return v.BuildTLSConfigVersion(host)
+	}
+	cfg, err := c.echManager.BuildTLSConfig(host)
+	return cfg, 0, err
+}
+
+// fallbackTLSConfig 返回回退连接的TLS配置，配置来源未实现 FallbackTLSBuilder 时只设置服务器名称
+func (c *WebSocketClient) fallbackTLSConfig(host string) (*tls.Config, error) {
+	if b, ok := c.echManager.(FallbackTLSBuilder); ok {
+		return b.BuildFallbackTLSConfig(host)
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, ServerName: host}, nil
+}
+
+// dialFallback 在 ECH 不可用时以普通 TLS 连接，真实 SNI 会以明文发送
+func (c *WebSocketClient) dialFallback(ctx context.Context, wsURL, host, port string, echErr error) (*websocket.Conn, error) {
+	log.Printf("[ECH] ECH 不可用 (%v)，回退到普通 TLS，服务器名称 %s 将以明文发送", echErr, host)
+	ep, err := c.pickEndpoint(host, port, nil)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg, err := c.fallbackTLSConfig(host)
+	if err != nil {
+		return nil, fmt.Errorf("回退到普通TLS失败: %w", err)
+	}
+	wsConn, resp, _, err := c.dialOnce(ctx, wsURL, []string{ep}, tlsCfg)
+	if ctx.Err() != nil {
+		c.breaker.Abort(ep)
+		return nil, ErrDialCanceled
+	}
+	c.reportEndpoint(ep, resp, err)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			events.Emit(events.AuthFailed, c.serverAddr, err)
+			return nil, fmt.Errorf("%w (HTTP %d): %w", ErrAuthFailed, resp.StatusCode, err)
+		}
+		return nil, fmt.Errorf("回退到普通TLS后连接失败: %w", err)
+	}
+	audit.Record(c.serverAddr, audit.Fallback, echErr.Error())
+	log.Printf("[WebSocket] 连接成功建立 (普通TLS)")
+	return wsConn, nil
+}
+
+// checkECH 记录握手的 ECH 结果；未允许回退时，ECH 未被接受的连接视为失败
+func (c *WebSocketClient) checkECH(wsConn *websocket.Conn) error {
+	tlsConn, ok := wsConn.NetConn().(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if tlsConn.ConnectionState().ECHAccepted {
+		audit.Record(c.serverAddr, audit.Accepted, "")
+		c.reportECH(true)
+		return nil
+	}
+	audit.Record(c.serverAddr, audit.GREASE, "")
+	c.reportECH(false)
+	if !c.echFallback {
+		return fmt.Errorf("%w: 服务器未接受ECH，严格模式下拒绝连接", ech.ErrECHRejected)
+	}
+	return nil
+}
+
+// reportECH 把握手的 ECH 结果交给实现了 ECHReporter 的配置来源
+func (c *WebSocketClient) reportECH(accepted bool) {
+	if r, ok := c.echManager.(ECHReporter); ok {
+		r.ReportECH(accepted)
+	}
+}
+
+// isECHError 判断连接失败是否与 ECH 有关
+func isECHError(err error) bool {
+	return isECHRejection(err) || errors.Is(err, ech.ErrECHNotLoaded) || errors.Is(err, ech.ErrNoECHRecord)
+}
+
+// applyRetryConfigs 握手因 ECH 被拒绝而失败且服务器提供了 retry_configs 时交给配置来源，返回是否已更新
+func (c *WebSocketClient) applyRetryConfigs(err error) bool {
+	var rejection *tls.ECHRejectionError
+	if !errors.As(err, &rejection) || len(rejection.RetryConfigList) == 0 {
+		return false
+	}
+	applier, ok := c.echManager.(RetryConfigApplier)
+	if !ok {
+		return false
+	}
+	if err := applier.ApplyRetryConfigs(rejection.RetryConfigList); err != nil {
+		log.Printf("[ECH] %v", err)
+		return false
+	}
+	return true
+}
+
+// isECHRejection 判断握手失败是否因为服务器拒绝了 ECH
+func isECHRejection(err error) bool {
+	var rejection *tls.ECHRejectionError
+	return errors.As(err, &rejection) || errors.Is(err, ech.ErrECHRejected)
+}
+
+// dialOnce 连接节点 eps（多于一个时按 Happy Eyeballs 竞速），使用给定的TLS配置完成一次 WebSocket 握手，
+// 返回建立了连接的节点，没有节点连接成功时为空字符串
+func (c *WebSocketClient) dialOnce(ctx context.Context, wsURL string, eps []string, tlsCfg *tls.Config) (*websocket.Conn, *http.Response, string, error) {
+	dialer := websocket.Dialer{
+		TLSClientConfig: tlsCfg,
+		Subprotocols: func() []string {
+			token := c.currentToken()
+			if token == "" {
+				return nil
+			}
+			return []string{token}
+		}(),
+		HandshakeTimeout: 10 * time.Second,
+		WriteBufferPool:  &writeBufferPool,
+	}
+
+	netDial := func(ctx context.Context, network, endpoint string) (net.Conn, error) {
+		if c.netDial != nil {
+			return c.netDial(network, endpoint)
+		}
+		if c.underlying != nil {
+			return c.underlying.DialContext(ctx, network, endpoint)
+		}
+		d := net.Dialer{Timeout: 10 * time.Second}
+		return d.DialContext(ctx, network, endpoint)
+	}
+	// 取消时关闭底层连接，使升级请求的读写立即返回
+	var stopClose func() bool
+	used := ""
+	dialer.NetDialContext = func(dctx context.Context, network, _ string) (net.Conn, error) {
+		conn, endpoint, err := raceDial(dctx, network, eps, netDial)
+		if err == nil {
+			used = endpoint
+			conn = c.track(endpoint, conn)
+			stopClose = context.AfterFunc(ctx, func() { conn.Close() })
+		}
+		return conn, err
+	}
+
+	wsConn, resp, dialErr := dialer.DialContext(ctx, wsURL, c.requestHeader())
+	if stopClose != nil {
+		stopClose()
+	}
+	if ctx.Err() != nil {
+		if wsConn != nil {
+			wsConn.Close()
+		}
+		return nil, nil, used, ErrDialCanceled
+	}
+	return wsConn, resp, used, dialErr
+}
+
+// sleepCtx 等待 d 或直到 ctx 结束
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}